@@ -0,0 +1,386 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamBuffer    = 64               // Messages buffered for each stream before the ones that don't fit are dropped.
+	streamHeartbeat = 30 * time.Second // Time between the comments that keep idle streams open.
+)
+
+// Type that represents a message seen by the bot on a channel or on a private message.
+type Message struct {
+	Network string    `json:"network"`
+	Target  string    `json:"target"` // Channel of the message, or the nick of the bot on a private message.
+	Nick    string    `json:"nick"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
+
+// Type that represents a hub that hands the messages seen by a bot to its subscribers.
+// Publishing never blocks the IRC loop, so a subscriber that doesn't keep up misses messages instead.
+type Hub struct {
+	sync.Mutex
+	subscribers map[chan<- Message]bool
+}
+
+// The newHub function creates a hub without subscribers.
+func newHub() *Hub {
+	return &Hub{subscribers: make(map[chan<- Message]bool)}
+}
+
+// The Subscribe method sends every message published from now on to ch, as long as ch has room for it.
+// The same go channel can be subscribed to several hubs, to receive the messages of several bots.
+func (h *Hub) Subscribe(ch chan<- Message) {
+	h.Lock()
+	defer h.Unlock()
+	h.subscribers[ch] = true
+}
+
+// The Unsubscribe method stops sending messages to ch.
+func (h *Hub) Unsubscribe(ch chan<- Message) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.subscribers, ch)
+}
+
+// The Publish method sends m to every subscriber with room for it.
+func (h *Hub) Publish(m Message) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+}
+
+// Type that represents the local HTTP/JSON API, which lets other programs talk to IRC through the bots.
+type api struct {
+	bots  []*Bot
+	token string // Token expected on the Authorization header as Bearer token, not checked when empty (unix sockets only).
+}
+
+// The newAPIHandler function creates the handler of the local API of bots. Every endpoint takes the name of
+// the network on the network query parameter or JSON field, which may be left out when there's a single network.
+//
+//	GET  /api/networks       Health of every network.
+//	GET  /api/channels       Channels of a network and their settings.
+//	GET  /api/users          Registered users of a network.
+//	GET  /api/messages       Stream of the messages seen by the bots (of a network when given), as Server-Sent Events.
+//	POST /api/messages       Send {"network", "target", "text", "kind"}, where kind is privmsg (default), notice or action.
+//	POST /api/announcements  Announce the next event matching {"network", "category", "session"}, both any by default.
+func newAPIHandler(bots []*Bot, token string) http.Handler {
+	a := &api{bots: bots, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/networks", a.handle(http.MethodGet, a.networks))
+	mux.HandleFunc("/api/channels", a.handle(http.MethodGet, a.channels))
+	mux.HandleFunc("/api/users", a.handle(http.MethodGet, a.users))
+	mux.HandleFunc("/api/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			a.handle(http.MethodPost, a.send)(w, r)
+			return
+		}
+		a.handle(http.MethodGet, a.stream)(w, r)
+	})
+	mux.HandleFunc("/api/announcements", a.handle(http.MethodPost, a.announce))
+	return mux
+}
+
+// The handle method wraps an endpoint, checking the method and the token of the request.
+func (a *api) handle(method string, endpoint http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.token)) != 1 {
+			respondError(w, http.StatusUnauthorized, "Invalid or missing token.")
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			respondError(w, http.StatusMethodNotAllowed, "Use "+method+" on this endpoint.")
+			return
+		}
+		// Browsers only send JSON to another origin after a CORS preflight, which the API never answers.
+		// So requiring it keeps web pages from posting forms or text to the API on behalf of the user.
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); method == http.MethodPost && mediaType != "application/json" {
+			respondError(w, http.StatusUnsupportedMediaType, "Use Content-Type: application/json on this endpoint.")
+			return
+		}
+		endpoint(w, r)
+	}
+}
+
+// The bot method returns the bot of the named network, or the only one when name is empty.
+func (a *api) bot(name string) (*Bot, error) {
+	if name == "" {
+		if len(a.bots) == 1 {
+			return a.bots[0], nil
+		}
+		return nil, fmt.Errorf("Missing network, use one of %s.", strings.Join(a.networkNames(), ", "))
+	}
+	for _, b := range a.bots {
+		if strings.EqualFold(b.config.Name, name) {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown network %s, use one of %s.", name, strings.Join(a.networkNames(), ", "))
+}
+
+func (a *api) networkNames() (names []string) {
+	for _, b := range a.bots {
+		names = append(names, b.config.Name)
+	}
+	return
+}
+
+func (a *api) networks(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]HealthStatus, 0, len(a.bots))
+	for _, b := range a.bots {
+		statuses = append(statuses, b.status())
+	}
+	respondJSON(w, http.StatusOK, statuses)
+}
+
+// Type that represents a channel of a bot on the API.
+type apiChannel struct {
+	Name     string   `json:"name"`
+	On       bool     `json:"on"` // The bot is on the channel right now.
+	Category string   `json:"category,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+	Prefix   string   `json:"prefix,omitempty"`
+	Feeds    bool     `json:"feeds"`
+	Titles   bool     `json:"titles"`
+	Language string   `json:"language,omitempty"`
+}
+
+// The channels method lists the channels the bot should be on, along with any other channel it happens to be on.
+func (a *api) channels(w http.ResponseWriter, r *http.Request) {
+	b, err := a.bot(r.URL.Query().Get("network"))
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	on := make(map[string]bool)
+	for _, channel := range b.health.Channels() {
+		on[channel] = true
+	}
+	names := b.channels()
+	for _, channel := range b.health.Channels() {
+		if !containsFold(names, channel) {
+			names = append(names, channel)
+		}
+	}
+	channels := make([]apiChannel, 0, len(names))
+	for _, name := range names {
+		s := b.settings(name)
+		channels = append(channels, apiChannel{
+			Name:     name,
+			On:       on[strings.ToLower(name)],
+			Category: s.Category,
+			Commands: s.Commands,
+			Prefix:   s.Prefix,
+			Feeds:    s.Feeds,
+			Titles:   s.Titles,
+			Language: s.Language,
+		})
+	}
+	respondJSON(w, http.StatusOK, channels)
+}
+
+// Type that represents a registered user on the API.
+type apiUser struct {
+	Nick     string   `json:"nick"`
+	TimeZone string   `json:"time_zone"`
+	Points   int      `json:"points"`
+	Channels []string `json:"channels"` // Channels where the user is mentioned when an event starts.
+	Mask     string   `json:"mask,omitempty"`
+}
+
+func (a *api) users(w http.ResponseWriter, r *http.Request) {
+	b, err := a.bot(r.URL.Query().Get("network"))
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	var all []User
+	err = b.store.View(func(tx *Tx) (err error) {
+		all, err = tx.Users().All()
+		return
+	})
+	if err != nil {
+		b.logger.Error("Error getting users.", "err", err)
+		respondError(w, http.StatusInternalServerError, "Error getting users.")
+		return
+	}
+	users := make([]apiUser, 0, len(all))
+	for _, u := range all {
+		users = append(users, apiUser{Nick: u.Nick, TimeZone: u.TimeZone, Points: u.Points, Channels: u.Channels, Mask: u.Mask})
+	}
+	respondJSON(w, http.StatusOK, users)
+}
+
+// The send method queues a message to a channel or nick, which is sent once the bot is online.
+func (a *api) send(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Network string `json:"network"`
+		Target  string `json:"target"`
+		Text    string `json:"text"`
+		Kind    string `json:"kind"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	b, err := a.bot(request.Network)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := checkTarget(request.Target); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(request.Text) == "" {
+		respondError(w, http.StatusBadRequest, "Missing text.")
+		return
+	}
+	switch strings.ToLower(request.Kind) {
+	case "", "privmsg":
+		b.queue.Privmsg(PriorityNormal, request.Target, request.Text)
+	case "notice":
+		b.queue.Notice(PriorityNormal, request.Target, request.Text)
+	case "action":
+		b.queue.Action(PriorityNormal, request.Target, request.Text)
+	default:
+		respondError(w, http.StatusBadRequest, "Invalid kind "+request.Kind+", use privmsg, notice or action.")
+		return
+	}
+	respondJSON(w, http.StatusAccepted, map[string]int{"queued": b.queue.Len()})
+}
+
+// The announce method announces the next event matching a category and session, like the bot does before it starts.
+func (a *api) announce(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Network  string `json:"network"`
+		Category string `json:"category"`
+		Session  string `json:"session"`
+	}{Category: "any", Session: "any"}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	b, err := a.bot(request.Network)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	event, err := b.findNext(request.Category, request.Session)
+	if errors.Is(err, errNoEvent) {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err == nil {
+		err = b.announce(event, "Coming up:")
+	}
+	if err != nil {
+		b.logger.Error("Error announcing event.", "err", err)
+		respondError(w, http.StatusInternalServerError, "Error announcing event.")
+		return
+	}
+	respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"category": event.Category,
+		"name":     event.Name,
+		"session":  event.Session,
+		"time":     event.Time,
+		"channel":  event.Channel,
+	})
+}
+
+// The stream method sends the messages seen by the bots as Server-Sent Events, until the client goes away.
+// Each message is a message event with the JSON of the message as data.
+func (a *api) stream(w http.ResponseWriter, r *http.Request) {
+	bots := a.bots
+	if name := r.URL.Query().Get("network"); name != "" {
+		b, err := a.bot(name)
+		if err != nil {
+			respondError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		bots = []*Bot{b}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, http.StatusInternalServerError, "Streaming isn't supported.")
+		return
+	}
+	ch := make(chan Message, streamBuffer)
+	for _, b := range bots {
+		b.messages.Subscribe(ch)
+		defer b.messages.Unsubscribe(ch)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case m := <-ch:
+			data, _ := json.Marshal(m)
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Small utility function that checks if a target is a channel or a nick that a message can be sent to.
+func checkTarget(target string) error {
+	if target == "" || strings.ContainsAny(target, " ,:\r\n\x00") {
+		return fmt.Errorf("Invalid target %q, use a channel or a nick.", target)
+	}
+	return nil
+}
+
+// Small utility function that writes v as the JSON body of a response with status.
+func respondJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Small utility function that writes an error as the JSON body of a response with status.
+func respondError(w http.ResponseWriter, status int, message string) {
+	respondJSON(w, status, map[string]string{"error": message})
+}
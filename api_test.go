@@ -0,0 +1,175 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Small utility function that sends a request to handler and returns the response.
+func apiRequest(handler http.Handler, method string, path string, body string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// Small utility function that returns every line queued on the send queue of a bot.
+func queuedLines(b *Bot) (lines []string) {
+	b.queue.Lock()
+	defer b.queue.Unlock()
+	for _, queue := range b.queue.queues {
+		lines = append(lines, queue...)
+	}
+	return
+}
+
+func TestAPI(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{
+		eventsFile: {{"[Formula 1]", "Monaco Grand Prix", "Race", eventTime(time.Hour), "#f1", "", "notify"}},
+		usersFile:  {{"gluon", "Europe/Lisbon", "10", "#f1"}},
+	})
+	b.config.Channels = "#f1"
+	handler := newAPIHandler([]*Bot{b}, "secret")
+	tests := []struct {
+		method, path, body, token string
+		code                      int
+		want                      string
+	}{
+		{"GET", "/api/channels", "", "", http.StatusUnauthorized, "Invalid or missing token."},
+		{"GET", "/api/channels", "", "wrong", http.StatusUnauthorized, "Invalid or missing token."},
+		{"PUT", "/api/users", "", "secret", http.StatusMethodNotAllowed, "Use GET"},
+		{"GET", "/api/channels?network=libera", "", "secret", http.StatusNotFound, "Unknown network libera"},
+		{"GET", "/api/channels", "", "secret", http.StatusOK, `"name":"#f1","on":false`},
+		{"GET", "/api/users?network=test", "", "secret", http.StatusOK, `"nick":"gluon","time_zone":"Europe/Lisbon","points":10`},
+		{"GET", "/api/networks", "", "secret", http.StatusOK, `"network":"test","connected":false`},
+		{"POST", "/api/messages", `{"target":"#f1 :x","text":"hi"}`, "secret", http.StatusBadRequest, "Invalid target"},
+		{"POST", "/api/messages", `{"target":"#f1","text":"hi","kind":"shout"}`, "secret", http.StatusBadRequest, "Invalid kind"},
+		{"POST", "/api/messages", `{"target":"#f1","text":"hi\r\nQUIT"}`, "secret", http.StatusAccepted, `"queued":2`},
+		{"POST", "/api/messages", `{"target":"gluon","text":"psst","kind":"notice"}`, "secret", http.StatusAccepted, `"queued":3`},
+		{"POST", "/api/announcements", `{"category":"[Formula 2]"}`, "secret", http.StatusNotFound, "No event found."},
+		{"POST", "/api/announcements", `{"category":"[Formula 1]","session":"race"}`, "secret", http.StatusAccepted, `"name":"Monaco Grand Prix"`},
+	}
+	for _, test := range tests {
+		w := apiRequest(handler, test.method, test.path, test.body, test.token)
+		if w.Code != test.code || !strings.Contains(w.Body.String(), test.want) {
+			t.Errorf("%s %s %s = %d %s, want %d %s", test.method, test.path, test.body, w.Code, w.Body, test.code, test.want)
+		}
+	}
+	lines := strings.Join(queuedLines(b), "\n")
+	for _, want := range []string{"PRIVMSG #f1 :hi", "PRIVMSG #f1 :QUIT", "NOTICE gluon :psst", "Coming up:", "PRIVMSG #f1 :gluon "} {
+		if !strings.Contains(lines, want) {
+			t.Errorf("queued lines %q don't contain %q", lines, want)
+		}
+	}
+}
+
+func TestAPIRejectsBrowserRequests(t *testing.T) {
+	b := newTestBot(t, nil)
+	handler := newAPIHandler([]*Bot{b}, "secret")
+	// A form or fetch from a web page sends one of the content types that skip the CORS preflight.
+	for _, contentType := range []string{"", "text/plain", "application/x-www-form-urlencoded", "multipart/form-data; boundary=x"} {
+		for _, path := range []string{"/api/messages", "/api/announcements"} {
+			r := httptest.NewRequest("POST", path, strings.NewReader(`{"target":"#f1","text":"hi"}`))
+			r.Header.Set("Authorization", "Bearer secret")
+			if contentType != "" {
+				r.Header.Set("Content-Type", contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("POST %s with %q = %d %s, want %d", path, contentType, w.Code, w.Body, http.StatusUnsupportedMediaType)
+			}
+		}
+	}
+	if lines := queuedLines(b); len(lines) != 0 {
+		t.Errorf("got queued lines %q", lines)
+	}
+	tests := []struct {
+		listen, token string
+		ok            bool
+	}{
+		{"127.0.0.1:9121", "", false},
+		{"[::1]:9121", "", false},
+		{"127.0.0.1:9121", "secret", true},
+		{"unix:" + filepath.Join(t.TempDir(), "api.sock"), "", true},
+	}
+	for _, test := range tests {
+		c := defaultConfig()
+		c.APIListen, c.APIToken = test.listen, test.token
+		problems := strings.Join(c.validate(), "\n")
+		if strings.Contains(problems, "api_token") == test.ok {
+			t.Errorf("validate with api_listen %q and api_token %q = %q", test.listen, test.token, problems)
+		}
+	}
+}
+
+func TestAPIStream(t *testing.T) {
+	b := newTestBot(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewUnstartedServer(newAPIHandler([]*Bot{b}, ""))
+	server.Config.BaseContext = func(net.Listener) context.Context { return ctx }
+	server.Start()
+	defer server.Close()
+	res, err := http.Get(server.URL + "/api/messages?network=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", res.Header.Get("Content-Type"))
+	}
+	// The subscription happens before the headers are sent, so the message can't be missed.
+	sent := Message{Network: "test", Target: "#f1", Nick: "gluon", Text: "hello"}
+	b.messages.Publish(sent)
+	scanner := bufio.NewScanner(res.Body)
+	var event, data string
+	for scanner.Scan() && scanner.Text() != "" {
+		if strings.HasPrefix(scanner.Text(), "event: ") {
+			event = strings.TrimPrefix(scanner.Text(), "event: ")
+		}
+		if strings.HasPrefix(scanner.Text(), "data: ") {
+			data = strings.TrimPrefix(scanner.Text(), "data: ")
+		}
+	}
+	var received Message
+	if err := json.Unmarshal([]byte(data), &received); err != nil || event != "message" || received.Text != "hello" || received.Nick != "gluon" {
+		t.Errorf("received event %q with %q (%v)", event, data, err)
+	}
+	// Cancelling the context of the server ends the stream.
+	cancel()
+	for scanner.Scan() {
+	}
+}
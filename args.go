@@ -0,0 +1,200 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Type that represents a single argument of a command message, as split by the tokenize function.
+type token struct {
+	text   string
+	quoted bool // Quoted tokens are never taken as options, so "--foo" can be passed as a plain argument.
+}
+
+// Type that represents the arguments accepted by a command.
+// The arguments of a command with a schema are checked before its handler runs, which only sees valid arguments.
+type ArgSchema struct {
+	Min     int         // Minimum number of arguments.
+	Max     int         // Maximum number of arguments, or -1 for no limit.
+	Counts  []int       // Exact numbers of arguments accepted, used instead of Min and Max when set.
+	Options []OptionDef // Named options accepted as --name value or --name=value.
+}
+
+// Type that represents a named option of a command.
+type OptionDef struct {
+	Name        string
+	Value       bool // The option takes a value, otherwise it is a flag set to "true" when present.
+	Description string
+}
+
+// Small utility function that splits the message of a command into tokens.
+// Tokens are separated by any amount of whitespace, unless they are inside double quotes.
+// Inside or outside quotes, a backslash escapes a double quote or another backslash.
+// Single quotes aren't special, since they are common in regular text (don't, Hamilton's, etc).
+// An unterminated quote runs until the end of the message.
+func tokenize(message string) (tokens []token) {
+	var current strings.Builder
+	var inQuotes, inToken, quoted bool
+	runes := []rune(message)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\'):
+			i++
+			current.WriteRune(runes[i])
+			inToken = true
+		case r == '"':
+			inQuotes = !inQuotes
+			inToken = true
+			quoted = true
+		case !inQuotes && (r == ' ' || r == '\t'):
+			if inToken {
+				tokens = append(tokens, token{current.String(), quoted})
+				current.Reset()
+				inToken, quoted = false, false
+			}
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+	if inToken {
+		tokens = append(tokens, token{current.String(), quoted})
+	}
+	return
+}
+
+// The bind method checks the arguments of a command against the schema and moves its options to command.Options.
+// The error message is meant to be shown to the user, followed by the usage of the command.
+func (s *ArgSchema) bind(command *Command) error {
+	tokens := command.tokens
+	if tokens == nil {
+		for _, arg := range command.Args {
+			tokens = append(tokens, token{text: arg})
+		}
+	}
+	var args []string
+	options := make(map[string]string)
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.quoted || !strings.HasPrefix(t.text, "--") {
+			args = append(args, t.text)
+			continue
+		}
+		// A lone "--" ends the options, everything after it is an argument.
+		if t.text == "--" {
+			for _, t := range tokens[i+1:] {
+				args = append(args, t.text)
+			}
+			break
+		}
+		name, value := strings.ToLower(t.text[2:]), ""
+		hasValue := strings.Contains(name, "=")
+		if hasValue {
+			name, value = name[:strings.Index(name, "=")], t.text[strings.Index(t.text, "=")+1:]
+		}
+		option, ok := s.option(name)
+		if !ok {
+			return errors.New("Unknown option --" + name + ".")
+		}
+		switch {
+		case !option.Value && hasValue:
+			return errors.New("Option --" + name + " doesn't take a value.")
+		case !option.Value:
+			value = "true"
+		case !hasValue && i+1 < len(tokens):
+			i++
+			value = tokens[i].text
+		case !hasValue:
+			return errors.New("Option --" + name + " requires a value.")
+		}
+		options[name] = value
+	}
+	if !s.accepts(len(args)) {
+		return fmt.Errorf("Wrong number of arguments: %s expected, %d given.", s.expected(), len(args))
+	}
+	command.Args = args
+	command.Options = options
+	return nil
+}
+
+// The option method returns the definition of an option of the schema, ignoring case.
+func (s *ArgSchema) option(name string) (option OptionDef, ok bool) {
+	for _, option := range s.Options {
+		if strings.EqualFold(option.Name, name) {
+			return option, true
+		}
+	}
+	return
+}
+
+// The accepts method checks if the schema accepts a given number of arguments.
+func (s *ArgSchema) accepts(n int) bool {
+	if len(s.Counts) > 0 {
+		for _, count := range s.Counts {
+			if n == count {
+				return true
+			}
+		}
+		return false
+	}
+	return n >= s.Min && (s.Max < 0 || n <= s.Max)
+}
+
+// The expected method describes the numbers of arguments accepted by the schema, for example "1 to 3" or "0, 1 or 4".
+func (s *ArgSchema) expected() string {
+	if len(s.Counts) > 0 {
+		var counts []string
+		for _, count := range s.Counts {
+			counts = append(counts, strconv.Itoa(count))
+		}
+		if len(counts) == 1 {
+			return counts[0]
+		}
+		return strings.Join(counts[:len(counts)-1], ", ") + " or " + counts[len(counts)-1]
+	}
+	switch {
+	case s.Max < 0:
+		return fmt.Sprintf("at least %d", s.Min)
+	case s.Min == s.Max:
+		return strconv.Itoa(s.Min)
+	case s.Min == 0:
+		return fmt.Sprintf("at most %d", s.Max)
+	default:
+		return fmt.Sprintf("%d to %d", s.Min, s.Max)
+	}
+}
+
+// Small utility function that returns the value of a numeric option, or def when the option isn't set.
+// The value must be between min and max, so that users can't pass absurd values to a command.
+func intOption(options map[string]string, name string, def int, min int, max int) (int, error) {
+	value, ok := options[name]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("Option --%s must be a number between %d and %d.", name, min, max)
+	}
+	return n, nil
+}
@@ -0,0 +1,152 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		message string
+		want    []token
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"a b", []token{{"a", false}, {"b", false}}},
+		{"  a \t  b  ", []token{{"a", false}, {"b", false}}},
+		{`say "hello world"`, []token{{"say", false}, {"hello world", true}}},
+		{`a"b c"d`, []token{{"ab cd", true}}},
+		{`""`, []token{{"", true}}},
+		{`say "he said \"hi\""`, []token{{"say", false}, {`he said "hi"`, true}}},
+		{`back\\slash \"x`, []token{{`back\slash`, false}, {`"x`, false}}},
+		{`path C:\temp`, []token{{"path", false}, {`C:\temp`, false}}},
+		{"don't stop", []token{{"don't", false}, {"stop", false}}},
+		{`"unterminated quote`, []token{{"unterminated quote", true}}},
+	}
+	for _, test := range tests {
+		got := tokenize(test.message)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenize(%q) = %v, want %v", test.message, got, test.want)
+		}
+	}
+}
+
+func TestArgSchemaBind(t *testing.T) {
+	schema := &ArgSchema{Min: 1, Max: 2, Options: []OptionDef{
+		{Name: "timeout", Value: true},
+		{Name: "all"},
+	}}
+	tests := []struct {
+		message string
+		args    []string
+		options map[string]string
+		err     string
+	}{
+		{"!c a", []string{"a"}, map[string]string{}, ""},
+		{"!c a --timeout 30 b", []string{"a", "b"}, map[string]string{"timeout": "30"}, ""},
+		{"!c --TIMEOUT=30 --all a", []string{"a"}, map[string]string{"timeout": "30", "all": "true"}, ""},
+		{`!c "--all" a`, []string{"--all", "a"}, map[string]string{}, ""},
+		{"!c -- --all", []string{"--all"}, map[string]string{}, ""},
+		{"!c a --timeout", nil, nil, "Option --timeout requires a value."},
+		{"!c a --all=yes", nil, nil, "Option --all doesn't take a value."},
+		{"!c a --foo", nil, nil, "Unknown option --foo."},
+		{"!c --all", nil, nil, "Wrong number of arguments: 1 to 2 expected, 0 given."},
+		{"!c a b c", nil, nil, "Wrong number of arguments: 1 to 2 expected, 3 given."},
+	}
+	for _, test := range tests {
+		command, err := parseCommand(test.message, "!", "gluon", "#f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = schema.bind(&command)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("bind(%q): got error %v, want %q", test.message, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("bind(%q): unexpected error %v", test.message, err)
+			continue
+		}
+		if !reflect.DeepEqual(command.Args, test.args) || !reflect.DeepEqual(command.Options, test.options) {
+			t.Errorf("bind(%q) = %q %v, want %q %v", test.message, command.Args, command.Options, test.args, test.options)
+		}
+	}
+}
+
+func TestArgSchemaBindWithoutTokens(t *testing.T) {
+	command := Command{Name: "c", Args: []string{"a", "--all"}}
+	schema := &ArgSchema{Counts: []int{1}, Options: []OptionDef{{Name: "all"}}}
+	if err := schema.bind(&command); err != nil || command.Options["all"] != "true" {
+		t.Errorf("bind: got %v %v", command, err)
+	}
+}
+
+func TestArgSchemaExpected(t *testing.T) {
+	tests := []struct {
+		schema ArgSchema
+		want   string
+	}{
+		{ArgSchema{}, "0"},
+		{ArgSchema{Min: 2, Max: 2}, "2"},
+		{ArgSchema{Max: 1}, "at most 1"},
+		{ArgSchema{Min: 1, Max: -1}, "at least 1"},
+		{ArgSchema{Min: 1, Max: 3}, "1 to 3"},
+		{ArgSchema{Counts: []int{4}}, "4"},
+		{ArgSchema{Counts: []int{0, 1, 4}}, "0, 1 or 4"},
+	}
+	for _, test := range tests {
+		if got := test.schema.expected(); got != test.want {
+			t.Errorf("expected(%+v) = %q, want %q", test.schema, got, test.want)
+		}
+	}
+}
+
+func TestBetSchema(t *testing.T) {
+	var bet *CommandDef
+	for _, def := range builtinCommands() {
+		if def.Name == "bet" {
+			bet = def
+		}
+	}
+	for args, ok := range map[string]bool{"": true, "log": true, "ver ham lec nor": true, "ver ham lec": false, "ver ham lec nor ver": false} {
+		command, _ := parseCommand("!bet "+args, "!", "gluon", "#f1")
+		if err := bet.Args.bind(&command); (err == nil) != ok {
+			t.Errorf("bet %q: got error %v, want ok %v", args, err, ok)
+		}
+	}
+}
+
+func TestIntOption(t *testing.T) {
+	options := map[string]string{"timeout": "30", "bad": "x", "big": "1000"}
+	if n, err := intOption(options, "timeout", 60, 10, 600); n != 30 || err != nil {
+		t.Errorf("intOption(timeout) = %d, %v", n, err)
+	}
+	if n, err := intOption(options, "missing", 60, 10, 600); n != 60 || err != nil {
+		t.Errorf("intOption(missing) = %d, %v", n, err)
+	}
+	for _, name := range []string{"bad", "big"} {
+		if _, err := intOption(options, name, 60, 10, 600); err == nil {
+			t.Errorf("intOption(%s): expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const authTimeout = 15 * time.Second // Time to wait for the services to confirm the authentication.
+
+// Replies of the services to IDENTIFY and AUTH on Atheme, Anope and the Q of QuakeNet, in lower case and without
+// formatting. Other notices of the services, like the reminders to identify, don't end the wait for the result.
+var (
+	authSuccesses = []string{"you are now identified for", "password accepted - you are now recognized", "you are now logged in as"}
+	authFailures  = []string{"invalid password for", "password incorrect.", "username or password incorrect."}
+)
+
+// Small utility function that builds the TLS configuration of a network, loading the CA and client certificates.
+func tlsConfig(n NetworkConfig) (config *tls.Config, err error) {
+	host, _, err := net.SplitHostPort(n.Server)
+	if err != nil {
+		return
+	}
+	config = &tls.Config{ServerName: host, InsecureSkipVerify: n.TLSSkipVerify}
+	if n.TLSCAFile != "" {
+		pem, err := os.ReadFile(n.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file %s: %w", n.TLSCAFile, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Error parsing CA file %s: no certificates found.", n.TLSCAFile)
+		}
+	}
+	if n.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(n.TLSCertFile, n.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate %s: %w", n.TLSCertFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// The setupAuth method configures TLS and SASL on the connection and the callbacks used by services authentication.
+// SASL is skipped when it failed on a previous attempt and services authentication is available as a fallback.
+func (b *Bot) setupAuth() error {
+	if b.config.TLS {
+		config, err := tlsConfig(b.config)
+		if err != nil {
+			return err
+		}
+		b.conn.UseTLS = true
+		b.conn.TLSConfig = config
+	}
+	if b.config.SASL != "" && !(b.saslFailed && b.config.Auth != "") {
+		b.conn.UseSASL = true
+		b.conn.SASLMech = strings.ToUpper(b.config.SASL)
+		b.conn.SASLLogin = b.config.Account
+		b.conn.SASLPassword = b.config.Password
+	}
+	// Services confirm the authentication either with the 900 numeric or with a notice.
+	// The result is sent to the auth go channel, without blocking if nobody is waiting.
+	result := func(ok bool) {
+		select {
+		case b.auth <- ok:
+		default:
+		}
+	}
+	b.conn.AddCallback("900", func(event *irc.Event) {
+		result(true)
+	})
+	b.conn.AddCallback("NOTICE", func(event *irc.Event) {
+		if !strings.EqualFold(event.Nick, "NickServ") && !strings.EqualFold(event.Nick, "Q") {
+			return
+		}
+		message := strings.ToLower(strings.NewReplacer("\x02", "", "\x1f", "", "\x1d", "", "\x0f", "").Replace(event.Message()))
+		switch {
+		case hasAnyPrefix(message, authSuccesses):
+			result(true)
+		case hasAnyPrefix(message, authFailures):
+			result(false)
+		}
+	})
+	return nil
+}
+
+// The identify method authenticates with NickServ or Q when services authentication is configured.
+// It runs after the "001" callback and waits for the services to confirm, so that registered-only channels can be joined.
+// Joining happens anyway after authTimeout, in which case the bot only joins the channels that accept it.
+func (b *Bot) identify() {
+	if b.config.Auth == "" || b.conn.UseSASL {
+		return
+	}
+	switch strings.ToLower(b.config.Auth) {
+	case "nickserv":
+		b.queue.Privmsg(PriorityHigh, "NickServ", "IDENTIFY "+b.config.Account+" "+b.config.Password)
+	case "q":
+		b.queue.Privmsg(PriorityHigh, "Q@CServe.quakenet.org", "AUTH "+b.config.Account+" "+b.config.Password)
+	}
+	select {
+	case ok := <-b.auth:
+		if !ok {
+			b.logger.Error("Authentication failed.", "auth", b.config.Auth)
+		}
+	case <-time.After(authTimeout):
+		b.logger.Error("Authentication timed out.", "auth", b.config.Auth, "timeout", authTimeout)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Type that represents a buffer that can be written by several goroutines, like the logger of a connected bot.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+// Type that represents a fake IRC server, which registers the bot, answers SASL PLAIN and NickServ for the account
+// alice with password secret, and records the lines it gets, prefixed by the number of their connection.
+type fakeIRC struct {
+	sync.Mutex
+	listener net.Listener
+	conns    []net.Conn
+	saslDown bool        // Fails every SASL attempt, as when the services are split from the network.
+	lines    chan string // Lines sent by the bot.
+}
+
+// Small utility function that starts a fake IRC server for the rest of the test.
+func serveIRC(t *testing.T, saslDown bool) *fakeIRC {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeIRC{listener: listener, saslDown: saslDown, lines: make(chan string, 256)}
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.conns = append(s.conns, conn)
+			s.Unlock()
+			go s.serve(n, conn)
+		}
+	}()
+	return s
+}
+
+// The close method stops the server and closes its connections, so that the bot sees them drop.
+func (s *fakeIRC) close() {
+	s.listener.Close()
+	s.Lock()
+	defer s.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// The serve method answers the lines of a connection until the bot quits.
+func (s *fakeIRC) serve(n int, conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		s.lines <- fmt.Sprintf("%d %s", n, line)
+		reply := func(lines ...string) {
+			for _, line := range lines {
+				io.WriteString(conn, line+"\r\n")
+			}
+		}
+		switch {
+		case line == "CAP LS":
+			reply(":irc.test CAP * LS :multi-prefix sasl")
+		case line == "CAP REQ :sasl":
+			reply(":irc.test CAP * ACK :sasl")
+		case line == "AUTHENTICATE PLAIN":
+			reply("AUTHENTICATE +")
+		case strings.HasPrefix(line, "AUTHENTICATE "):
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTHENTICATE "))
+			if s.saslDown || string(credentials) != "alice\x00alice\x00secret" {
+				reply(":irc.test 904 Schumacher :SASL authentication failed")
+				continue
+			}
+			reply(":irc.test 900 Schumacher Schumacher!bot@test alice :You are now logged in as alice",
+				":irc.test 903 Schumacher :SASL authentication successful")
+		case strings.HasPrefix(line, "USER "):
+			reply(":irc.test 001 Schumacher :Welcome to the test network")
+		case strings.HasPrefix(line, "PRIVMSG NickServ :IDENTIFY "):
+			// Other notices of the services, even mentioning an invalid nick, don't end the wait for the result.
+			reply(":NickServ!NickServ@services.test NOTICE Schumacher :Invalid nicks are not accepted by \x02GHOST\x02.")
+			if line == "PRIVMSG NickServ :IDENTIFY alice secret" {
+				reply(":NickServ!NickServ@services.test NOTICE Schumacher :You are now identified for \x02alice\x02.")
+			} else {
+				reply(":NickServ!NickServ@services.test NOTICE Schumacher :Invalid password for \x02alice\x02.")
+			}
+		case strings.HasPrefix(line, "QUIT"):
+			return
+		}
+	}
+}
+
+// The expect method returns the lines sent by the bot up to the first one that starts with prefix.
+// It fails the test if no such line is sent within timeout.
+func (s *fakeIRC) expect(t *testing.T, prefix string, timeout time.Duration) (lines []string) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line := <-s.lines:
+			lines = append(lines, line)
+			if strings.HasPrefix(line, prefix) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no line %q within %s, got %q", prefix, timeout, lines)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		sasl     string
+		password string
+		saslDown bool
+		want     []string // Lines sent by the bot, in order, up to the JOIN of its channels.
+		absent   string   // Line that the bot must not send.
+		log      string   // Record that must be logged.
+		noLog    string   // Record that must not be logged.
+	}{
+		{
+			name: "sasl", sasl: "plain", password: "secret",
+			want:   []string{"1 CAP LS", "1 AUTHENTICATE PLAIN", "1 CAP END", "1 USER", "1 JOIN #f1"},
+			absent: "PRIVMSG NickServ", noLog: "Authentication failed.",
+		},
+		{
+			name: "sasl failure", sasl: "plain", password: "secret", saslDown: true,
+			want: []string{"1 AUTHENTICATE PLAIN", "1 QUIT", "2 USER", "2 PRIVMSG NickServ :IDENTIFY alice secret", "2 JOIN #f1"},
+			log:  "SASL failed, falling back to services.", noLog: "Authentication failed.",
+		},
+		{
+			name: "nickserv", password: "secret",
+			want:   []string{"1 USER", "1 PRIVMSG NickServ :IDENTIFY alice secret", "1 JOIN #f1"},
+			absent: "AUTHENTICATE", noLog: "Authentication failed.",
+		},
+		{
+			name: "nickserv failure", password: "wrong",
+			want: []string{"1 USER", "1 PRIVMSG NickServ :IDENTIFY alice wrong", "1 JOIN #f1"},
+			log:  "Authentication failed.",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := serveIRC(t, test.saslDown)
+			b := newTestBot(t, nil)
+			b.config.Server = s.listener.Addr().String()
+			b.config.Channels = "#f1"
+			b.config.SASL = test.sasl
+			b.config.Auth = "nickserv"
+			b.config.Account = "alice"
+			b.config.Password = test.password
+			var log syncBuffer
+			b.logger = newLogger(&log, LevelInfo, false)
+			ctx, cancel := context.WithCancel(context.Background())
+			b.ctx = ctx
+			b.queue.burst, b.queue.interval = 10, 10*time.Millisecond
+			stop := make(chan struct{})
+			go b.queue.run(stop)
+			defer func() {
+				cancel()
+				close(stop)
+				s.close()
+				if conn := b.connection(); conn != nil {
+					conn.Disconnect()
+				}
+			}()
+			if err := b.connect(); err != nil {
+				t.Fatal(err)
+			}
+			// The channels are joined as soon as the services answer, long before authTimeout.
+			var lines []string
+			for _, want := range test.want {
+				lines = append(lines, s.expect(t, want, 5*time.Second)...)
+			}
+			for _, line := range lines {
+				if test.absent != "" && strings.Contains(line, test.absent) {
+					t.Errorf("got line %q", line)
+				}
+			}
+			if test.log != "" && !strings.Contains(log.String(), test.log) {
+				t.Errorf("%q not logged, got %s", test.log, log.String())
+			}
+			if test.noLog != "" && strings.Contains(log.String(), test.noLog) {
+				t.Errorf("%q logged, got %s", test.noLog, log.String())
+			}
+		})
+	}
+}
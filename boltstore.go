@@ -0,0 +1,123 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Type that represents a store backed by an embedded bbolt database.
+// Each table is a bucket holding one JSON encoded row per key, with the keys keeping the order of the rows.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// Type that represents the tables of a boltStore inside a transaction.
+type boltTables struct {
+	tx *bolt.Tx
+}
+
+// The openBoltStore function opens (or creates) the bbolt database at path.
+// Only one process can open the database at a time, so it fails if another one holds it for too long.
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening database %s: %w", path, err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) View(fn func(tx *Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&Tx{tables: &boltTables{tx: tx}})
+	})
+}
+
+func (s *boltStore) Update(fn func(tx *Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&Tx{tables: &boltTables{tx: tx}})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// Small utility function that returns the name of the bucket of a table, which is the table name without .csv.
+func bucketName(table string) []byte {
+	return []byte(strings.TrimSuffix(table, ".csv"))
+}
+
+func (t *boltTables) source(table string) string {
+	return t.tx.DB().Path() + "/" + string(bucketName(table))
+}
+
+func (t *boltTables) read(table string) (rows [][]string, err error) {
+	bucket := t.tx.Bucket(bucketName(table))
+	if bucket == nil {
+		return
+	}
+	err = bucket.ForEach(func(k, v []byte) error {
+		var row []string
+		err := json.Unmarshal(v, &row)
+		if err != nil {
+			return fmt.Errorf("Error decoding row %d of %s: %w", binary.BigEndian.Uint64(k), table, err)
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	return
+}
+
+// The write method replaces the bucket of a table with a new one holding rows.
+func (t *boltTables) write(table string, rows [][]string) error {
+	if !t.tx.Writable() {
+		return errWriteOnView
+	}
+	name := bucketName(table)
+	if t.tx.Bucket(name) != nil {
+		err := t.tx.DeleteBucket(name)
+		if err != nil {
+			return err
+		}
+	}
+	bucket, err := t.tx.CreateBucket(name)
+	if err != nil {
+		return err
+	}
+	for i, row := range rows {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(i))
+		value, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+// Type that represents an instance of the bot connected to a single IRC network.
+// Each instance has its own connection, settings, data folder, background tasks and games.
+type Bot struct {
+	ctx        context.Context // Context of the bot, cancelled when it shuts down.
+	config     NetworkConfig
+	conn       *irc.Connection
+	store      Store              // Storage of the data of the bot, which may be shared with other networks.
+	cache      *storeCache        // Tables of the store read on every message and command, kept in memory.
+	auth       chan bool          // Go channel used to receive the result of services authentication.
+	saslFailed bool               // Bool to check if SASL failed on a previous connection attempt.
+	games      *Games             // Polls and quizzes running on the channels of the network.
+	idents     *Identities        // Accounts and hostmasks of the nicks seen on the network.
+	queue      *SendQueue         // Queue of the messages sent to the network, which keeps the bot from flooding.
+	health     *Health            // State of the connection, kept up to date by the supervisor.
+	connMu     sync.Mutex         // Mutex guarding conn, which the supervisor replaces on each connection attempt, and nick.
+	nick       string             // Current nick of the bot, which the library keeps too, but without guarding it.
+	work       sync.WaitGroup     // Commands and tasks in flight, which the bot waits for when shutting down.
+	logger     *Logger            // Logger that adds the name of the network to every record.
+	messages   *Hub               // Messages seen by the bot, streamed by the API and written by the file bridge.
+	plugins    pluginSlots        // Plugins running for each user.
+	daemons    map[string]*daemon // Plugins running as daemons, by lower case name.
+	daemonsMu  sync.Mutex         // Mutex guarding daemons.
+}
+
+// The newBot function creates a bot instance for a network, which keeps its data on store.
+func newBot(config NetworkConfig, store Store) *Bot {
+	b := &Bot{
+		ctx:      context.Background(),
+		config:   config,
+		store:    store,
+		cache:    cacheOf(store),
+		auth:     make(chan bool),
+		games:    newGames(),
+		idents:   newIdentities(nil),
+		health:   newHealth(),
+		logger:   defaultLogger.With("network", config.Name),
+		messages: newHub(),
+	}
+	// The queue holds its lines while the bot is offline, and sends them once it reconnects or drops them on shutdown.
+	b.queue = newSendQueue(func(line string) {
+		if b.health.Wait(b.ctx) {
+			sendRaw(b.connection(), line)
+		}
+	}, b.currentNick, config.SendBurst, time.Duration(config.SendInterval)*time.Millisecond)
+	return b
+}
+
+// The connection method returns the current IRC connection of the bot, which is nil before the first attempt.
+func (b *Bot) connection() *irc.Connection {
+	b.connMu.Lock()
+	defer b.connMu.Unlock()
+	return b.conn
+}
+
+// The currentNick method returns the nick of the bot on the current connection, or the configured one before it.
+func (b *Bot) currentNick() string {
+	b.connMu.Lock()
+	defer b.connMu.Unlock()
+	if b.nick == "" {
+		return b.config.Nick
+	}
+	return b.nick
+}
+
+// The setNick method sets the nick of the bot on the current connection.
+func (b *Bot) setNick(nick string) {
+	b.connMu.Lock()
+	defer b.connMu.Unlock()
+	b.nick = nick
+}
+
+// The run method launches the background tasks of the bot and supervises its connection until ctx is cancelled.
+// Whenever a connection attempt fails or the connection drops, the supervisor waits and reconnects.
+// The wait starts at reconnect_min and doubles on each failed attempt up to reconnect_max, starting over
+// once a connection lasts stableTime. The tasks keep running across connections, pausing while offline.
+func (b *Bot) run(ctx context.Context) {
+	b.ctx = ctx
+	stop := make(chan struct{})
+	defer close(stop)
+	go b.queue.run(stop)
+	metrics.Collect(func() {
+		queueLines.Set(float64(b.queue.Len()), b.config.Name)
+		connected := 0.0
+		if b.health.Online() {
+			connected = 1
+		}
+		connectedGauge.Set(connected, b.config.Name)
+	})
+	if err := b.seedSettings(); err != nil {
+		b.logger.Error("Error storing the legacy channel settings.", "err", err)
+	}
+	b.startDaemons()
+	b.spawn(b.tskEvents)
+	b.spawn(b.tskFeeds)
+	b.spawn(b.tskRejoin)
+	if len(modules) > 0 {
+		b.spawn(b.tskModules)
+	}
+	if b.config.InputFile != "" {
+		b.spawn(b.tskWrite)
+	}
+	if b.config.OutputFile != "" {
+		b.spawn(b.tskOutput)
+	}
+	min := time.Duration(b.config.ReconnectMin) * time.Second
+	max := time.Duration(b.config.ReconnectMax) * time.Second
+	attempts := 0
+	for {
+		err := b.connect()
+		if err == nil {
+			start := time.Now()
+			select {
+			case err = <-b.conn.ErrorChan():
+			case <-ctx.Done():
+				b.shutdown(true)
+				return
+			}
+			b.health.SetOffline(err)
+			b.conn.Disconnect()
+			b.logger.Warn("Disconnected.", "server", b.config.Server, "err", err)
+			if time.Since(start) >= stableTime {
+				attempts = 0
+			}
+		} else {
+			b.health.SetOffline(err)
+			b.logger.Error("Error connecting.", "server", b.config.Server, "err", err)
+		}
+		attempts++
+		reconnectsTotal.Inc(b.config.Name)
+		delay := backoff(attempts, min, max)
+		b.logger.Info("Reconnecting.", "delay", delay, "attempts", attempts)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			b.shutdown(false)
+			return
+		}
+	}
+}
+
+// The shutdown method ends the bot gracefully, after its context is cancelled.
+// Games are aborted and announce it, and the commands and tasks in flight get up to shutdownTime to finish,
+// so that no data is left half written. When online, the bot then sends what is left on its queue and quits.
+func (b *Bot) shutdown(online bool) {
+	b.logger.Info("Shutting down.")
+	b.games.Abort()
+	done := make(chan struct{})
+	go func() {
+		b.work.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTime):
+		b.logger.Warn("Commands or tasks still running.", "timeout", shutdownTime)
+	}
+	if !online {
+		return
+	}
+	if !b.queue.Drain(shutdownTime) {
+		b.logger.Warn("Dropping lines still queued.", "lines", b.queue.Len())
+	}
+	b.conn.QuitMessage = b.config.QuitMessage
+	b.conn.Quit()
+	// The connection is only closed after the server closes it, since closing it first waits for a pending read.
+	b.health.SetOffline(errors.New("shut down"))
+	select {
+	case <-b.conn.ErrorChan():
+		b.conn.Disconnect()
+	case <-time.After(quitTime):
+		b.logger.Warn("The server didn't close the connection after QUIT.")
+	}
+}
+
+// The spawn method runs task on a goroutine that the bot waits for when shutting down.
+func (b *Bot) spawn(task func()) {
+	b.work.Add(1)
+	go func() {
+		defer b.work.Done()
+		task()
+	}()
+}
+
+// The sleep method pauses a background task for d, and then for as long as the bot is offline.
+// It returns false when the bot shuts down in the meantime, so that the task can return.
+func (b *Bot) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+	case <-b.ctx.Done():
+		return false
+	}
+	return b.health.Wait(b.ctx)
+}
+
+// The connect method creates a new IRC connection, defines the IRC callbacks to handle events and connects.
+// Channels are only joined after services authentication, which happens after the "001" callback.
+// If SASL fails, the next attempt falls back to services authentication, when it is configured.
+func (b *Bot) connect() error {
+	conn := irc.IRC(b.config.Nick, b.config.Nick)
+	// A connection that stopped answering is detected within a few minutes, instead of the default quarter of an hour.
+	conn.PingFreq = 2 * time.Minute
+	// The messages of the IRC library are only logged at the debug level, the bot logs the ones that matter.
+	conn.Log = log.New(b.logger.Writer(LevelDebug), "", 0)
+	b.connMu.Lock()
+	b.conn = conn
+	b.nick = ""
+	b.connMu.Unlock()
+	conn.AddCallback("001", func(event *irc.Event) {
+		b.setNick(event.Arguments[0])
+		b.health.SetOnline()
+		b.logger.Info("Connected.", "server", b.config.Server, "nick", event.Arguments[0])
+		go func() {
+			b.identify()
+			if channels := b.channels(); len(channels) > 0 {
+				sendRaw(conn, "JOIN "+strings.Join(channels, ","))
+			}
+		}()
+	})
+	conn.AddCallback("NICK", func(event *irc.Event) {
+		if strings.EqualFold(event.Nick, b.currentNick()) {
+			b.setNick(event.Message())
+		}
+	})
+	conn.AddCallback("366", func(event *irc.Event) {})
+	conn.AddCallback("PONG", func(event *irc.Event) { b.health.Pong() })
+	conn.AddCallback("PRIVMSG", b.onPrivmsg)
+	b.trackIdentities()
+	b.trackChannels(conn)
+	b.trackDaemonEvents(conn)
+	err := b.setupAuth()
+	if err != nil {
+		return err
+	}
+	err = b.conn.Connect(b.config.Server)
+	if err != nil && b.conn.UseSASL && b.conn.Connected() {
+		b.saslFailed = true
+		// The library sent QUIT, and the connection is only closed after the server closes it, like on shutdown.
+		select {
+		case <-b.conn.ErrorChan():
+			b.conn.Disconnect()
+		case <-time.After(quitTime):
+			b.logger.Warn("The server didn't close the connection after QUIT.")
+		}
+		if b.config.Auth != "" {
+			b.logger.Warn("SASL failed, falling back to services.", "auth", b.config.Auth, "err", err)
+			return b.connect()
+		}
+	}
+	return err
+}
+
+// The onPrivmsg method is the PRIVMSG callback of the bot.
+// Every message, except the ones from the bot itself, is published to the subscribers of the messages of the bot,
+// and sent to the plugin daemons.
+// We try to parse a command from every PRIVMSG that the bot sees on each channel.
+// If we cannot parse a command, this means the message is just a regular message.
+// So we need to check if there's an ongoing poll or quiz on the channel or an embedded HTTP URL.
+// In case there's an ongoing poll or quiz on the channel, we send the nick/message to the game.
+// Otherwise, if the message contains "http", we try to obtain its HTML title tag.
+// Finally, if we successfully parse a command, we call the matching cmd method.
+// The prefix, link titles and enabled commands follow the settings of the channel.
+// On a private message the target is the nick of the bot, so replies go back to the nick of the sender instead.
+func (b *Bot) onPrivmsg(event *irc.Event) {
+	b.messages.Publish(Message{
+		Network: b.config.Name,
+		Target:  event.Arguments[0],
+		Nick:    event.Nick,
+		Text:    event.Message(),
+		Time:    time.Now(),
+	})
+	target := event.Arguments[0]
+	private := checkChannel(target) != nil
+	message := pluginEvent{Type: "message", Channel: target, Private: private, Nick: event.Nick, Text: event.Message(), Time: time.Now()}
+	if private {
+		message.Channel = ""
+	}
+	b.notifyDaemons(message)
+	if private {
+		target = event.Nick
+	}
+	settings := b.settings(target)
+	prefix := settings.Prefix
+	if prefix == "" {
+		prefix = b.config.Prefix
+	}
+	m := strings.Trim(event.Message(), " ")
+	command, err := parseCommand(m, prefix, event.Nick, target)
+	if err != nil {
+		if !private && b.games.Answer(target, event.Nick, event.Message()) {
+			return
+		}
+		if settings.Titles && strings.Contains(strings.ToLower(event.Message()), "http") {
+			b.spawn(func() { b.tskHTMLTitle(target, event.Message()) })
+		}
+		return
+	}
+	command.Private = private
+	// Commands are looked up on the registry, which is refreshed from the plugins folder on a miss.
+	// This way a plugin dropped on the plugins folder is available without restarting the bot.
+	def, ok := registry.Lookup(command.Name)
+	if !ok {
+		registry.RefreshPlugins(config.PluginsFolder)
+		def, ok = registry.Lookup(command.Name)
+	}
+	resolved := b.setIdentity(&command, event)
+	command.Role = b.roleOf(command.Source, command.Account)
+	if !ok {
+		b.queue.Privmsg(PriorityNormal, command.Channel, "Unknown command or plugin.")
+		return
+	}
+	if !settings.Enabled(def) {
+		commandsTotal.Inc(b.config.Name, def.Name, "disabled")
+		return
+	}
+	ctx := newContext(b.queue, command, def.Priority, def.Reply)
+	ctx.Log = b.logger.With("channel", command.Channel, "nick", command.Nick, "command", def.Name).trackErrors()
+	// The account of the nick may still be on its way, so commands that need a role wait for it before being denied.
+	// The wait happens on its own goroutine, since the reply with the account comes through this same IRC loop.
+	if ctx.Role < def.Role && !resolved {
+		go func() {
+			ctx.Account, _ = b.idents.Resolve(ctx.Nick, resolveTimeout)
+			ctx.Role = b.roleOf(ctx.Source, ctx.Account)
+			b.dispatch(ctx, def)
+		}()
+		return
+	}
+	b.dispatch(ctx, def)
+}
+
+// The dispatch method checks the role and arguments of a command and runs its handler.
+// Commands issued while the bot is shutting down are ignored, and the others are logged with how long they took.
+func (b *Bot) dispatch(ctx *Context, def *CommandDef) {
+	if b.ctx.Err() != nil {
+		return
+	}
+	if ctx.Role < def.Role {
+		ctx.Reply("You need the " + def.Role.String() + " role to use this command.")
+		commandsTotal.Inc(b.config.Name, def.Name, "denied")
+		return
+	}
+	if def.ChannelOnly && ctx.Private {
+		ctx.Reply("This command only works on a channel.")
+		commandsTotal.Inc(b.config.Name, def.Name, "private")
+		return
+	}
+	if !def.available(ctx.Channel, ctx.Private) {
+		ctx.Reply("This command only works on " + strings.Join(def.Channels, ", ") + ".")
+		commandsTotal.Inc(b.config.Name, def.Name, "channel")
+		return
+	}
+	if def.Args != nil {
+		err := def.Args.bind(&ctx.Command)
+		if err != nil {
+			ctx.Reply(err.Error() + " Usage: " + def.usage(b.prefix(ctx.Channel)))
+			commandsTotal.Inc(b.config.Name, def.Name, "usage")
+			return
+		}
+	}
+	// The outcome is error when the handler logged an error, since handlers answer the user instead of returning one.
+	run := func() {
+		start := time.Now()
+		def.Handler(b, ctx)
+		ctx.Log.Info("Command done.", "role", ctx.Role, "duration", time.Since(start))
+		outcome := "ok"
+		if ctx.Log.Failed() {
+			outcome = "error"
+		}
+		commandsTotal.Inc(b.config.Name, def.Name, outcome)
+	}
+	if def.Async {
+		b.spawn(run)
+	} else {
+		run()
+	}
+}
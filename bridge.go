@@ -0,0 +1,69 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// The file bridge is the legacy way for other programs to talk to IRC, kept for the ones that still use it.
+// New programs should use the local API instead, since writers of the input file race with the bot truncating it,
+// and the output file only ever holds the last message.
+
+// The tskWrite function runs in the background as a goroutine that reads messages from an input file and outputs them.
+// Messages are left on the input file while the bot is offline, and read errors are only logged once until it recovers.
+func (b *Bot) tskWrite() {
+	var failed bool
+	for b.sleep(1 * time.Second) {
+		message, err := readIn(b.config.InputFile)
+		if err != nil {
+			if !failed {
+				b.logger.Error("Error reading the input file.", "err", err)
+			}
+			failed = true
+			continue
+		}
+		failed = false
+		// We need to make sure the message starts with a # prefixed word and use that as a target channel.
+		splitMessage := strings.Split(message, " ")
+		if len(splitMessage) > 1 && strings.HasPrefix(splitMessage[0], "#") {
+			b.queue.Privmsg(PriorityNormal, splitMessage[0], strings.Join(splitMessage[1:], " "))
+		}
+	}
+}
+
+// The tskOutput function runs in the background as a goroutine that writes every message seen by the bot to an output file.
+// Each message replaces the previous one, as target nick text, so the file only holds the last message.
+func (b *Bot) tskOutput() {
+	ch := make(chan Message, streamBuffer)
+	b.messages.Subscribe(ch)
+	defer b.messages.Unsubscribe(ch)
+	for {
+		select {
+		case m := <-ch:
+			err := writeOut(b.config.OutputFile, m.Target+" "+m.Nick+" "+m.Text+"\n")
+			if err != nil {
+				b.logger.Error("Error writing to the output file.", "err", err)
+			}
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
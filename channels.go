@@ -0,0 +1,325 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var settingNames = []string{"category", "commands", "prefix", "feeds", "titles", "language"} // Names of the settings of a channel.
+
+// The Enabled method returns whether a command is enabled on the channel, which they all are when none was picked.
+// Commands for admins are always enabled, so that admins can't lock themselves out of the channel command.
+func (c ChannelSettings) Enabled(def *CommandDef) bool {
+	if len(c.Commands) == 0 || def.Role >= RoleAdmin {
+		return true
+	}
+	for _, name := range c.Commands {
+		if strings.EqualFold(name, def.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// The inConfig method returns whether a channel is one of the channels of the config.
+func (b *Bot) inConfig(channel string) bool {
+	for _, c := range strings.Split(b.config.Channels, ",") {
+		if strings.EqualFold(c, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// The defaultSettings method returns the settings of a channel that has none stored.
+func (b *Bot) defaultSettings(channel string) ChannelSettings {
+	return ChannelSettings{Network: b.config.Name, Channel: channel, Joined: b.inConfig(channel), Feeds: true, Titles: true}
+}
+
+// Categories of the events shown by next on these channels before the category was a setting.
+// They are stored as the settings of the channels of the config the first time any settings of the network are
+// stored, so that existing deployments keep showing the same events.
+var legacyCategories = [][2]string{{"#formula1", "Formula 1"}, {"#geeks", "Space"}}
+
+// The storedSettings method returns the stored settings of every channel of the network, by lower case channel.
+// They are kept in memory, since they are needed for every message, and read again after they change.
+func (b *Bot) storedSettings() (map[string]ChannelSettings, error) {
+	value, err := b.cache.get(channelsFile, func() (interface{}, error) {
+		var all []ChannelSettings
+		err := b.store.View(func(tx *Tx) (err error) {
+			all, err = tx.Channels().All()
+			return
+		})
+		return all, err
+	})
+	all, _ := value.([]ChannelSettings)
+	settings := make(map[string]ChannelSettings)
+	for _, s := range all {
+		if strings.EqualFold(s.Network, b.config.Name) {
+			settings[strings.ToLower(s.Channel)] = s
+		}
+	}
+	return settings, err
+}
+
+// The settings method returns the settings of a channel.
+// Private messages and channels without settings get the defaults, and so does a channel whose settings can't be read.
+func (b *Bot) settings(channel string) ChannelSettings {
+	if checkChannel(channel) != nil {
+		return b.defaultSettings(channel)
+	}
+	stored, err := b.storedSettings()
+	if err != nil {
+		b.logger.Error("Error getting channel settings.", "channel", channel, "err", err)
+	}
+	if settings, ok := stored[strings.ToLower(channel)]; ok {
+		return settings
+	}
+	return b.defaultSettings(channel)
+}
+
+// The seedSettings method stores the legacy categories of the channels of the config, when no settings are stored
+// yet for the network.
+func (b *Bot) seedSettings() error {
+	defer b.cache.invalidate(channelsFile)
+	return b.store.Update(func(tx *Tx) error {
+		all, err := tx.Channels().All()
+		if err != nil {
+			return err
+		}
+		for _, settings := range all {
+			if strings.EqualFold(settings.Network, b.config.Name) {
+				return nil
+			}
+		}
+		for _, legacy := range legacyCategories {
+			if b.inConfig(legacy[0]) {
+				settings := b.defaultSettings(legacy[0])
+				settings.Category = legacy[1]
+				if err := tx.Channels().Put(settings); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// The updateSettings method applies change to the settings of a channel and stores them.
+func (b *Bot) updateSettings(channel string, change func(settings *ChannelSettings)) error {
+	defer b.cache.invalidate(channelsFile)
+	return b.store.Update(func(tx *Tx) error {
+		settings, ok, err := tx.Channels().Get(b.config.Name, channel)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			settings = b.defaultSettings(channel)
+		}
+		change(&settings)
+		return tx.Channels().Put(settings)
+	})
+}
+
+// The channels method returns the channels the bot should be on.
+// These are the channels of the config it wasn't parted from with the part command, and the ones joined with join.
+func (b *Bot) channels() (channels []string) {
+	all, err := b.storedSettings()
+	if err != nil {
+		b.logger.Error("Error getting channel settings.", "err", err)
+	}
+	for _, channel := range strings.Split(b.config.Channels, ",") {
+		if settings, ok := all[strings.ToLower(channel)]; channel != "" && (settings.Joined || !ok) {
+			channels = append(channels, channel)
+		}
+	}
+	var joined []string
+	for _, settings := range all {
+		if settings.Joined && !b.inConfig(settings.Channel) {
+			joined = append(joined, settings.Channel)
+		}
+	}
+	sort.Strings(joined)
+	return append(channels, joined...)
+}
+
+// The configured method returns whether channel is one of the channels the bot should be on.
+func (b *Bot) configured(channel string) bool {
+	for _, c := range b.channels() {
+		if strings.EqualFold(c, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// The prefix method returns the prefix of the commands on a channel.
+func (b *Bot) prefix(channel string) string {
+	if prefix := b.settings(channel).Prefix; prefix != "" {
+		return prefix
+	}
+	return b.config.Prefix
+}
+
+// Small utility function that changes a setting of a channel to value, where default restores the default value.
+// The errors are meant to be shown to the user who changed the setting.
+func setSetting(settings *ChannelSettings, name string, value string) error {
+	reset := strings.EqualFold(value, "default")
+	switch name {
+	case "category":
+		settings.Category = ""
+		if !reset {
+			settings.Category = strings.Trim(value, "[] ")
+		}
+	case "commands":
+		settings.Commands = nil
+		if reset || strings.EqualFold(value, "all") {
+			return nil
+		}
+		for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+			def, ok := registry.Lookup(name)
+			if !ok {
+				return errors.New("Unknown command: " + name + ".")
+			}
+			settings.Commands = append(settings.Commands, def.Name)
+		}
+	case "prefix":
+		if strings.Contains(value, " ") {
+			return errors.New("The prefix can't contain spaces.")
+		}
+		settings.Prefix = ""
+		if !reset {
+			settings.Prefix = value
+		}
+	case "feeds", "titles":
+		on := true
+		if !reset {
+			var err error
+			if on, err = parseOnOff(value); err != nil {
+				return errors.New("Use on, off or default for " + name + ".")
+			}
+		}
+		if name == "feeds" {
+			settings.Feeds = on
+		} else {
+			settings.Titles = on
+		}
+	case "language":
+		if reset {
+			value = ""
+		}
+		if checkLanguage(value) != nil {
+			return errors.New("Invalid language, use a code like en or pt_br.")
+		}
+		settings.Language = strings.ToLower(value)
+	default:
+		return errors.New("Invalid setting, use one of " + strings.Join(settingNames, ", ") + ".")
+	}
+	return nil
+}
+
+// The describeSettings method returns the settings of a channel the way the channel command shows them.
+func (b *Bot) describeSettings(settings ChannelSettings) string {
+	category, commands, prefix, language := "any", "all", b.config.Prefix, "en"
+	if settings.Category != "" {
+		category = settings.Category
+	}
+	if len(settings.Commands) > 0 {
+		commands = strings.Join(settings.Commands, " ")
+	}
+	if settings.Prefix != "" {
+		prefix = settings.Prefix
+	}
+	if settings.Language != "" {
+		language = settings.Language
+	}
+	return settings.Channel + ": category " + category + ", commands " + commands + ", prefix " + prefix +
+		", feeds " + onOff(settings.Feeds) + ", titles " + onOff(settings.Titles) + ", language " + language + "."
+}
+
+// The cmdJoin method handles the join command, which joins a channel and keeps the bot on it from then on.
+func (b *Bot) cmdJoin(ctx *Context) {
+	channel := ctx.Args[0]
+	if checkChannel(channel) != nil {
+		ctx.Reply("Invalid channel, use a name like #channel.")
+		return
+	}
+	err := b.updateSettings(channel, func(settings *ChannelSettings) { settings.Joined = true })
+	if err != nil {
+		ctx.Reply("Error storing channel settings.")
+		ctx.Log.Error("Error storing channel settings.", "err", err)
+		return
+	}
+	ctx.Reply("Joining " + channel + ".")
+	b.queue.Raw(PriorityNormal, "JOIN "+channel)
+}
+
+// The cmdPart method handles the part command, which leaves a channel, the current one by default, for good.
+func (b *Bot) cmdPart(ctx *Context) {
+	channel := ctx.Channel
+	if len(ctx.Args) > 0 {
+		channel = ctx.Args[0]
+	}
+	if checkChannel(channel) != nil {
+		ctx.Reply("Invalid channel, use a name like #channel.")
+		return
+	}
+	err := b.updateSettings(channel, func(settings *ChannelSettings) { settings.Joined = false })
+	if err != nil {
+		ctx.Reply("Error storing channel settings.")
+		ctx.Log.Error("Error storing channel settings.", "err", err)
+		return
+	}
+	ctx.Reply("Leaving " + channel + ".")
+	b.queue.Raw(PriorityNormal, "PART "+channel)
+}
+
+// The cmdChannel method handles the channel command, which shows and changes the settings of a channel.
+// The settings apply right away, since they are read from the storage whenever they are needed.
+func (b *Bot) cmdChannel(ctx *Context) {
+	channel := ctx.Channel
+	if c, ok := ctx.Options["channel"]; ok {
+		channel = c
+	}
+	if checkChannel(channel) != nil {
+		ctx.Reply("Use this command on a channel, or pick one with --channel #channel.")
+		return
+	}
+	settings := b.settings(channel)
+	if len(ctx.Args) < 2 {
+		ctx.Reply(b.describeSettings(settings))
+		return
+	}
+	name, value := strings.ToLower(ctx.Args[0]), strings.Join(ctx.Args[1:], " ")
+	// The change is checked before storing it, so that a wrong value gets a helpful reply instead of a storage error.
+	if err := setSetting(&settings, name, value); err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	err := b.updateSettings(channel, func(settings *ChannelSettings) { setSetting(settings, name, value) })
+	if err != nil {
+		ctx.Reply("Error storing channel settings.")
+		ctx.Log.Error("Error storing channel settings.", "err", err)
+		return
+	}
+	ctx.Reply("Updated the " + name + " of " + b.describeSettings(settings))
+}
@@ -0,0 +1,188 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChannels(t *testing.T) {
+	b := newTestBot(t, nil)
+	b.config.Channels = "#f1,#motorsport"
+	if got := strings.Join(b.channels(), ","); got != "#f1,#motorsport" {
+		t.Fatalf("channels() = %q before any join or part", got)
+	}
+	join, _ := newFakeContext("gluon", "#f1", "#geeks")
+	b.cmdJoin(join)
+	part, _ := newFakeContext("gluon", "#motorsport")
+	b.cmdPart(part)
+	if got := strings.Join(b.channels(), ","); got != "#f1,#geeks" {
+		t.Errorf("channels() = %q, want #f1,#geeks", got)
+	}
+	if !b.configured("#GEEKS") || b.configured("#motorsport") {
+		t.Error("configured() doesn't follow join and part")
+	}
+	if lines := strings.Join(b.queue.queues[PriorityNormal], "|"); lines != "JOIN #geeks|PART #motorsport" {
+		t.Errorf("queued %q", lines)
+	}
+	bad, r := newFakeContext("gluon", "#f1", "geeks")
+	b.cmdJoin(bad)
+	if !r.contains("Invalid channel, use a name like #channel.") {
+		t.Errorf("cmdJoin: got %q", r.replies())
+	}
+}
+
+func TestSettingsCache(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{channelsFile: {{"test", "#f1", "on", "", "", "", "on", "on", ""}}})
+	if got := b.prefix("#f1"); got != "!" {
+		t.Fatalf("prefix(#f1) = %q", got)
+	}
+	// Changes made by the bot apply at once.
+	if err := b.updateSettings("#f1", func(s *ChannelSettings) { s.Prefix = "." }); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.prefix("#f1"); got != "." {
+		t.Errorf("prefix(#f1) = %q after updating it", got)
+	}
+	// Changes made outside of the bot apply once the cache expires, and the file isn't read before that.
+	if err := writeCSV(b.config.path(channelsFile), [][]string{{"test", "#f1", "on", "", "", "?", "on", "on", ""}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.prefix("#f1"); got != "." {
+		t.Errorf("prefix(#f1) = %q, want the cached one", got)
+	}
+	b.cache.Lock()
+	cached := b.cache.tables[channelsFile]
+	cached.loaded = cached.loaded.Add(-cacheTime)
+	b.cache.tables[channelsFile] = cached
+	b.cache.Unlock()
+	if got := b.prefix("#f1"); got != "?" {
+		t.Errorf("prefix(#f1) = %q once the cache expired", got)
+	}
+	// Networks sharing a store share its cache.
+	other := newBot(b.config, b.store)
+	if other.cache != b.cache {
+		t.Error("bots on the same store have different caches")
+	}
+}
+
+func TestSettingsPerNetwork(t *testing.T) {
+	b := newTestBot(t, nil)
+	b.config.Channels = "#f1"
+	other := newBot(b.config, b.store)
+	other.config.Name = "other"
+	// Networks on the same folder share the store, but each one keeps its own settings.
+	if err := b.updateSettings("#foo", func(s *ChannelSettings) { s.Joined = true }); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.updateSettings("#F1", func(s *ChannelSettings) { s.Prefix = "." }); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(b.channels(), ","); got != "#f1,#foo" {
+		t.Errorf("channels of test = %q", got)
+	}
+	if got := strings.Join(other.channels(), ","); got != "#f1" {
+		t.Errorf("channels of other = %q", got)
+	}
+	if b.prefix("#f1") != "!" || other.prefix("#f1") != "." {
+		t.Errorf("prefixes of #f1 = %q and %q", b.prefix("#f1"), other.prefix("#f1"))
+	}
+	rows, _ := readCSV(b.config.path(channelsFile))
+	if len(rows) != 2 || rows[0][0] != "test" || rows[1][0] != "other" {
+		t.Errorf("got rows %q", rows)
+	}
+}
+
+func TestSeedSettings(t *testing.T) {
+	b := newTestBot(t, nil)
+	b.config.Channels = "#formula1,#f1"
+	if err := b.seedSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.settings("#formula1"); got.Category != "Formula 1" || !got.Joined {
+		t.Errorf("settings(#formula1) = %+v, want the legacy category", got)
+	}
+	// Only channels of the config are seeded, since the settings of other channels would count them as parted.
+	if got := b.settings("#geeks"); got.Category != "" {
+		t.Errorf("settings(#geeks) = %+v, want none", got)
+	}
+	// Settings are only seeded once, so that they can be changed afterwards.
+	b.updateSettings("#formula1", func(s *ChannelSettings) { s.Category = "" })
+	b.config.Channels = "#formula1,#geeks"
+	if err := b.seedSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.settings("#formula1").Category + b.settings("#geeks").Category; got != "" {
+		t.Errorf("categories %q after seeding again", got)
+	}
+}
+
+func TestCmdChannel(t *testing.T) {
+	useBuiltins(t)
+	b := newTestBot(t, map[string][][]string{eventsFile: testEvents()})
+	b.config.Channels = "#f1"
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "#f1: category any, commands all, prefix !, feeds on, titles on, language en."},
+		{[]string{"category", "[Formula", "1]"}, "Updated the category of #f1: category Formula 1,"},
+		{[]string{"commands", "next", "n0pe"}, "Unknown command: n0pe."},
+		{[]string{"commands", "n,", "bet"}, "commands next bet,"},
+		{[]string{"prefix", "."}, "prefix .,"},
+		{[]string{"feeds", "maybe"}, "Use on, off or default for feeds."},
+		{[]string{"titles", "off"}, "titles off,"},
+		{[]string{"language", "pt_br"}, "language pt_br."},
+		{[]string{"colour", "red"}, "Invalid setting, use one of category, commands, prefix, feeds, titles, language."},
+	}
+	for _, test := range tests {
+		ctx, r := newFakeContext("gluon", "#f1", test.args...)
+		b.cmdChannel(ctx)
+		if replies := strings.Join(r.replies(), "|"); !strings.Contains(replies, test.want) {
+			t.Errorf("channel %q: got %q, want %q", test.args, replies, test.want)
+		}
+	}
+	settings := b.settings("#F1")
+	if b.prefix("#f1") != "." || settings.Titles || !settings.Feeds || !settings.Joined {
+		t.Errorf("settings(#f1) = %+v", settings)
+	}
+	next, _ := registry.Lookup("next")
+	poll, _ := registry.Lookup("poll")
+	grant, _ := registry.Lookup("grant")
+	if !settings.Enabled(next) || settings.Enabled(poll) || !settings.Enabled(grant) {
+		t.Error("Enabled() doesn't follow the commands of the channel, or disabled an admin command")
+	}
+	// The settings apply right away, like the category of the events shown by next.
+	ctx, r := newFakeContext("alice", "#f1")
+	b.cmdNext(ctx)
+	if !r.contains("Monaco Grand Prix") {
+		t.Errorf("cmdNext: got %q, want the next Formula 1 event", r.replies())
+	}
+	ctx, r = newFakeContext("gluon", "#f1", "category", "default")
+	b.cmdChannel(ctx)
+	if b.settings("#f1").Category != "" {
+		t.Errorf("category wasn't reset: %q", r.replies())
+	}
+	ctx, r = newFakeContext("gluon", "alice")
+	b.cmdChannel(ctx)
+	if !r.contains("Use this command on a channel, or pick one with --channel #channel.") {
+		t.Errorf("cmdChannel on a private message: got %q", r.replies())
+	}
+}
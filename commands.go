@@ -22,113 +22,89 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
-	"os/exec"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
-
-	owm "github.com/briandowns/openweathermap"
-	irc "github.com/thoj/go-ircevent"
 )
 
+var errNoEvent = errors.New("No event found.") // Error returned by findNext when no upcoming event matches.
+
 // The findNext function receives a category and session and returns the chronologically next event matching that criteria.
-func findNext(category string, session string) (event []string, err error) {
-	var t time.Time
-	var timeFormat = "2006-01-02 15:04:05 UTC"
-	events, err := readCSV(eventsFile)
+func (b *Bot) findNext(category string, session string) (event Event, err error) {
+	var events []Event
+	err = b.store.View(func(tx *Tx) (err error) {
+		events, err = tx.Events().All()
+		return
+	})
 	if err != nil {
 		return
 	}
-	// Loop through all events and get a parsed time for the event that matches the category and session criteria.
-	// There are 3 special cases where the category and session can be set to the wildcard any in different ways.
-	// Otherwise, use the default case to search for a specific category and session.
+	// Loop through all events and return the first one in the future that matches the category and session criteria.
+	// Either the category or the session (or both) can be set to the wildcard any.
 	for _, e := range events {
-		switch {
-		case strings.ToLower(category) == "any" && strings.ToLower(session) == "any":
-			t, err = time.Parse(timeFormat, e[3])
-			if err != nil {
-				err = errors.New("Error parsing time.")
-				return event, err
-			}
-		case strings.ToLower(category) != "any" && strings.ToLower(session) == "any":
-			if strings.ToLower(e[0]) == strings.ToLower(category) {
-				t, err = time.Parse(timeFormat, e[3])
-				if err != nil {
-					err = errors.New("Error parsing time.")
-					return event, err
-				}
-			}
-		case strings.ToLower(category) == "any" && strings.ToLower(session) != "any":
-			if strings.ToLower(e[2]) == strings.ToLower(session) {
-				t, err = time.Parse(timeFormat, e[3])
-				if err != nil {
-					err = errors.New("Error parsing time.")
-					return event, err
-				}
-			}
-		default:
-			if strings.ToLower(e[0]) == strings.ToLower(category) && strings.ToLower(e[2]) == strings.ToLower(session) {
-				t, err = time.Parse(timeFormat, e[3])
-				if err != nil {
-					err = errors.New("Error parsing time.")
-					return event, err
-				}
-			}
+		if strings.ToLower(category) != "any" && !strings.EqualFold(e.Category, category) {
+			continue
+		}
+		if strings.ToLower(session) != "any" && !strings.EqualFold(e.Session, session) {
+			continue
 		}
 		// Get the time delta from now until the time of the event.
 		// If delta is equal or greater than zero, this is the next event that will happen.
-		delta := time.Until(t)
-		if delta >= 0 {
-			event = []string{e[0], e[1], e[2], e[3], e[4], e[5], e[6]}
-			return event, nil
+		if time.Until(e.Time) >= 0 {
+			return e, nil
 		}
 	}
-	err = errors.New("No event found.")
+	err = errNoEvent
 	return
 }
 
-// The help command receives an IRC connection pointer, a channel and a search string.
-// It then shows a compact help message listing all the possible commands of the bot.
-func cmdHelp(irccon *irc.Connection, channel string, search string) {
-	help := [13]string{
-		"ask <question>.",
-		"bet <xxx> <yyy> <zzz> or [log/odds/nick] - Place a bet for the next F1 race or get bet info.",
-		"help - Show this help message.",
-		"next [category] - Show the next motorsport event.",
-		"notify [on/off] - Turn on/off notifications for the current channel.",
-		"omdb [movie/show] - Show info about a movie or a show.",
-		"poll <question;option_1;option_2;option_n>",
-		"quiz [number] - Start an F1 quiz game.",
-		"quote [get/add] [text] - Get a random quote or add one.",
-		"wbc - Show the current Betting Championship standings.",
-		"wcc - Show the current World Constructor Championship standings.",
-		"wdc - Show the current World Driver Championship standings.",
-		"weather [location] - Show the current weather for a locattion.",
-	}
+// The help command receives a context with an optional search string.
+// It then shows a compact list of the commands the nick can run, or how to use the command matching search.
+// Both are generated from the registry, which also includes the plugins found on the plugins folder.
+func (b *Bot) cmdHelp(ctx *Context) {
+	search := strings.Join(ctx.Args, "")
+	registry.RefreshPlugins(config.PluginsFolder)
+	settings := b.settings(ctx.Channel)
+	prefix := b.prefix(ctx.Channel)
 	if search == "" {
 		var commandList string
-		irccon.Privmsg(channel, "This is a list of all the commands of this bot, !help command_name shows how to use each one:")
-		for _, v := range help {
-			commandList += prefix + strings.Split(v, " ")[0] + " "
-		}
-		irccon.Privmsg(channel, commandList)
-	} else {
-		for _, v := range help {
-			if strings.HasPrefix(v, strings.ToLower(search)) {
-				irccon.Privmsg(channel, prefix+v)
-				return
+		ctx.Reply("This is a list of all the commands of this bot, " + prefix + "help command_name shows how to use each one:")
+		for _, def := range registry.Commands() {
+			if ctx.Role >= def.Role && settings.Enabled(def) && def.available(ctx.Channel, ctx.Private) {
+				commandList += prefix + def.Name + " "
 			}
 		}
+		ctx.Reply(strings.TrimSpace(commandList))
+		return
+	}
+	def, ok := registry.Lookup(strings.TrimPrefix(search, prefix))
+	if !ok {
+		ctx.Reply("Unknown command or plugin.")
+		return
+	}
+	help := def.usage(prefix) + " - " + def.Description
+	if def.Args != nil && len(def.Args.Options) > 0 {
+		var options []string
+		for _, option := range def.Args.Options {
+			options = append(options, "--"+option.Name+" ("+strings.TrimSuffix(option.Description, ".")+")")
+		}
+		help += " Options: " + strings.Join(options, ", ") + "."
+	}
+	if len(def.Aliases) > 0 {
+		help += " Aliases: " + strings.Join(def.Aliases, ", ") + "."
+	}
+	if len(def.Channels) > 0 {
+		help += " Channels: " + strings.Join(def.Channels, ", ") + "."
 	}
+	ctx.Reply(help)
 }
 
-// The standings command receives an IRC connection pointer, a channel, a nick and a championship string.
+// The standings command receives a context and a championship string.
 // It then queries the Ergast F1 API for either the WDC or the WCC and displays the results on the channel.
-func cmdStandings(irccon *irc.Connection, channel string, nick string, championship string) {
+func (b *Bot) cmdStandings(ctx *Context, championship string) {
 	var output string
 	// Base URL of the Ergast F1 API.
 	url := "http://ergast.com/api/f1/current/"
@@ -145,23 +121,27 @@ func cmdStandings(irccon *irc.Connection, channel string, nick string, champions
 	// The API returns in JSON format which is decoded to either a DStandings or CStandings strut.
 	switch strings.ToLower(championship) {
 	case "bet", "bets":
-		users, err := readCSV(usersFile)
+		var users []User
+		err := b.store.View(func(tx *Tx) (err error) {
+			users, err = tx.Users().All()
+			return
+		})
 		if err != nil {
-			irccon.Privmsg(channel, "Error getting users.")
-			log.Println("cmdStandings:", err)
+			ctx.Reply("Error getting users.")
+			ctx.Log.Error("Error getting users.", "err", err)
 			return
 		}
 		scoreList := make(ScoreList, len(users))
 		for _, user := range users {
-			points, _ := strconv.Atoi(user[2])
+			points := user.Points
 			if points > 0 {
 				re, err := regexp.Compile("[^a-zA-Z0-9]+")
 				if err != nil {
-					irccon.Privmsg(channel, "Error getting standings.")
-					log.Println("cmdStandings:", err)
+					ctx.Reply("Error getting standings.")
+					ctx.Log.Error("Error getting standings.", "err", err)
 					return
 				}
-				scoreList = append(scoreList, Score{strings.ToUpper(re.ReplaceAllString(user[0], "")[0:3]), points})
+				scoreList = append(scoreList, Score{strings.ToUpper(re.ReplaceAllString(user.Nick, "")[0:3]), points})
 			}
 		}
 		sort.Sort(sort.Reverse(scoreList))
@@ -171,22 +151,22 @@ func cmdStandings(irccon *irc.Connection, channel string, nick string, champions
 			}
 		}
 		if len(output) > 3 {
-			irccon.Privmsg(channel, output[:len(output)-3])
+			ctx.Reply(output[:len(output)-3])
 		}
 		return
 	case "driver", "drivers":
 		// Get the raw data through HTTP.
 		data, err := getURL(url)
 		if err != nil {
-			irccon.Privmsg(channel, "Error getting standings.")
-			log.Println("cmdStandings:", err)
+			ctx.Reply("Error getting standings.")
+			ctx.Log.Error("Error getting standings.", "err", err)
 			return
 		}
 		var standings DStandings
 		err = json.Unmarshal(data, &standings)
 		if err != nil {
-			irccon.Privmsg(channel, "Error getting driver standings.")
-			log.Println("cmdStandings:", err)
+			ctx.Reply("Error getting driver standings.")
+			ctx.Log.Error("Error getting driver standings.", "err", err)
 			return
 		}
 		for _, driver := range standings.MRData.StandingsTable.StandingsLists[0].DriverStandings {
@@ -202,15 +182,15 @@ func cmdStandings(irccon *irc.Connection, channel string, nick string, champions
 		// Get the raw data through HTTP.
 		data, err := getURL(url)
 		if err != nil {
-			irccon.Privmsg(channel, "Error getting standings.")
-			log.Println("cmdStandings:", err)
+			ctx.Reply("Error getting standings.")
+			ctx.Log.Error("Error getting standings.", "err", err)
 			return
 		}
 		var standings CStandings
 		err = json.Unmarshal(data, &standings)
 		if err != nil {
-			irccon.Privmsg(channel, "Error getting constructor standings.")
-			log.Println("cmdStandings:", err)
+			ctx.Reply("Error getting constructor standings.")
+			ctx.Log.Error("Error getting constructor standings.", "err", err)
 			return
 		}
 		for _, constructor := range standings.MRData.StandingsTable.StandingsLists[0].ConstructorStandings {
@@ -223,25 +203,23 @@ func cmdStandings(irccon *irc.Connection, channel string, nick string, champions
 			)
 		}
 	}
-	irccon.Privmsg(channel, output)
+	ctx.Reply(output)
 }
 
-// The next command receives an IRC connection pointer, a channel, a nick and an optional search string.
+// The next command receives a context with an optional search string.
 // It then queries the events CSV file and returns which event is happening next, showing it on the channel.
-func cmdNext(irccon *irc.Connection, channel string, nick string, search string) {
+func (b *Bot) cmdNext(ctx *Context) {
+	search := strings.Join(ctx.Args, " ")
 	var tz = "Europe/Berlin"
-	var event []string
-	var timeFormat = "2006-01-02 15:04:05 UTC"
-	users, err := readCSV(usersFile)
+	var event Event
+	user, ok, err := b.findUser(ctx)
 	if err != nil {
-		irccon.Privmsg(channel, "Error getting users.")
-		log.Println("cmdNext:", err)
+		ctx.Reply("Error getting users.")
+		ctx.Log.Error("Error getting users.", "err", err)
 		return
 	}
-	for _, user := range users {
-		if strings.ToLower(user[0]) == strings.ToLower(nick) {
-			tz = user[1]
-		}
+	if ok {
+		tz = user.TimeZone
 	}
 	// Do some search string replacements in case there's actually a search argument.
 	// Users use abreviated search terms, which are expanded for better database matching.
@@ -250,53 +228,48 @@ func cmdNext(irccon *irc.Connection, channel string, nick string, search string)
 	if search != "" {
 		switch strings.ToLower(search) {
 		case "f1", "formula1", "formula 1":
-			event, err = findNext("[Formula 1]", "any")
+			event, err = b.findNext("[Formula 1]", "any")
 		case "f2", "formula2", "formula 2":
-			event, err = findNext("[Formula 2]", "any")
+			event, err = b.findNext("[Formula 2]", "any")
 		case "f3", "formula3", "formula 3":
-			event, err = findNext("[Formula 3]", "any")
+			event, err = b.findNext("[Formula 3]", "any")
 		case "q", "quali", "qualy", "qualifying",
 			"f1 quali", "f1 qualy", "f1quali", "f1qualy", "f1 qualifying",
 			"formula1 quali", "formula1 qualy", "formula1 qualifying":
-			event, err = findNext("[Formula 1]", "Qualifying")
+			event, err = b.findNext("[Formula 1]", "Qualifying")
 		case "r", "race", "f1 race", "f1race", "formula 1 race":
-			event, err = findNext("[Formula 1]", "Race")
+			event, err = b.findNext("[Formula 1]", "Race")
 		case "s", "sprint", "sprint race",
 			"f1 sprint", "f1sprint", "f1 sprint race",
 			"formula1 sprint", "formula1 sprint race":
-			event, err = findNext("[Formula 1]", "Sprint Race")
+			event, err = b.findNext("[Formula 1]", "Sprint Race")
 		default:
-			event, err = findNext("["+search+"]", "any")
+			event, err = b.findNext("["+search+"]", "any")
 		}
 	} else {
-		switch channel {
-		case "#formula1":
-			event, err = findNext("[Formula 1]", "any")
-		case "#geeks":
-			event, err = findNext("[Space]", "any")
-		default:
-			event, err = findNext("any", "any")
+		// Without a search, the category picked on the settings of the channel is used, if any.
+		if category := b.settings(ctx.Channel).Category; category != "" {
+			event, err = b.findNext("["+category+"]", "any")
+		} else {
+			event, err = b.findNext("any", "any")
 		}
 	}
 	if err != nil {
-		irccon.Privmsg(channel, "No event found.")
-		log.Println("cmdNext:", err)
+		ctx.Reply("No event found.")
+		if !errors.Is(err, errNoEvent) {
+			ctx.Log.Error("Error finding the next event.", "err", err)
+		}
 		return
 	}
-	// Parse the time of the event, calculate time delta, do some formatting and finally show the results.
+	// Calculate time delta, do some formatting and finally show the results.
 	// The times are localised as per the user's time zone before being shown.
 	// The time delta between now and the next event uses modulo to perfectly round days, hour an minutes.
-	t, err := time.Parse(timeFormat, event[3])
-	if err != nil {
-		irccon.Privmsg(channel, "Error parsing time.")
-		log.Println("cmdNext: Error parsing time.")
-		return
-	}
+	t := event.Time
 	delta := time.Until(t)
 	loc, err := time.LoadLocation(tz)
 	if err != nil {
-		irccon.Privmsg(channel, "Error converting time to user time zone. Using default one.")
-		log.Println("cmdNext: Error converting time to user time zone. Using default one.")
+		ctx.Reply("Error converting time to user time zone. Using default one.")
+		ctx.Log.Warn("Error converting time to user time zone.", "timezone", tz, "err", err)
 		loc, _ = time.LoadLocation("Europe/Berlin")
 	}
 	t = t.In(loc)
@@ -312,469 +285,435 @@ func cmdNext(irccon *irc.Connection, channel string, nick string, search string)
 	days := int((delta % (86400 * 30)) / 86400)
 	hours := int((delta % 86400) / 3600)
 	minutes := int((delta % 3600) / 60)
-	irccon.Privmsg(channel, fmt.Sprintf(
+	ctx.Reply(fmt.Sprintf(
 		"%s, %d %s at %02d:%02d \x02%s (UTC+%d)\x02 | %s | %d month(s), %d day(s), %d hour(s), %d minute(s)",
-		wday, mday, month, hour, min, zone, uoffset, event[0]+" "+event[1]+" "+event[2], months, days, hours, minutes))
+		wday, mday, month, hour, min, zone, uoffset, event.Category+" "+event.Name+" "+event.Session, months, days, hours, minutes))
 }
 
-// The bet command receives an IRC connection pointer, a channel, a nick and a bet containing 3 drivers.
+// The bet command receives a context with a bet containing 3 drivers.
 // It then stores the bet provided by the user, or lets the user know his current bet for the next race.
-func cmdBet(irccon *irc.Connection, channel string, nick string, bet []string) {
+func (b *Bot) cmdBet(ctx *Context) {
 	var correct int
-	var bets [][]string
-	var update bool
-	users, err := readCSV(usersFile)
+	var bets []Bet
+	var drivers []Driver
+	// Bets are kept under the registered nick of the user, so they follow the user across nick changes.
+	user, registered, err := b.findUser(ctx)
 	if err != nil {
-		irccon.Privmsg(channel, "Error getting users.")
-		log.Println("cmdBet:", err)
+		ctx.Reply("Error getting users.")
+		ctx.Log.Error("Error getting users.", "err", err)
 		return
 	}
-	if !isUser(nick, users) {
-		irccon.Privmsg(channel, "You're not a registered user. Use !register to register your nick.")
+	if !registered {
+		ctx.Reply("You're not a registered user. Use !register to register your nick.")
 		return
 	}
-	event, err := findNext("[formula 1]", "race")
+	event, err := b.findNext("[formula 1]", "race")
 	if err != nil {
-		irccon.Privmsg(channel, "Bets are closed.")
-		log.Println("cmdBet:", err)
+		ctx.Reply("Bets are closed.")
+		if !errors.Is(err, errNoEvent) {
+			ctx.Log.Error("Error finding the next race.", "err", err)
+		}
 		return
 	}
-	bets, err = readCSV(betsFile)
+	err = b.store.View(func(tx *Tx) (err error) {
+		bets, err = tx.Bets().All()
+		return
+	})
 	if err != nil {
-		irccon.Privmsg(channel, "Error getting bets.")
-		log.Println("cmdBet:", err)
+		ctx.Reply("Error getting bets.")
+		ctx.Log.Error("Error getting bets.", "err", err)
 		return
 	}
 	// If no bet is provided as argument, we simply show the user's current bet, if he's placed one.
-	if len(bet) == 0 {
+	if len(ctx.Args) == 0 {
 		for i := len(bets) - 1; i >= 0; i-- {
-			if strings.ToLower(bets[i][0]) == strings.ToLower(event[1]) && strings.ToLower(bets[i][1]) == strings.ToLower(nick) {
-				first := strings.ToUpper(bets[i][2])
-				second := strings.ToUpper(bets[i][3])
-				third := strings.ToUpper(bets[i][4])
-				fourth := strings.ToUpper(bets[i][5])
-                irccon.Privmsg(channel, fmt.Sprintf("Your current bet for the %s -> 1: %s | 2: %s | 3: %s | FL: %s", event[1], first, second, third, fourth))
+			if strings.EqualFold(bets[i].Race, event.Name) && strings.EqualFold(bets[i].Nick, user.Nick) {
+				ctx.Reply(fmt.Sprintf("Your current bet for the %s -> %s", event.Name, formatBet(bets[i])))
 				return
 			}
 		}
-		irccon.Privmsg(channel, fmt.Sprintf("You haven't placed a bet for the %s yet.", event[1]))
-		irccon.Privmsg(channel, fmt.Sprintf("Use !bet log to check older bets."))
+		ctx.Reply(fmt.Sprintf("You haven't placed a bet for the %s yet.", event.Name))
+		ctx.Reply(fmt.Sprintf("Use !bet log to check older bets."))
 		return
 	}
-	drivers, err := readCSV(driversFile)
+	err = b.store.View(func(tx *Tx) (err error) {
+		drivers, err = tx.Drivers().All()
+		return
+	})
 	if err != nil {
-		irccon.Privmsg(channel, "Error getting drivers.")
-		log.Println("cmdBet:", err)
+		ctx.Reply("Error getting drivers.")
+		ctx.Log.Error("Error getting drivers.", "err", err)
 		return
 	}
 	// If instead of a normal bet the user provides a single word, we interpret it as an argument.
-	// There are multiple arguments, for which we show the driver odds or a log of the user's bets.
+	// There are multiple arguments, for which we show a log of the user's bets.
 	// Other possible argument is the nick of a registered user, for which we show that user's bet.
 	// Alternatively, if the argument provided isn't a valid command option, we let the user know.
-	if len(bet) == 1 {
-		switch strings.ToLower(bet[0]) {
-		/*
-			case "multipliers", "odds":
-				var output string
-				odds, err := toStringMap(drivers, 1, 2)
-				if err != nil {
-					irccon.Privmsg(channel, "Error getting odds.")
-					log.Println("cmdBet:", err)
-					return
-				}
-				scoreList := make(ScoreList, len(drivers))
-				i := 0
-				for k, v := range odds {
-					//output += fmt.Sprintf("%s %s | ", strings.ToUpper(k), v)
-					integerOdds, err := strconv.Atoi(v)
-					if err != nil {
-						irccon.Privmsg(channel, "Error getting odds.")
-						log.Println("cmdBet:", err)
-						return
-					}
-					scoreList[i] = Score{k, integerOdds}
-					i++
-				}
-				sort.Sort(scoreList)
-				for _, v := range scoreList {
-					output += fmt.Sprintf("%s %d | ", strings.ToUpper(v.Nick), v.Points)
-				}
-				if len(output) > 3 {
-					irccon.Privmsg(channel, output[:len(output)-3])
-				}
-		*/
+	if len(ctx.Args) == 1 {
+		switch strings.ToLower(ctx.Args[0]) {
 		case "log":
 			var betsFound bool
 			var counter int
 			for i := len(bets) - 1; i >= 0 && counter < 3; i-- {
-				if strings.ToLower(bets[i][1]) == strings.ToLower(nick) {
+				if strings.EqualFold(bets[i].Nick, user.Nick) {
 					betsFound = true
-					irccon.Privmsg(channel,
-                    fmt.Sprintf("Your bet for the %s -> 1: %s | 2: %s | 3: %s | FL: %s | Points: %s",
-							bets[i][0],
-							strings.ToUpper(bets[i][2]),
-							strings.ToUpper(bets[i][3]),
-							strings.ToUpper(bets[i][4]),
-							strings.ToUpper(bets[i][5]),
-							bets[i][6]))
+					ctx.Reply(fmt.Sprintf("Your bet for the %s -> %s | Points: %d", bets[i].Race, formatBet(bets[i]), bets[i].Points))
 					counter += 1
 				}
 			}
 			if !betsFound {
-				irccon.Privmsg(channel, "No recent bets from you.")
+				ctx.Reply("No recent bets from you.")
 			}
 		default:
-			if isUser(strings.ToLower(bet[0]), users) {
+			var isUser bool
+			err = b.store.View(func(tx *Tx) (err error) {
+				_, isUser, err = tx.Users().Get(ctx.Args[0])
+				return
+			})
+			if err != nil {
+				ctx.Reply("Error getting users.")
+				ctx.Log.Error("Error getting users.", "err", err)
+				return
+			}
+			if isUser {
 				for i := len(bets) - 1; i >= 0; i-- {
-					if strings.ToLower(bets[i][0]) == strings.ToLower(event[1]) &&
-						strings.ToLower(bets[i][1]) == strings.ToLower(bet[0]) {
-						first := strings.ToUpper(bets[i][2])
-						second := strings.ToUpper(bets[i][3])
-						third := strings.ToUpper(bets[i][4])
-						fourth := strings.ToUpper(bets[i][5])
-						irccon.Privmsg(channel,
-							fmt.Sprintf("%s's current bet for the %s -> 1: %s | 2: %s | 3: %s | FL: %s",
-								bet[0],
-								event[1],
-								first,
-								second,
-								third,
-								fourth))
+					if strings.EqualFold(bets[i].Race, event.Name) && strings.EqualFold(bets[i].Nick, ctx.Args[0]) {
+						ctx.Reply(fmt.Sprintf("%s's current bet for the %s -> %s", ctx.Args[0], event.Name, formatBet(bets[i])))
 						return
 					}
 				}
-				irccon.Privmsg(channel, "That user hasn't bet for the current race yet.")
+				ctx.Reply("That user hasn't bet for the current race yet.")
 				return
 			}
-			irccon.Privmsg(channel, "Unknown command option.")
+			ctx.Reply("Unknown command option.")
 		}
 		return
 	}
-	if len(bet) != 4 {
-		irccon.Privmsg(channel, "The bet must contain 4 drivers.")
-		irccon.Privmsg(channel, "2023 bet format: <first> <second> <third> <fl_driver>.")
-		return
-	}
-	// Finally, if we reach this point, it means the user has provided a valid bet composed of 4 drivers.
-	// We verify that all 4 driver codes are valid as per the drivers CSV file before we go any further.
+	// Finally, if we reach this point, it means the user has provided a bet composed of 4 drivers.
+	// The schema of the command rejects any other number of arguments before we get here.
+	// We verify that all 4 driver codes are valid as per the drivers table before we go any further.
 	// If the 4 codes are valid, we either place a new bet or update an already placed bet for the race.
-	first := strings.ToLower(bet[0])
-	second := strings.ToLower(bet[1])
-	third := strings.ToLower(bet[2])
+	first := strings.ToLower(ctx.Args[0])
+	second := strings.ToLower(ctx.Args[1])
+	third := strings.ToLower(ctx.Args[2])
 	for _, driver := range drivers {
-		code := strings.ToLower(driver[1])
+		code := strings.ToLower(driver.Code)
 		if code == first || code == second || code == third {
 			correct++
 		}
 	}
 	if correct != 3 {
-		irccon.Privmsg(channel, "Invalid podium drivers.")
+		ctx.Reply("Invalid podium drivers.")
 		return
 	}
-    correct = 0;
-    fourth := strings.ToLower(bet[3])
-    for _, driver := range drivers {
-        code := strings.ToLower(driver[1])
-        if code == fourth {
-            correct++
-        }
-    }
-    if correct != 1 {
-        irccon.Privmsg(channel, "Invalid FL driver.")
-        return
-    }
-	for i := 0; i < len(bets); i++ {
-		if strings.ToLower(bets[i][0]) == strings.ToLower(event[1]) && strings.ToLower(bets[i][1]) == strings.ToLower(nick) {
-			update = true
-			bets[i] = []string{event[1], strings.ToLower(nick), first, second, third, fourth, "0"}
-			break
+	correct = 0
+	fourth := strings.ToLower(ctx.Args[3])
+	for _, driver := range drivers {
+		code := strings.ToLower(driver.Code)
+		if code == fourth {
+			correct++
 		}
 	}
-	if !update {
-		bets = append(bets, []string{event[1], strings.ToLower(nick), first, second, third, fourth, "0"})
+	if correct != 1 {
+		ctx.Reply("Invalid FL driver.")
+		return
 	}
-	err = writeCSV(betsFile, bets)
+	err = b.store.Update(func(tx *Tx) error {
+		return tx.Bets().Put(Bet{
+			Race:       event.Name,
+			Nick:       strings.ToLower(user.Nick),
+			First:      first,
+			Second:     second,
+			Third:      third,
+			FastestLap: fourth,
+		})
+	})
 	if err != nil {
-		irccon.Privmsg(channel, "Error updating bet.")
-		log.Println("cmdBet:", err)
+		ctx.Reply("Error updating bet.")
+		ctx.Log.Error("Error updating bet.", "err", err)
 		return
 	}
-	irccon.Privmsg(channel, "Your bet for the "+event[1]+" was successfully updated.")
+	ctx.Reply("Your bet for the " + event.Name + " was successfully updated.")
 }
 
-// The processbets command receives an IRC connection pointer, a channel and a nick.
+// Small utility function that formats the drivers of a bet, for example "1: VER | 2: HAM | 3: LEC | FL: VER".
+func formatBet(bet Bet) string {
+	return fmt.Sprintf("1: %s | 2: %s | 3: %s | FL: %s",
+		strings.ToUpper(bet.First),
+		strings.ToUpper(bet.Second),
+		strings.ToUpper(bet.Third),
+		strings.ToUpper(bet.FastestLap))
+}
+
+// The processbets command receives a context.
 // It then processes the placed bets, according to the results in the results file.
-func cmdProcessBets(irccon *irc.Connection, channel string, nick string) {
-	if strings.ToLower(nick) != strings.ToLower(adminNick) {
-		irccon.Privmsg(channel, "Only "+adminNick+" can use this command.")
-		return
-	}
-	results, err := readCSV(resultsFile)
-	if err != nil {
-		irccon.Privmsg(channel, "Error getting results.")
-		log.Println("cmdProcessBets:", err)
-		return
-	}
-	if results[0][0] == results[0][4] {
-		irccon.Privmsg(channel, results[0][0]+" bets have already been processed in the past.")
-		return
-	}
-	bets, err := readCSV(betsFile)
-	if err != nil {
-		irccon.Privmsg(channel, "Error getting bets.")
-		log.Println("cmdProcessBets:", err)
-		return
-	}
-	users, err := readCSV(usersFile)
-	if err != nil {
-		irccon.Privmsg(channel, "Error getting users.")
-		log.Println("cmdProcessBets:", err)
-		return
-	}
-	drivers, err := readCSV(driversFile)
-	if err != nil {
-		irccon.Privmsg(channel, "Error getting drivers.")
-		log.Println("cmdProcessBets:", err)
-		return
-	}
-	odds, err := toStringMap(drivers, 1, 2)
-	if err != nil {
-		irccon.Privmsg(channel, "Error getting odds.")
-		log.Println("cmdProcessBets:", err)
+func (b *Bot) cmdProcessBets(ctx *Context) {
+	if ctx.Role < RoleAdmin {
+		ctx.Reply("You need the admin role to use this command.")
 		return
 	}
-	// This is the main loop where we go through each bet placed by the user and process it.
-	// If the race on the bet matches the race on the results file, we calculate its score.
-	for i, bet := range bets {
-		score := 0
-		first := strings.ToLower(results[0][1])
-		second := strings.ToLower(results[0][2])
-		third := strings.ToLower(results[0][3])
-		if strings.ToLower(bet[0]) == strings.ToLower(results[0][0]) {
-			// If the first driver is on the podium, we have two different possibilities.
-			// If the first driver is the first on the results, we score 10 * multiplier.
-			// If the first driver is not the first on the results, we score 5 * multiplier.
-			if contains([]string{first, second, third}, strings.ToLower(bet[2])) {
-				multiplier, err := strconv.Atoi(odds[bet[2]])
-				if err != nil {
-					irccon.Privmsg(channel, "Error applying multiplier.")
-					log.Println("cmdProcessBets:", err)
-					return
-				}
-				if strings.ToLower(bet[2]) == strings.ToLower(results[0][1]) {
-					score += (10 * multiplier)
-				} else {
-					score += (5 * multiplier)
-				}
+	// Everything happens on a single transaction, so bets are never processed twice or only partially.
+	// The reply is an error message when something fails, which also discards the transaction.
+	var reply string
+	err := b.store.Update(func(tx *Tx) error {
+		result, err := tx.Results().Last()
+		if err != nil {
+			reply = "Error getting results."
+			return err
+		}
+		if result.IsProcessed() {
+			reply = result.Race + " bets have already been processed in the past."
+			return errors.New("Bets already processed.")
+		}
+		bets, err := tx.Bets().All()
+		if err != nil {
+			reply = "Error getting bets."
+			return err
+		}
+		drivers, err := tx.Drivers().All()
+		if err != nil {
+			reply = "Error getting drivers."
+			return err
+		}
+		odds := make(map[string]int)
+		for _, driver := range drivers {
+			odds[strings.ToLower(driver.Code)] = driver.Odds
+		}
+		// This is the main loop where we go through each bet placed by the user and process it.
+		// If the race on the bet matches the race on the results file, we calculate its score.
+		// Each driver on the podium scores 10 * multiplier on the right position, or 5 * multiplier otherwise.
+		podium := []string{strings.ToLower(result.First), strings.ToLower(result.Second), strings.ToLower(result.Third)}
+		for _, bet := range bets {
+			if !strings.EqualFold(bet.Race, result.Race) {
+				continue
 			}
-			// If the second driver is on the podium, we have two different possibilities.
-			// If the second driver is the second on the results, we score 10 * multiplier.
-			// If the second driver is not the second on the results, we score 5 * multiplier.
-			if contains([]string{first, second, third}, strings.ToLower(bet[3])) {
-				multiplier, err := strconv.Atoi(odds[bet[3]])
-				if err != nil {
-					irccon.Privmsg(channel, "Error applying multiplier.")
-					log.Println("cmdProcessBets:", err)
-					return
+			score := 0
+			for position, driver := range []string{bet.First, bet.Second, bet.Third} {
+				if !contains(podium, strings.ToLower(driver)) {
+					continue
 				}
-				if strings.ToLower(bet[3]) == strings.ToLower(results[0][2]) {
-					score += (10 * multiplier)
-				} else {
-					score += (5 * multiplier)
+				multiplier, ok := odds[strings.ToLower(driver)]
+				if !ok {
+					reply = "Error applying multiplier."
+					return errors.New("Error getting odds: unknown driver " + driver + ".")
 				}
-			}
-			// If the third driver is on the podium, we have two different possibilities.
-			// If the third driver is the third on the results, we score 10 * multiplier.
-			// If the third driver is not the third on the results, we score 5 * multiplier.
-			if contains([]string{first, second, third}, strings.ToLower(bet[4])) {
-				multiplier, err := strconv.Atoi(odds[bet[4]])
-				if err != nil {
-					irccon.Privmsg(channel, "Error applying multiplier.")
-					log.Println("cmdProcessBets:", err)
-					return
-				}
-				if strings.ToLower(bet[4]) == strings.ToLower(results[0][3]) {
+				if strings.ToLower(driver) == podium[position] {
 					score += (10 * multiplier)
 				} else {
 					score += (5 * multiplier)
 				}
 			}
-			bets[i][5] = strconv.Itoa(score)
-			// Update the total number of points for each driver on the users file.
+			bet.Points = score
+			err = tx.Bets().Put(bet)
+			if err != nil {
+				reply = "Error storing bet points."
+				return err
+			}
+			// Update the total number of points for each user.
 			// The code above only handles points for each bet, not for each user.
-			for j, user := range users {
-				if strings.ToLower(user[0]) == strings.ToLower(bet[1]) {
-					currentScore, err := strconv.Atoi(users[j][2])
-					if err != nil {
-						irccon.Privmsg(channel, "Error getting current score.")
-						log.Println("cmdProcessBets:", err)
-						return
-					}
-					users[j][2] = strconv.Itoa(currentScore + score)
+			user, ok, err := tx.Users().Get(bet.Nick)
+			if err != nil {
+				reply = "Error getting users."
+				return err
+			}
+			if ok {
+				user.Points += score
+				err = tx.Users().Put(user)
+				if err != nil {
+					reply = "Error storing user points."
+					return err
 				}
 			}
 		}
-		err = writeCSV(usersFile, users)
+		// The results are marked as processed, so that the bets of the race are never processed again.
+		result.Processed = result.Race
+		reply = result.Race + " bets successfully processed."
+		err = tx.Results().Put(result)
 		if err != nil {
-			irccon.Privmsg(channel, "Error storing user points.")
-			log.Println("cmdProcessBets:", err)
-			return
+			reply = "Error storing last processed bet.."
 		}
-	}
-	// Finally update the bets file with the points for each bet for the current race.
-	// The results file is updated so that the last field is set to the current race.
-	err = writeCSV(betsFile, bets)
-	if err != nil {
-		irccon.Privmsg(channel, "Error storing bet points.")
-		log.Println("cmdProcessBets:", err)
-		return
-	}
-	results[0][4] = results[0][0]
-	err = writeCSV(resultsFile, results)
+		return err
+	})
 	if err != nil {
-		irccon.Privmsg(channel, "Error storing last processed bet..")
-		log.Println("cmdProcessBets:", err)
-		return
+		ctx.Log.Error("Error processing bets.", "err", err)
 	}
-	irccon.Privmsg(channel, results[0][0]+" bets successfully processed.")
+	ctx.Reply(reply)
 }
 
-// The poll command receives an IRC connection pointer, an IRC channel, a [2]string channel and poll data.
+// The poll command receives a context with the poll data.
 // It runs as a goroutine that makes a poll on an IRC channel using the given poll data.
 // It then waits for votes from the users and finally displays the results of the poll.
-func cmdPoll(irccon *irc.Connection, channel string, c chan [2]string, pollData string) {
+func (b *Bot) cmdPoll(ctx *Context) {
+	if len(ctx.Args) == 1 && strings.EqualFold(ctx.Args[0], "stop") {
+		b.stopGame(ctx, "poll")
+		return
+	}
+	pollData := strings.Join(ctx.Args, " ")
+	timeout, err := intOption(ctx.Options, "timeout", b.config.PollTimeout, 10, 600)
+	if err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
 	// Parse the poll data into a question and possible answers and then show it on the IRC channel.
 	parsed := strings.Split(pollData, ";")
 	if len(parsed) <= 1 {
-		irccon.Privmsg(channel, "Syntax: !poll question;option 1;option 2;option n")
+		ctx.Reply("Syntax: !poll question;option 1;option 2;option n")
+		return
+	}
+	game, ok := b.games.Start("poll", ctx.Channel, ctx.Nick, identityMask(ctx.Source, ctx.Account))
+	if !ok {
+		ctx.Reply("There's already a " + game.Kind + " running on this channel.")
 		return
 	}
-	irccon.Privmsg(channel, fmt.Sprintf("Poll: %s (%d seconds to vote)", parsed[0], pollTimeout))
-	time.Sleep(1 * time.Second)
+	defer b.games.End(game)
+	// Replies are paced by the send queue, so the options can be sent at once.
+	ctx.Reply(fmt.Sprintf("Poll: %s (%d seconds to vote)", parsed[0], timeout))
 	for k, v := range parsed[1:] {
-		irccon.Privmsg(channel, fmt.Sprintf("%d. %s", k+1, v))
-		time.Sleep(1 * time.Second)
+		ctx.Reply(fmt.Sprintf("%d. %s", k+1, v))
 	}
-	poll = true
-	activeChannel = channel
 	votes := make(map[string]int)
 	results := make(map[string]int)
 	var total int
-	// This is the main loop of the goroutine, which waits for answers to the poll on the "c" go channel.
-	// The answer is sent to the "c" go channel on the main goroutine, inside the "PRIVMSG" callback.
-	// Eventually it times out after pollTimeout seconds and shows the results of the poll on the IRC channel.
-	time.AfterFunc(time.Duration(pollTimeout)*time.Second, func() {
-		c <- [2]string{nick, "--TIMEOUT--"}
-	})
-	for answer := range c {
-		if answer[0] == nick && answer[1] == "--TIMEOUT--" {
-			poll = false
-			activeChannel = ""
-			irccon.Privmsg(channel, "The Poll has ended.")
-			if len(votes) > 0 {
-				time.Sleep(1 * time.Second)
-				irccon.Privmsg(channel, "Results: ")
-				for _, v := range votes {
-					results[strconv.Itoa(v)] += 1
-				}
-				for _, v := range results {
-					total += v
-				}
-				for k, v := range results {
-					index, _ := strconv.Atoi(k)
-					irccon.Privmsg(channel,
-						fmt.Sprintf("%s. %s - %.2f%% votes",
-							k,
-							parsed[index],
-							(float32(v)/float32(total))*100))
-				}
-			}
-			return
-		} else {
-			vote, err := strconv.Atoi(answer[1])
+	// This is the main loop of the goroutine, which waits for answers to the poll on the answers go channel of the game.
+	// The answer is sent to the game on the main goroutine, inside the "PRIVMSG" callback.
+	// Eventually it times out after the poll timeout, or is stopped, and shows the results of the poll on the IRC channel.
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case answer := <-game.answers:
+			vote, err := strconv.Atoi(answer.Text)
 			if err == nil && (vote > 0 && vote <= len(parsed[1:])) {
-				votes[answer[0]] = vote
+				votes[answer.Nick] = vote
 			}
+			continue
+		case <-game.stop:
+			if game.aborted {
+				ctx.Reply("The Poll was aborted, the bot is shutting down.")
+			} else {
+				ctx.Reply("The Poll was stopped.")
+			}
+		case <-timer.C:
+			ctx.Reply("The Poll has ended.")
+		}
+		break
+	}
+	if len(votes) > 0 {
+		ctx.Reply("Results: ")
+		for _, v := range votes {
+			results[strconv.Itoa(v)] += 1
+		}
+		for _, v := range results {
+			total += v
+		}
+		for k, v := range results {
+			index, _ := strconv.Atoi(k)
+			ctx.Reply(
+				fmt.Sprintf("%s. %s - %.2f%% votes",
+					k,
+					parsed[index],
+					(float32(v)/float32(total))*100))
 		}
 	}
 }
 
-// The quiz command receives an IRC connection pointer, an IRC channel and a [2]string channel.
+// The quiz command receives a context with a number of questions.
 // It runs as a goroutine that opens a quiz file and asks questions on the given IRC channel.
 // It then waits for answers to classify as correct or wrong or times out after a while.
-func cmdQuiz(irccon *irc.Connection, channel string, c chan [2]string, number string) {
-	quiz = true
-	activeChannel = channel
+func (b *Bot) cmdQuiz(ctx *Context) {
+	if len(ctx.Args) == 1 && strings.EqualFold(ctx.Args[0], "stop") {
+		b.stopGame(ctx, "quiz")
+		return
+	}
+	number := strings.Join(ctx.Args, " ")
+	timeout, err := intOption(ctx.Options, "timeout", b.config.QuizTimeout, 5, 120)
+	if err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	game, ok := b.games.Start("quiz", ctx.Channel, ctx.Nick, identityMask(ctx.Source, ctx.Account))
+	if !ok {
+		ctx.Reply("There's already a " + game.Kind + " running on this channel.")
+		return
+	}
+	defer b.games.End(game)
 	score := make(map[string]int)
 	n, err := strconv.Atoi(number)
 	if err != nil || (n <= 0 || n > 10) {
 		n = 5
 	}
-	questions, err := readCSV(quizFile)
-	if err != nil {
-		irccon.Privmsg(channel, "Error reading questions.")
-		log.Println("cmdQuiz:", err)
-		activeChannel = ""
+	// Get only the questions of the current channel.
+	var channelQuestions []Question
+	err = b.store.View(func(tx *Tx) (err error) {
+		channelQuestions, err = tx.Questions().Channel(ctx.Channel)
 		return
-	}
-	// Filter only the questions of the current channel.
-	var channelQuestions [][]string
-	for _, question := range questions {
-		if strings.ToLower(question[2]) == strings.ToLower(channel) {
-			channelQuestions = append(channelQuestions, question)
+	})
+	if err != nil || len(channelQuestions) == 0 {
+		if err != nil {
+			ctx.Reply("Error reading questions.")
+			ctx.Log.Error("Error reading questions.", "err", err)
+		} else {
+			ctx.Reply("There are no questions for this channel.")
 		}
+		return
 	}
 	// This is an obfuscated way to randomise a slice that I googled in order to randomise the questions.
 	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(channelQuestions), func(i, j int) { channelQuestions[i], channelQuestions[j] = channelQuestions[j], channelQuestions[i] })
-	// This is the main loop of the goroutine, which for now only asks up to 5 questions to avoid SPAM.
-	// After showing the question on irc, it waits for an answer on the "c" go channel and classifies it.
-	// The answer is sent to the "c" go channel on the main goroutine, inside the "PRIVMSG" callback.
-	// Eventually if no correct answer is sent, it times out after quizTimeout seconds.
-	timer := time.AfterFunc(time.Duration(quizTimeout)*time.Second, func() {
-		c <- [2]string{nick, "--TIMEOUT--"}
-	})
+	if n > len(channelQuestions) {
+		n = len(channelQuestions)
+	}
+	// This is the main loop of the goroutine, which for now only asks up to 10 questions to avoid SPAM.
+	// After showing the question on irc, it waits for an answer on the answers go channel of the game and classifies it.
+	// The answer is sent to the game on the main goroutine, inside the "PRIVMSG" callback.
+	// Eventually if no correct answer is sent, it times out after the quiz timeout.
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
 	start := time.Now()
-	for i := 0; i < n; i++ {
-		irccon.Privmsg(
-			channel,
+	stopped := false
+	for i := 0; i < n && !stopped; i++ {
+		ctx.Reply(
 			fmt.Sprintf(
 				"%d/%d - %s (%0.0f seconds remaining)",
-				i+1, n, channelQuestions[i][0], 20-time.Since(start).Seconds(),
+				i+1, n, channelQuestions[i].Text, float64(timeout)-time.Since(start).Seconds(),
 			),
 		)
 		select {
-		case answer := <-c:
-			if strings.ToLower(answer[1]) == strings.ToLower(channelQuestions[i][1]) {
-				timer.Reset(time.Duration(quizTimeout) * time.Second)
-				start = time.Now()
-				irccon.Privmsg(channel, "Correct!")
-				score[answer[0]] += 1
-			} else if answer[0] == nick && answer[1] == "--TIMEOUT--" {
-				timer.Reset(time.Duration(quizTimeout) * time.Second)
+		case answer := <-game.answers:
+			if strings.ToLower(answer.Text) == strings.ToLower(channelQuestions[i].Answer) {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(time.Duration(timeout) * time.Second)
 				start = time.Now()
-				irccon.Privmsg(channel, "Time's up... The correct answer was: "+channelQuestions[i][1])
+				ctx.Reply("Correct!")
+				score[answer.Nick] += 1
 			} else {
-				if i >= 0 {
-					i-- // Avoid advancing to the next question, when answer is wrong.
-				}
-				irccon.Privmsg(channel, "Wrong!")
+				i-- // Avoid advancing to the next question, when answer is wrong.
+				ctx.Reply("Wrong!")
 			}
+		case <-timer.C:
+			timer.Reset(time.Duration(timeout) * time.Second)
+			start = time.Now()
+			ctx.Reply("Time's up... The correct answer was: " + channelQuestions[i].Answer)
+		case <-game.stop:
+			stopped = true
 		}
 	}
-	// At the end of the quiz we stop the timer and set quiz to false.
-	// We then proceed to show the final score sorted by points (value).
+	// At the end of the quiz we stop the timer and show the final score sorted by points (value).
 	// Internally we store the score in a map[string]int but fmt only sorts maps by key.
 	// Therefore we must use a trick to sort by points (value) which is to use sort.Sort.
 	// sort.Sort requires us to use a slice of struts (ScoreList) which we declare above.
 	// We create a ScoreList with the length of scores and populate it with its values.
 	// Finally we use sort.Reverse to sort by highest score and show the results.
 	timer.Stop()
-	quiz = false
-	activeChannel = ""
-	irccon.Privmsg(channel, "The quiz is over!")
-	time.Sleep(1 * time.Second)
-	irccon.Privmsg(channel, "Score:")
+	if game.aborted {
+		ctx.Reply("The quiz was aborted, the bot is shutting down.")
+	} else if stopped {
+		ctx.Reply("The quiz was stopped.")
+	} else {
+		ctx.Reply("The quiz is over!")
+	}
+	ctx.Reply("Score:")
 	scoreList := make(ScoreList, len(score))
 	i := 0
 	for key, value := range score {
@@ -783,314 +722,197 @@ func cmdQuiz(irccon *irc.Connection, channel string, c chan [2]string, number st
 	}
 	sort.Sort(sort.Reverse(scoreList))
 	for _, value := range scoreList {
-		irccon.Privmsg(channel, fmt.Sprintf("%s - %d", value.Nick, value.Points))
-		time.Sleep(1 * time.Second)
+		ctx.Reply(fmt.Sprintf("%s - %d", value.Nick, value.Points))
 	}
 }
 
-// The quote command receives an IRC connection pointer, a channel and an arguments slice of strings.
+// The quote command receives a context with an arguments slice of strings.
 // It then checks if there are arguments and displays a random quote or adds a new quote accordingly.
-func cmdQuote(irccon *irc.Connection, channel string, args []string) {
-	// Get a collection of quotes stored as a CSV file.
-	quotes, err := readCSV(quotesFile)
+func (b *Bot) cmdQuote(ctx *Context) {
+	// Get the collection of quotes of the current channel.
+	var channelQuotes []Quote
+	err := b.store.View(func(tx *Tx) (err error) {
+		channelQuotes, err = tx.Quotes().Channel(ctx.Channel)
+		return
+	})
 	if err != nil {
-		irccon.Privmsg(channel, "Error getting quote.")
-		log.Println("cmdQuote:", err)
+		ctx.Reply("Error getting quote.")
+		ctx.Log.Error("Error getting quote.", "err", err)
 		return
 	}
-	// Filter only the quotes of the current channel.
-	var channelQuotes [][]string
-	for _, quote := range quotes {
-		if strings.ToLower(quote[2]) == strings.ToLower(channel) {
-			channelQuotes = append(channelQuotes, quote)
-		}
-	}
 	// If there are no arguments or if the first argument is "get", show a random quote.
 	// We seed the randomizer with some variable number, the current time in nano seconds.
 	// Then we set the index to the quotes to a random number between 0 and the length of quotes.
 	// Finally we show a random quote on the channel.
-	if len(args) == 0 || (len(args) > 0 && strings.ToLower(args[0]) == "get") {
+	if len(ctx.Args) == 0 || (len(ctx.Args) > 0 && strings.ToLower(ctx.Args[0]) == "get") {
 		if len(channelQuotes) == 0 {
-			irccon.Privmsg(channel, "There are no quotes for this channel.")
+			ctx.Reply("There are no quotes for this channel.")
 			return
 		}
 		rand.Seed(time.Now().UnixNano())
 		index := rand.Intn(len(channelQuotes))
-		irccon.Privmsg(channel, fmt.Sprintf("%s - %s", channelQuotes[index][1], channelQuotes[index][0]))
+		ctx.Reply(fmt.Sprintf("%s - %s", channelQuotes[index].Text, channelQuotes[index].Date))
 		// If there is more than one argument and the first argument is "add", add the provided quote.
 		// Finally we show a confirmation message on the channel.
-	} else if len(args) > 1 && strings.ToLower(args[0]) == "add" {
-		quotes = append(quotes, []string{time.Now().Format("02-01-2006"), strings.Join(args[1:], " "), strings.ToLower(channel)})
-		err = writeCSV(quotesFile, quotes)
+	} else if len(ctx.Args) > 1 && strings.ToLower(ctx.Args[0]) == "add" {
+		err = b.store.Update(func(tx *Tx) error {
+			return tx.Quotes().Add(Quote{
+				Date:    time.Now().Format("02-01-2006"),
+				Text:    strings.Join(ctx.Args[1:], " "),
+				Channel: strings.ToLower(ctx.Channel),
+			})
+		})
 		if err != nil {
-			irccon.Privmsg(channel, "Error adding quote.")
-			log.Println("cmdQuote:", err)
+			ctx.Reply("Error adding quote.")
+			ctx.Log.Error("Error adding quote.", "err", err)
 			return
 		}
-		irccon.Privmsg(channel, "Quote added.")
+		ctx.Reply("Quote added.")
 		// Otherwise, if we get here, it means the user didn't use the command correctly.
 		// Ttherefore we show a usage message on the channel.
 	} else {
-		irccon.Privmsg(channel, "Usage: !quote [get|add] [text]")
+		ctx.Reply("Usage: !quote [get|add] [text]")
 	}
 }
 
-// The ask command receives an IRC connection pointer, a channel and an arguments slice of strings.
+// The ask command receives a context with an arguments slice of strings.
 // It then checks if the user has asked a question and displays a random answer on the channel.
-func cmdAsk(irccon *irc.Connection, channel string, args []string) {
-	// Get a collection of answers stored as a CSV file.
-	answers, err := readCSV(answersFile)
+func (b *Bot) cmdAsk(ctx *Context) {
+	// Get the collection of answers from the storage.
+	var answers []Answer
+	err := b.store.View(func(tx *Tx) (err error) {
+		answers, err = tx.Answers().All()
+		return
+	})
+	if err == nil && len(answers) == 0 {
+		err = errors.New("Error reading " + answersFile + ": no answers.")
+	}
 	if err != nil {
-		irccon.Privmsg(channel, "Error getting answer.")
-		log.Println("cmdAsk:", err)
+		ctx.Reply("Error getting answer.")
+		ctx.Log.Error("Error getting answer.", "err", err)
 		return
 	}
-	// If the number of arguments is greater than 0, a question was asked, we show a random answer.
+	// The schema of the command makes sure a question was asked, so we simply show a random answer.
 	// We seed the randomizer with some variable number, the current time in nano seconds.
 	// Then we set the index to the answers to a random number between 0 and the length of answers.
 	// Finally we show a random answer on the channel.
-	if len(args) > 0 {
-		rand.Seed(time.Now().UnixNano())
-		index := rand.Intn(len(answers))
-		irccon.Privmsg(channel, fmt.Sprintf("%s", answers[index][0]))
-		// Otherwise, if we get here, it means the user didn't use the command correctly.
-		// Ttherefore we show a usage message on the channel.
-	} else {
-		irccon.Privmsg(channel, "Usage: !ask <question>")
-	}
+	rand.Seed(time.Now().UnixNano())
+	index := rand.Intn(len(answers))
+	ctx.Reply(answers[index].Text)
 }
 
-// The notify command receives an IRC connection pointer, a channel, a nick and an arguments slice of strings.
+// The notify command receives a context with an arguments slice of strings.
 // It then enables or disables notifications for the current channel's events if the argument is on or off.
-func cmdNotify(irccon *irc.Connection, channel string, nick string, args []string) {
-	users, err := readCSV(usersFile)
-	if err != nil {
-		irccon.Privmsg(channel, "Error getting users.")
-		log.Println("cmdNotify:", err)
-		return
-	}
-	// If the number of arguments is exactly one, we check whether it is on or off.
-	// If it is on, we add the current channel to the user's notification list.
-	// If it is off, we remove the current channel from the user's notification list.
-	if len(args) == 1 {
-		if strings.ToLower(args[0]) == "on" {
-			for i, user := range users {
-				if strings.ToLower(user[0]) == strings.ToLower(nick) {
-					channels := strings.Split(user[3], ":")
-					if !contains(channels, channel) {
-						channels = append(channels, channel)
-						users[i][3] = strings.Trim(strings.Join(channels, ":"), ":")
-						err = writeCSV(usersFile, users)
-						if err != nil {
-							irccon.Privmsg(channel, "Error storing notifications.")
-							log.Println("cmdNotify:", err)
-							return
-						}
-					}
-					irccon.Privmsg(channel, "Notifications updated. Get mentions for events on: "+users[i][3])
-				}
+func (b *Bot) cmdNotify(ctx *Context) {
+	// The argument must be on or off, which adds or removes the current channel from the user's notification list.
+	on := strings.ToLower(ctx.Args[0]) == "on"
+	if !on && strings.ToLower(ctx.Args[0]) != "off" {
+		ctx.Reply("Usage: !notify <on/off>")
+		return
+	}
+	user, ok, err := b.findUser(ctx)
+	if err == nil && ok {
+		err = b.store.Update(func(tx *Tx) (err error) {
+			// The user is read again on the transaction, so a concurrent update can't be lost.
+			user, ok, err = tx.Users().Get(user.Nick)
+			if err != nil || !ok {
+				return
 			}
-		} else if strings.ToLower(args[0]) == "off" {
-			for i, user := range users {
-				if strings.ToLower(user[0]) == strings.ToLower(nick) {
-					channels := strings.Split(user[3], ":")
-					var updatedChannels string
-					if contains(channels, channel) {
-						for _, v := range channels {
-							if v != channel {
-								updatedChannels += v + ":"
-							}
-						}
-						users[i][3] = strings.Trim(updatedChannels, ":")
-						err = writeCSV(usersFile, users)
-						if err != nil {
-							irccon.Privmsg(channel, "Error storing notifications.")
-							log.Println("cmdNotify:", err)
-							return
-						}
-					}
-					irccon.Privmsg(channel, "Notifications updated. Get mentions for events on: "+users[i][3])
+			var channels []string
+			for _, channel := range user.Channels {
+				if channel != ctx.Channel {
+					channels = append(channels, channel)
 				}
 			}
-		} else {
-			irccon.Privmsg(channel, "Usage: !notifiy <on/off>")
-		}
-	} else {
-		irccon.Privmsg(channel, "Usage: !notify <on/off>")
+			if on {
+				channels = append(channels, ctx.Channel)
+			}
+			user.Channels = channels
+			return tx.Users().Put(user)
+		})
 	}
-}
-
-// The weather command receives an IRC connection pointer, a channel, a nick and an arguments slice of strings.
-// It then shows the current weather for a given location on the channel using the OpenWeatherMap API.
-func cmdWeather(irccon *irc.Connection, channel string, nick string, args []string) {
-	weather, err := readCSV(weatherFile)
 	if err != nil {
-		irccon.Privmsg(channel, "Error getting weather settings.")
-		log.Println("cmdWeather:", err)
+		ctx.Reply("Error storing notifications.")
+		ctx.Log.Error("Error storing notifications.", "err", err)
 		return
 	}
-	location := ""
-	tempUnits := "C"
-	windUnits := "m/s"
-	// Neither a location nor temperature unit were provided as an argument to the command.
-	// So we must get the location and temperature unit for the user from the weather file.
-	// If a user in the weather file matches nick, we get its location and temperature unit.
-	if len(args) == 0 {
-		for _, v := range weather {
-			if strings.ToLower(v[0]) == strings.ToLower(nick) {
-				tempUnits = strings.ToUpper(v[1])
-				location = v[2]
-			}
-		}
-		// A temperature unit was provided as an argument to the command, we must update the setting.
-		// However, we must first check if the user already has a location set on the weather file.
-		// If so, we update the user units, otherwise we ask him to get the wether for a location.
-		// This is so that the user gets registered on the weather file before we can set a location.
-	} else if len(args) == 1 && (strings.ToLower(args[0]) == "c" || strings.ToLower(args[0]) == "f") {
-		var unitsUpdated bool
-		for i, v := range weather {
-			// User with a location on the weather database.
-			if strings.ToLower(v[0]) == strings.ToLower(nick) {
-				unitsUpdated = true
-				weather[i][1] = strings.ToLower(args[0])
-			}
-		}
-		if !unitsUpdated {
-			irccon.Privmsg(channel, "Get the weather for some location before setting the units.")
-			return
-		}
-		err = writeCSV(weatherFile, weather)
-		if err != nil {
-			irccon.Privmsg(channel, "Error storing weather units.")
-			log.Println("cmdWeather:", err)
-			return
-		}
-		irccon.Privmsg(channel, "Temperature units updated.")
-		return
-		// If we reach this point, a location was provided as an argument to the command.
-		// If the user already exists, we update his location, otherwise we register him.
-	} else {
-		var newUser bool = true
-		location = strings.Join(args, " ")
-		for i, v := range weather {
-			// User with a location on the weather database.
-			if strings.ToLower(v[0]) == strings.ToLower(nick) {
-				newUser = false
-				weather[i][2] = location
-			}
-		}
-		if newUser {
-			// User without a location on the weather database.
-			weather = append(weather, []string{nick, "c", location})
-		}
-		err = writeCSV(weatherFile, weather)
-		if err != nil {
-			irccon.Privmsg(channel, "Error storing weather location.")
-			log.Println("cmdWeather:", err)
-			return
-		}
+	if ok {
+		ctx.Reply("Notifications updated. Get mentions for events on: " + strings.Join(user.Channels, ":"))
 	}
-	if location == "" {
-		irccon.Privmsg(channel, "Please provide a location as argument.")
+}
+
+// The register command receives a context.
+// It then checks if the user isn't already registered and registers it with the bot.
+func (b *Bot) cmdRegister(ctx *Context) {
+	// If the person is already a known user to the bot, we don't register it again.
+	// Otherwise we add this new nick as a registered user, bound to the account or hostmask of the person.
+	user, registered, err := b.findUser(ctx)
+	if err != nil {
+		ctx.Reply("Error registering user.")
+		ctx.Log.Error("Error registering user.", "err", err)
 		return
 	}
-	if tempUnits == "F" {
-		windUnits = "mph"
-	}
-	// Finally we get the current weather at a location using the temperature units.
-	// Then we display a nicely formatted and compact weather string on the channel.
-	w, err := owm.NewCurrent(tempUnits, "en", owmAPIKey)
-	if err != nil {
-		irccon.Privmsg(channel, "Error fetching weather.")
-		log.Println("cmdWeather:", err)
+	if registered {
+		ctx.Reply("You're already registered as " + user.Nick + ".")
 		return
 	}
-	err = w.CurrentByName(location)
-	if err != nil {
-		irccon.Privmsg(channel, "Could not fetch weather for that location.")
-		log.Println("cmdWeather:", err)
+	mask := identityMask(ctx.Source, ctx.Account)
+	if mask == "" {
+		ctx.Reply("Couldn't check who you are, try again later.")
 		return
 	}
-	irccon.Privmsg(
-		channel,
-		fmt.Sprintf("%s: %s | Temperature: %0.1f%s | Humidity: %d%% | Pressure: %0.1fhPa | Wind: %0.1f%s",
-			w.Name,
-			w.Weather[0].Description,
-			w.Main.Temp,
-			tempUnits,
-			w.Main.Humidity,
-			w.Main.Pressure,
-			w.Wind.Speed,
-			windUnits))
-}
-
-// The register command receives an IRC connection pointer, a channel and a nick.
-// It then checks if the user isn't already registered and registers it with the bot.
-func cmdRegister(irccon *irc.Connection, channel string, nick string) {
-	users, err := readCSV(usersFile)
+	var owner User
+	var taken bool
+	err = b.store.Update(func(tx *Tx) (err error) {
+		owner, taken, err = tx.Users().Get(ctx.Nick)
+		if err != nil || taken {
+			return
+		}
+		return tx.Users().Put(User{Nick: strings.ToLower(ctx.Nick), TimeZone: "Europe/Berlin", Mask: mask})
+	})
 	if err != nil {
-		irccon.Privmsg(channel, "Error getting users.")
-		log.Println("cmdRegister:", err)
+		ctx.Reply("Error registering user.")
+		ctx.Log.Error("Error registering user.", "err", err)
 		return
 	}
-	// If the nick is already a known user to the bot, we don't register it.
-	// Otherwise we add this new nick as a registered user on the users file.
-	if isUser(strings.ToLower(nick), users) {
-		irccon.Privmsg(channel, "Your nick is already registered.")
+	// Users registered before identities existed are bound by their services account, or else by an admin.
+	if taken && owner.Mask == "" {
+		ctx.Reply("This nick was registered before identities, identify with services as " + owner.Nick + " or ask an admin to bind it.")
 		return
 	}
-	users = append(users, []string{strings.ToLower(nick), "Europe/Berlin", "0", ""})
-	err = writeCSV(usersFile, users)
-	if err != nil {
-		irccon.Privmsg(channel, "Error registering user.")
-		log.Println("cmdRegister:", err)
+	if taken {
+		ctx.Reply("This nick is registered by someone else.")
 		return
 	}
-	irccon.Privmsg(channel, "Your nick was successfully registered.")
+	ctx.Reply("Your nick was successfully registered.")
 }
 
-// The plugin command receives a name, an IRC connection pointer, a channel, a nick and an arguments slice of strings.
-// It then tries to execute the given plugin name if a file with that name is found on the plugins folder.
-func cmdPlugin(name string, irccon *irc.Connection, channel string, nick string, args []string, finishedCh chan bool) {
-	var cmd *exec.Cmd
-	if !fileExists(pluginsFolder + name) {
-		select {
-		case finishedCh <- true:
-			// The plugin doesn't exist, but we still send true to the finished channel.
-		case <-time.After(1 * time.Second):
-			// If the main thread doesn't read the channel, then timeout after 1 second.
+// The bind command receives a context with a registered nick and a mask.
+// It then binds the user with the nick to the mask, so that only its owner can act as the user from then on.
+func (b *Bot) cmdBind(ctx *Context) {
+	nick, mask := ctx.Args[0], ctx.Args[1]
+	if checkMask(mask) != nil {
+		ctx.Reply("Invalid mask, use a hostmask like nick!user@host or an account like $a:account.")
+		return
+	}
+	var found bool
+	err := b.store.Update(func(tx *Tx) (err error) {
+		var user User
+		user, found, err = tx.Users().Get(nick)
+		if err != nil || !found {
+			return
 		}
-		irccon.Privmsg(channel, "Unknown command or plugin.")
-		return
-	}
-	if len(args) == 0 {
-		cmd = exec.Command(pluginsFolder+name, nick)
-	} else {
-		var fullArgs []string
-		fullArgs = append(fullArgs, nick)
-		fullArgs = append(fullArgs, args...)
-		cmd = exec.Command(pluginsFolder+name, fullArgs...)
-	}
-	output, err := cmd.CombinedOutput()
+		user.Mask = mask
+		return tx.Users().Put(user)
+	})
 	if err != nil {
-		select {
-		case finishedCh <- true:
-			// The plugin had a problem, but we still send true to the finished channel.
-		case <-time.After(1 * time.Second):
-			// If the main thread doesn't read the channel, then timeout after 1 second.
-		}
-		irccon.Privmsg(channel, "Error executing plugin.")
-		log.Println("cmdPlugin:", err)
+		ctx.Reply("Error storing user.")
+		ctx.Log.Error("Error storing user.", "err", err)
 		return
 	}
-	select {
-	case finishedCh <- true:
-		// The plugin finished with success so we send true to the finished channel.
-	case <-time.After(1 * time.Second):
-		// If the main thread doesn't read the channel, then timeout after 1 second.
-	}
-	for _, line := range strings.Split(strings.TrimSuffix(string(output), "\n"), "\n") {
-		irccon.Privmsg(channel, line)
-		time.Sleep(1 * time.Second)
+	if !found {
+		ctx.Reply(nick + " isn't a registered user.")
+		return
 	}
+	ctx.Reply("Bound " + nick + " to " + mask + ".")
 }
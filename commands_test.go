@@ -0,0 +1,461 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Small utility function that creates a bot whose data folder is a temporary folder with the given CSV files.
+func newTestBot(t *testing.T, files map[string][][]string) *Bot {
+	t.Helper()
+	folder := t.TempDir()
+	b := newBot(NetworkConfig{
+		Name:        "test",
+		Nick:        "Schumacher",
+		AdminNick:   "gluon",
+		Prefix:      "!",
+		Folder:      folder,
+		PollTimeout: 1,
+		QuizTimeout: 1,
+	}, newCSVStore(folder, 0))
+	for name, data := range files {
+		err := writeCSV(b.config.path(name), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+// Small utility function that replaces the registry with one holding only the built-in commands, for the rest of the test.
+func useBuiltins(t *testing.T) {
+	t.Helper()
+	saved := registry
+	registry = newRegistry()
+	t.Cleanup(func() { registry = saved })
+	for _, def := range builtinCommands() {
+		if err := registry.Register(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Small utility function that formats a time relative to now the way it is stored on the events file.
+func eventTime(d time.Duration) string {
+	return time.Now().Add(d).UTC().Format("2006-01-02 15:04:05 UTC")
+}
+
+func testEvents() [][]string {
+	return [][]string{
+		{"[Formula 1]", "Bahrain Grand Prix", "Race", eventTime(-48 * time.Hour), "#f1", "", ""},
+		{"[Formula 2]", "Monaco", "Feature Race", eventTime(time.Hour), "#f1", "", ""},
+		{"[Formula 1]", "Monaco Grand Prix", "Qualifying", eventTime(2 * time.Hour), "#f1", "", ""},
+		{"[Formula 1]", "Monaco Grand Prix", "Race", eventTime(24 * time.Hour), "#f1", "", ""},
+	}
+}
+
+func TestFindNext(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{eventsFile: testEvents()})
+	tests := []struct {
+		category string
+		session  string
+		want     string
+	}{
+		{"any", "any", "Monaco Feature Race"},
+		{"[Formula 1]", "any", "Monaco Grand Prix Qualifying"},
+		{"[formula 1]", "race", "Monaco Grand Prix Race"},
+		{"any", "Qualifying", "Monaco Grand Prix Qualifying"},
+		{"[Formula 2]", "Feature Race", "Monaco Feature Race"},
+	}
+	for _, test := range tests {
+		event, err := b.findNext(test.category, test.session)
+		if err != nil {
+			t.Errorf("findNext(%q, %q): unexpected error %v", test.category, test.session, err)
+			continue
+		}
+		if got := event.Name + " " + event.Session; got != test.want {
+			t.Errorf("findNext(%q, %q) = %q, want %q", test.category, test.session, got, test.want)
+		}
+	}
+	for _, criteria := range [][2]string{{"[Formula 3]", "any"}, {"[Formula 2]", "Sprint Race"}} {
+		if _, err := b.findNext(criteria[0], criteria[1]); err == nil {
+			t.Errorf("findNext(%q, %q): expected an error", criteria[0], criteria[1])
+		}
+	}
+}
+
+func TestFindNextBadTime(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{
+		eventsFile: {{"[Formula 1]", "Monaco Grand Prix", "Race", "tomorrow", "#f1", "", ""}},
+	})
+	if _, err := b.findNext("any", "any"); err == nil {
+		t.Error("findNext: expected an error for an invalid time")
+	}
+}
+
+func TestFindNextMissingFile(t *testing.T) {
+	b := newTestBot(t, nil)
+	if _, err := b.findNext("any", "any"); err == nil {
+		t.Error("findNext: expected an error for a missing events file")
+	}
+}
+
+func newBetBot(t *testing.T, events [][]string) *Bot {
+	return newTestBot(t, map[string][][]string{
+		eventsFile: events,
+		usersFile:  {{"alice", "Europe/Lisbon", "0", ""}, {"bob", "Europe/Berlin", "0", ""}},
+		// The users are bound to the hostmasks of the fake contexts.
+		identitiesFile: {{"alice", "*!~alice@example.com"}, {"bob", "*!~bob@example.com"}},
+		driversFile: {
+			{"Max Verstappen", "ver", "1"},
+			{"Lewis Hamilton", "ham", "2"},
+			{"Charles Leclerc", "lec", "3"},
+			{"Lando Norris", "nor", "4"},
+		},
+		betsFile: {},
+	})
+}
+
+func TestCmdBetValidation(t *testing.T) {
+	b := newBetBot(t, testEvents())
+	tests := []struct {
+		nick string
+		args []string
+		want string
+	}{
+		{"carol", []string{"ver", "ham", "lec", "nor"}, "You're not a registered user."},
+		{"alice", []string{"ver", "ham", "xxx", "nor"}, "Invalid podium drivers."},
+		{"alice", []string{"ver", "ver", "ham", "nor"}, "Invalid podium drivers."},
+		{"alice", []string{"ver", "ham", "lec", "xxx"}, "Invalid FL driver."},
+		{"alice", []string{"foo"}, "Unknown command option."},
+		{"alice", []string{"bob"}, "That user hasn't bet for the current race yet."},
+		{"alice", nil, "You haven't placed a bet for the Monaco Grand Prix yet."},
+	}
+	for _, test := range tests {
+		ctx, r := newFakeContext(test.nick, "#f1", test.args...)
+		b.cmdBet(ctx)
+		if !r.contains(test.want) {
+			t.Errorf("cmdBet(%s %v): got %q, want %q", test.nick, test.args, r.replies(), test.want)
+		}
+	}
+	bets, err := readCSV(b.config.path(betsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 0 {
+		t.Errorf("invalid bets were stored: %v", bets)
+	}
+}
+
+func TestCmdBetPlaceAndUpdate(t *testing.T) {
+	b := newBetBot(t, testEvents())
+	for _, args := range [][]string{{"VER", "ham", "lec", "nor"}, {"lec", "ver", "ham", "ver"}} {
+		ctx, r := newFakeContext("Alice", "#f1", args...)
+		b.cmdBet(ctx)
+		if !r.contains("Your bet for the Monaco Grand Prix was successfully updated.") {
+			t.Fatalf("cmdBet(%v): got %q", args, r.replies())
+		}
+	}
+	bets, err := readCSV(b.config.path(betsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 1 || strings.Join(bets[0], ",") != "Monaco Grand Prix,alice,lec,ver,ham,ver,0" {
+		t.Fatalf("unexpected bets: %v", bets)
+	}
+	ctx, r := newFakeContext("alice", "#f1")
+	b.cmdBet(ctx)
+	if !r.contains("Your current bet for the Monaco Grand Prix -> 1: LEC | 2: VER | 3: HAM | FL: VER") {
+		t.Errorf("cmdBet: got %q", r.replies())
+	}
+	ctx, r = newFakeContext("bob", "#f1", "alice")
+	b.cmdBet(ctx)
+	if !r.contains("alice's current bet for the Monaco Grand Prix") {
+		t.Errorf("cmdBet(alice): got %q", r.replies())
+	}
+}
+
+func TestCmdBetClosed(t *testing.T) {
+	b := newBetBot(t, testEvents()[:1])
+	ctx, r := newFakeContext("alice", "#f1", "ver", "ham", "lec", "nor")
+	b.cmdBet(ctx)
+	if !r.contains("Bets are closed.") {
+		t.Errorf("cmdBet: got %q", r.replies())
+	}
+}
+
+// Small utility function that runs a game command on its own goroutine, like the bot does.
+// It returns a go channel that is closed when the game is over.
+func runGame(game func(*Context), ctx *Context) chan bool {
+	done := make(chan bool)
+	go func() {
+		game(ctx)
+		close(done)
+	}()
+	return done
+}
+
+// Small utility function that waits for a game to end, failing the test if it takes longer than timeout.
+func waitGame(t *testing.T, done chan bool, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("the game didn't end in time")
+	}
+}
+
+// Small utility function that waits for a game of a kind to start on a channel.
+func waitGameStart(t *testing.T, b *Bot, kind string, channel string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if game, ok := b.games.Get(channel); ok && game.Kind == kind {
+			return
+		}
+	}
+	t.Fatalf("no %s started on %s", kind, channel)
+}
+
+// Small utility function that sends messages to the game running on a channel, as nick and text pairs.
+func answer(t *testing.T, b *Bot, channel string, messages ...string) {
+	t.Helper()
+	for i := 0; i+1 < len(messages); i += 2 {
+		if !b.games.Answer(channel, messages[i], messages[i+1]) {
+			t.Fatalf("no game running on %s", channel)
+		}
+	}
+}
+
+func TestCmdPoll(t *testing.T) {
+	b := newTestBot(t, nil)
+	ctx, r := newFakeContext("alice", "#f1", "Best", "team?;Ferrari;McLaren;Mercedes")
+	done := runGame(b.cmdPoll, ctx)
+	waitGameStart(t, b, "poll", "#f1")
+	answer(t, b, "#f1",
+		"alice", "1",
+		"bob", "2",
+		"carol", "2",
+		"alice", "2", // Users can change their vote.
+		"dave", "4", // Out of range votes are ignored.
+		"erin", "mclaren",
+	)
+	waitGame(t, done, 10*time.Second)
+	if _, ok := b.games.Get("#f1"); ok {
+		t.Error("the poll should be off")
+	}
+	for _, want := range []string{
+		"Poll: Best team? (1 seconds to vote)",
+		"1. Ferrari",
+		"3. Mercedes",
+		"The Poll has ended.",
+		"2. McLaren - 100.00% votes",
+	} {
+		if !r.contains(want) {
+			t.Errorf("cmdPoll: missing %q in %q", want, r.replies())
+		}
+	}
+	if r.contains("Ferrari - ") || r.contains("Mercedes - ") {
+		t.Errorf("cmdPoll: unexpected results %q", r.replies())
+	}
+}
+
+func TestCmdPollSyntax(t *testing.T) {
+	b := newTestBot(t, nil)
+	ctx, r := newFakeContext("alice", "#f1", "Best", "team?")
+	b.cmdPoll(ctx)
+	if _, ok := b.games.Get("#f1"); !r.contains("Syntax: !poll question;option 1;option 2;option n") || ok {
+		t.Errorf("cmdPoll: got %q", r.replies())
+	}
+}
+
+func TestCmdQuiz(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{
+		quizFile: {
+			{"Who won the 2007 title with Ferrari?", "Raikkonen", "#f1"},
+			{"Who replaced Schumacher at Ferrari in 2007?", "Raikkonen", "#f1"},
+			{"Which team is from Woking?", "McLaren", "#other"},
+		},
+	})
+	// More questions than the channel has, so the quiz is cut down to the 2 questions of #f1.
+	ctx, r := newFakeContext("alice", "#f1", "5")
+	done := runGame(b.cmdQuiz, ctx)
+	waitGameStart(t, b, "quiz", "#f1")
+	answer(t, b, "#f1", "bob", "Hamilton", "alice", "RAIKKONEN")
+	// The second question is left unanswered, so it times out.
+	waitGame(t, done, 10*time.Second)
+	if _, ok := b.games.Get("#f1"); ok {
+		t.Error("the quiz should be off")
+	}
+	for _, want := range []string{
+		"1/2 - ",
+		"Wrong!",
+		"Correct!",
+		"2/2 - ",
+		"Time's up... The correct answer was: Raikkonen",
+		"The quiz is over!",
+		"alice - 1",
+	} {
+		if !r.contains(want) {
+			t.Errorf("cmdQuiz: missing %q in %q", want, r.replies())
+		}
+	}
+	if r.contains("Woking") || r.contains("bob - ") {
+		t.Errorf("cmdQuiz: unexpected replies %q", r.replies())
+	}
+}
+
+func TestCmdQuizNoQuestions(t *testing.T) {
+	b := newTestBot(t, nil)
+	ctx, r := newFakeContext("alice", "#f1")
+	b.cmdQuiz(ctx)
+	if _, ok := b.games.Get("#f1"); !r.contains("There are no questions for this channel.") || ok {
+		t.Errorf("cmdQuiz: got %q, quiz %v", r.replies(), ok)
+	}
+}
+
+func TestGamesPerChannel(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{
+		quizFile: {{"Who won the 2007 title with Ferrari?", "Raikkonen", "#formula1"}},
+	})
+	quizCtx, quizReplies := newFakeContext("alice", "#formula1", "1")
+	quizDone := runGame(b.cmdQuiz, quizCtx)
+	pollCtx, pollReplies := newFakeContext("bob", "#motorsport", "Best", "team?;Ferrari;McLaren")
+	pollDone := runGame(b.cmdPoll, pollCtx)
+	waitGameStart(t, b, "quiz", "#formula1")
+	waitGameStart(t, b, "poll", "#motorsport")
+	// A second game on a channel is refused, while the games on other channels go on.
+	ctx, r := newFakeContext("carol", "#Formula1", "Best", "team?;Ferrari;McLaren")
+	b.cmdPoll(ctx)
+	if !r.contains("There's already a quiz running on this channel.") {
+		t.Errorf("cmdPoll: got %q", r.replies())
+	}
+	answer(t, b, "#motorsport", "carol", "2")
+	answer(t, b, "#formula1", "carol", "Raikkonen")
+	waitGame(t, quizDone, 10*time.Second)
+	waitGame(t, pollDone, 10*time.Second)
+	if !quizReplies.contains("carol - 1") || quizReplies.contains("Wrong!") {
+		t.Errorf("cmdQuiz: got %q", quizReplies.replies())
+	}
+	if !pollReplies.contains("2. McLaren - 100.00% votes") {
+		t.Errorf("cmdPoll: got %q", pollReplies.replies())
+	}
+}
+
+func TestGameStop(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{
+		quizFile: {{"Who won the 2007 title with Ferrari?", "Raikkonen", "#f1"}},
+	})
+	ctx, r := newFakeContext("alice", "#f1", "1")
+	ctx.Options = map[string]string{"timeout": "60"}
+	done := runGame(b.cmdQuiz, ctx)
+	waitGameStart(t, b, "quiz", "#f1")
+	// Someone else using the nick of alice doesn't match the identity of the user who started the quiz.
+	tests := []struct {
+		game   func(*Context)
+		nick   string
+		source string
+		role   Role
+		want   string
+	}{
+		{b.cmdPoll, "alice", "", RoleUser, "There's no poll running on this channel."},
+		{b.cmdQuiz, "bob", "", RoleUser, "Only alice or a moderator can stop this quiz."},
+		{b.cmdQuiz, "alice", "alice!~mallory@example.net", RoleUser, "Only alice or a moderator can stop this quiz."},
+		{b.cmdQuiz, "carol", "", RoleModerator, ""},
+	}
+	for _, test := range tests {
+		ctx, stopReplies := newFakeContext(test.nick, "#f1", "stop")
+		if test.source != "" {
+			ctx.Source = test.source
+		}
+		ctx.Role = test.role
+		test.game(ctx)
+		if test.want != "" && !stopReplies.contains(test.want) {
+			t.Errorf("stop as %s: got %q, want %q", test.nick, stopReplies.replies(), test.want)
+		}
+	}
+	waitGame(t, done, 5*time.Second)
+	if !r.contains("The quiz was stopped.") || r.contains("Time's up") {
+		t.Errorf("cmdQuiz: got %q", r.replies())
+	}
+	if _, ok := b.games.Get("#f1"); ok {
+		t.Error("the quiz should be off")
+	}
+}
+
+func TestGameAbort(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{
+		quizFile: {{"Who won the 2007 title with Ferrari?", "Raikkonen", "#f1"}},
+	})
+	quiz, quizReplies := newFakeContext("alice", "#f1", "1")
+	quiz.Options = map[string]string{"timeout": "60"}
+	quizDone := runGame(b.cmdQuiz, quiz)
+	poll, pollReplies := newFakeContext("bob", "#motorsport", "Best driver?;Senna;Prost")
+	poll.Options = map[string]string{"timeout": "60"}
+	pollDone := runGame(b.cmdPoll, poll)
+	waitGameStart(t, b, "quiz", "#f1")
+	waitGameStart(t, b, "poll", "#motorsport")
+	b.games.Abort()
+	waitGame(t, quizDone, 5*time.Second)
+	waitGame(t, pollDone, 5*time.Second)
+	if !quizReplies.contains("The quiz was aborted, the bot is shutting down.") {
+		t.Errorf("cmdQuiz: got %q", quizReplies.replies())
+	}
+	if !pollReplies.contains("The Poll was aborted, the bot is shutting down.") {
+		t.Errorf("cmdPoll: got %q", pollReplies.replies())
+	}
+}
+
+func TestCmdProcessBets(t *testing.T) {
+	b := newBetBot(t, testEvents())
+	writeCSV(b.config.path(betsFile), [][]string{
+		{"Monaco Grand Prix", "alice", "ver", "ham", "lec", "ver", "0"},
+		{"Monaco Grand Prix", "bob", "ham", "nor", "ver", "nor", "0"},
+		{"Bahrain Grand Prix", "bob", "ver", "ham", "lec", "ver", "25"},
+	})
+	writeCSV(b.config.path(resultsFile), [][]string{{"Monaco Grand Prix", "ver", "ham", "nor", "Bahrain Grand Prix"}})
+	ctx, r := newFakeContext("alice", "#f1")
+	b.cmdProcessBets(ctx)
+	if !r.contains("You need the admin role to use this command.") {
+		t.Fatalf("cmdProcessBets: got %q", r.replies())
+	}
+	ctx, r = newFakeContext("gluon", "#f1")
+	ctx.Role = RoleAdmin
+	b.cmdProcessBets(ctx)
+	if !r.contains("Monaco Grand Prix bets successfully processed.") {
+		t.Fatalf("cmdProcessBets: got %q", r.replies())
+	}
+	// alice: ver first (10 * 1) and ham second (10 * 2), bob: ham (5 * 2), nor (5 * 4) and ver (5 * 1).
+	bets, _ := readCSV(b.config.path(betsFile))
+	users, _ := readCSV(b.config.path(usersFile))
+	if bets[0][6] != "30" || bets[1][6] != "35" || bets[2][6] != "25" || bets[0][5] != "ver" {
+		t.Errorf("unexpected bets: %v", bets)
+	}
+	if users[0][2] != "30" || users[1][2] != "35" {
+		t.Errorf("unexpected users: %v", users)
+	}
+	ctx, r = newFakeContext("gluon", "#f1")
+	ctx.Role = RoleAdmin
+	b.cmdProcessBets(ctx)
+	if !r.contains("Monaco Grand Prix bets have already been processed in the past.") {
+		t.Errorf("cmdProcessBets: got %q", r.replies())
+	}
+}
@@ -0,0 +1,573 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Type that represents the configuration of the bot.
+// The settings of the embedded NetworkConfig are defaults inherited by every network.
+// When no network is configured, a single network named "default" is built from those defaults.
+type Config struct {
+	NetworkConfig
+	PluginsFolder     string                  `toml:"plugins_folder"`
+	OWMAPIKey         string                  `toml:"owm_api_key"`        // Legacy setting, the api_key of [plugin.weather] when that isn't set.
+	HTTPListen        string                  `toml:"http_listen"`        // Address of the HTTP server with /healthz and /metrics, disabled when empty.
+	APIListen         string                  `toml:"api_listen"`         // Address of the local API, a loopback host:port or unix:path, disabled when empty.
+	APIToken          string                  `toml:"api_token"`          // Token the clients of the local API must send, not checked when empty.
+	LogLevel          string                  `toml:"log_level"`          // Lowest level of the records logged: debug, info, warn or error.
+	LogFormat         string                  `toml:"log_format"`         // Format of the records, text or json.
+	LogFile           string                  `toml:"log_file"`           // File the records are written to, stderr when empty.
+	LogMaxSize        int                     `toml:"log_max_size"`       // Megabytes the log file grows to before it's rotated.
+	LogMaxBackups     int                     `toml:"log_max_backups"`    // Rotated log files kept.
+	PluginTimeout     int                     `toml:"plugin_timeout"`     // Seconds a plugin may run before it's killed.
+	PluginMemory      int                     `toml:"plugin_memory"`      // Megabytes of memory of each process of a plugin, unlimited when 0.
+	PluginCPU         int                     `toml:"plugin_cpu"`         // Seconds of CPU time of each process of a plugin, unlimited when 0.
+	PluginOutput      int                     `toml:"plugin_output"`      // Kilobytes of output kept from a plugin.
+	PluginConcurrency int                     `toml:"plugin_concurrency"` // Plugins each user can run at once.
+	PluginManifests   bool                    `toml:"plugin_manifests"`   // Only executables with a manifest are plugins.
+	Plugins           map[string]PluginConfig `toml:"plugin"`             // Settings of each plugin, by lower case name.
+	Networks          []NetworkConfig         `toml:"-"`
+	unknown           []string                // Keys of the config file that aren't settings.
+}
+
+// Type that represents the configuration of a bot instance on one IRC network.
+type NetworkConfig struct {
+	Name          string `toml:"name"`
+	Server        string `toml:"server"`
+	TLS           bool   `toml:"tls"`
+	TLSSkipVerify bool   `toml:"tls_skip_verify"`
+	TLSCAFile     string `toml:"tls_ca_file"`
+	TLSCertFile   string `toml:"tls_cert_file"`
+	TLSKeyFile    string `toml:"tls_key_file"`
+	SASL          string `toml:"sasl"`
+	Auth          string `toml:"auth"`
+	Account       string `toml:"account"`
+	Password      string `toml:"password"`
+	Nick          string `toml:"nick"`
+	Channels      string `toml:"channels"`
+	AdminNick     string `toml:"admin_nick"` // Deprecated, the services account of the owner when owners isn't set.
+	Owners        string `toml:"owners"`     // Masks of the owners of the bot, separated by commas.
+	Prefix        string `toml:"prefix"`
+	Folder        string `toml:"folder"`
+	Storage       string `toml:"storage"`
+	Backups       int    `toml:"backups"`
+	InputFile     string `toml:"input_file"`
+	OutputFile    string `toml:"output_file"`
+	PollTimeout   int    `toml:"poll_timeout"`
+	QuizTimeout   int    `toml:"quiz_timeout"`
+	FeedInterval  int    `toml:"feed_interval"`
+	SendBurst     int    `toml:"send_burst"`    // Messages sent at once before the bot starts pacing itself.
+	SendInterval  int    `toml:"send_interval"` // Milliseconds between messages once the burst is spent.
+	ReconnectMin  int    `toml:"reconnect_min"` // Seconds before the first reconnection attempt, doubled on each failure.
+	ReconnectMax  int    `toml:"reconnect_max"` // Maximum seconds between reconnection attempts.
+	QuitMessage   string `toml:"quit_message"`  // Message sent with QUIT when the bot shuts down.
+}
+
+// Small utility function that returns a Config populated with the default settings.
+func defaultConfig() Config {
+	return Config{
+		NetworkConfig: NetworkConfig{
+			Server:       "irc.quakenet.org:6667",
+			Nick:         "Schumacher",
+			Channels:     "#motorsport",
+			Prefix:       "!",
+			Folder:       "/home/gluon/var/irc/bots/Schumacher/",
+			Storage:      "bolt",
+			Backups:      5,
+			InputFile:    "/home/gluon/mnt/schumacher/in",
+			OutputFile:   "/home/gluon/mnt/schumacher/out",
+			PollTimeout:  60,
+			QuizTimeout:  20,
+			FeedInterval: 300,
+			SendBurst:    5,
+			SendInterval: 1000,
+			ReconnectMin: 5,
+			ReconnectMax: 300,
+			QuitMessage:  "Shutting down.",
+		},
+		LogLevel:          "info",
+		LogFormat:         "text",
+		LogMaxSize:        10,
+		LogMaxBackups:     5,
+		PluginTimeout:     30,
+		PluginMemory:      1024,
+		PluginCPU:         10,
+		PluginOutput:      64,
+		PluginConcurrency: 2,
+	}
+}
+
+// The loadConfig function builds the configuration of the bot from the defaults, a config file and the environment.
+// Each source overrides the previous one, so environment variables always take precedence over the config file.
+// That includes the network sections, which are overridden by the global variables and then by those of the network.
+// A missing config file is only an error when required is true, otherwise the defaults and the environment are used.
+func loadConfig(path string, required bool) (config Config, err error) {
+	// The network sections are decoded later, on top of the defaults, with the same metadata.
+	file := struct {
+		Config
+		Networks []toml.Primitive `toml:"network"`
+	}{Config: defaultConfig()}
+	var md toml.MetaData
+	if _, err = os.Stat(path); err == nil {
+		md, err = toml.DecodeFile(path, &file)
+		if err != nil {
+			err = fmt.Errorf("Error reading config file %s: %w", path, err)
+			return
+		}
+	} else if required || !errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("Error opening config file %s: %w", path, err)
+		return
+	}
+	config = file.Config
+	// Global settings and network defaults are overridden by SCHUMACHER_<KEY> variables.
+	// The settings of a single network are overridden by SCHUMACHER_<NAME>_<KEY> variables.
+	for key, value := range map[string]*string{
+		"plugins_folder": &config.PluginsFolder,
+		"owm_api_key":    &config.OWMAPIKey,
+		"http_listen":    &config.HTTPListen,
+		"api_listen":     &config.APIListen,
+		"api_token":      &config.APIToken,
+		"log_level":      &config.LogLevel,
+		"log_format":     &config.LogFormat,
+		"log_file":       &config.LogFile,
+	} {
+		if v, ok := os.LookupEnv(envName("", key)); ok {
+			*value = v
+		}
+	}
+	for key, value := range map[string]*int{
+		"log_max_size":       &config.LogMaxSize,
+		"log_max_backups":    &config.LogMaxBackups,
+		"plugin_timeout":     &config.PluginTimeout,
+		"plugin_memory":      &config.PluginMemory,
+		"plugin_cpu":         &config.PluginCPU,
+		"plugin_output":      &config.PluginOutput,
+		"plugin_concurrency": &config.PluginConcurrency,
+	} {
+		if v, ok := os.LookupEnv(envName("", key)); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return config, fmt.Errorf("Invalid value for %s: %q is not a number.", envName("", key), v)
+			}
+			*value = n
+		}
+	}
+	if v, ok := os.LookupEnv(envName("", "plugin_manifests")); ok {
+		if config.PluginManifests, err = strconv.ParseBool(v); err != nil {
+			return config, fmt.Errorf("Invalid value for %s: %q is not a boolean.", envName("", "plugin_manifests"), v)
+		}
+	}
+	err = config.NetworkConfig.loadEnv("", os.LookupEnv)
+	if err != nil {
+		return
+	}
+	// Each network section is decoded on top of a copy of the defaults, so it only needs the settings that differ.
+	if len(file.Networks) == 0 {
+		network := config.NetworkConfig
+		network.Name = "default"
+		config.Networks = append(config.Networks, network)
+	}
+	for _, primitive := range file.Networks {
+		network := config.NetworkConfig
+		network.Name = ""
+		err = md.PrimitiveDecode(primitive, &network)
+		if err != nil {
+			err = fmt.Errorf("Error reading config file %s: %w", path, err)
+			return
+		}
+		config.Networks = append(config.Networks, network)
+	}
+	// Keys the config file sets but the bot doesn't know are reported by validate, with every other problem.
+	for _, key := range md.Undecoded() {
+		config.unknown = append(config.unknown, key.String())
+	}
+	// The environment takes precedence over the network sections, so the global variables are applied again.
+	for i := range config.Networks {
+		for _, name := range []string{"", config.Networks[i].Name} {
+			err = config.Networks[i].loadEnv(name, os.LookupEnv)
+			if err != nil {
+				return
+			}
+		}
+	}
+	// Plugin names are matched ignoring case, like the commands they become.
+	plugins := make(map[string]PluginConfig)
+	for name, settings := range config.Plugins {
+		plugins[strings.ToLower(name)] = settings
+	}
+	config.Plugins = plugins
+	// The owm_api_key setting predates the weather module, which reads the api_key of [plugin.weather] instead.
+	if _, ok := config.Plugins["weather"]["api_key"]; config.OWMAPIKey != "" && !ok {
+		if config.Plugins["weather"] == nil {
+			config.Plugins["weather"] = PluginConfig{}
+		}
+		config.Plugins["weather"]["api_key"] = config.OWMAPIKey
+	}
+	if config.PluginsFolder == "" {
+		config.PluginsFolder = filepath.Join(config.Folder, "plugins")
+	}
+	return config, nil
+}
+
+// The loadEnv method overrides the settings of the network with environment variables.
+// The name of each variable is the upper case toml key of the setting, for example SCHUMACHER_POLL_TIMEOUT.
+// When name isn't empty it is added to the variable name, for example SCHUMACHER_LIBERA_NICK.
+func (n *NetworkConfig) loadEnv(name string, lookup func(string) (string, bool)) error {
+	strs := map[string]*string{
+		"server":        &n.Server,
+		"tls_ca_file":   &n.TLSCAFile,
+		"tls_cert_file": &n.TLSCertFile,
+		"tls_key_file":  &n.TLSKeyFile,
+		"sasl":          &n.SASL,
+		"auth":          &n.Auth,
+		"account":       &n.Account,
+		"password":      &n.Password,
+		"nick":          &n.Nick,
+		"channels":      &n.Channels,
+		"admin_nick":    &n.AdminNick,
+		"owners":        &n.Owners,
+		"prefix":        &n.Prefix,
+		"folder":        &n.Folder,
+		"storage":       &n.Storage,
+		"input_file":    &n.InputFile,
+		"output_file":   &n.OutputFile,
+		"quit_message":  &n.QuitMessage,
+	}
+	bools := map[string]*bool{
+		"tls":             &n.TLS,
+		"tls_skip_verify": &n.TLSSkipVerify,
+	}
+	ints := map[string]*int{
+		"backups":       &n.Backups,
+		"poll_timeout":  &n.PollTimeout,
+		"quiz_timeout":  &n.QuizTimeout,
+		"feed_interval": &n.FeedInterval,
+		"send_burst":    &n.SendBurst,
+		"send_interval": &n.SendInterval,
+		"reconnect_min": &n.ReconnectMin,
+		"reconnect_max": &n.ReconnectMax,
+	}
+	for key, value := range strs {
+		if v, ok := lookup(envName(name, key)); ok {
+			*value = v
+		}
+	}
+	for key, value := range bools {
+		if v, ok := lookup(envName(name, key)); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s: %q is not a boolean.", envName(name, key), v)
+			}
+			*value = b
+		}
+	}
+	for key, value := range ints {
+		if v, ok := lookup(envName(name, key)); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s: %q is not a number.", envName(name, key), v)
+			}
+			*value = n
+		}
+	}
+	return nil
+}
+
+// The validate method checks every setting of the config and returns a list with all the problems found.
+// It doesn't stop on the first problem, so that the user can fix the whole config file at once.
+func (c *Config) validate() (problems []string) {
+	for _, key := range c.unknown {
+		problems = append(problems, fmt.Sprintf("%s: unknown setting.", key))
+	}
+	if info, err := os.Stat(c.PluginsFolder); err == nil && !info.IsDir() {
+		problems = append(problems, fmt.Sprintf("plugins_folder: %q is not a directory.", c.PluginsFolder))
+	}
+	if c.HTTPListen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPListen); err != nil {
+			problems = append(problems, fmt.Sprintf("http_listen: %q must be in the host:port format.", c.HTTPListen))
+		}
+	}
+	if c.APIListen != "" {
+		if path := strings.TrimPrefix(c.APIListen, "unix:"); path != c.APIListen {
+			if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+				problems = append(problems, fmt.Sprintf("api_listen: the folder of %q does not exist.", path))
+			}
+		} else if !isLoopback(c.APIListen) {
+			problems = append(problems, fmt.Sprintf("api_listen: %q must be unix:path or a loopback host:port.", c.APIListen))
+		} else if c.APIToken == "" {
+			// Any web page opened on the same machine can reach a loopback port, but not a unix socket.
+			problems = append(problems, "api_token: must be set when api_listen is a host:port.")
+		}
+		if c.APIListen == c.HTTPListen {
+			problems = append(problems, "api_listen: must differ from http_listen.")
+		}
+	}
+	if _, err := parseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("log_level: %q must be debug, info, warn or error.", c.LogLevel))
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "text", "json":
+	default:
+		problems = append(problems, fmt.Sprintf("log_format: %q must be text or json.", c.LogFormat))
+	}
+	if c.LogFile != "" {
+		if info, err := os.Stat(filepath.Dir(c.LogFile)); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("log_file: the folder of %q does not exist.", c.LogFile))
+		}
+	}
+	if c.LogMaxSize <= 0 {
+		problems = append(problems, fmt.Sprintf("log_max_size: %d must be a positive number of megabytes.", c.LogMaxSize))
+	}
+	if c.LogMaxBackups < 0 {
+		problems = append(problems, fmt.Sprintf("log_max_backups: %d can't be negative.", c.LogMaxBackups))
+	}
+	problems = append(problems, c.validatePlugins()...)
+	// Names must be unique and the input file can't be shared, since it's truncated after being read.
+	names := make(map[string]bool)
+	inputFiles := make(map[string]bool)
+	for _, n := range c.Networks {
+		if n.Name == "" {
+			problems = append(problems, "network: every network needs a name.")
+		} else if names[strings.ToLower(n.Name)] {
+			problems = append(problems, fmt.Sprintf("network: the name %q is used more than once.", n.Name))
+		}
+		names[strings.ToLower(n.Name)] = true
+		if n.InputFile != "" && inputFiles[n.InputFile] {
+			problems = append(problems, fmt.Sprintf("network %s: input_file: %q is used by another network.", n.Name, n.InputFile))
+		}
+		inputFiles[n.InputFile] = true
+		for _, problem := range n.validate() {
+			problems = append(problems, fmt.Sprintf("network %s: %s", n.Name, problem))
+		}
+	}
+	return
+}
+
+// The validatePlugins method checks the limits of the plugins, both the global ones and the ones of each plugin,
+// and the daemon setting of each plugin.
+func (c *Config) validatePlugins() (problems []string) {
+	for _, limit := range []struct {
+		key      string
+		value    int
+		positive bool
+	}{
+		{"plugin_timeout", c.PluginTimeout, true},
+		{"plugin_memory", c.PluginMemory, false},
+		{"plugin_cpu", c.PluginCPU, false},
+		{"plugin_output", c.PluginOutput, true},
+		{"plugin_concurrency", c.PluginConcurrency, true},
+	} {
+		if limit.value < 0 || (limit.positive && limit.value == 0) {
+			problems = append(problems, fmt.Sprintf("%s: %d must be a positive number.", limit.key, limit.value))
+		}
+	}
+	for name, settings := range c.Plugins {
+		for key, value := range settings {
+			if _, ok := value.(bool); strings.EqualFold(key, "daemon") && !ok {
+				problems = append(problems, fmt.Sprintf("plugin.%s: %s: %v must be true or false.", name, key, value))
+			}
+			if !containsFold(pluginLimitKeys, key) {
+				continue
+			}
+			if n, ok := value.(int64); !ok || n < 0 || (n == 0 && (strings.EqualFold(key, "timeout") || strings.EqualFold(key, "output"))) {
+				problems = append(problems, fmt.Sprintf("plugin.%s: %s: %v must be a positive number.", name, key, value))
+			}
+		}
+	}
+	return
+}
+
+// The validate method checks every setting of the network and returns a list with all the problems found.
+func (n *NetworkConfig) validate() (problems []string) {
+	if _, port, err := net.SplitHostPort(n.Server); err != nil || port == "" {
+		problems = append(problems, fmt.Sprintf("server: %q must be in the host:port format.", n.Server))
+	}
+	problems = append(problems, n.validateAuth()...)
+	if n.Nick == "" || strings.ContainsAny(n.Nick, " ,!@#") {
+		problems = append(problems, fmt.Sprintf("nick: %q is not a valid IRC nick.", n.Nick))
+	}
+	if n.Channels == "" {
+		problems = append(problems, "channels: at least one channel is required.")
+	} else {
+		for _, channel := range strings.Split(n.Channels, ",") {
+			if len(channel) < 2 || !strings.ContainsAny(channel[:1], "#&") {
+				problems = append(problems, fmt.Sprintf("channels: %q is not a valid channel name.", channel))
+			}
+		}
+	}
+	if n.Owners != "" {
+		for _, mask := range strings.Split(n.Owners, ",") {
+			if err := checkMask(mask); err != nil {
+				problems = append(problems, "owners: "+err.Error())
+			}
+		}
+	}
+	if n.Prefix == "" || strings.Contains(n.Prefix, " ") {
+		problems = append(problems, fmt.Sprintf("prefix: %q must be non-empty and contain no spaces.", n.Prefix))
+	}
+	if info, err := os.Stat(n.Folder); err != nil || !info.IsDir() {
+		problems = append(problems, fmt.Sprintf("folder: %q is not an existing directory.", n.Folder))
+	}
+	switch strings.ToLower(n.Storage) {
+	case "csv", "bolt":
+	default:
+		problems = append(problems, fmt.Sprintf("storage: %q must be csv or bolt.", n.Storage))
+	}
+	if n.Backups < 0 {
+		problems = append(problems, fmt.Sprintf("backups: %d can't be negative.", n.Backups))
+	}
+	// The input and output files are optional, an empty path disables the file bridge.
+	for _, file := range []struct{ key, path string }{
+		{"input_file", n.InputFile},
+		{"output_file", n.OutputFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if info, err := os.Stat(filepath.Dir(file.path)); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s: the folder of %q does not exist.", file.key, file.path))
+		}
+	}
+	for _, timeout := range []struct {
+		key   string
+		value int
+	}{
+		{"poll_timeout", n.PollTimeout},
+		{"quiz_timeout", n.QuizTimeout},
+		{"feed_interval", n.FeedInterval},
+		{"reconnect_min", n.ReconnectMin},
+		{"reconnect_max", n.ReconnectMax},
+	} {
+		if timeout.value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s: %d must be a positive number of seconds.", timeout.key, timeout.value))
+		}
+	}
+	if n.SendBurst <= 0 {
+		problems = append(problems, fmt.Sprintf("send_burst: %d must be a positive number of messages.", n.SendBurst))
+	}
+	if n.SendInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("send_interval: %d must be a positive number of milliseconds.", n.SendInterval))
+	}
+	if n.ReconnectMax < n.ReconnectMin {
+		problems = append(problems, fmt.Sprintf("reconnect_max: %d must not be lower than reconnect_min (%d).", n.ReconnectMax, n.ReconnectMin))
+	}
+	return
+}
+
+// Small utility function that checks if an address is a host:port on the loopback interface.
+// The API can send messages as the bot, so it must never be reachable from other machines.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// The ownerMasks method returns the masks of the owners of the bot.
+// Without owners, the admin nick is taken as the services account of the only owner, so a nick alone is never trusted.
+// Neither has a default, so a bot without them on its config has no owners until one is set.
+func (n NetworkConfig) ownerMasks() []string {
+	if n.Owners != "" {
+		return strings.Split(n.Owners, ",")
+	}
+	if n.AdminNick != "" {
+		return []string{"$a:" + n.AdminNick}
+	}
+	return nil
+}
+
+// The validateAuth method checks the TLS, SASL and services authentication settings of the network.
+func (n *NetworkConfig) validateAuth() (problems []string) {
+	for _, file := range []struct{ key, path string }{
+		{"tls_ca_file", n.TLSCAFile},
+		{"tls_cert_file", n.TLSCertFile},
+		{"tls_key_file", n.TLSKeyFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if !n.TLS {
+			problems = append(problems, fmt.Sprintf("%s: requires tls to be enabled.", file.key))
+		}
+		if !fileExists(file.path) {
+			problems = append(problems, fmt.Sprintf("%s: %q does not exist.", file.key, file.path))
+		}
+	}
+	if (n.TLSCertFile == "") != (n.TLSKeyFile == "") {
+		problems = append(problems, "tls_cert_file and tls_key_file must be set together.")
+	}
+	switch strings.ToLower(n.SASL) {
+	case "":
+	case "plain":
+		if n.Account == "" || n.Password == "" {
+			problems = append(problems, "sasl: plain requires an account and a password.")
+		}
+	case "external":
+		if n.TLSCertFile == "" {
+			problems = append(problems, "sasl: external requires a client certificate (tls_cert_file).")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("sasl: %q must be plain or external.", n.SASL))
+	}
+	switch strings.ToLower(n.Auth) {
+	case "":
+	case "nickserv", "q":
+		if n.Account == "" || n.Password == "" {
+			problems = append(problems, fmt.Sprintf("auth: %s requires an account and a password.", n.Auth))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("auth: %q must be nickserv or q.", n.Auth))
+	}
+	return
+}
+
+// The path method returns the full path to one of the data files (or folders) inside the network folder.
+func (n *NetworkConfig) path(name string) string {
+	return filepath.Join(n.Folder, name)
+}
+
+// Small utility function that returns the environment variable name used to override a config key.
+// The network name is optional and is upper cased with any character other than letters and digits dropped.
+func envName(network string, key string) string {
+	var name strings.Builder
+	for _, r := range strings.ToUpper(network) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			name.WriteRune(r)
+		}
+	}
+	if name.Len() > 0 {
+		return "SCHUMACHER_" + name.String() + "_" + strings.ToUpper(key)
+	}
+	return "SCHUMACHER_" + strings.ToUpper(key)
+}
@@ -0,0 +1,69 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schumacher.toml")
+	err := os.WriteFile(path, []byte(`
+nick = "Schumacher"
+prefix = "?"
+colour = "red"
+
+[[network]]
+name = "libera"
+nick = "Senna"
+prefix = "."
+channel = "#f1"
+
+[[network]]
+name = "oftc"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SCHUMACHER_NICK", "Prost")
+	t.Setenv("SCHUMACHER_OFTC_NICK", "Lauda")
+	config, err := loadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the network sections, and the variables of a network override the global ones.
+	for i, want := range []struct{ name, nick, prefix string }{
+		{"libera", "Prost", "."},
+		{"oftc", "Lauda", "?"},
+	} {
+		n := config.Networks[i]
+		if n.Name != want.name || n.Nick != want.nick || n.Prefix != want.prefix {
+			t.Errorf("network %d = %s, %s, %s, want %s, %s, %s", i, n.Name, n.Nick, n.Prefix, want.name, want.nick, want.prefix)
+		}
+	}
+	problems := strings.Join(config.validate(), "\n")
+	for _, key := range []string{"colour", "network.channel"} {
+		if !strings.Contains(problems, key+": unknown setting.") {
+			t.Errorf("problems %q don't report %s", problems, key)
+		}
+	}
+}
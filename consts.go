@@ -18,24 +18,24 @@
 
 package main
 
+// Names of the data files, relative to the folder setting of the config.
 const (
-	server        = "irc.quakenet.org:6667"                // Hostname of the server to connect to.
-	prefix        = "!"                                    // Prefix which is used by the user to issue commands.
-	folder        = "/home/gluon/var/irc/bots/Schumacher/" // Full path to the folder.
-	answersFile   = folder + "answers.csv"                 // Full path to the answers file.
-	betsFile      = folder + "bets.csv"                    // Full path to the bets file.
-	driversFile   = folder + "drivers.csv"                 // Full path to the drivers file.
-	eventsFile    = folder + "events.csv"                  // Full path to the events file.
-	feedsFile     = folder + "feeds.csv"                   // Full path to the feeds file.
-	usersFile     = folder + "users.csv"                   // Full path to the users file.
-	resultsFile   = folder + "results.csv"                 // Full path to the results file.
-	quizFile      = folder + "quiz.csv"                    // Full path to the quiz file.
-	quotesFile    = folder + "quotes.csv"                  // Full path to the quotes file.
-	weatherFile   = folder + "weather.csv"                 // Full path to the weather file.
-	pluginsFolder = folder + "plugins/"                    // Full path to the plugins folder.
-	pollTimeout   = 60                                     // Poll timeout in seconds.
-	quizTimeout   = 20                                     // Quiz timeout in seconds.
-	hns           = 3600000000000                          // Number of nanoseconds in one hour.
-	feedInterval  = 300                                    // Feed poll interval in seconds.
-	owmAPIKey     = "f97b1089707bd013b60c22db86730cf8"     // OpenWeatherMap API key.
+	answersFile      = "answers.csv"     // Name of the answers file.
+	backupsFolder    = "backups"         // Name of the folder with the backups of the data files.
+	betsFile         = "bets.csv"        // Name of the bets file.
+	channelsFile     = "channels.csv"    // Name of the channel settings file.
+	boltFile         = "schumacher.db"   // Name of the database file of the bolt storage.
+	driversFile      = "drivers.csv"     // Name of the drivers file.
+	eventsFile       = "events.csv"      // Name of the events file.
+	feedsFile        = "feeds.csv"       // Name of the feeds file.
+	identitiesFile   = "identities.csv"  // Name of the file with the identities of the registered users.
+	lockFileName     = "schumacher.lock" // Name of the lock file of the data files.
+	pluginDataFolder = ".data"           // Name of the folder with the working folders of the plugins, inside the plugins folder.
+	pluginsDisabled  = ".disabled"       // Name of the file with the disabled plugins, inside the plugins folder.
+	usersFile        = "users.csv"       // Name of the users file.
+	resultsFile      = "results.csv"     // Name of the results file.
+	rolesFile        = "roles.csv"       // Name of the roles file.
+	quizFile         = "quiz.csv"        // Name of the quiz file.
+	quotesFile       = "quotes.csv"      // Name of the quotes file.
+	hns              = 3600000000000     // Number of nanoseconds in one hour.
 )
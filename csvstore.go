@@ -0,0 +1,177 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Type that represents a store that keeps each table on a CSV file inside a folder.
+// This is the original format of the bot, which is also read and written by the f1_plugin binaries and the WebApp.
+// Transactions are serialized with a lock and their writes are only flushed to the files when they succeed.
+// The CSV files can't be replaced at once though, so a crash while a transaction that changed several tables is
+// renaming its files can leave only some of them updated. Unlike bolt, this store isn't fully transactional.
+// The lock is also an flock on the lock file of the folder, so external programs can take part in it:
+// they should hold a shared lock while reading the files and an exclusive lock while writing them. This protocol
+// is documented for plugin authors on schumacher.example.toml, and the f1_plugin binaries follow it.
+type csvStore struct {
+	sync.RWMutex
+	folder  string
+	backups int // Number of backups kept of each file, 0 disables backups.
+}
+
+// Type that represents the tables of a csvStore inside a transaction.
+// Writes are kept in memory until the transaction is committed.
+type csvTables struct {
+	store   *csvStore
+	pending map[string][][]string
+}
+
+// The newCSVStore function creates a store that keeps its tables as CSV files on folder.
+// Before a file is replaced, a timestamped copy is kept on the backups folder, up to backups copies per file.
+func newCSVStore(folder string, backups int) *csvStore {
+	return &csvStore{folder: folder, backups: backups}
+}
+
+func (s *csvStore) View(fn func(tx *Tx) error) error {
+	s.RLock()
+	defer s.RUnlock()
+	unlock, err := lockFile(filepath.Join(s.folder, lockFileName), false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn(&Tx{tables: &csvTables{store: s}})
+}
+
+func (s *csvStore) Update(fn func(tx *Tx) error) error {
+	s.Lock()
+	defer s.Unlock()
+	unlock, err := lockFile(filepath.Join(s.folder, lockFileName), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	tables := &csvTables{store: s, pending: make(map[string][][]string)}
+	err = fn(&Tx{tables: tables})
+	if err != nil {
+		return err
+	}
+	// Every table is written to a temporary file first, so that a failed write doesn't leave a partial commit.
+	// Only then are the files renamed, which is quick but still not atomic as a whole.
+	names := make([]string, 0, len(tables.pending))
+	for table := range tables.pending {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+	temps := make(map[string]string)
+	for _, table := range names {
+		temp, err := createCSV(filepath.Join(s.folder, table), tables.pending[table])
+		if err != nil {
+			for _, temp := range temps {
+				os.Remove(temp)
+			}
+			return err
+		}
+		temps[table] = temp
+	}
+	for i, table := range names {
+		err = s.backup(table)
+		if err != nil {
+			defaultLogger.Warn("Error backing up table.", "table", table, "err", err)
+		}
+		err = replaceFile(temps[table], filepath.Join(s.folder, table))
+		if err != nil {
+			for _, table := range names[i+1:] {
+				os.Remove(temps[table])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// The backup method copies the file of a table to the backups folder, with the current time on its name.
+// Only the newest backups of each file are kept, the older ones are removed.
+func (s *csvStore) backup(table string) error {
+	if s.backups <= 0 {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(s.folder, table))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading %s for a backup: %w", table, err)
+	}
+	folder := filepath.Join(s.folder, backupsFolder)
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating backups folder: %w", err)
+	}
+	// The timestamp sorts like the time, so the oldest backups are the first ones returned by Glob.
+	name := table + "." + time.Now().UTC().Format("20060102-150405.000000")
+	err = os.WriteFile(filepath.Join(folder, name), data, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing backup %s: %w", name, err)
+	}
+	backups, err := filepath.Glob(filepath.Join(folder, table+".*"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > s.backups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (s *csvStore) Close() error {
+	return nil
+}
+
+// The read method returns the rows of a table, an empty table when its file doesn't exist yet.
+func (t *csvTables) read(table string) ([][]string, error) {
+	if rows, ok := t.pending[table]; ok {
+		return rows, nil
+	}
+	path := filepath.Join(t.store.folder, table)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return readCSV(path)
+}
+
+func (t *csvTables) source(table string) string {
+	return filepath.Join(t.store.folder, table)
+}
+
+func (t *csvTables) write(table string, rows [][]string) error {
+	if t.pending == nil {
+		return errWriteOnView
+	}
+	t.pending[table] = rows
+	return nil
+}
@@ -0,0 +1,584 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+// Plugins whose [plugin.<name>] section sets daemon = true are started once on each network, when the bot starts,
+// instead of once per command. The bot talks JSON-RPC 2.0 with a daemon, one JSON object per line on its stdin and
+// stdout, while stderr is logged. The bot sends these, where a notification has no id and gets no response:
+//
+//	initialize  {"version", "network", "nick", "prefix", "config"}, answered with {"events": [...], "tick": seconds}
+//	            to subscribe to message, join and part events, and to a tick event every tick seconds.
+//	command     A pluginRequest, answered with a pluginResponse, for each command of the plugin.
+//	event       Notification with a pluginEvent the daemon subscribed to.
+//	shutdown    Notification sent before the bot closes stdin, after which the daemon should exit.
+//
+// A daemon can send the bot these, as a request to get a response or as a notification:
+//
+//	send        {"target", "text", "kind"} sends text to a channel or nick, where kind is privmsg (default),
+//	            notice or action. The response is {"queued": lines}.
+//
+// A daemon that exits, doesn't answer a call within its timeout or stops reading its stdin, is killed and restarted
+// with a backoff.
+// Daemons run under the same limits as other plugins, except for the limit of CPU time, since they run for long.
+const (
+	daemonEvents     = 64              // Events kept for a daemon that doesn't keep up, or is restarting.
+	daemonWrites     = 64              // Lines waiting to be written to the stdin of a daemon, before it counts as stuck.
+	daemonBackoffMin = time.Second     // Time before restarting a daemon that stopped, doubled each time it stops again.
+	daemonBackoffMax = 5 * time.Minute // Longest time before restarting a daemon.
+	rpcVersion       = "2.0"           // Version of JSON-RPC spoken with daemons.
+	rpcMethodMissing = -32601          // Code of the JSON-RPC error for an unknown method.
+	rpcInvalidParams = -32602          // Code of the JSON-RPC error for invalid params.
+)
+
+// Type that represents a JSON-RPC request, notification or response exchanged with a daemon.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"` // Missing on notifications.
+	Method  string          `json:"method,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// Type that represents the error of a JSON-RPC response.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// Type that represents something that happened on a network, sent to the daemons that subscribed to it.
+type pluginEvent struct {
+	Type    string    `json:"type"` // message, join, part or tick.
+	Network string    `json:"network"`
+	Channel string    `json:"channel,omitempty"` // Empty on a private message and on a tick.
+	Private bool      `json:"private,omitempty"`
+	Nick    string    `json:"nick,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Type that represents a plugin running as a daemon on a network, across its restarts.
+type daemon struct {
+	sync.Mutex
+	name    string
+	log     *Logger
+	events  chan pluginEvent             // Events waiting to be sent, kept while the daemon restarts.
+	cmd     *exec.Cmd                    // Process of the daemon, nil while it isn't running.
+	writes  chan []byte                  // Lines waiting to be written to the stdin of the daemon by writeLines.
+	closing chan struct{}                // Closed to have writeLines close stdin, once it wrote the lines waiting.
+	pending map[string]chan<- rpcMessage // Calls waiting for a response, by id.
+	nextID  int64
+	subs    map[string]bool // Events the daemon subscribed to.
+	ready   chan struct{}   // Closed once the daemon is initialized, replaced when it stops.
+}
+
+// The startDaemons method starts every plugin set to run as a daemon, each supervised on its own goroutine.
+func (b *Bot) startDaemons() {
+	b.daemonsMu.Lock()
+	defer b.daemonsMu.Unlock()
+	b.daemons = make(map[string]*daemon)
+	for name := range config.Plugins {
+		if !config.pluginDaemon(name) {
+			continue
+		}
+		// The name of the executable is taken from the registry, since the names of the config are lower case.
+		def, ok := registry.Lookup(name)
+		if !ok || !def.Plugin {
+			b.logger.Error("Plugin daemon not found.", "plugin", name, "folder", config.PluginsFolder)
+			continue
+		}
+		d := &daemon{
+			name:   def.Name,
+			log:    b.logger.With("plugin", def.Name),
+			events: make(chan pluginEvent, daemonEvents),
+			ready:  make(chan struct{}),
+		}
+		b.daemons[strings.ToLower(def.Name)] = d
+		b.spawn(func() { b.superviseDaemon(d) })
+	}
+}
+
+// The daemon method returns the daemon of the plugin name, or nil when it doesn't run as one.
+func (b *Bot) daemon(name string) *daemon {
+	b.daemonsMu.Lock()
+	defer b.daemonsMu.Unlock()
+	return b.daemons[strings.ToLower(name)]
+}
+
+// The notifyDaemons method hands event to every daemon, dropping it for the daemons that can't keep up.
+func (b *Bot) notifyDaemons(event pluginEvent) {
+	b.daemonsMu.Lock()
+	defer b.daemonsMu.Unlock()
+	event.Network = b.config.Name
+	for _, d := range b.daemons {
+		select {
+		case d.events <- event:
+		default:
+			d.log.Debug("Dropping event of a daemon that doesn't keep up.", "type", event.Type)
+		}
+	}
+}
+
+// The trackDaemonEvents method adds the IRC callbacks that send joins and parts to the daemons.
+func (b *Bot) trackDaemonEvents(conn *irc.Connection) {
+	for _, code := range []string{"JOIN", "PART"} {
+		kind := strings.ToLower(code)
+		conn.AddCallback(code, func(event *irc.Event) {
+			if len(event.Arguments) > 0 {
+				b.notifyDaemons(pluginEvent{Type: kind, Channel: event.Arguments[0], Nick: event.Nick, Time: time.Now()})
+			}
+		})
+	}
+}
+
+// The superviseDaemon method runs d until the bot shuts down, restarting it whenever it stops.
+// The wait before a restart doubles each time the daemon stops again, and starts over once it runs for stableTime.
+func (b *Bot) superviseDaemon(d *daemon) {
+	attempts := 0
+	for {
+		start := time.Now()
+		err := b.runDaemon(d)
+		if b.ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) >= stableTime {
+			attempts = 0
+		}
+		attempts++
+		pluginFailures.Inc(b.config.Name, d.name)
+		delay := backoff(attempts, daemonBackoffMin, daemonBackoffMax)
+		d.log.Error("Plugin daemon stopped, restarting.", "err", err, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// The runDaemon method starts d, initializes it and sends it its events until it stops or the bot shuts down.
+// It returns why the daemon stopped, which is nil when it was stopped by the bot.
+func (b *Bot) runDaemon(d *daemon) error {
+	limits := config.pluginLimits(d.name)
+	limits.CPU = 0
+	dir, err := pluginFolder(d.name)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(filepath.Join(config.PluginsFolder, d.name))
+	cmd.Dir = dir
+	cmd.Env = append(pluginEnv(dir),
+		"SCHUMACHER_NETWORK="+b.config.Name,
+		"SCHUMACHER_DAEMON=1",
+		fmt.Sprintf("SCHUMACHER_PROTOCOL=%d", pluginProtocol),
+	)
+	cmd.Stderr = d.log.Writer(LevelWarn)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	sandbox(cmd, limits)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Error starting plugin daemon: %w", err)
+	}
+	d.start(cmd, stdin)
+	read := make(chan error, 1)
+	go func() { read <- b.readDaemon(d, stdout, limits.Output) }()
+	// The daemon is stopped and its calls fail once it stops writing, which happens when it exits.
+	// Closing stdin also unblocks the writer when the daemon stopped reading it.
+	stop := func(err error) error {
+		killGroup(cmd)
+		d.stop()
+		stdin.Close()
+		waited := make(chan error, 1)
+		go func() { waited <- cmd.Wait() }()
+		select {
+		case werr := <-waited:
+			if err == nil && werr != nil {
+				err = fmt.Errorf("Error running plugin daemon: %w", werr)
+			}
+		case <-time.After(pluginKillGrace):
+		}
+		return err
+	}
+	var result struct {
+		Events []string `json:"events"`
+		Tick   int      `json:"tick"`
+	}
+	params := map[string]interface{}{
+		"version": pluginProtocol,
+		"network": b.config.Name,
+		"nick":    b.config.Nick,
+		"prefix":  b.config.Prefix,
+		"config":  config.pluginSettings(d.name),
+	}
+	if err := d.call("initialize", params, &result, limits.Timeout); err != nil {
+		return stop(fmt.Errorf("Error initializing plugin daemon: %w", err))
+	}
+	d.subscribe(result.Events)
+	d.Lock()
+	close(d.ready)
+	d.Unlock()
+	d.log.Info("Plugin daemon started.", "events", strings.Join(result.Events, ","), "tick", result.Tick)
+	var tick <-chan time.Time
+	if result.Tick > 0 {
+		ticker := time.NewTicker(time.Duration(result.Tick) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		var err error
+		select {
+		case event := <-d.events:
+			if d.subscribed(event.Type) {
+				err = d.notify("event", event)
+			}
+		case now := <-tick:
+			err = d.notify("event", pluginEvent{Type: "tick", Network: b.config.Name, Time: now})
+		case err := <-read:
+			if err = stop(err); err == nil {
+				err = errors.New("Error running plugin daemon: it exited.")
+			}
+			return err
+		case <-b.ctx.Done():
+			// The daemon gets the chance to exit on its own, and is killed when it doesn't.
+			d.notify("shutdown", nil)
+			d.closeInput()
+			select {
+			case <-read:
+			case <-time.After(pluginKillGrace):
+			}
+			stop(nil)
+			return nil
+		}
+		if err != nil {
+			return stop(err)
+		}
+	}
+}
+
+// The readDaemon method reads what d writes to stdout, line by line, until it closes it.
+// Responses go to the calls waiting for them, and requests and notifications are handled by handleDaemon.
+// A line longer than max stops the reading with an error, like the output cap of other plugins.
+func (b *Bot) readDaemon(d *daemon, stdout io.Reader, max int) error {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 4096), max)
+	for scanner.Scan() {
+		var m struct {
+			rpcMessage
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil || m.JSONRPC != rpcVersion {
+			d.log.Warn("Invalid line from plugin daemon.", "line", scanner.Text())
+			continue
+		}
+		if m.Method == "" {
+			d.respond(m.rpcMessage)
+			continue
+		}
+		result, rerr := b.handleDaemon(d, m.Method, m.Params)
+		if m.ID == nil {
+			if rerr != nil {
+				d.log.Warn("Error handling plugin daemon notification.", "method", m.Method, "err", rerr)
+			}
+			continue
+		}
+		response := rpcMessage{JSONRPC: rpcVersion, ID: m.ID, Error: rerr}
+		if rerr == nil {
+			response.Result, _ = json.Marshal(result)
+		}
+		if err := d.write(response); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// The handleDaemon method handles a request or notification sent by d, returning its result or a JSON-RPC error.
+func (b *Bot) handleDaemon(d *daemon, method string, params json.RawMessage) (interface{}, *rpcError) {
+	switch method {
+	case "send":
+		var send struct {
+			Target string `json:"target"`
+			Text   string `json:"text"`
+			Kind   string `json:"kind"`
+		}
+		if err := json.Unmarshal(params, &send); err != nil {
+			return nil, &rpcError{rpcInvalidParams, "Invalid params: " + err.Error()}
+		}
+		if err := checkTarget(send.Target); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		if strings.TrimSpace(send.Text) == "" {
+			return nil, &rpcError{rpcInvalidParams, "Missing text."}
+		}
+		switch strings.ToLower(send.Kind) {
+		case "", "privmsg":
+			b.queue.Privmsg(PriorityNormal, send.Target, send.Text)
+		case "notice":
+			b.queue.Notice(PriorityNormal, send.Target, send.Text)
+		case "action":
+			b.queue.Action(PriorityNormal, send.Target, send.Text)
+		default:
+			return nil, &rpcError{rpcInvalidParams, "Invalid kind " + send.Kind + ", use privmsg, notice or action."}
+		}
+		return map[string]int{"queued": b.queue.Len()}, nil
+	default:
+		return nil, &rpcError{rpcMethodMissing, "Unknown method " + method + "."}
+	}
+}
+
+// The cmdDaemon method runs a command of the plugin of d, by calling the command method of the daemon.
+// A daemon that is starting or restarting is waited for, up to the timeout of the plugin.
+func (b *Bot) cmdDaemon(ctx *Context, d *daemon, finishedCh chan bool) {
+	var response pluginResponse
+	timeout := config.pluginLimits(d.name).Timeout
+	start := time.Now()
+	err := errors.New("Error calling plugin daemon: it isn't running.")
+	if d.wait(timeout) {
+		err = d.call("command", b.pluginRequest(ctx, d.name), &response, timeout)
+	}
+	pluginDuration.Observe(time.Since(start).Seconds(), b.config.Name, d.name)
+	pluginFinished(finishedCh)
+	if err == nil && response.Version != pluginProtocol {
+		err = fmt.Errorf("Error parsing plugin response: unsupported protocol version %d.", response.Version)
+	}
+	if err != nil {
+		pluginFailures.Inc(b.config.Name, d.name)
+		ctx.Reply("Error executing plugin.")
+		ctx.Log.Error("Error executing plugin.", "plugin", d.name, "err", err)
+		return
+	}
+	b.runPluginActions(ctx, d.name, response.Actions)
+}
+
+// The start method sets d up to be called, after its process was started.
+func (d *daemon) start(cmd *exec.Cmd, stdin io.WriteCloser) {
+	d.Lock()
+	defer d.Unlock()
+	d.cmd = cmd
+	d.writes = make(chan []byte, daemonWrites)
+	d.closing = make(chan struct{})
+	d.pending = make(map[string]chan<- rpcMessage)
+	d.subs = nil
+	go d.writeLines(stdin, d.writes, d.closing)
+}
+
+// The writeLines method writes the lines of writes to stdin, on its own goroutine, so that a daemon that stops
+// reading its stdin only blocks this goroutine, never the callers of d. It stops on the first error, and closes
+// stdin once closing is closed and the lines waiting are written.
+func (d *daemon) writeLines(stdin io.WriteCloser, writes <-chan []byte, closing <-chan struct{}) {
+	defer stdin.Close()
+	for {
+		select {
+		case line := <-writes:
+			if _, err := stdin.Write(line); err != nil {
+				d.log.Debug("Error writing to plugin daemon.", "err", err)
+				return
+			}
+		case <-closing:
+			for {
+				select {
+				case line := <-writes:
+					if _, err := stdin.Write(line); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// The closeInput method has the stdin of d closed, once the lines waiting are written.
+func (d *daemon) closeInput() {
+	d.Lock()
+	defer d.Unlock()
+	if d.closing != nil {
+		close(d.closing)
+		d.closing = nil
+	}
+}
+
+// The stop method fails the calls waiting for d, after its process stopped.
+func (d *daemon) stop() {
+	d.Lock()
+	defer d.Unlock()
+	for _, ch := range d.pending {
+		close(ch)
+	}
+	if d.closing != nil {
+		close(d.closing)
+	}
+	d.cmd, d.writes, d.closing, d.pending, d.subs = nil, nil, nil, nil, nil
+	select {
+	case <-d.ready:
+		d.ready = make(chan struct{})
+	default:
+	}
+}
+
+// The wait method waits up to timeout for d to be initialized, returning whether it is.
+func (d *daemon) wait(timeout time.Duration) bool {
+	d.Lock()
+	ready := d.ready
+	d.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// The subscribe method sets the events sent to d.
+func (d *daemon) subscribe(events []string) {
+	d.Lock()
+	defer d.Unlock()
+	d.subs = make(map[string]bool)
+	for _, event := range events {
+		d.subs[strings.ToLower(event)] = true
+	}
+}
+
+// The subscribed method returns whether d subscribed to events of the given type.
+func (d *daemon) subscribed(event string) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.subs[event]
+}
+
+// Small utility function that encodes m as a single line of JSON.
+func rpcLine(m rpcMessage) ([]byte, error) {
+	line, err := json.Marshal(m)
+	return append(line, '\n'), err
+}
+
+// The write method queues m to be written to the stdin of d, as a single line.
+// It never waits, and fails when d has too many lines waiting, since then it stopped reading its stdin.
+func (d *daemon) write(m rpcMessage) error {
+	line, err := rpcLine(m)
+	if err != nil {
+		return fmt.Errorf("Error encoding plugin daemon message: %w", err)
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.writes == nil {
+		return errors.New("Error writing to plugin daemon: it isn't running.")
+	}
+	select {
+	case d.writes <- line:
+		return nil
+	default:
+		return errors.New("Error writing to plugin daemon: it doesn't read its input.")
+	}
+}
+
+// The notify method sends a notification to d.
+func (d *daemon) notify(method string, params interface{}) error {
+	return d.write(rpcMessage{JSONRPC: rpcVersion, Method: method, Params: params})
+}
+
+// The call method calls method on d and decodes its result into result.
+// A daemon that doesn't read the call or answer it within timeout is killed, so that it's restarted.
+func (d *daemon) call(method string, params interface{}, result interface{}, timeout time.Duration) error {
+	ch := make(chan rpcMessage, 1)
+	d.Lock()
+	if d.writes == nil {
+		d.Unlock()
+		return errors.New("Error calling plugin daemon: it isn't running.")
+	}
+	d.nextID++
+	id := strconv.FormatInt(d.nextID, 10)
+	line, err := rpcLine(rpcMessage{JSONRPC: rpcVersion, ID: json.RawMessage(id), Method: method, Params: params})
+	if err != nil {
+		d.Unlock()
+		return fmt.Errorf("Error encoding plugin daemon message: %w", err)
+	}
+	d.pending[id] = ch
+	cmd, writes := d.cmd, d.writes
+	d.Unlock()
+	// The call is queued without holding the lock, since the writer may be stuck on a daemon that doesn't read.
+	// The channel of the call is closed when the daemon stops in the meantime.
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case writes <- line:
+	case <-ch:
+		return errors.New("Error calling plugin daemon: it stopped.")
+	case <-timer.C:
+		killGroup(cmd)
+		return fmt.Errorf("Error calling plugin daemon: timed out after %s.", timeout)
+	}
+	select {
+	case m, ok := <-ch:
+		if !ok {
+			return errors.New("Error calling plugin daemon: it stopped.")
+		}
+		if m.Error != nil {
+			return fmt.Errorf("Error calling plugin daemon: %w", m.Error)
+		}
+		if err := json.Unmarshal(m.Result, result); err != nil {
+			return fmt.Errorf("Error decoding plugin daemon result: %w", err)
+		}
+		return nil
+	case <-timer.C:
+		killGroup(cmd)
+		return fmt.Errorf("Error calling plugin daemon: timed out after %s.", timeout)
+	}
+}
+
+// The respond method hands the response m to the call waiting for it.
+func (d *daemon) respond(m rpcMessage) {
+	d.Lock()
+	defer d.Unlock()
+	id := string(m.ID)
+	if ch, ok := d.pending[id]; ok {
+		ch <- m
+		delete(d.pending, id)
+		return
+	}
+	d.log.Warn("Unexpected response from plugin daemon.", "id", id)
+}
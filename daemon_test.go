@@ -0,0 +1,198 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Daemon that counts the commands it gets, says it saw each message and exits on "crash".
+// It would also say it saw each join, but it doesn't subscribe to them.
+const counterDaemon = `n=0
+while read -r line; do
+	id=$(printf '%s\n' "$line" | sed -n 's/.*"id":\([0-9]*\).*/\1/p')
+	case "$line" in
+	*'"method":"initialize"'*)
+		echo '{"jsonrpc":"2.0","id":'$id',"result":{"events":["message"]}}';;
+	*'"args":["crash"]'*)
+		exit 3;;
+	*'"method":"command"'*)
+		n=$((n+1))
+		echo '{"jsonrpc":"2.0","id":'$id',"result":{"version":2,"actions":[{"type":"say","text":"Count '$n'."}]}}';;
+	*'"type":"join"'*)
+		echo '{"jsonrpc":"2.0","method":"send","params":{"target":"#f1","text":"Joined."}}';;
+	*'"method":"event"'*)
+		echo '{"jsonrpc":"2.0","id":"s1","method":"send","params":{"target":"#f1","text":"Seen."}}';;
+	*'"method":"shutdown"'*)
+		exit 0;;
+	esac
+done
+`
+
+func TestDaemon(t *testing.T) {
+	b := newTestBot(t, nil)
+	folder := config.PluginsFolder
+	config.PluginsFolder = t.TempDir()
+	config.Plugins = map[string]PluginConfig{"counter": {"daemon": true}}
+	config.PluginTimeout, config.PluginOutput, config.PluginConcurrency = 5, 64, 2
+	defer func() {
+		config.PluginsFolder, config.Plugins = folder, nil
+		registry.RefreshPlugins(t.TempDir())
+	}()
+	writePlugin(t, "counter", counterDaemon)
+	if err := registry.RefreshPlugins(config.PluginsFolder); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.ctx = ctx
+	b.startDaemons()
+	d := b.daemon("Counter")
+	if d == nil {
+		t.Fatal("counter isn't running as a daemon")
+	}
+	run := func(args ...string) []string {
+		ctx, r := newFakeContext("gluon", "#f1", args...)
+		ctx.Log = b.logger.trackErrors()
+		b.cmdPlugin(ctx, "counter", make(chan bool, 1))
+		return r.messages
+	}
+	// The daemon may still be starting, or restarting after the crash, so the first count is waited for.
+	waitCount := func() {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if got := run(); reflect.DeepEqual(got, []string{"reply Count 1."}) {
+				return
+			}
+		}
+		t.Fatal("the daemon didn't start")
+	}
+	waitCount()
+	if got := run(); !reflect.DeepEqual(got, []string{"reply Count 2."}) {
+		t.Errorf("second command replied %q, want the daemon to keep counting", got)
+	}
+	b.notifyDaemons(pluginEvent{Type: "join", Channel: "#f1", Nick: "gluon", Time: time.Now()})
+	b.notifyDaemons(pluginEvent{Type: "message", Channel: "#f1", Nick: "gluon", Text: "Hi.", Time: time.Now()})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if lines := queuedLines(b); len(lines) > 0 {
+			if !reflect.DeepEqual(lines, []string{"PRIVMSG #f1 :Seen."}) {
+				t.Errorf("daemon sent %q, want a single message", lines)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the daemon didn't send anything")
+		}
+	}
+	if got := run("crash"); !reflect.DeepEqual(got, []string{"reply Error executing plugin."}) {
+		t.Errorf("crash replied %q", got)
+	}
+	waitCount()
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		b.work.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(pluginKillGrace):
+		t.Error("the daemon didn't stop when the bot shut down")
+	}
+}
+
+// Daemon that answers initialize, notes that it started and then never reads its stdin again.
+const stuckDaemon = `read -r line
+id=$(printf '%s\n' "$line" | sed -n 's/.*"id":\([0-9]*\).*/\1/p')
+echo '{"jsonrpc":"2.0","id":'$id',"result":{"events":["message"]}}'
+echo started >> starts
+exec sleep 60
+`
+
+func TestDaemonNotReading(t *testing.T) {
+	b := newTestBot(t, nil)
+	folder := config.PluginsFolder
+	config.PluginsFolder = t.TempDir()
+	config.Plugins = map[string]PluginConfig{"stuck": {"daemon": true}}
+	config.PluginTimeout, config.PluginOutput, config.PluginConcurrency = 1, 64, 2
+	defer func() {
+		config.PluginsFolder, config.Plugins = folder, nil
+		registry.RefreshPlugins(t.TempDir())
+	}()
+	writePlugin(t, "stuck", stuckDaemon)
+	if err := registry.RefreshPlugins(config.PluginsFolder); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.ctx = ctx
+	b.startDaemons()
+	d := b.daemon("stuck")
+	if d == nil || !d.wait(5*time.Second) {
+		t.Fatal("stuck didn't start as a daemon")
+	}
+	starts := func() int {
+		data, _ := os.ReadFile(filepath.Join(config.PluginsFolder, pluginDataFolder, "stuck", "starts"))
+		return strings.Count(string(data), "started")
+	}
+	// Each message is larger than the buffer of a pipe, so the daemon stops taking them right away.
+	// Then the lines waiting pile up until the daemon counts as stuck, and is killed and restarted.
+	text := strings.Repeat("x", 70*1024)
+	for deadline := time.Now().Add(10 * time.Second); starts() < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the daemon wasn't restarted after it stopped reading")
+		}
+		b.notifyDaemons(pluginEvent{Type: "message", Channel: "#f1", Nick: "gluon", Text: text, Time: time.Now()})
+		// Nothing waits on the daemon while holding its lock, so the daemon can always be looked at.
+		locked := make(chan struct{})
+		go func() {
+			d.subscribed("message")
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(time.Second):
+			t.Fatal("the lock of the daemon is held while it doesn't read")
+		}
+	}
+	// Commands fail once their timeout is up, instead of waiting for the daemon forever.
+	start := time.Now()
+	c, r := newFakeContext("gluon", "#f1")
+	c.Log = b.logger.trackErrors()
+	b.cmdPlugin(c, "stuck", make(chan bool, 1))
+	if !reflect.DeepEqual(r.messages, []string{"reply Error executing plugin."}) || time.Since(start) > 3*time.Second {
+		t.Errorf("command replied %q after %s", r.messages, time.Since(start))
+	}
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		b.work.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * pluginKillGrace):
+		t.Error("the daemon didn't stop when the bot shut down")
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// Type that represents a message sent to a channel while a game is running on it.
+type gameAnswer struct {
+	Nick string
+	Text string
+}
+
+// Type that represents a game, like a poll or a quiz, running on a channel.
+// The game reads the messages of the channel from answers until it's over or stopped.
+type Game struct {
+	Kind     string // Kind of game, poll or quiz.
+	Channel  string
+	Nick     string // Nick of the user who started the game.
+	Mask     string // Identity mask of the user who started the game, which can stop it even after a nick change.
+	answers  chan gameAnswer
+	stop     chan struct{} // Closed when the game is stopped before it's over.
+	aborted  bool          // Bool to check if the game was stopped because the bot is shutting down, set before stop is closed.
+	done     chan struct{} // Closed when the game is over.
+	stopOnce sync.Once
+}
+
+// The Stop method asks the game to end before it's over.
+func (g *Game) Stop() {
+	g.stopOnce.Do(func() { close(g.stop) })
+}
+
+// The Abort method stops the game because the bot is shutting down, which the game announces.
+func (g *Game) Abort() {
+	g.stopOnce.Do(func() {
+		g.aborted = true
+		close(g.stop)
+	})
+}
+
+// Type that represents the games running on the channels of a network, at most one on each channel.
+// Games on different channels are independent, so one channel can run a quiz while another runs a poll.
+type Games struct {
+	sync.Mutex
+	games map[string]*Game // Games indexed by lower case channel.
+}
+
+// The newGames function creates an empty set of games.
+func newGames() *Games {
+	return &Games{games: make(map[string]*Game)}
+}
+
+// The Start method starts a game of a kind on a channel, started by the user with nick and identity mask.
+// If a game is already running on the channel, it returns that game and false.
+func (g *Games) Start(kind string, channel string, nick string, mask string) (game *Game, ok bool) {
+	g.Lock()
+	defer g.Unlock()
+	if game, ok := g.games[strings.ToLower(channel)]; ok {
+		return game, false
+	}
+	game = &Game{
+		Kind:    kind,
+		Channel: channel,
+		Nick:    nick,
+		Mask:    mask,
+		answers: make(chan gameAnswer, 16),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	g.games[strings.ToLower(channel)] = game
+	return game, true
+}
+
+// The End method removes a game that is over, so that a new one can start on its channel.
+func (g *Games) End(game *Game) {
+	g.Lock()
+	defer g.Unlock()
+	if g.games[strings.ToLower(game.Channel)] == game {
+		delete(g.games, strings.ToLower(game.Channel))
+	}
+	close(game.done)
+}
+
+// The Get method returns the game running on a channel, ignoring case.
+func (g *Games) Get(channel string) (game *Game, ok bool) {
+	g.Lock()
+	defer g.Unlock()
+	game, ok = g.games[strings.ToLower(channel)]
+	return
+}
+
+// The Abort method aborts every game, since the bot is shutting down.
+func (g *Games) Abort() {
+	g.Lock()
+	defer g.Unlock()
+	for _, game := range g.games {
+		game.Abort()
+	}
+}
+
+// The Answer method sends a message to the game running on a channel.
+// It returns false when there is no game on the channel, so the message should be handled as a regular message.
+func (g *Games) Answer(channel string, nick string, text string) bool {
+	game, ok := g.Get(channel)
+	if !ok {
+		return false
+	}
+	select {
+	case game.answers <- gameAnswer{nick, text}:
+	case <-game.done:
+	}
+	return true
+}
+
+// The stopGame method stops the game of a kind running on the channel of a context.
+// Only the user who started the game, matched by identity rather than by nick, and moderators can stop it.
+func (b *Bot) stopGame(ctx *Context, kind string) {
+	game, ok := b.games.Get(ctx.Channel)
+	if !ok || game.Kind != kind {
+		ctx.Reply("There's no " + kind + " running on this channel.")
+		return
+	}
+	if !matchMask(game.Mask, ctx.Source, ctx.Account) && ctx.Role < RoleModerator {
+		ctx.Reply("Only " + game.Nick + " or a moderator can stop this " + kind + ".")
+		return
+	}
+	game.Stop()
+}
@@ -3,10 +3,12 @@ module gitlab.com/vascocosta/schumacher
 go 1.17
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/briandowns/openweathermap v0.16.0
 	github.com/gocolly/colly v1.2.0
 	github.com/mmcdole/gofeed v1.1.3
 	github.com/thoj/go-ircevent v0.0.0-20210723090443-73e444401d64
+	go.etcd.io/bbolt v1.3.6
 	mvdan.cc/xurls/v2 v2.3.0
 )
 
@@ -27,6 +29,7 @@ require (
 	github.com/saintfish/chardet v0.0.0-20120816061221-3af4cd4741ca // indirect
 	github.com/temoto/robotstxt v1.1.2 // indirect
 	golang.org/x/net v0.0.0-20210614182718-04defd469f4e // indirect
+	golang.org/x/sys v0.10.0 // indirect
 	golang.org/x/text v0.3.6 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 )
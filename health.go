@@ -0,0 +1,283 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	stableTime     = 5 * time.Minute  // Time a connection must last for the reconnection backoff to start over.
+	rejoinDelay    = 10 * time.Second // Time before rejoining a channel the bot was kicked from.
+	rejoinInterval = time.Minute      // Time between checks for configured channels the bot isn't on.
+	shutdownTime   = 15 * time.Second // Time given to commands, tasks and the send queue to finish when shutting down.
+	quitTime       = 5 * time.Second  // Time given to the server to close the connection after QUIT.
+)
+
+// Type that represents the health of the connection of a bot, which the supervisor keeps up to date.
+// Background tasks wait on it while the bot is offline, and the health command reports it.
+type Health struct {
+	sync.Mutex
+	online     chan struct{}   // Go channel closed while the bot is online, replaced by an open one when it goes offline.
+	connected  bool            // Bool to check if the bot is registered on the network.
+	started    bool            // Bool to check if the bot has ever been online.
+	since      time.Time       // Time the bot last went online or offline.
+	reconnects int             // Number of connections established after the first one.
+	attempts   int             // Number of failed attempts since the bot was last online.
+	lastError  error           // Last error that failed a connection attempt or dropped the connection.
+	lastPong   time.Time       // Time the server last answered a PING of the bot.
+	channels   map[string]bool // Channels the bot is on, by lower case name.
+}
+
+// The newHealth function creates the health of a bot that has never been online.
+func newHealth() *Health {
+	return &Health{online: make(chan struct{}), since: time.Now(), channels: make(map[string]bool)}
+}
+
+// The Online method returns whether the bot is registered on the network.
+func (h *Health) Online() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.connected
+}
+
+// The Wait method blocks until the bot is online, returning at once if it already is.
+// It returns false when ctx is cancelled first, which means the bot is shutting down.
+func (h *Health) Wait(ctx context.Context) bool {
+	h.Lock()
+	online := h.online
+	h.Unlock()
+	select {
+	case <-online:
+		return true
+	default:
+	}
+	select {
+	case <-online:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// The SetOnline method records that the bot registered on the network, resuming the tasks waiting for it.
+func (h *Health) SetOnline() {
+	h.Lock()
+	defer h.Unlock()
+	if h.connected {
+		return
+	}
+	if h.started {
+		h.reconnects++
+	}
+	h.started = true
+	h.connected = true
+	h.since = time.Now()
+	h.attempts = 0
+	close(h.online)
+}
+
+// The SetOffline method records that the connection was lost or couldn't be established because of err.
+// Tasks waiting for the bot block from now on, and the bot is no longer on any channel.
+func (h *Health) SetOffline(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastError = err
+	h.channels = make(map[string]bool)
+	if !h.connected {
+		h.attempts++
+		return
+	}
+	h.connected = false
+	h.since = time.Now()
+	h.online = make(chan struct{})
+}
+
+// The Pong method records that the server answered a PING, which shows the connection is alive.
+func (h *Health) Pong() {
+	h.Lock()
+	defer h.Unlock()
+	h.lastPong = time.Now()
+}
+
+// Type that represents a snapshot of the health of a bot, as reported by the /healthz endpoint.
+type HealthStatus struct {
+	Network    string     `json:"network"`
+	Connected  bool       `json:"connected"`
+	Since      time.Time  `json:"since"`               // Time the bot last went online or offline.
+	LastPong   *time.Time `json:"last_pong,omitempty"` // Time of the last PONG, nil before the first one.
+	Reconnects int        `json:"reconnects"`
+	LastError  string     `json:"last_error,omitempty"`
+	Storage    string     `json:"storage"` // ok, or the error that the storage returned.
+}
+
+// The Status method returns a snapshot of the connection, without the network and storage which the bot fills in.
+func (h *Health) Status() HealthStatus {
+	h.Lock()
+	defer h.Unlock()
+	status := HealthStatus{Connected: h.connected, Since: h.since, Reconnects: h.reconnects}
+	if !h.lastPong.IsZero() {
+		lastPong := h.lastPong
+		status.LastPong = &lastPong
+	}
+	if h.lastError != nil {
+		status.LastError = h.lastError.Error()
+	}
+	return status
+}
+
+// The Joined method records that the bot is on channel.
+func (h *Health) Joined(channel string) {
+	h.Lock()
+	defer h.Unlock()
+	h.channels[strings.ToLower(channel)] = true
+}
+
+// The Parted method records that the bot left or was kicked from channel.
+func (h *Health) Parted(channel string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.channels, strings.ToLower(channel))
+}
+
+// The Missing method returns the channels out of configured that the bot isn't on.
+func (h *Health) Missing(configured []string) (missing []string) {
+	h.Lock()
+	defer h.Unlock()
+	for _, channel := range configured {
+		if channel != "" && !h.channels[strings.ToLower(channel)] {
+			missing = append(missing, channel)
+		}
+	}
+	return
+}
+
+// The Channels method returns the channels the bot is on, sorted by name.
+func (h *Health) Channels() []string {
+	h.Lock()
+	defer h.Unlock()
+	channels := make([]string, 0, len(h.channels))
+	for channel := range h.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// The Report method describes the health of the connection, given the channels the bot should be on.
+func (h *Health) Report(configured []string) string {
+	missing := h.Missing(configured)
+	channels := h.Channels()
+	h.Lock()
+	defer h.Unlock()
+	var report string
+	if h.connected {
+		report = fmt.Sprintf("Online for %s, %d reconnects. Channels: %s.", time.Since(h.since).Round(time.Second), h.reconnects, strings.Join(channels, " "))
+		if len(missing) > 0 {
+			report += " Missing: " + strings.Join(missing, " ") + "."
+		}
+	} else {
+		report = fmt.Sprintf("Offline for %s, %d failed attempts.", time.Since(h.since).Round(time.Second), h.attempts)
+	}
+	if h.lastError != nil {
+		report += " Last error: " + h.lastError.Error() + "."
+	}
+	return report
+}
+
+// Small utility function that returns the delay before the next of attempts failed connection attempts.
+// The delay starts at min and doubles on each attempt, up to max.
+func backoff(attempts int, min time.Duration, max time.Duration) time.Duration {
+	delay := min
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Small utility function that writes a raw line to conn.
+// The supervisor may close the connection at any time, so a line written after that is dropped instead of panicking.
+func sendRaw(conn *irc.Connection, line string) {
+	defer func() {
+		if recover() != nil {
+			defaultLogger.Debug("Connection closed, dropping line.", "line", line)
+		}
+	}()
+	conn.SendRaw(line)
+}
+
+// The trackChannels method adds the IRC callbacks that keep the channels of the bot up to date on its health.
+// When the bot is kicked from one of the configured channels, it rejoins it after rejoinDelay.
+func (b *Bot) trackChannels(conn *irc.Connection) {
+	conn.AddCallback("JOIN", func(event *irc.Event) {
+		if strings.EqualFold(event.Nick, b.currentNick()) && len(event.Arguments) > 0 {
+			b.health.Joined(event.Arguments[0])
+		}
+	})
+	conn.AddCallback("PART", func(event *irc.Event) {
+		if strings.EqualFold(event.Nick, b.currentNick()) && len(event.Arguments) > 0 {
+			b.health.Parted(event.Arguments[0])
+		}
+	})
+	conn.AddCallback("KICK", func(event *irc.Event) {
+		if len(event.Arguments) < 2 || !strings.EqualFold(event.Arguments[1], b.currentNick()) {
+			return
+		}
+		channel := event.Arguments[0]
+		b.health.Parted(channel)
+		b.logger.Warn("Kicked.", "channel", channel, "nick", event.Nick, "reason", event.Message())
+		if b.configured(channel) {
+			time.AfterFunc(rejoinDelay, func() {
+				if b.health.Online() {
+					sendRaw(conn, "JOIN "+channel)
+				}
+			})
+		}
+	})
+}
+
+// The status method returns the health of the bot, checking that its storage can be read.
+func (b *Bot) status() HealthStatus {
+	status := b.health.Status()
+	status.Network = b.config.Name
+	status.Storage = "ok"
+	err := b.store.View(func(tx *Tx) error {
+		_, err := tx.Rows(eventsFile)
+		return err
+	})
+	if err != nil {
+		status.Storage = err.Error()
+	}
+	return status
+}
+
+// The cmdHealth method handles the health command, which reports the state of the connection of the bot.
+func (b *Bot) cmdHealth(ctx *Context) {
+	ctx.Reply(fmt.Sprintf("%s (%s): %s Queued lines: %d.", b.config.Name, b.config.Server, b.health.Report(b.channels()), b.queue.Len()))
+}
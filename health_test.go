@@ -0,0 +1,90 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	min, max := 5*time.Second, time.Minute
+	for attempts, want := range []time.Duration{
+		5 * time.Second, 5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute,
+	} {
+		if got := backoff(attempts, min, max); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	h := newHealth()
+	waited := make(chan struct{})
+	go func() {
+		if h.Wait(context.Background()) {
+			close(waited)
+		}
+	}()
+	h.SetOffline(errors.New("connection refused"))
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while offline")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if report := h.Report(nil); !strings.Contains(report, "Offline") || !strings.Contains(report, "1 failed attempts") {
+		t.Errorf("Report() = %q while offline", report)
+	}
+	h.SetOnline()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return once online")
+	}
+	h.Joined("#F1")
+	if missing := h.Missing([]string{"#f1", "#motorsport"}); len(missing) != 1 || missing[0] != "#motorsport" {
+		t.Errorf("Missing() = %q, want [#motorsport]", missing)
+	}
+	h.Parted("#f1")
+	if missing := h.Missing([]string{"#f1"}); len(missing) != 1 {
+		t.Errorf("Missing() = %q after parting, want [#f1]", missing)
+	}
+	// Losing the connection leaves every channel, and the next connection counts as a reconnect.
+	h.Joined("#f1")
+	h.SetOffline(errors.New("EOF"))
+	if h.Online() || len(h.Missing([]string{"#f1"})) != 1 {
+		t.Error("the bot is still online or on #f1 after disconnecting")
+	}
+	h.SetOnline()
+	h.Joined("#f1")
+	if report := h.Report([]string{"#f1"}); !strings.Contains(report, "Online") || !strings.Contains(report, "1 reconnects") ||
+		!strings.Contains(report, "Channels: #f1.") || !strings.Contains(report, "Last error: EOF.") {
+		t.Errorf("Report() = %q after reconnecting", report)
+	}
+	// Tasks waiting for the bot give up when it shuts down while offline.
+	h.SetOffline(errors.New("EOF"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if h.Wait(ctx) {
+		t.Error("Wait() = true after the context was cancelled while offline")
+	}
+}
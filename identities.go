@@ -0,0 +1,317 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	whoxToken      = "152"           // Token of our WHOX queries, so that replies to other WHO queries are ignored.
+	resolveTimeout = 5 * time.Second // Time to wait for the services account of a nick to be looked up.
+)
+
+// Type that represents what is known about the person using a nick on the network.
+type identity struct {
+	source   string        // Hostmask of the nick, as nick!user@host.
+	account  string        // Services account, empty when the nick isn't logged in.
+	resolved bool          // The account is known, so an empty account means the nick isn't logged in.
+	done     chan struct{} // Closed when a pending lookup of the account ends, nil without one.
+}
+
+// Type that represents the identities of the nicks seen on a network.
+// They are kept up to date from JOIN (with extended-join), ACCOUNT (account-notify), WHOX and WHOIS replies,
+// and follow the person when the nick changes, so that a nick alone is never taken as proof of who someone is.
+type Identities struct {
+	sync.Mutex
+	nicks  map[string]*identity // Identities indexed by lower case nick.
+	lookup func(nick string)    // Sends a query for the account of a nick, answered through the IRC callbacks.
+}
+
+// The newIdentities function creates an empty set of identities, which uses lookup to query unknown accounts.
+func newIdentities(lookup func(nick string)) *Identities {
+	return &Identities{nicks: make(map[string]*identity), lookup: lookup}
+}
+
+// The Reset method forgets every identity and sends future queries with lookup, since a new connection starts over.
+// Pending lookups end at once, as their replies won't come through the new connection.
+func (ids *Identities) Reset(lookup func(nick string)) {
+	ids.Lock()
+	defer ids.Unlock()
+	for _, id := range ids.nicks {
+		if id.done != nil {
+			close(id.done)
+		}
+	}
+	ids.nicks = make(map[string]*identity)
+	ids.lookup = lookup
+}
+
+func (ids *Identities) get(nick string) *identity {
+	id, ok := ids.nicks[strings.ToLower(nick)]
+	if !ok {
+		id = &identity{}
+		ids.nicks[strings.ToLower(nick)] = id
+	}
+	return id
+}
+
+// The Seen method records the hostmask of a nick, as nick!user@host.
+func (ids *Identities) Seen(nick string, source string) {
+	ids.Lock()
+	defer ids.Unlock()
+	if source != "" {
+		ids.get(nick).source = source
+	}
+}
+
+// The SetAccount method records the services account of a nick, where an empty account, "*" or "0" mean none.
+func (ids *Identities) SetAccount(nick string, account string) {
+	ids.Lock()
+	defer ids.Unlock()
+	if account == "*" || account == "0" {
+		account = ""
+	}
+	id := ids.get(nick)
+	id.account = account
+	id.resolved = true
+	if id.done != nil {
+		close(id.done)
+		id.done = nil
+	}
+}
+
+// The LookupDone method marks the lookup of a nick as over, leaving it without an account if none was found.
+func (ids *Identities) LookupDone(nick string) {
+	ids.Lock()
+	id, ok := ids.nicks[strings.ToLower(nick)]
+	pending := ok && id.done != nil
+	ids.Unlock()
+	if pending {
+		ids.SetAccount(nick, "")
+	}
+}
+
+// The Rename method moves the identity of a nick to its new nick.
+func (ids *Identities) Rename(old string, nick string) {
+	ids.Lock()
+	defer ids.Unlock()
+	id, ok := ids.nicks[strings.ToLower(old)]
+	if !ok {
+		return
+	}
+	delete(ids.nicks, strings.ToLower(old))
+	if i := strings.Index(id.source, "!"); i >= 0 {
+		id.source = nick + id.source[i:]
+	}
+	ids.nicks[strings.ToLower(nick)] = id
+}
+
+// The Forget method removes the identity of a nick that left the network.
+func (ids *Identities) Forget(nick string) {
+	ids.Lock()
+	defer ids.Unlock()
+	if id, ok := ids.nicks[strings.ToLower(nick)]; ok && id.done != nil {
+		close(id.done)
+	}
+	delete(ids.nicks, strings.ToLower(nick))
+}
+
+// The Get method returns the hostmask and services account of a nick, and weather the account is known.
+func (ids *Identities) Get(nick string) (source string, account string, resolved bool) {
+	ids.Lock()
+	defer ids.Unlock()
+	if id, ok := ids.nicks[strings.ToLower(nick)]; ok {
+		return id.source, id.account, id.resolved
+	}
+	return
+}
+
+// The Resolve method returns the services account of a nick, looking it up when it isn't known yet.
+// It waits up to timeout for the lookup, or returns right away when timeout is 0 (the lookup goes on anyway).
+func (ids *Identities) Resolve(nick string, timeout time.Duration) (account string, resolved bool) {
+	ids.Lock()
+	id := ids.get(nick)
+	if id.resolved || ids.lookup == nil {
+		ids.Unlock()
+		return id.account, id.resolved
+	}
+	if id.done == nil {
+		id.done = make(chan struct{})
+		if ids.lookup != nil {
+			ids.lookup(nick)
+		}
+	}
+	done := id.done
+	ids.Unlock()
+	if timeout > 0 {
+		select {
+		case <-done:
+		case <-time.After(timeout):
+		}
+	}
+	_, account, resolved = ids.Get(nick)
+	return
+}
+
+// The NickOf method returns the nick currently used by a registered user, found by matching its mask.
+func (ids *Identities) NickOf(user User) (nick string, ok bool) {
+	ids.Lock()
+	defer ids.Unlock()
+	if user.Mask == "" {
+		return
+	}
+	for _, id := range ids.nicks {
+		if matchMask(user.Mask, id.source, id.account) {
+			return id.source[:strings.Index(id.source+"!", "!")], true
+		}
+	}
+	return
+}
+
+// Small utility function that returns the mask that identifies a user: its account when it has one, or its hostmask.
+// The nick is left out of the hostmask, so that the user can change nick.
+func identityMask(source string, account string) string {
+	if account != "" {
+		return "$a:" + account
+	}
+	if i := strings.Index(source, "!"); i >= 0 {
+		return "*" + source[i:]
+	}
+	return ""
+}
+
+// The trackIdentities method adds the IRC callbacks that keep the identities of the bot up to date.
+// Accounts are taken from extended-join and account-notify when the server supports them, which are requested after
+// registration, and otherwise looked up with WHOX (or WHOIS, on servers without WHOX) as nicks join or run commands.
+func (b *Bot) trackIdentities() {
+	var whox bool
+	conn := b.conn
+	b.idents.Reset(func(nick string) {
+		if whox {
+			sendRaw(conn, fmt.Sprintf("WHO %s %%tuhna,%s", nick, whoxToken))
+		} else {
+			sendRaw(conn, "WHOIS "+nick)
+		}
+	})
+	conn.AddCallback("001", func(event *irc.Event) {
+		conn.SendRaw("CAP REQ :account-notify extended-join")
+	})
+	conn.AddCallback("005", func(event *irc.Event) {
+		for _, token := range event.Arguments {
+			if token == "WHOX" {
+				whox = true
+			}
+		}
+	})
+	conn.AddCallback("JOIN", func(event *irc.Event) {
+		if strings.EqualFold(event.Nick, b.currentNick()) {
+			return
+		}
+		b.idents.Seen(event.Nick, event.Source)
+		if len(event.Arguments) >= 3 {
+			b.idents.SetAccount(event.Nick, event.Arguments[1]) // Extended join: channel, account and real name.
+		} else {
+			b.idents.Resolve(event.Nick, 0)
+		}
+	})
+	conn.AddCallback("366", func(event *irc.Event) {
+		if whox && len(event.Arguments) > 1 {
+			conn.SendRawf("WHO %s %%tuhna,%s", event.Arguments[1], whoxToken)
+		}
+	})
+	conn.AddCallback("354", func(event *irc.Event) {
+		// WHOX reply with the fields in the fixed order of the protocol: token, user, host, nick and account.
+		if len(event.Arguments) == 6 && event.Arguments[1] == whoxToken {
+			nick := event.Arguments[4]
+			b.idents.Seen(nick, nick+"!"+event.Arguments[2]+"@"+event.Arguments[3])
+			b.idents.SetAccount(nick, event.Arguments[5])
+		}
+	})
+	conn.AddCallback("315", func(event *irc.Event) {
+		if len(event.Arguments) > 1 {
+			b.idents.LookupDone(event.Arguments[1])
+		}
+	})
+	conn.AddCallback("311", func(event *irc.Event) {
+		if len(event.Arguments) > 3 {
+			nick := event.Arguments[1]
+			b.idents.Seen(nick, nick+"!"+event.Arguments[2]+"@"+event.Arguments[3])
+		}
+	})
+	conn.AddCallback("330", func(event *irc.Event) {
+		if len(event.Arguments) > 2 {
+			b.idents.SetAccount(event.Arguments[1], event.Arguments[2])
+		}
+	})
+	conn.AddCallback("318", func(event *irc.Event) {
+		if len(event.Arguments) > 1 {
+			b.idents.LookupDone(event.Arguments[1])
+		}
+	})
+	conn.AddCallback("ACCOUNT", func(event *irc.Event) {
+		if len(event.Arguments) > 0 {
+			b.idents.Seen(event.Nick, event.Source)
+			b.idents.SetAccount(event.Nick, event.Arguments[0])
+		}
+	})
+	conn.AddCallback("NICK", func(event *irc.Event) {
+		b.idents.Rename(event.Nick, event.Message())
+	})
+	conn.AddCallback("QUIT", func(event *irc.Event) {
+		b.idents.Forget(event.Nick)
+	})
+}
+
+// The setIdentity method fills the source and account of a command from the identities of the bot.
+// Accounts sent on the account tag of the message take precedence, otherwise an unknown account is looked up.
+// It returns weather the account is known, without waiting for the lookup.
+func (b *Bot) setIdentity(command *Command, event *irc.Event) (resolved bool) {
+	b.idents.Seen(event.Nick, event.Source)
+	if account, ok := event.Tags["account"]; ok {
+		b.idents.SetAccount(event.Nick, account)
+	}
+	command.Source = event.Source
+	command.Account, resolved = b.idents.Resolve(event.Nick, 0)
+	return
+}
+
+// The findUser method returns the registered user running a command, matched by account or hostmask.
+// Users registered before identities existed are only matched by the services account with their name, and are
+// then bound to it. The account is waited for when it isn't known.
+func (b *Bot) findUser(ctx *Context) (user User, ok bool, err error) {
+	account, _ := b.idents.Resolve(ctx.Nick, resolveTimeout)
+	if account != "" {
+		ctx.Account = account
+	}
+	err = b.store.Update(func(tx *Tx) (err error) {
+		user, ok, err = tx.Users().Identify(ctx.Source, ctx.Account)
+		if err != nil || !ok || user.Mask != "" {
+			return
+		}
+		user.Mask = identityMask("", ctx.Account)
+		return tx.Users().Put(user)
+	})
+	return
+}
@@ -0,0 +1,175 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdentities(t *testing.T) {
+	var ids *Identities
+	var lookups []string
+	ids = newIdentities(func(nick string) {
+		lookups = append(lookups, nick)
+		// The reply comes later through the IRC callbacks, which run on their own goroutine.
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			if nick == "alice" {
+				ids.SetAccount(nick, "Alice")
+			}
+			ids.LookupDone(nick)
+		}()
+	})
+	ids.Seen("alice", "alice!~alice@example.com")
+	if account, resolved := ids.Resolve("alice", time.Second); account != "Alice" || !resolved {
+		t.Errorf("Resolve(alice) = %q, %v, want Alice", account, resolved)
+	}
+	if account, resolved := ids.Resolve("bob", time.Second); account != "" || !resolved {
+		t.Errorf("Resolve(bob) = %q, %v, want no account", account, resolved)
+	}
+	ids.Resolve("alice", time.Second)
+	if len(lookups) != 2 {
+		t.Errorf("lookups = %q, want one for each nick", lookups)
+	}
+	// The identity follows the person across nick changes, until the account is logged out.
+	ids.Rename("alice", "alice_away")
+	source, account, _ := ids.Get("alice_away")
+	if source != "alice_away!~alice@example.com" || account != "Alice" {
+		t.Errorf("Get(alice_away) = %q, %q", source, account)
+	}
+	if _, account, resolved := ids.Get("alice"); account != "" || resolved {
+		t.Errorf("Get(alice) = %q, %v, want nothing", account, resolved)
+	}
+	if nick, ok := ids.NickOf(User{Nick: "alice", Mask: "$a:alice"}); !ok || nick != "alice_away" {
+		t.Errorf("NickOf(alice) = %q, %v, want alice_away", nick, ok)
+	}
+	ids.SetAccount("alice_away", "*")
+	if _, ok := ids.NickOf(User{Nick: "alice", Mask: "$a:alice"}); ok {
+		t.Error("NickOf(alice) after logging out should find nobody")
+	}
+	ids.Forget("alice_away")
+	if source, _, _ := ids.Get("alice_away"); source != "" {
+		t.Errorf("Get(alice_away) after quitting = %q", source)
+	}
+}
+
+func TestFindUser(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{
+		usersFile: {
+			{"alice", "Europe/Lisbon", "0", ""},
+			{"bob", "Europe/Berlin", "0", ""},  // Registered by nick only.
+			{"dave", "Europe/Berlin", "0", ""}, // Registered by nick only.
+		},
+		identitiesFile: {{"alice", "$a:alice"}},
+	})
+	tests := []struct {
+		nick    string
+		source  string
+		account string
+		want    string
+	}{
+		{"alice", "alice!~x@example.com", "", ""}, // Taking the nick isn't enough.
+		{"alice_", "alice_!~alice@example.com", "alice", "alice"},
+		{"bob", "bob!~bob@bob.example.com", "", ""},          // Users registered by nick aren't bound to the first one using it.
+		{"bob", "bob!~impostor@example.com", "impostor", ""}, // Nor to another account.
+		{"bob_", "bob_!~bob@bob.example.com", "bob", "bob"},  // The services account named after them binds them.
+		{"bob", "bob!~bob@bob.example.com", "", ""},
+		{"bobby", "bobby!~x@example.com", "bob", "bob"},
+		{"dave", "dave!~dave@example.com", "", ""},
+		{"carol", "carol!~carol@example.com", "carol", ""},
+	}
+	for _, test := range tests {
+		ctx, _ := newFakeContext(test.nick, "#f1")
+		ctx.Source, ctx.Account = test.source, test.account
+		user, ok, err := b.findUser(ctx)
+		if err != nil || ok != (test.want != "") || user.Nick != test.want {
+			t.Errorf("findUser(%s, %s, %q) = %q, %v, %v, want %q", test.nick, test.source, test.account, user.Nick, ok, err, test.want)
+		}
+	}
+	// The users file keeps the 4 columns that the plugins read and write, and the masks go to the identities file.
+	users, _ := readCSV(b.config.path(usersFile))
+	for _, user := range users {
+		if len(user) != 4 {
+			t.Errorf("got user row %q, want 4 columns", user)
+		}
+	}
+	identities, _ := readCSV(b.config.path(identitiesFile))
+	if len(identities) != 2 || strings.Join(identities[1], ",") != "bob,$a:bob" {
+		t.Errorf("got identities %q", identities)
+	}
+}
+
+func TestCmdRegister(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{
+		usersFile:      {{"alice", "Europe/Lisbon", "0", ""}, {"bob", "Europe/Berlin", "0", ""}},
+		identitiesFile: {{"alice", "$a:alice"}},
+	})
+	tests := []struct {
+		nick    string
+		account string
+		want    string
+	}{
+		{"alice", "", "This nick is registered by someone else."},
+		{"bob", "", "This nick was registered before identities, identify with services as bob or ask an admin to bind it."},
+		{"bob", "bob", "You're already registered as bob."},
+		{"alice_", "alice", "You're already registered as alice."},
+		{"carol", "carol", "Your nick was successfully registered."},
+		{"carol_", "carol", "You're already registered as carol."},
+	}
+	for _, test := range tests {
+		ctx, r := newFakeContext(test.nick, "#f1")
+		ctx.Source, ctx.Account = test.nick+"!~user@example.com", test.account
+		b.cmdRegister(ctx)
+		if !r.contains(test.want) {
+			t.Errorf("cmdRegister(%s, %q): got %q, want %q", test.nick, test.account, r.replies(), test.want)
+		}
+	}
+}
+
+func TestCmdBind(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{
+		usersFile: {{"bob", "Europe/Berlin", "0", ""}},
+	})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"bob", "bob"}, "Invalid mask, use a hostmask like nick!user@host or an account like $a:account."},
+		{[]string{"carol", "$a:carol"}, "carol isn't a registered user."},
+		{[]string{"BOB", "*!~bob@bob.example.com"}, "Bound BOB to *!~bob@bob.example.com."},
+	}
+	for _, test := range tests {
+		ctx, r := newFakeContext("alice", "#f1", test.args...)
+		ctx.Role = RoleAdmin
+		b.cmdBind(ctx)
+		if !r.contains(test.want) {
+			t.Errorf("cmdBind(%q): got %q, want %q", test.args, r.replies(), test.want)
+		}
+	}
+	// Once bound, the owner is found by the mask, and whoever else takes the nick isn't.
+	for source, want := range map[string]bool{"bob!~bob@bob.example.com": true, "bob!~impostor@example.com": false} {
+		ctx, _ := newFakeContext("bob", "#f1")
+		ctx.Source = source
+		if _, ok, err := b.findUser(ctx); err != nil || ok != want {
+			t.Errorf("findUser(%s) = %v, %v, want %v", source, ok, err, want)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type that represents the severity of a log record, with the same values as the levels of log/slog.
+type Level int
+
+const (
+	LevelDebug Level = -4 // Details that are only useful when looking into a problem.
+	LevelInfo  Level = 0  // Normal operation, like connections and commands.
+	LevelWarn  Level = 4  // Something went wrong, but the bot carried on.
+	LevelError Level = 8  // Something failed, like a command that couldn't do its job.
+)
+
+var defaultLogger = newLogger(os.Stderr, LevelInfo, false) // Logger used by the whole bot, set up from the config.
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Small utility function that parses the name of a level, ignoring case.
+func parseLevel(name string) (Level, error) {
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown level %q, expected debug, info, warn or error.", name)
+}
+
+// Type that represents where the records of a logger and of the loggers derived from it are written.
+type logOutput struct {
+	sync.Mutex
+	w     io.Writer
+	level Level // Records below this level are discarded.
+	json  bool  // Records are written as JSON objects instead of key=value text.
+}
+
+// Type that represents a structured logger in the style of log/slog.
+// Every record has a time, a level, a message and key-value attributes, and With returns a logger that adds
+// attributes to each of its records, which is how the network, channel, nick and command get on every line.
+// A nil logger writes to the default logger, so contexts built without one can still log.
+type Logger struct {
+	out   *logOutput
+	attrs []interface{} // Key-value pairs added to every record.
+	errs  *int32        // Records logged at the error level, only counted by loggers returned by trackErrors.
+}
+
+// The newLogger function creates a logger that writes the records of level and above to w, as text or JSON.
+func newLogger(w io.Writer, level Level, json bool) *Logger {
+	return &Logger{out: &logOutput{w: w, level: level, json: json}}
+}
+
+// The With method returns a logger that adds the key-value pairs of args to every record.
+func (l *Logger) With(args ...interface{}) *Logger {
+	if l == nil {
+		l = defaultLogger
+	}
+	attrs := make([]interface{}, 0, len(l.attrs)+len(args))
+	return &Logger{out: l.out, attrs: append(append(attrs, l.attrs...), args...), errs: l.errs}
+}
+
+// The trackErrors method returns a logger that counts the records it logs at the error level, even when they're discarded.
+// This is how the metrics tell a command that failed from one that succeeded.
+func (l *Logger) trackErrors() *Logger {
+	l = l.With()
+	l.errs = new(int32)
+	return l
+}
+
+// The Failed method returns whether a record was logged at the error level since trackErrors.
+func (l *Logger) Failed() bool {
+	return l != nil && l.errs != nil && atomic.LoadInt32(l.errs) > 0
+}
+
+func (l *Logger) Debug(msg string, args ...interface{}) { l.log(LevelDebug, msg, args) }
+func (l *Logger) Info(msg string, args ...interface{})  { l.log(LevelInfo, msg, args) }
+func (l *Logger) Warn(msg string, args ...interface{})  { l.log(LevelWarn, msg, args) }
+func (l *Logger) Error(msg string, args ...interface{}) { l.log(LevelError, msg, args) }
+
+// The Enabled method returns whether records of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	if l == nil {
+		l = defaultLogger
+	}
+	l.out.Lock()
+	defer l.out.Unlock()
+	return level >= l.out.level
+}
+
+// The log method writes a record with the attributes of the logger followed by the key-value pairs of args.
+// A key without a value, or a value that isn't preceded by a string key, is written under the !BADKEY key like slog does.
+func (l *Logger) log(level Level, msg string, args []interface{}) {
+	if l == nil {
+		l = defaultLogger
+	}
+	if level >= LevelError && l.errs != nil {
+		atomic.AddInt32(l.errs, 1)
+	}
+	if !l.Enabled(level) {
+		return
+	}
+	attrs := append(append([]interface{}{}, l.attrs...), args...)
+	var buf bytes.Buffer
+	now := time.Now()
+	l.out.Lock()
+	defer l.out.Unlock()
+	if l.out.json {
+		buf.WriteString("{")
+		writeJSON(&buf, "time", now.Format(time.RFC3339Nano))
+		buf.WriteString(",")
+		writeJSON(&buf, "level", level.String())
+		buf.WriteString(",")
+		writeJSON(&buf, "msg", msg)
+		forEachAttr(attrs, func(key string, value interface{}) {
+			buf.WriteString(",")
+			writeJSON(&buf, key, logValue(value))
+		})
+		buf.WriteString("}\n")
+	} else {
+		buf.WriteString("time=" + now.Format(time.RFC3339) + " level=" + level.String() + " msg=" + quoteText(msg))
+		forEachAttr(attrs, func(key string, value interface{}) {
+			buf.WriteString(" " + key + "=" + quoteText(fmt.Sprint(logValue(value))))
+		})
+		buf.WriteString("\n")
+	}
+	l.out.w.Write(buf.Bytes())
+}
+
+// The Writer method returns a writer that logs each line written to it as a record of level.
+// It lets the standard log package, used by the IRC library, write through the logger.
+func (l *Logger) Writer(level Level) io.Writer {
+	return logWriter{l, level}
+}
+
+// Type that represents a writer that logs each line written to it.
+type logWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			w.logger.log(w.level, line, nil)
+		}
+	}
+	return len(p), nil
+}
+
+// Small utility function that calls fn with each key-value pair of attrs.
+func forEachAttr(attrs []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(attrs); i++ {
+		key, ok := attrs[i].(string)
+		if !ok || i+1 == len(attrs) {
+			fn("!BADKEY", attrs[i])
+			continue
+		}
+		fn(key, attrs[i+1])
+		i++
+	}
+}
+
+// Small utility function that returns how a value is logged: errors and durations as their text.
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+// Small utility function that writes a JSON key and value, falling back to the text of values JSON can't encode.
+func writeJSON(buf *bytes.Buffer, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(k)
+	buf.WriteString(":")
+	buf.Write(v)
+}
+
+// Small utility function that quotes a text value when it's empty or has spaces, quotes or equal signs.
+func quoteText(s string) string {
+	if s == "" || strings.ContainsAny(s, " \"=\t\r\n") || !strconv.CanBackquote(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Type that represents a log file that is rotated once it grows past a maximum size.
+// The current file keeps its name, and the previous ones get .1, .2 and so on, up to backups of them.
+type rotatingFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// The openRotatingFile function opens a log file for appending, rotating it after maxSize bytes.
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening log file %s: %w", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Error opening log file %s: %w", f.path, err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// The rotate method moves the current file to .1, shifting the older ones, and starts a new one.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.backups))
+	for i := f.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.backups > 0 {
+		os.Rename(f.path, f.path+".1")
+	} else {
+		os.Remove(f.path)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// The setupLogging function sets up the default logger from the config, and sends the standard log package through it.
+func setupLogging(c Config) error {
+	level, err := parseLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stderr
+	if c.LogFile != "" {
+		w, err = openRotatingFile(c.LogFile, int64(c.LogMaxSize)*1024*1024, c.LogMaxBackups)
+		if err != nil {
+			return err
+		}
+	}
+	defaultLogger = newLogger(w, level, strings.EqualFold(c.LogFormat, "json"))
+	log.SetFlags(0)
+	log.SetOutput(defaultLogger.Writer(LevelInfo))
+	return nil
+}
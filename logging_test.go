@@ -0,0 +1,121 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, LevelInfo, false).With("network", "libera")
+	logger.Debug("Hidden.")
+	logger.With("nick", "gluon").Error("Error getting users.", "err", fmt.Errorf("Error reading users.csv: %w", os.ErrNotExist), "took", 2*time.Second)
+	logger.Info("Odd.", "key")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2: %q", len(lines), buf.String())
+	}
+	for _, want := range []string{
+		`level=ERROR msg="Error getting users." network=libera nick=gluon err="Error reading users.csv: file does not exist" took=2s`,
+		`level=INFO msg=Odd. network=libera !BADKEY=key`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log %q doesn't contain %q", buf.String(), want)
+		}
+	}
+	if !strings.HasPrefix(lines[0], "time=") {
+		t.Errorf("line %q doesn't start with the time", lines[0])
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, LevelDebug, true).With("network", "libera")
+	logger.Debug("Command done.", "command", "next", "role", RoleAdmin, "duration", time.Millisecond, "err", errors.New("boom"))
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid JSON %q: %s", buf.String(), err)
+	}
+	for key, want := range map[string]interface{}{
+		"level":    "DEBUG",
+		"msg":      "Command done.",
+		"network":  "libera",
+		"command":  "next",
+		"role":     RoleAdmin.String(),
+		"duration": "1ms",
+		"err":      "boom",
+	} {
+		if record[key] != want {
+			t.Errorf("%s = %v, want %v", key, record[key], want)
+		}
+	}
+}
+
+func TestLoggerWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, LevelInfo, false)
+	fmt.Fprint(logger.Writer(LevelWarn), "first line\nsecond line\n")
+	fmt.Fprint(logger.Writer(LevelDebug), "hidden line\n")
+	if got := strings.Count(buf.String(), "level=WARN"); got != 2 || strings.Contains(buf.String(), "hidden") {
+		t.Errorf("Writer logged %q", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "Warn": LevelWarn, "error": LevelError} {
+		if got, err := parseLevel(name); err != nil || got != want {
+			t.Errorf("parseLevel(%q) = %s, %v, want %s", name, got, err, want)
+		}
+	}
+	if _, err := parseLevel("verbose"); err == nil {
+		t.Error("parseLevel(\"verbose\") didn't fail")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.file.Close()
+	for name, want := range map[string]string{"": "dddddddd\n", ".1": "cccccccc\n", ".2": "bbbbbbbb\n"} {
+		data, err := os.ReadFile(path + name)
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", filepath.Base(path+name), data, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("kept more than 2 backups")
+	}
+}
@@ -19,114 +19,167 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
-	"time"
-
-	irc "github.com/thoj/go-ircevent"
+	"sync"
+	"syscall"
 )
 
-var nick = "Schumacher"                           // Nick to be used by the bot.
-var channels = "#motorsport"                      // Names of the channels to join.
-var adminNick = "gluon"                           // Nick used by the admin of the bot.
-var inputFile = "/home/gluon/mnt/schumacher/in"   // File used to read messages.
-var outputFile = "/home/gluon/mnt/schumacher/out" // File used to output messages.
-var poll bool                                     // Bool to check if a poll is on.
-var quiz bool                                     // Bool to check if a quiz is on.
-var activeChannel string                          // The active channel.
+var config Config // Configuration of the bot.
 
-// The main function handles flags, defines some IRC callbacks to handle events and launches background tasks.
+// The main function handles flags and config, then creates and runs a bot for each network.
 func main() {
-	flag.StringVar(&nick, "nick", "Schumacher", "Nick to be used by the bot.")
-	flag.StringVar(&channels, "channels", "#motorsport", "Names of the channels to join.")
+	var nick, channels string
+	configFile := flag.String("config", "schumacher.toml", "Path to the config file.")
+	flag.StringVar(&nick, "nick", "", "Nick to be used by the bot on every network (overrides the config).")
+	flag.StringVar(&channels, "channels", "", "Names of the channels to join on every network (overrides the config).")
+	importFlag := flag.Bool("import", false, "Import the CSV files of every network using the bolt storage into its database and exit.")
 	flag.Parse()
-	c := make(chan [2]string)
-	irccon := irc.IRC(nick, nick)
-	irccon.AddCallback("001", func(event *irc.Event) {
-		irccon.Join(channels)
+	// The config file is only mandatory when its path was explicitly given on the command line.
+	// Flags are applied on top of the config file and the environment, then everything is validated.
+	var required bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			required = true
+		}
 	})
-	irccon.AddCallback("366", func(event *irc.Event) {})
-	err := irccon.Connect(server)
+	var err error
+	config, err = loadConfig(*configFile, required)
 	if err != nil {
-		fmt.Printf("Err %s", err)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	irccon.AddCallback("PRIVMSG", func(event *irc.Event) {
-		// Every message, except the ones from the bot itself, are sent to an output file.
-		// We try to parse a command from every PRIVMSG that the bot sees on each channel.
-		// If we cannot parse a command, this means the message is just a regular message.
-		// So we need to check if there's an ongoing poll or quiz or an embedded HTTP URL.
-		// In case there's an ongoing poll or quiz, we send the nick/message to a channel.
-		// Otherwise, if the message contains "http", we try to obtain its HTML title tag.
-		// Finally, if we successfully parse a command, we call the matching cmd function.
-		err = writeOut(outputFile, event.Arguments[0]+" "+event.Nick+" "+event.Message()+"\n")
-		if err != nil {
-			log.Println("main:", err)
+	for i := range config.Networks {
+		if nick != "" {
+			config.Networks[i].Nick = nick
+		}
+		if channels != "" {
+			config.Networks[i].Channels = channels
+		}
+	}
+	if problems := config.validate(); len(problems) > 0 {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, "  "+problem)
+		}
+		os.Exit(1)
+	}
+	if *importFlag {
+		os.Exit(importNetworks())
+	}
+	if err := setupLogging(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, network := range config.Networks {
+		if len(network.ownerMasks()) == 0 {
+			defaultLogger.Warn("No owners set, use owners or admin_nick to set them.", "network", network.Name)
+		}
+	}
+	for _, err := range moduleTableErrors {
+		defaultLogger.Error("Invalid module table.", "err", err)
+	}
+	// Built-in commands, modules and plugins are registered once and shared by every network.
+	for _, def := range append(builtinCommands(), moduleCommands(modules)...) {
+		if err := registry.Register(def); err != nil {
+			defaultLogger.Error("Error registering command.", "command", def.Name, "err", err)
+		}
+	}
+	if err := registry.RefreshPlugins(config.PluginsFolder); err != nil {
+		defaultLogger.Error("Error loading plugins.", "err", err)
+	}
+	// Each network runs on its own goroutine, sharing the plugins and global settings.
+	// Each bot supervises its own connection, so that one network can't take the others down.
+	// SIGINT or SIGTERM shut every bot down gracefully, and a second signal kills the program right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		watchPlugins(ctx)
+	}()
+	var bots []*Bot
+	for _, network := range config.Networks {
+		if needsImport(network) {
+			defaultLogger.Warn("The folder has CSV files but no database yet, run the bot with -import to copy them.", "network", network.Name)
 		}
-		m := strings.Trim(event.Message(), " ")
-		command, err := parseCommand(m, event.Nick, event.Arguments[0])
+		store, err := openStore(network)
 		if err != nil {
-			if poll || quiz {
-				if activeChannel == event.Arguments[0] {
-					c <- [2]string{event.Nick, event.Message()}
-				}
-			} else if strings.Contains(strings.ToLower(event.Message()), "http") {
-				go tskHTMLTitle(irccon, event.Arguments[0], event.Message())
+			fmt.Fprintf(os.Stderr, "%s: %s\n", network.Name, err)
+			os.Exit(1)
+		}
+		for _, problem := range checkStore(store) {
+			defaultLogger.Warn("Invalid row.", "network", network.Name, "err", problem)
+		}
+		bots = append(bots, newBot(network, store))
+	}
+	for _, b := range bots {
+		wg.Add(1)
+		go func(b *Bot) {
+			defer wg.Done()
+			b.run(ctx)
+		}(b)
+	}
+	// The HTTP server and the local API are optional, and a failure to start them doesn't stop the bots.
+	for _, server := range []struct {
+		addr    string
+		handler http.Handler
+	}{
+		{config.HTTPListen, newHTTPHandler(bots)},
+		{config.APIListen, newAPIHandler(bots, config.APIToken)},
+	} {
+		if server.addr == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(addr string, handler http.Handler) {
+			defer wg.Done()
+			if err := serveHTTP(ctx, addr, handler); err != nil {
+				defaultLogger.Error("Error serving HTTP.", "addr", addr, "err", err)
 			}
-		} else {
-			switch strings.ToLower(command.Name) {
-			case "a", "ask":
-				cmdAsk(irccon, command.Channel, command.Args)
-			case "c", "h", "commands", "help":
-				cmdHelp(irccon, command.Channel, strings.Join(command.Args, ""))
-			case "n", "next":
-				cmdNext(irccon, command.Channel, command.Nick, strings.Join(command.Args, " "))
-			case "ny", "notify":
-				cmdNotify(irccon, command.Channel, command.Nick, command.Args)
-			case "b", "bet":
-				cmdBet(irccon, command.Channel, command.Nick, command.Args)
-			case "p", "poll":
-				if !poll && !quiz {
-					go cmdPoll(irccon, command.Channel, c, strings.Join(command.Args, " "))
-				}
-            /*
-			case "pb", "processbets":
-				cmdProcessBets(irccon, command.Channel, command.Nick)
-            */
-			case "qz", "quiz":
-				if !quiz && !poll {
-					go cmdQuiz(irccon, command.Channel, c, strings.Join(command.Args, " "))
+		}(server.addr, server.handler)
+	}
+	wg.Wait()
+	// Every bot is done writing, so the stores can be flushed and closed.
+	closeStores()
+	defaultLogger.Info("Shut down.")
+}
+
+// The importNetworks function imports the CSV files of every network using the bolt storage into its database.
+// It returns the exit status of the program, which is 1 if any import failed.
+func importNetworks() (status int) {
+	defer closeStores()
+	for _, network := range config.Networks {
+		if !strings.EqualFold(network.Storage, "bolt") {
+			continue
+		}
+		// Invalid rows are imported as they are, but reported so that they can be fixed.
+		for _, problem := range checkStore(newCSVStore(network.Folder, 0)) {
+			fmt.Fprintf(os.Stderr, "%s: Invalid row: %s\n", network.Name, problem)
+		}
+		store, err := openStore(network)
+		if err == nil {
+			var imported map[string]int
+			imported, err = importCSV(network.Folder, store)
+			for _, table := range tables {
+				if n, ok := imported[table]; ok {
+					fmt.Printf("%s: imported %d rows from %s.\n", network.Name, n, table)
 				}
-			case "q", "quote":
-				cmdQuote(irccon, command.Channel, command.Args)
-            /*
-                case "rr", "register":
-                    cmdRegister(irccon, command.Channel, command.Nick)
-                case "wbc", "points":
-                    go cmdStandings(irccon, command.Channel, command.Nick, "bet")
-            */
-			case "wdc":
-				go cmdStandings(irccon, command.Channel, command.Nick, "driver")
-			case "wcc":
-				go cmdStandings(irccon, command.Channel, command.Nick, "constructor")
-			default:
-				finishedCh := make(chan bool)
-				go func() {
-					select {
-					case <-finishedCh:
-					case <-time.After(4 * time.Second):
-						irccon.Privmsg(command.Channel, "Command is taking long to run... Please wait.")
-					}
-				}()
-				go cmdPlugin(strings.ToLower(command.Name), irccon, command.Channel, command.Nick, command.Args, finishedCh)
 			}
 		}
-	})
-	// Here we launch some background tasks that run in parallel with the main goroutine.
-	go tskEvents(irccon)
-	go tskFeeds(irccon)
-	go tskWrite(irccon, inputFile)
-	irccon.Loop()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", network.Name, err)
+			status = 1
+		}
+	}
+	return
 }
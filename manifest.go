@@ -0,0 +1,187 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	manifestExt     = ".toml"          // Extension of the manifest files, named after the executable of their plugin.
+	pluginsInterval = 30 * time.Second // Time between refreshes of the plugins from the plugins folder.
+)
+
+// Type that represents the manifest of a plugin, a <name>.toml file next to its executable on the plugins folder,
+// which describes the command of the plugin for !help and sets who can run it and where. For instance:
+//
+//	name = "omdb"
+//	aliases = ["movie"]
+//	usage = "<title>"
+//	description = "Show the plot and rating of a movie."
+//	role = "user"
+//	reply = "public"
+//	channels = ["#movies"]
+//	timeout = 10
+//	protocol = 2
+type PluginManifest struct {
+	Name        string   `toml:"name"`        // Name of the command, which is the name of the executable.
+	Aliases     []string `toml:"aliases"`     // Other names of the command.
+	Usage       string   `toml:"usage"`       // Arguments of the command, shown by !help.
+	Description string   `toml:"description"` // Description of the command, shown by !help.
+	Role        string   `toml:"role"`        // Minimum role required to run the plugin, user by default.
+	Reply       string   `toml:"reply"`       // Where the replies go: public (the default), private or notice.
+	Channels    []string `toml:"channels"`    // Channels where the plugin runs, every channel and private messages when empty.
+	Timeout     int      `toml:"timeout"`     // Seconds the plugin may run, plugin_timeout by default.
+	Protocol    int      `toml:"protocol"`    // 1 for plain text, 2 for JSON, or 0 to tell them apart by the output.
+}
+
+// The loadManifest function reads and checks the manifest of the plugin with the executable file.
+// Unknown keys are an error, so that a typo doesn't go unnoticed.
+func loadManifest(path string, file string) (*PluginManifest, error) {
+	var manifest PluginManifest
+	md, err := toml.DecodeFile(path, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading plugin manifest %s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("Error reading plugin manifest %s: unknown key %s.", path, undecoded[0])
+	}
+	if err := manifest.validate(file); err != nil {
+		return nil, fmt.Errorf("Error reading plugin manifest %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// The validate method checks the settings of the manifest of the plugin with the executable file.
+func (m *PluginManifest) validate(file string) error {
+	if m.Name != "" && !strings.EqualFold(m.Name, file) {
+		return fmt.Errorf("name %q doesn't match the executable %q.", m.Name, file)
+	}
+	for _, alias := range m.Aliases {
+		if alias == "" || strings.ContainsAny(alias, " \t\r\n") {
+			return fmt.Errorf("invalid alias %q.", alias)
+		}
+	}
+	if m.Role != "" {
+		if _, err := parseRole(m.Role); err != nil {
+			return err
+		}
+	}
+	if m.Reply != "" {
+		if _, err := parseReplyMode(m.Reply); err != nil {
+			return err
+		}
+	}
+	for _, channel := range m.Channels {
+		if err := checkChannel(channel); err != nil {
+			return err
+		}
+	}
+	if m.Timeout < 0 {
+		return fmt.Errorf("timeout %d can't be negative.", m.Timeout)
+	}
+	if m.Protocol < 0 || m.Protocol > pluginProtocol {
+		return fmt.Errorf("unsupported protocol version %d, expected at most %d.", m.Protocol, pluginProtocol)
+	}
+	return nil
+}
+
+// Type that represents a plugin found on the plugins folder, whether it's registered as a command or not.
+type pluginInfo struct {
+	Name     string          // Name of the executable.
+	Manifest *PluginManifest // Manifest of the plugin, nil when it has none.
+	Modified int64           // Modification time of the manifest in nanoseconds, to reload it when it changes.
+	Disabled bool            // The plugin was disabled with !plugins disable.
+	Err      error           // Why the plugin couldn't be registered, if it couldn't.
+}
+
+// The status method returns a short description of the state of the plugin, for !plugins list.
+func (p pluginInfo) status() string {
+	switch {
+	case p.Disabled:
+		return "disabled"
+	case p.Err != nil:
+		return "broken"
+	case p.Manifest == nil:
+		return "no manifest"
+	default:
+		return "enabled"
+	}
+}
+
+// The watchPlugins function refreshes the plugins every pluginsInterval until ctx is cancelled, so that new, removed
+// and changed plugins and manifests are picked up without restarting the bot, even when no command misses them.
+func watchPlugins(ctx context.Context) {
+	ticker := time.NewTicker(pluginsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := registry.RefreshPlugins(config.PluginsFolder); err != nil {
+				defaultLogger.Debug("Error refreshing plugins.", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Small utility function that reads the names of the disabled plugins from the plugins folder, by lower case name.
+// A missing file means that no plugin is disabled.
+func readDisabledPlugins(folder string) (map[string]bool, error) {
+	disabled := make(map[string]bool)
+	f, err := os.Open(filepath.Join(folder, pluginsDisabled))
+	if errors.Is(err, os.ErrNotExist) {
+		return disabled, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading disabled plugins: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			disabled[strings.ToLower(name)] = true
+		}
+	}
+	return disabled, scanner.Err()
+}
+
+// Small utility function that writes the names of the disabled plugins to the plugins folder, one per line.
+func writeDisabledPlugins(folder string, disabled map[string]bool) error {
+	var names []string
+	for name := range disabled {
+		names = append(names, name+"\n")
+	}
+	sort.Strings(names)
+	err := os.WriteFile(filepath.Join(folder, pluginsDisabled), []byte(strings.Join(names, "")), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing disabled plugins: %w", err)
+	}
+	return nil
+}
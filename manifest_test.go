@@ -0,0 +1,185 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Small utility function that writes the manifest of a plugin to folder, a second later than the last one.
+func writeManifest(t *testing.T, folder string, name string, manifest string) {
+	t.Helper()
+	path := filepath.Join(folder, name+manifestExt)
+	if err := os.WriteFile(path, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(time.Second)
+	if info, err := os.Stat(path); err == nil && !info.ModTime().Before(modified) {
+		modified = info.ModTime().Add(time.Second)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	folder := t.TempDir()
+	for _, test := range []struct {
+		manifest string
+		err      string
+	}{
+		{"name = \"Omdb\"\naliases = [\"movie\"]\nrole = \"admin\"\nreply = \"Notice\"\nchannels = [\"#movies\"]\ntimeout = 5\nprotocol = 2\n", ""},
+		{"descripton = \"Typo.\"\n", "unknown key descripton"},
+		{"name = \"imdb\"\n", "doesn't match"},
+		{"aliases = [\"two words\"]\n", "invalid alias"},
+		{"role = \"king\"\n", "invalid role"},
+		{"reply = \"shout\"\n", "invalid reply"},
+		{"channels = [\"movies\"]\n", "invalid channel"},
+		{"timeout = -1\n", "can't be negative"},
+		{"protocol = 3\n", "unsupported protocol"},
+		{"name = \n", "Error reading plugin manifest"},
+	} {
+		writeManifest(t, folder, "omdb", test.manifest)
+		_, err := loadManifest(filepath.Join(folder, "omdb"+manifestExt), "omdb")
+		if (test.err == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("loadManifest(%q) = %v, want %q", test.manifest, err, test.err)
+		}
+	}
+}
+
+func TestRefreshPlugins(t *testing.T) {
+	folder := t.TempDir()
+	defer func() { config.PluginManifests = false }()
+	r := newRegistry()
+	r.Register(&CommandDef{Name: "help", Aliases: []string{"h"}})
+	writePluginTo := func(name string) {
+		if err := os.WriteFile(filepath.Join(folder, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"legacy", "omdb", "h", "broken"} {
+		writePluginTo(name)
+	}
+	writeManifest(t, folder, "omdb", "aliases = [\"movie\"]\ndescription = \"Movies.\"\nrole = \"moderator\"\nreply = \"private\"\nchannels = [\"#movies\"]\n")
+	writeManifest(t, folder, "broken", "role = \"king\"\n")
+	if err := r.RefreshPlugins(folder); err != nil {
+		t.Fatal(err)
+	}
+	status := func() map[string]string {
+		statuses := make(map[string]string)
+		for _, plugin := range r.Plugins() {
+			statuses[plugin.Name] = plugin.status()
+		}
+		return statuses
+	}
+	want := map[string]string{"legacy": "no manifest", "omdb": "enabled", "h": "broken", "broken": "broken"}
+	if got := status(); !reflect.DeepEqual(got, want) {
+		t.Errorf("plugins = %v, want %v", got, want)
+	}
+	def, ok := r.Lookup("movie")
+	if !ok || def.Name != "omdb" || def.Description != "Movies." || def.Role != RoleModerator || def.Reply != ReplyPrivate || !reflect.DeepEqual(def.Channels, []string{"#movies"}) {
+		t.Errorf("movie = %+v, want the omdb plugin from its manifest", def)
+	}
+	if def, ok := r.Lookup("h"); !ok || def.Plugin {
+		t.Error("a plugin shadowed the alias of a built-in command")
+	}
+	// A changed manifest is loaded again, and a disabled plugin is unregistered but still listed.
+	writeManifest(t, folder, "omdb", "aliases = [\"film\"]\n")
+	if err := r.EnablePlugin(folder, "OMDB", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Lookup("omdb"); ok {
+		t.Error("disabled plugin is still registered")
+	}
+	if got := status()["omdb"]; got != "disabled" {
+		t.Errorf("omdb is %s, want disabled", got)
+	}
+	if err := r.EnablePlugin(folder, "omdb", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Lookup("movie"); ok {
+		t.Error("alias of the old manifest is still registered")
+	}
+	if _, ok := r.Lookup("film"); !ok {
+		t.Error("alias of the new manifest isn't registered")
+	}
+	// Plugins without a manifest are left out when manifests are required, and removed plugins are unregistered.
+	config.PluginManifests = true
+	os.Remove(filepath.Join(folder, "omdb"))
+	if err := r.RefreshPlugins(folder); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"legacy", "omdb", "film"} {
+		if _, ok := r.Lookup(name); ok {
+			t.Errorf("%s is still registered", name)
+		}
+	}
+}
+
+func TestPluginsCommand(t *testing.T) {
+	b := newTestBot(t, nil)
+	folder := config.PluginsFolder
+	config.PluginsFolder = t.TempDir()
+	defer func() {
+		config.PluginsFolder = folder
+		registry.RefreshPlugins(t.TempDir())
+	}()
+	writePlugin(t, "omdb", "echo \"Movie.\"\n")
+	writePlugin(t, "legacy", "echo \"Legacy.\"\n")
+	writeManifest(t, config.PluginsFolder, "omdb", "channels = [\"#movies\"]\nprotocol = 1\n")
+	run := func(args ...string) []string {
+		ctx, r := newFakeContext("gluon", "#f1", args...)
+		ctx.Role = RoleAdmin
+		ctx.Log = b.logger.trackErrors()
+		b.cmdPlugins(ctx)
+		return r.messages
+	}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"reply Plugins: legacy (no manifest), omdb (enabled)."}},
+		{[]string{"disable", "Legacy"}, []string{"reply Disabled plugin legacy."}},
+		{[]string{"list"}, []string{"reply Plugins: legacy (disabled), omdb (enabled)."}},
+		{[]string{"enable", "nope"}, []string{"reply Unknown plugin nope."}},
+		{[]string{"enable", "legacy"}, []string{"reply Enabled plugin legacy."}},
+		{[]string{"reload"}, []string{"reply Reloaded 2 plugins."}},
+		{[]string{"remove", "legacy"}, []string{"reply Usage: !plugins [list/reload] or <enable/disable> <plugin>"}},
+	}
+	for _, test := range tests {
+		if got := run(test.args...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("plugins %q replied %q, want %q", test.args, got, test.want)
+		}
+	}
+	// The channels of the manifest are enforced when the plugin is dispatched.
+	def, ok := registry.Lookup("omdb")
+	if !ok {
+		t.Fatal("omdb isn't registered")
+	}
+	ctx, r := newFakeContext("gluon", "#f1")
+	ctx.Log = b.logger.trackErrors()
+	b.dispatch(ctx, def)
+	if want := []string{"reply This command only works on #movies."}; !reflect.DeepEqual(r.messages, want) {
+		t.Errorf("omdb on #f1 replied %q, want %q", r.messages, want)
+	}
+}
@@ -0,0 +1,227 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Upper bounds in seconds of the buckets of the histograms, the default buckets of Prometheus plus a slow one.
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics of every network, exposed on /metrics in the Prometheus text format.
+var (
+	metrics            = newMetrics()
+	commandsTotal      = metrics.counter("schumacher_commands_total", "Commands handled, by outcome.", "network", "command", "outcome")
+	pluginDuration     = metrics.histogram("schumacher_plugin_duration_seconds", "Time taken by plugin executions.", "network", "plugin")
+	pluginFailures     = metrics.counter("schumacher_plugin_failures_total", "Plugin executions that failed.", "network", "plugin")
+	feedDuration       = metrics.histogram("schumacher_feed_fetch_duration_seconds", "Time taken to fetch news feeds.", "network", "feed")
+	feedErrors         = metrics.counter("schumacher_feed_errors_total", "News feeds that couldn't be fetched.", "network", "feed")
+	queueLines         = metrics.gauge("schumacher_send_queue_lines", "Lines waiting on the send queue.", "network")
+	connectedGauge     = metrics.gauge("schumacher_connected", "Whether the bot is registered on the network.", "network")
+	reconnectsTotal    = metrics.counter("schumacher_reconnects_total", "Connections lost or failed that the bot reconnected after.", "network")
+	announcementsTotal = metrics.counter("schumacher_announcements_total", "Events announced on channels.", "network", "channel")
+)
+
+// Type that represents a set of metrics, along with functions that update the gauges right before they're written.
+type Metrics struct {
+	sync.Mutex
+	metrics    []*Metric
+	collectors []func()
+}
+
+// Type that represents a counter, gauge or histogram, with a series for each combination of its label values.
+type Metric struct {
+	sync.Mutex
+	name    string
+	help    string
+	kind    string // Type of the metric on the text format: counter, gauge or histogram.
+	labels  []string
+	buckets []float64 // Upper bounds of the buckets of a histogram.
+	series  map[string]*series
+}
+
+// Type that represents the value of a metric for some label values.
+type series struct {
+	values []string
+	value  float64  // Value of a counter or gauge, or the sum of the observations of a histogram.
+	counts []uint64 // Observations on each bucket of a histogram, not cumulative.
+	count  uint64   // Observations of a histogram.
+}
+
+// The newMetrics function creates an empty set of metrics.
+func newMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) counter(name string, help string, labels ...string) *Metric {
+	return m.add(&Metric{name: name, help: help, kind: "counter", labels: labels})
+}
+
+func (m *Metrics) gauge(name string, help string, labels ...string) *Metric {
+	return m.add(&Metric{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+func (m *Metrics) histogram(name string, help string, labels ...string) *Metric {
+	return m.add(&Metric{name: name, help: help, kind: "histogram", labels: labels, buckets: defaultBuckets})
+}
+
+func (m *Metrics) add(metric *Metric) *Metric {
+	metric.series = make(map[string]*series)
+	m.Lock()
+	defer m.Unlock()
+	m.metrics = append(m.metrics, metric)
+	return metric
+}
+
+// The Collect method adds a function that is called before the metrics are written, to update gauges like queue depths.
+func (m *Metrics) Collect(fn func()) {
+	m.Lock()
+	defer m.Unlock()
+	m.collectors = append(m.collectors, fn)
+}
+
+// The WriteTo method writes every metric on the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.Lock()
+	collectors := append([]func(){}, m.collectors...)
+	all := append([]*Metric{}, m.metrics...)
+	m.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+	var text strings.Builder
+	for _, metric := range all {
+		metric.write(&text)
+	}
+	n, err := io.WriteString(w, text.String())
+	return int64(n), err
+}
+
+// The get method returns the series of the label values, creating it when needed. The metric must be locked.
+func (m *Metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	key := strings.Join(values, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: append([]string{}, values...), counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// The Add method adds v to the counter or gauge with the label values.
+func (m *Metric) Add(v float64, values ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.get(values).value += v
+}
+
+// The Inc method adds one to the counter or gauge with the label values.
+func (m *Metric) Inc(values ...string) {
+	m.Add(1, values...)
+}
+
+// The Set method sets the gauge with the label values to v.
+func (m *Metric) Set(v float64, values ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.get(values).value = v
+}
+
+// The Observe method records an observation of v on the histogram with the label values.
+func (m *Metric) Observe(v float64, values ...string) {
+	m.Lock()
+	defer m.Unlock()
+	s := m.get(values)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.value += v
+	s.count++
+}
+
+// The write method writes the metric on the text format, with its series sorted by label values.
+func (m *Metric) write(text *strings.Builder) {
+	m.Lock()
+	defer m.Unlock()
+	fmt.Fprintf(text, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(text, "%s%s %s\n", m.name, m.labelText(s.values, ""), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(text, "%s_bucket%s %d\n", m.name, m.labelText(s.values, formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(text, "%s_bucket%s %d\n", m.name, m.labelText(s.values, "+Inf"), s.count)
+		fmt.Fprintf(text, "%s_sum%s %s\n", m.name, m.labelText(s.values, ""), formatValue(s.value))
+		fmt.Fprintf(text, "%s_count%s %d\n", m.name, m.labelText(s.values, ""), s.count)
+	}
+}
+
+// The labelText method formats the label values of a series, adding the le label of a bucket when it isn't empty.
+func (m *Metric) labelText(values []string, le string) string {
+	var pairs []string
+	for i, label := range m.labels {
+		pairs = append(pairs, label+"="+quoteLabel(values[i]))
+	}
+	if le != "" {
+		pairs = append(pairs, "le="+quoteLabel(le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Small utility function that quotes a label value, escaping backslashes, quotes and new lines.
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+// Small utility function that formats a sample value the way Prometheus expects it.
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,57 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	commands := m.counter("test_commands_total", "Commands handled.", "command", "outcome")
+	queue := m.gauge("test_queue_lines", "Lines queued.")
+	durations := m.histogram("test_duration_seconds", "Time taken.", "plugin")
+	commands.Inc("next", "ok")
+	commands.Inc("next", "ok")
+	commands.Inc("say \"hi\"", "error")
+	m.Collect(func() { queue.Set(3) })
+	durations.Observe(0.02, "f1")
+	durations.Observe(42, "f1")
+	var text strings.Builder
+	if _, err := m.WriteTo(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# HELP test_commands_total Commands handled.\n# TYPE test_commands_total counter\n",
+		`test_commands_total{command="next",outcome="ok"} 2`,
+		`test_commands_total{command="say \"hi\"",outcome="error"} 1`,
+		"# TYPE test_queue_lines gauge\ntest_queue_lines 3\n",
+		`test_duration_seconds_bucket{plugin="f1",le="0.01"} 0`,
+		`test_duration_seconds_bucket{plugin="f1",le="0.025"} 1`,
+		`test_duration_seconds_bucket{plugin="f1",le="30"} 1`,
+		`test_duration_seconds_bucket{plugin="f1",le="+Inf"} 2`,
+		`test_duration_seconds_sum{plugin="f1"} 42.02`,
+		`test_duration_seconds_count{plugin="f1"} 2`,
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, text.String())
+		}
+	}
+}
@@ -0,0 +1,509 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventTimeFormat = "2006-01-02 15:04:05 UTC"       // Format of the time of events.
+	feedTimeFormat  = "2006-01-02 15:04:05 +0000 UTC" // Format of the time of the last item of feeds.
+)
+
+// Type that represents a record that is stored as a row of a table, using the layout of its CSV file.
+// UnmarshalCSV validates the row, so a record is never loaded with missing or malformed fields.
+type Record interface {
+	MarshalCSV() []string
+	UnmarshalCSV(row []string) error
+}
+
+// Type that represents an invalid row of a table, with the file (or database bucket) and line where it was found.
+type RowError struct {
+	Source string
+	Line   int
+	Err    error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Source, e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// Type that represents a registered user of the bot.
+type User struct {
+	Nick     string
+	TimeZone string
+	Points   int
+	Channels []string // Channels where the user is mentioned when an event starts.
+	Mask     string   // Account ($a:account) or hostmask that identifies the user, kept on the identities table.
+}
+
+// Type that represents the bet of a user for a race.
+type Bet struct {
+	Race       string
+	Nick       string
+	First      string
+	Second     string
+	Third      string
+	FastestLap string
+	Points     int
+}
+
+// Type that represents the results of the last race, used to process the bets.
+type RaceResult struct {
+	Race      string
+	First     string
+	Second    string
+	Third     string
+	Processed string // Race whose bets were already processed, equal to Race once they are.
+}
+
+// Type that represents a driver that can be picked on a bet.
+type Driver struct {
+	Name string
+	Code string // Three letter code of the driver, for example VER.
+	Odds int    // Multiplier of the points scored when the driver is picked.
+}
+
+// Type that represents a motorsport event, like a session of a race weekend.
+type Event struct {
+	Category string // Category between square brackets, for example [Formula 1].
+	Name     string
+	Session  string
+	Time     time.Time
+	Channel  string // Channel where the event is announced.
+	Link     string
+	Notify   bool // Mention the users subscribed to the notifications of the channel.
+}
+
+// Type that represents a news feed and the time of the last item shown.
+type Feed struct {
+	Name     string
+	URL      string
+	Channel  string
+	LastTime time.Time
+}
+
+// Type that represents a quote added to a channel.
+type Quote struct {
+	Date    string
+	Text    string
+	Channel string
+}
+
+// Type that represents a question of the quiz of a channel.
+type Question struct {
+	Text    string
+	Answer  string
+	Channel string
+}
+
+// Type that represents one of the answers of the ask command.
+type Answer struct {
+	Text string
+}
+
+// Type that represents a role granted to the users matching a mask.
+// The mask is either a hostmask like nick!user@host, with * and ? wildcards, or a services account like $a:account.
+type RoleGrant struct {
+	Mask string
+	Role Role
+}
+
+// Type that represents the account or hostmask bound to the nick of a registered user.
+// Identities are kept apart from the users, since the users file is shared with plugins that only know its 4 columns.
+type Identity struct {
+	Nick string
+	Mask string
+}
+
+// Type that represents the settings of a channel, which apply on that channel instead of the ones of the network.
+// Empty settings fall back to the network, so a channel without settings behaves as before.
+// Each network has its own settings, since networks using the same folder share their storage.
+type ChannelSettings struct {
+	Network  string // Name of the network of the channel.
+	Channel  string
+	Joined   bool     // The bot is on the channel, set by the join command and cleared by the part command.
+	Category string   // Category of the events shown by next without arguments, for example Formula 1.
+	Commands []string // Commands enabled on the channel, all of them when empty.
+	Prefix   string   // Prefix of the commands on the channel, the prefix of the network when empty.
+	Feeds    bool     // News feeds are shown on the channel.
+	Titles   bool     // Titles of the links posted on the channel are shown.
+	Language string   // Language of the replies that support one, like the weather, English when empty.
+}
+
+func (g RoleGrant) MarshalCSV() []string {
+	return []string{g.Mask, g.Role.String()}
+}
+
+func (g *RoleGrant) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 2); err != nil {
+		return
+	}
+	if err = checkMask(row[0]); err != nil {
+		return
+	}
+	role, err := parseRole(row[1])
+	if err != nil {
+		return
+	}
+	*g = RoleGrant{Mask: row[0], Role: role}
+	return
+}
+
+// Small utility function that checks if a row has the number of columns of a table.
+func checkColumns(row []string, columns int) error {
+	if len(row) != columns {
+		return fmt.Errorf("expected %d columns, found %d.", columns, len(row))
+	}
+	return nil
+}
+
+// Small utility function that checks that none of the given fields is empty.
+// The fields are given as name and value pairs, so that the error can name the missing field.
+func checkRequired(fields ...string) error {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if strings.TrimSpace(fields[i+1]) == "" {
+			return errors.New("missing " + fields[i] + ".")
+		}
+	}
+	return nil
+}
+
+// Small utility function that parses a number field of a row.
+func parseNumber(name string, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q, expected a positive number.", name, value)
+	}
+	return n, nil
+}
+
+// Small utility function that checks if a name is a valid channel name.
+func checkChannel(channel string) error {
+	if len(channel) < 2 || !strings.ContainsAny(channel[:1], "#&") {
+		return fmt.Errorf("invalid channel %q.", channel)
+	}
+	return nil
+}
+
+func (u User) MarshalCSV() []string {
+	return []string{u.Nick, u.TimeZone, strconv.Itoa(u.Points), strings.Join(u.Channels, ":")}
+}
+
+func (u *User) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 4); err != nil {
+		return
+	}
+	if err = checkRequired("nick", row[0], "time zone", row[1]); err != nil {
+		return
+	}
+	points, err := parseNumber("points", row[2])
+	if err != nil {
+		return
+	}
+	*u = User{Nick: row[0], TimeZone: row[1], Points: points}
+	if row[3] != "" {
+		u.Channels = strings.Split(row[3], ":")
+	}
+	return
+}
+
+func (i Identity) MarshalCSV() []string {
+	return []string{i.Nick, i.Mask}
+}
+
+func (i *Identity) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 2); err != nil {
+		return
+	}
+	if err = checkRequired("nick", row[0]); err != nil {
+		return
+	}
+	if err = checkMask(row[1]); err != nil {
+		return
+	}
+	*i = Identity{Nick: row[0], Mask: row[1]}
+	return
+}
+
+func (b Bet) MarshalCSV() []string {
+	return []string{b.Race, b.Nick, b.First, b.Second, b.Third, b.FastestLap, strconv.Itoa(b.Points)}
+}
+
+func (b *Bet) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 7); err != nil {
+		return
+	}
+	err = checkRequired("race", row[0], "nick", row[1], "first driver", row[2], "second driver", row[3], "third driver", row[4], "fastest lap driver", row[5])
+	if err != nil {
+		return
+	}
+	points, err := parseNumber("points", row[6])
+	if err != nil {
+		return
+	}
+	*b = Bet{Race: row[0], Nick: row[1], First: row[2], Second: row[3], Third: row[4], FastestLap: row[5], Points: points}
+	return
+}
+
+func (r RaceResult) MarshalCSV() []string {
+	return []string{r.Race, r.First, r.Second, r.Third, r.Processed}
+}
+
+func (r *RaceResult) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 5); err != nil {
+		return
+	}
+	err = checkRequired("race", row[0], "first driver", row[1], "second driver", row[2], "third driver", row[3])
+	if err != nil {
+		return
+	}
+	*r = RaceResult{Race: row[0], First: row[1], Second: row[2], Third: row[3], Processed: row[4]}
+	return
+}
+
+// The IsProcessed method checks if the bets of the race were already processed.
+func (r RaceResult) IsProcessed() bool {
+	return strings.EqualFold(r.Race, r.Processed)
+}
+
+func (d Driver) MarshalCSV() []string {
+	return []string{d.Name, d.Code, strconv.Itoa(d.Odds)}
+}
+
+func (d *Driver) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 3); err != nil {
+		return
+	}
+	if err = checkRequired("code", row[1]); err != nil {
+		return
+	}
+	odds, err := parseNumber("odds", row[2])
+	if err != nil {
+		return
+	}
+	*d = Driver{Name: row[0], Code: row[1], Odds: odds}
+	return
+}
+
+func (e Event) MarshalCSV() []string {
+	notify := ""
+	if e.Notify {
+		notify = "notify"
+	}
+	return []string{e.Category, e.Name, e.Session, e.Time.UTC().Format(eventTimeFormat), e.Channel, e.Link, notify}
+}
+
+func (e *Event) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 7); err != nil {
+		return
+	}
+	if err = checkRequired("category", row[0], "name", row[1], "session", row[2]); err != nil {
+		return
+	}
+	t, err := time.Parse(eventTimeFormat, row[3])
+	if err != nil {
+		return fmt.Errorf("invalid time %q, expected the %s format.", row[3], eventTimeFormat)
+	}
+	if err = checkChannel(row[4]); err != nil {
+		return
+	}
+	if row[6] != "" && strings.ToLower(row[6]) != "notify" {
+		return fmt.Errorf("invalid notify field %q, expected notify or nothing.", row[6])
+	}
+	*e = Event{
+		Category: row[0],
+		Name:     row[1],
+		Session:  row[2],
+		Time:     t,
+		Channel:  row[4],
+		Link:     row[5],
+		Notify:   row[6] != "",
+	}
+	return
+}
+
+func (f Feed) MarshalCSV() []string {
+	lastTime := ""
+	if !f.LastTime.IsZero() {
+		lastTime = f.LastTime.UTC().Format(feedTimeFormat)
+	}
+	return []string{f.Name, f.URL, f.Channel, lastTime}
+}
+
+// The UnmarshalCSV method of Feed accepts an empty last time, for a feed that was never read.
+// Older versions of the bot wrote the last time in the local time zone, so that format is accepted too.
+func (f *Feed) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 4); err != nil {
+		return
+	}
+	if err = checkRequired("name", row[0]); err != nil {
+		return
+	}
+	if u, err := url.Parse(row[1]); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid URL %q.", row[1])
+	}
+	if err = checkChannel(row[2]); err != nil {
+		return
+	}
+	*f = Feed{Name: row[0], URL: row[1], Channel: row[2]}
+	if row[3] != "" {
+		f.LastTime, err = time.Parse(feedTimeFormat, row[3])
+		if err != nil {
+			f.LastTime, err = time.Parse("2006-01-02 15:04:05 -0700 MST", row[3])
+		}
+		if err != nil {
+			return fmt.Errorf("invalid last time %q, expected the %s format.", row[3], feedTimeFormat)
+		}
+	}
+	return
+}
+
+func (q Quote) MarshalCSV() []string {
+	return []string{q.Date, q.Text, q.Channel}
+}
+
+func (q *Quote) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 3); err != nil {
+		return
+	}
+	if err = checkRequired("text", row[1]); err != nil {
+		return
+	}
+	if err = checkChannel(row[2]); err != nil {
+		return
+	}
+	*q = Quote{Date: row[0], Text: row[1], Channel: row[2]}
+	return
+}
+
+func (q Question) MarshalCSV() []string {
+	return []string{q.Text, q.Answer, q.Channel}
+}
+
+func (q *Question) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 3); err != nil {
+		return
+	}
+	if err = checkRequired("question", row[0], "answer", row[1]); err != nil {
+		return
+	}
+	if err = checkChannel(row[2]); err != nil {
+		return
+	}
+	*q = Question{Text: row[0], Answer: row[1], Channel: row[2]}
+	return
+}
+
+func (a Answer) MarshalCSV() []string {
+	return []string{a.Text}
+}
+
+func (a *Answer) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 1); err != nil {
+		return
+	}
+	if err = checkRequired("answer", row[0]); err != nil {
+		return
+	}
+	*a = Answer{Text: row[0]}
+	return
+}
+
+func (c ChannelSettings) MarshalCSV() []string {
+	return []string{c.Network, c.Channel, onOff(c.Joined), c.Category, strings.Join(c.Commands, ":"), c.Prefix, onOff(c.Feeds), onOff(c.Titles), c.Language}
+}
+
+func (c *ChannelSettings) UnmarshalCSV(row []string) (err error) {
+	if err = checkColumns(row, 9); err != nil {
+		return
+	}
+	if err = checkRequired("network", row[0]); err != nil {
+		return
+	}
+	network, row := row[0], row[1:]
+	if err = checkChannel(row[0]); err != nil {
+		return
+	}
+	if strings.Contains(row[4], " ") {
+		return fmt.Errorf("invalid prefix %q, expected no spaces.", row[4])
+	}
+	if err = checkLanguage(row[7]); err != nil {
+		return
+	}
+	var flags [3]bool
+	for i, column := range []int{1, 5, 6} {
+		if flags[i], err = parseOnOff(row[column]); err != nil {
+			return
+		}
+	}
+	var commands []string
+	if row[3] != "" {
+		commands = strings.Split(row[3], ":")
+	}
+	*c = ChannelSettings{
+		Network:  network,
+		Channel:  row[0],
+		Joined:   flags[0],
+		Category: row[2],
+		Commands: commands,
+		Prefix:   row[4],
+		Feeds:    flags[1],
+		Titles:   flags[2],
+		Language: row[7],
+	}
+	return
+}
+
+// Small utility function that formats a bool field of a row as on or off.
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+// Small utility function that parses an on or off field of a row.
+func parseOnOff(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid switch %q, expected on or off.", value)
+}
+
+// Small utility function that checks if a language is empty or a code like en or pt_br.
+func checkLanguage(language string) error {
+	if len(language) > 5 || strings.Trim(strings.ToLower(language), "abcdefghijklmnopqrstuvwxyz_") != "" {
+		return fmt.Errorf("invalid language %q, expected a code like en or pt_br.", language)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	at := time.Date(2023, 5, 28, 13, 0, 0, 0, time.UTC)
+	tests := []Record{
+		&User{Nick: "alice", TimeZone: "Europe/Lisbon", Points: 10, Channels: []string{"#f1", "#motorsport"}},
+		&Bet{Race: "Monaco Grand Prix", Nick: "alice", First: "ver", Second: "ham", Third: "lec", FastestLap: "ver", Points: 25},
+		&RaceResult{Race: "Monaco Grand Prix", First: "ver", Second: "ham", Third: "lec", Processed: "Monaco Grand Prix"},
+		&Driver{Name: "Max Verstappen", Code: "ver", Odds: 1},
+		&Event{Category: "[Formula 1]", Name: "Monaco Grand Prix", Session: "Race", Time: at, Channel: "#f1", Notify: true},
+		&Feed{Name: "F1", URL: "https://example.com/rss", Channel: "#f1", LastTime: at},
+		&Quote{Date: "2023-05-28", Text: "Just leave me alone, I know what to do.", Channel: "#f1"},
+		&Question{Text: "Who won the 2021 title?", Answer: "Verstappen", Channel: "#f1"},
+		&Answer{Text: "Yes."},
+		&Identity{Nick: "alice", Mask: "$a:alice"},
+		&ChannelSettings{Network: "libera", Channel: "#f1", Joined: true, Category: "Formula 1", Commands: []string{"next", "bet"}, Prefix: ".", Titles: true, Language: "pt_br"},
+	}
+	for _, record := range tests {
+		decoded := reflect.New(reflect.TypeOf(record).Elem()).Interface().(Record)
+		err := decoded.UnmarshalCSV(record.MarshalCSV())
+		if err != nil {
+			t.Errorf("%T: %v", record, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, record) {
+			t.Errorf("%T: got %+v, want %+v", record, decoded, record)
+		}
+	}
+}
+
+func TestRecordValidation(t *testing.T) {
+	tests := []struct {
+		record Record
+		row    []string
+		want   string
+	}{
+		{&User{}, []string{"alice", "Europe/Lisbon", "10"}, "expected 4 columns, found 3."},
+		{&User{}, []string{"", "Europe/Lisbon", "10", "#f1"}, "missing nick."},
+		{&User{}, []string{"alice", "Europe/Lisbon", "ten", "#f1"}, "invalid points"},
+		{&Identity{}, []string{"alice", "alice"}, "invalid mask"},
+		{&Bet{}, []string{"Monaco Grand Prix", "alice", "ver", "ham", "lec", "ver", "-1"}, "invalid points"},
+		{&RaceResult{}, []string{"Monaco Grand Prix", "ver", "", "lec", ""}, "missing second driver."},
+		{&Driver{}, []string{"Max Verstappen", "ver", "x"}, "invalid odds"},
+		{&Event{}, []string{"[Formula 1]", "Monaco Grand Prix", "Race", "tomorrow", "#f1", "", ""}, "time"},
+		{&Feed{}, []string{"F1", "example.com", "#f1", ""}, "url"},
+		{&Quote{}, []string{"2023-05-28", "Text", "f1"}, "invalid channel"},
+		{&ChannelSettings{}, []string{"libera", "#f1", "yes", "", "", "", "on", "on", ""}, "invalid switch"},
+		{&ChannelSettings{}, []string{"libera", "#f1", "on", "", "", "", "on", "on", "english"}, "invalid language"},
+		{&ChannelSettings{}, []string{"", "#f1", "on", "", "", "", "on", "on", ""}, "missing network."},
+		{&ChannelSettings{}, []string{"#f1", "on", "", "", "", "on", "on", ""}, "expected 9 columns, found 8."},
+	}
+	for _, test := range tests {
+		err := test.record.UnmarshalCSV(test.row)
+		if err == nil || !strings.Contains(strings.ToLower(err.Error()), test.want) {
+			t.Errorf("%T.UnmarshalCSV(%q): got %v, want %q", test.record, test.row, err, test.want)
+		}
+	}
+}
+
+func TestInvalidRowsReported(t *testing.T) {
+	folder := t.TempDir()
+	writeCSV(filepath.Join(folder, driversFile), [][]string{
+		{"Max Verstappen", "ver", "1"},
+		{"Lewis Hamilton", "ham"},
+		{"Charles Leclerc", "lec", "2"},
+	})
+	store := newCSVStore(folder, 0)
+	var drivers []Driver
+	err := store.View(func(tx *Tx) (err error) {
+		drivers, err = tx.Drivers().All()
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drivers) != 2 || drivers[0].Code != "ver" || drivers[1].Code != "lec" {
+		t.Errorf("drivers = %+v, want ver and lec", drivers)
+	}
+	problems := checkStore(store)
+	if len(problems) != 1 {
+		t.Fatalf("problems = %v, want 1", problems)
+	}
+	var rowErr *RowError
+	if !errors.As(problems[0], &rowErr) || rowErr.Source != filepath.Join(folder, driversFile) || rowErr.Line != 2 {
+		t.Errorf("problem = %v, want %s:2", problems[0], driversFile)
+	}
+	// Updating the table keeps the invalid row, so that it can still be fixed by hand.
+	err = store.Update(func(tx *Tx) error {
+		return tx.put(driversFile, &Driver{Name: "Max Verstappen", Code: "ver", Odds: 3}, func(record Record) bool {
+			return record.(*Driver).Code == "ver"
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, _ := readCSV(filepath.Join(folder, driversFile))
+	if len(rows) != 3 || rows[0][2] != "3" || len(rows[1]) != 2 {
+		t.Errorf("rows = %q", rows)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab.com/vascocosta/schumacher/modules/omdb"
+	"gitlab.com/vascocosta/schumacher/modules/weather"
+	"gitlab.com/vascocosta/schumacher/pkg/bot"
+)
+
+// Plugins built into the bot, written against the API of pkg/bot. Their settings are the [plugin.<name>] sections
+// of the config, like the ones of the exec plugins, and their commands take precedence over exec plugins.
+var modules = []bot.Plugin{
+	weather.New(),
+	omdb.New(),
+}
+
+var moduleClient = &http.Client{Timeout: 15 * time.Second} // HTTP client shared by every module.
+
+// Tables declared by the modules, by name, and the problems found declaring them.
+var moduleTables, moduleTableErrors = declaredTables(modules)
+
+// Type that represents a table of the storage owned by a module.
+type moduleTable struct {
+	bot.Table
+	module string // Name of the module that owns the table.
+}
+
+// The declaredTables function returns the tables declared by the modules, by name. Tables named like a table of the
+// bot, or already declared by another module, are left out with an error.
+func declaredTables(modules []bot.Plugin) (declared map[string]moduleTable, errs []error) {
+	declared = make(map[string]moduleTable)
+	for _, module := range modules {
+		for _, table := range module.Tables() {
+			if _, ok := tableRecords[table.Name]; ok || table.Name == "" {
+				errs = append(errs, fmt.Errorf("Error declaring table %q of module %s: invalid name.", table.Name, module.Name()))
+				continue
+			}
+			if owner, ok := declared[table.Name]; ok {
+				errs = append(errs, fmt.Errorf("Error declaring table %q of module %s: owned by module %s.", table.Name, module.Name(), owner.module))
+				continue
+			}
+			declared[table.Name] = moduleTable{table, module.Name()}
+		}
+	}
+	return
+}
+
+// The moduleTableNames function returns the names of the tables declared by the modules, sorted like the modules.
+func moduleTableNames(modules []bot.Plugin) (names []string) {
+	for _, module := range modules {
+		for _, table := range module.Tables() {
+			if moduleTables[table.Name].module == module.Name() {
+				names = append(names, table.Name)
+			}
+		}
+	}
+	return
+}
+
+// Type that represents a row of a table of a module, which the bot only checks with the validation of the module.
+type moduleRecord struct {
+	validate func(row []string) error
+	row      []string
+}
+
+func (r *moduleRecord) MarshalCSV() []string {
+	return r.row
+}
+
+func (r *moduleRecord) UnmarshalCSV(row []string) error {
+	if r.validate != nil {
+		if err := r.validate(row); err != nil {
+			return err
+		}
+	}
+	r.row = row
+	return nil
+}
+
+// The moduleCommands function returns the definitions of the commands of the modules.
+func moduleCommands(modules []bot.Plugin) (defs []*CommandDef) {
+	for _, module := range modules {
+		module := module
+		for _, command := range module.Commands() {
+			command := command
+			role := RoleUser
+			if command.Role != "" {
+				var err error
+				if role, err = parseRole(command.Role); err != nil {
+					defaultLogger.Error("Invalid role of module command.", "module", module.Name(), "command", command.Name, "err", err)
+					continue
+				}
+			}
+			defs = append(defs, &CommandDef{
+				Name:        command.Name,
+				Aliases:     command.Aliases,
+				Usage:       command.Usage,
+				Description: command.Description,
+				Role:        role,
+				Async:       true,
+				ChannelOnly: command.ChannelOnly,
+				Args:        &ArgSchema{Min: command.MinArgs, Max: command.MaxArgs},
+				Handler: func(b *Bot, ctx *Context) {
+					command.Handler(b.moduleContext(module, ctx))
+				},
+			})
+		}
+	}
+	return
+}
+
+// The moduleContext method returns the context of the command of a module, from the context of the bot.
+func (b *Bot) moduleContext(module bot.Plugin, ctx *Context) *bot.Context {
+	moduleCtx := &bot.Context{
+		Host:      moduleHost{b, module},
+		Responder: ctx,
+		Caller:    &moduleCaller{b: b, ctx: ctx},
+		Nick:      ctx.Nick,
+		Account:   ctx.Account,
+		Private:   ctx.Private,
+		Role:      ctx.Role.String(),
+		Language:  b.settings(ctx.Channel).Language,
+		Args:      append([]string{}, ctx.Args...),
+		Log:       ctx.Log.With("module", module.Name()),
+	}
+	if !ctx.Private {
+		moduleCtx.Channel = ctx.Channel
+	}
+	return moduleCtx
+}
+
+// Type that represents the caller of the command of a module, whose registered nick is only looked up when the
+// module asks for it, since that may wait for its services account or register its mask.
+type moduleCaller struct {
+	b    *Bot
+	ctx  *Context
+	once sync.Once
+	user string
+}
+
+func (c *moduleCaller) User() string {
+	c.once.Do(func() {
+		// Registered users keep their settings under their registered nick, so they follow them across nick changes.
+		c.user = c.ctx.Nick
+		if registered, ok, err := c.b.findUser(c.ctx); err != nil {
+			c.ctx.Log.Warn("Could not find the user of a module command.", "err", err)
+		} else if ok {
+			c.user = registered.Nick
+		}
+	})
+	return c.user
+}
+
+// The tskModules method passes the messages seen by the bot and a tick every bot.TickInterval to the modules.
+// Each module sees them one at a time, on this goroutine, until the bot shuts down.
+func (b *Bot) tskModules() {
+	messages := make(chan Message, 64)
+	b.messages.Subscribe(messages)
+	defer b.messages.Unsubscribe(messages)
+	ticker := time.NewTicker(bot.TickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-messages:
+			message := bot.Message{Channel: m.Target, Nick: m.Nick, Text: m.Text, Time: m.Time}
+			if checkChannel(m.Target) != nil {
+				message.Channel, message.Private = "", true
+			}
+			for _, module := range modules {
+				module.OnMessage(moduleHost{b, module}, message)
+			}
+		case now := <-ticker.C:
+			for _, module := range modules {
+				module.OnTick(moduleHost{b, module}, now)
+			}
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// Type that represents what the bot offers a module on its network.
+type moduleHost struct {
+	b      *Bot
+	module bot.Plugin
+}
+
+func (h moduleHost) Network() string          { return h.b.config.Name }
+func (h moduleHost) Config() bot.Config       { return bot.Config(config.pluginSettings(h.module.Name())) }
+func (h moduleHost) Storage() bot.Storage     { return moduleStorage{h.b.store, h.module.Name()} }
+func (h moduleHost) HTTPClient() *http.Client { return moduleClient }
+func (h moduleHost) Logger() bot.Logger       { return h.b.logger.With("module", h.module.Name()) }
+func (h moduleHost) Send(target, text string) { h.b.queue.Privmsg(PriorityNormal, target, text) }
+
+// Type that represents the storage of a bot as seen by a module.
+type moduleStorage struct {
+	store  Store
+	module string // Name of the module.
+}
+
+func (s moduleStorage) View(fn func(tx bot.Tx) error) error {
+	return s.store.View(func(tx *Tx) error { return fn(moduleTx{tx, s.module}) })
+}
+
+func (s moduleStorage) Update(fn func(tx bot.Tx) error) error {
+	return s.store.Update(func(tx *Tx) error { return fn(moduleTx{tx, s.module}) })
+}
+
+// Type that represents a transaction on the storage as seen by a module, which only reaches the tables it declares.
+type moduleTx struct {
+	tx     *Tx
+	module string // Name of the module.
+}
+
+// The owns method reports whether the table is declared by the module of the transaction.
+func (tx moduleTx) owns(table string) bool {
+	declared, ok := moduleTables[table]
+	return ok && declared.module == tx.module
+}
+
+func (tx moduleTx) Rows(table string) ([][]string, error) {
+	if !tx.owns(table) {
+		return nil, errors.New("Error reading table: unknown table " + table + ".")
+	}
+	return tx.tx.Rows(table)
+}
+
+func (tx moduleTx) SetRows(table string, rows [][]string) error {
+	if !tx.owns(table) {
+		return errors.New("Error writing table: unknown table " + table + ".")
+	}
+	return tx.tx.SetRows(table, rows)
+}
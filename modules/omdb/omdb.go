@@ -0,0 +1,132 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package omdb is the built-in plugin with the omdb command, which shows the details of a movie or show
+// using the OMDb API.
+package omdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gitlab.com/vascocosta/schumacher/pkg/bot"
+)
+
+// Default API key, used when the [plugin.omdb] section of the config doesn't set api_key.
+const defaultAPIKey = "70a330ff"
+
+// Type that represents the response of the OMDb API to a search by title.
+type SingleResultResponse struct {
+	Title      string `json:"Title"`
+	Year       string `json:"Year"`
+	Rated      string `json:"Rated"`
+	Released   string `json:"Released"`
+	Runtime    string `json:"Runtime"`
+	Genre      string `json:"Genre"`
+	Director   string `json:"Director"`
+	Writer     string `json:"Writer"`
+	Actors     string `json:"Actors"`
+	Plot       string `json:"Plot"`
+	Language   string `json:"Language"`
+	Country    string `json:"Country"`
+	Awards     string `json:"Awards"`
+	Poster     string `json:"Poster"`
+	Metascore  string `json:"Metascore"`
+	ImdbRating string `json:"imdbRating"`
+	ImdbVotes  string `json:"imdbVotes"`
+	ImdbId     string `json:"imdbId"`
+	Type       string `json:"Type"`
+	Response   string `json:"Response"`
+	Error      string `json:"Error"`
+}
+
+// Type that represents the omdb plugin. Its API key is the api_key of the [plugin.omdb] section of the config.
+type Plugin struct {
+	bot.Base
+	BaseURL string // URL of the OMDb API.
+}
+
+// The New function creates the omdb plugin.
+func New() *Plugin {
+	return &Plugin{BaseURL: "http://www.omdbapi.com/"}
+}
+
+func (p *Plugin) Name() string {
+	return "omdb"
+}
+
+func (p *Plugin) Commands() []bot.Command {
+	return []bot.Command{
+		{
+			Name:        "omdb",
+			Aliases:     []string{"movie"},
+			Usage:       "<title>",
+			Description: "Show the year, genre, director, rating and plot of a movie or show.",
+			MinArgs:     1,
+			MaxArgs:     -1,
+			Handler:     p.cmdOMDb,
+		},
+	}
+}
+
+// The omdb command receives a context with an arguments slice of strings.
+// It then shows the year, genre, director, rating and plot of the movie or show with that title.
+func (p *Plugin) cmdOMDb(ctx *bot.Context) {
+	result, err := p.searchByTitle(ctx, strings.Join(ctx.Args, " "))
+	if err != nil || result.Title == "" {
+		ctx.Reply("Cannot find movie or show.")
+		if err != nil {
+			ctx.Log.Warn("Error searching the OMDb API.", "err", err)
+		}
+		return
+	}
+	ctx.Reply(fmt.Sprintf("Title: %s | Year: %s | Genre: %s | Director: %s | IMDB Rating: %s",
+		result.Title,
+		result.Year,
+		result.Genre,
+		result.Director,
+		result.ImdbRating))
+	if result.Plot != "" {
+		ctx.Reply(result.Plot)
+	}
+}
+
+// The searchByTitle method receives a context and a title.
+// It then searches the OMDb API for the movie or show with that title.
+func (p *Plugin) searchByTitle(ctx *bot.Context, title string) (response SingleResultResponse, err error) {
+	req, err := http.NewRequest("GET", p.BaseURL, nil)
+	if err != nil {
+		return
+	}
+	query := req.URL.Query()
+	query.Add("t", title)
+	query.Add("apikey", ctx.Config().String("api_key", defaultAPIKey))
+	req.URL.RawQuery = query.Encode()
+	resp, err := ctx.HTTPClient().Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Error searching by title: %s", resp.Status)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	return
+}
@@ -0,0 +1,228 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package weather is the built-in plugin with the weather command, which shows the current weather of a location
+// using the OpenWeatherMap API and remembers the location and temperature units of each user.
+package weather
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	owm "github.com/briandowns/openweathermap"
+	"gitlab.com/vascocosta/schumacher/pkg/bot"
+)
+
+// Name of the table with the weather settings of the users.
+const Table = "weather.csv"
+
+// Type that represents the weather settings of a user.
+type Pref struct {
+	Nick     string
+	Units    string // Temperature units, c or f.
+	Location string
+}
+
+func (p Pref) MarshalCSV() []string {
+	return []string{p.Nick, p.Units, p.Location}
+}
+
+func (p *Pref) UnmarshalCSV(row []string) error {
+	if len(row) != 3 {
+		return fmt.Errorf("expected 3 columns, found %d.", len(row))
+	}
+	if strings.TrimSpace(row[0]) == "" {
+		return errors.New("missing nick.")
+	}
+	if strings.TrimSpace(row[2]) == "" {
+		return errors.New("missing location.")
+	}
+	if strings.ToLower(row[1]) != "c" && strings.ToLower(row[1]) != "f" {
+		return fmt.Errorf("invalid units %q, expected c or f.", row[1])
+	}
+	*p = Pref{Nick: row[0], Units: row[1], Location: row[2]}
+	return nil
+}
+
+// Type that represents the weather plugin. Its API key is the api_key of the [plugin.weather] section of the config.
+type Plugin struct {
+	bot.Base
+}
+
+// The New function creates the weather plugin.
+func New() *Plugin {
+	return &Plugin{}
+}
+
+func (p *Plugin) Name() string {
+	return "weather"
+}
+
+func (p *Plugin) Tables() []bot.Table {
+	return []bot.Table{
+		{Name: Table, Validate: func(row []string) error { return new(Pref).UnmarshalCSV(row) }},
+	}
+}
+
+func (p *Plugin) Commands() []bot.Command {
+	return []bot.Command{
+		{
+			Name:        "weather",
+			Aliases:     []string{"w"},
+			Usage:       "[location] or <c/f>",
+			Description: "Show the weather of a location, your own one by default, or set your temperature units.",
+			MaxArgs:     -1,
+			Handler:     p.cmdWeather,
+		},
+	}
+}
+
+// The weather command receives a context with an arguments slice of strings.
+// It then shows the current weather for a given location on the channel using the OpenWeatherMap API.
+// Registered users keep their settings under their registered nick, so they follow them across nick changes.
+func (p *Plugin) cmdWeather(ctx *bot.Context) {
+	var pref Pref
+	var found bool
+	user := ctx.User()
+	err := ctx.Storage().View(func(tx bot.Tx) (err error) {
+		pref, found, err = getPref(tx, user)
+		return
+	})
+	if err != nil {
+		ctx.Reply("Error getting weather settings.")
+		ctx.Log.Error("Error getting weather settings.", "err", err)
+		return
+	}
+	location := ""
+	tempUnits := "C"
+	windUnits := "m/s"
+	// Neither a location nor temperature unit were provided as an argument to the command.
+	// So we must get the location and temperature unit for the user from the weather settings.
+	if len(ctx.Args) == 0 {
+		if found {
+			tempUnits = strings.ToUpper(pref.Units)
+			location = pref.Location
+		}
+		// A temperature unit was provided as an argument to the command, we must update the setting.
+		// However, we must first check if the user already has a location set on the weather settings.
+		// If so, we update the user units, otherwise we ask him to get the wether for a location.
+		// This is so that the user gets registered on the weather settings before we can set a location.
+	} else if len(ctx.Args) == 1 && (strings.ToLower(ctx.Args[0]) == "c" || strings.ToLower(ctx.Args[0]) == "f") {
+		if !found {
+			ctx.Reply("Get the weather for some location before setting the units.")
+			return
+		}
+		pref.Units = strings.ToLower(ctx.Args[0])
+		err = ctx.Storage().Update(func(tx bot.Tx) error {
+			return putPref(tx, pref)
+		})
+		if err != nil {
+			ctx.Reply("Error storing weather units.")
+			ctx.Log.Error("Error storing weather units.", "err", err)
+			return
+		}
+		ctx.Reply("Temperature units updated.")
+		return
+		// If we reach this point, a location was provided as an argument to the command.
+		// If the user already exists, we update his location, otherwise we register him.
+	} else {
+		location = strings.Join(ctx.Args, " ")
+		if !found {
+			pref = Pref{Nick: user, Units: "c"}
+		}
+		pref.Location = location
+		err = ctx.Storage().Update(func(tx bot.Tx) error {
+			return putPref(tx, pref)
+		})
+		if err != nil {
+			ctx.Reply("Error storing weather location.")
+			ctx.Log.Error("Error storing weather location.", "err", err)
+			return
+		}
+		tempUnits = strings.ToUpper(pref.Units)
+	}
+	if location == "" {
+		ctx.Reply("Please provide a location as argument.")
+		return
+	}
+	if tempUnits == "F" {
+		windUnits = "mph"
+	}
+	// Finally we get the current weather at a location using the temperature units.
+	// Then we display a nicely formatted and compact weather string on the channel.
+	// The description of the weather is in the language of the channel, when OpenWeatherMap supports it.
+	language := strings.ToUpper(ctx.Language)
+	if !owm.ValidLangCode(language) {
+		language = "EN"
+	}
+	w, err := owm.NewCurrent(tempUnits, language, ctx.Config().String("api_key", ""), owm.WithHttpClient(ctx.HTTPClient()))
+	if err != nil {
+		ctx.Reply("Error fetching weather.")
+		ctx.Log.Error("Error fetching weather.", "err", err)
+		return
+	}
+	err = w.CurrentByName(location)
+	if err != nil || len(w.Weather) == 0 {
+		ctx.Reply("Could not fetch weather for that location.")
+		ctx.Log.Warn("Error fetching weather for the location.", "location", location, "err", err)
+		return
+	}
+	ctx.Reply(
+		fmt.Sprintf("%s: %s | Temperature: %0.1f%s | Humidity: %d%% | Pressure: %0.1fhPa | Wind: %0.1f%s",
+			w.Name,
+			w.Weather[0].Description,
+			w.Main.Temp,
+			tempUnits,
+			w.Main.Humidity,
+			w.Main.Pressure,
+			w.Wind.Speed,
+			windUnits))
+}
+
+// Small utility function that returns the weather settings of a nick, ignoring case, and whether it has any.
+// Invalid rows are skipped, since the bot reports them when it starts.
+func getPref(tx bot.Tx, nick string) (pref Pref, ok bool, err error) {
+	rows, err := tx.Rows(Table)
+	if err != nil {
+		return
+	}
+	for _, row := range rows {
+		if pref.UnmarshalCSV(row) == nil && strings.EqualFold(pref.Nick, nick) {
+			return pref, true, nil
+		}
+	}
+	return Pref{}, false, nil
+}
+
+// Small utility function that adds the weather settings of a nick, or replaces the ones of the same nick.
+// Invalid rows are kept as they are, so that they can still be fixed by hand.
+func putPref(tx bot.Tx, pref Pref) error {
+	rows, err := tx.Rows(Table)
+	if err != nil {
+		return err
+	}
+	updated := append([][]string{}, rows...)
+	for i, row := range updated {
+		var current Pref
+		if current.UnmarshalCSV(row) == nil && strings.EqualFold(current.Nick, pref.Nick) {
+			updated[i] = pref.MarshalCSV()
+			return tx.SetRows(Table, updated)
+		}
+	}
+	return tx.SetRows(Table, append(updated, pref.MarshalCSV()))
+}
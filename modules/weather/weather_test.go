@@ -0,0 +1,50 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package weather
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPref(t *testing.T) {
+	pref := Pref{Nick: "alice", Units: "c", Location: "Lisbon"}
+	var decoded Pref
+	if err := decoded.UnmarshalCSV(pref.MarshalCSV()); err != nil || !reflect.DeepEqual(decoded, pref) {
+		t.Errorf("got %+v, %v, want %+v", decoded, err, pref)
+	}
+	for _, test := range []struct {
+		row  []string
+		want string
+	}{
+		{[]string{"alice", "c"}, "expected 3 columns, found 2."},
+		{[]string{"", "c", "Lisbon"}, "missing nick."},
+		{[]string{"alice", "c", ""}, "missing location."},
+		{[]string{"alice", "k", "Lisbon"}, "invalid units"},
+	} {
+		if err := new(Pref).UnmarshalCSV(test.row); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("UnmarshalCSV(%q): got %v, want %q", test.row, err, test.want)
+		}
+	}
+	// The table of the plugin is validated like its rows are decoded.
+	tables := New().Tables()
+	if len(tables) != 1 || tables[0].Name != Table || tables[0].Validate([]string{"alice", "k", "Lisbon"}) == nil {
+		t.Errorf("got tables %+v", tables)
+	}
+}
@@ -0,0 +1,288 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/vascocosta/schumacher/modules/weather"
+	"gitlab.com/vascocosta/schumacher/pkg/bot"
+)
+
+// Type that represents an HTTP transport that sends every request to a test server, whatever its host.
+type rewriteTransport struct {
+	server *httptest.Server
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, _ := url.Parse(t.server.URL)
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Small utility function that sends the requests of the modules to handler for the rest of the test.
+func serveModules(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	client := moduleClient
+	moduleClient = &http.Client{Transport: rewriteTransport{server}, Timeout: time.Second}
+	t.Cleanup(func() {
+		moduleClient = client
+		server.Close()
+	})
+}
+
+// Small utility function that returns the command of the modules with a given name.
+func moduleCommand(t *testing.T, name string) *CommandDef {
+	t.Helper()
+	r := newRegistry()
+	for _, def := range moduleCommands(modules) {
+		if err := r.Register(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	def, ok := r.Lookup(name)
+	if !ok {
+		t.Fatalf("Lookup(%q) found no command", name)
+	}
+	return def
+}
+
+func TestModuleCommands(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		alias string
+		min   int
+	}{
+		{"weather", "w", 0},
+		{"omdb", "movie", 1},
+	} {
+		def := moduleCommand(t, test.alias)
+		if def.Name != test.name || def.Role != RoleUser || !def.Async || def.Plugin {
+			t.Errorf("%s: got %+v", test.alias, def)
+		}
+		if def.Args == nil || def.Args.Min != test.min || def.Args.Max != -1 {
+			t.Errorf("%s: got args %+v", test.alias, def.Args)
+		}
+	}
+}
+
+func TestWeatherModule(t *testing.T) {
+	plugins := config.Plugins
+	config.Plugins = map[string]PluginConfig{"weather": {"api_key": strings.Repeat("k", 32)}}
+	defer func() { config.Plugins = plugins }()
+	var queries []url.Values
+	serveModules(t, func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		fmt.Fprintf(w, `{"name": %q, "weather": [{"description": "clear sky"}], "main": {"temp": 20.5, "pressure": 1015, "humidity": 60}, "wind": {"speed": 3.5}}`, r.URL.Query().Get("q"))
+	})
+	b := newTestBot(t, nil)
+	def := moduleCommand(t, "weather")
+	run := func(args ...string) []string {
+		ctx, r := newFakeContext("alice", "#f1", args...)
+		def.Handler(b, ctx)
+		return r.replies()
+	}
+	if replies := run(); len(replies) != 1 || replies[0] != "Please provide a location as argument." {
+		t.Errorf("weather without a location = %q", replies)
+	}
+	if replies := run("f"); len(replies) != 1 || !strings.Contains(replies[0], "before setting the units") {
+		t.Errorf("weather f without a location = %q", replies)
+	}
+	want := "Lisbon: clear sky | Temperature: 20.5C | Humidity: 60% | Pressure: 1015.0hPa | Wind: 3.5m/s"
+	if replies := run("Lisbon"); len(replies) != 1 || replies[0] != want {
+		t.Errorf("weather Lisbon = %q, want %q", replies, want)
+	}
+	if replies := run("f"); len(replies) != 1 || replies[0] != "Temperature units updated." {
+		t.Errorf("weather f = %q", replies)
+	}
+	want = "Lisbon: clear sky | Temperature: 20.5F | Humidity: 60% | Pressure: 1015.0hPa | Wind: 3.5mph"
+	if replies := run(); len(replies) != 1 || replies[0] != want {
+		t.Errorf("weather = %q, want %q", replies, want)
+	}
+	if len(queries) != 2 || queries[0].Get("appid") != strings.Repeat("k", 32) || queries[1].Get("units") != "imperial" {
+		t.Errorf("got queries %v", queries)
+	}
+	// The settings are kept on the weather table of the bot, like the rest of its data.
+	var rows [][]string
+	b.store.View(func(tx *Tx) (err error) {
+		rows, err = tx.Rows(weather.Table)
+		return
+	})
+	if len(rows) != 1 || strings.Join(rows[0], ",") != "alice,f,Lisbon" {
+		t.Errorf("got rows %q", rows)
+	}
+}
+
+func TestOMDbModule(t *testing.T) {
+	serveModules(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("t") != "Rush" || r.URL.Query().Get("apikey") == "" {
+			fmt.Fprint(w, `{"Response": "False", "Error": "Movie not found!"}`)
+			return
+		}
+		fmt.Fprint(w, `{"Title": "Rush", "Year": "2013", "Genre": "Action, Biography, Drama", "Director": "Ron Howard", "imdbRating": "8.1", "Plot": "The rivalry between Hunt and Lauda."}`)
+	})
+	b := newTestBot(t, nil)
+	// The omdb module never asks for the user, so its commands don't wait for the account of the caller.
+	var lookups []string
+	b.idents.lookup = func(nick string) { lookups = append(lookups, nick) }
+	def := moduleCommand(t, "movie")
+	ctx, r := newFakeContext("alice", "#f1", "Rush")
+	def.Handler(b, ctx)
+	if len(lookups) != 0 {
+		t.Errorf("got account lookups %q", lookups)
+	}
+	want := []string{"Title: Rush | Year: 2013 | Genre: Action, Biography, Drama | Director: Ron Howard | IMDB Rating: 8.1", "The rivalry between Hunt and Lauda."}
+	if replies := r.replies(); strings.Join(replies, "\n") != strings.Join(want, "\n") {
+		t.Errorf("omdb Rush = %q, want %q", replies, want)
+	}
+	ctx, r = newFakeContext("alice", "#f1", "Nothing")
+	def.Handler(b, ctx)
+	if replies := r.replies(); len(replies) != 1 || replies[0] != "Cannot find movie or show." {
+		t.Errorf("omdb Nothing = %q", replies)
+	}
+}
+
+// Type that represents a module that records the messages it sees and answers them with Send.
+type echoModule struct {
+	bot.Base
+	messages chan bot.Message
+}
+
+func (m *echoModule) Name() string            { return "echo" }
+func (m *echoModule) Commands() []bot.Command { return nil }
+
+// The echo module declares a table of its own, and tries to take the users table and the table of the weather module.
+func (m *echoModule) Tables() []bot.Table {
+	return []bot.Table{{Name: "echo.csv"}, {Name: usersFile}, {Name: weather.Table}}
+}
+
+func (m *echoModule) OnMessage(host bot.Host, message bot.Message) {
+	host.Send("#f1", host.Network()+": "+message.Text)
+	m.messages <- message
+}
+
+func TestModuleMessages(t *testing.T) {
+	echo := &echoModule{messages: make(chan bot.Message, 2)}
+	defer func(saved []bot.Plugin) { modules = saved }(modules)
+	modules = []bot.Plugin{echo}
+	b := newTestBot(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	b.ctx = ctx
+	done := make(chan struct{})
+	go func() {
+		b.tskModules()
+		close(done)
+	}()
+	// The task subscribes on its own goroutine, so publish until it gets the first message.
+	var got []bot.Message
+	for len(got) == 0 {
+		b.messages.Publish(Message{Network: "test", Target: "#f1", Nick: "alice", Text: "hello"})
+		select {
+		case m := <-echo.messages:
+			got = append(got, m)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	b.messages.Publish(Message{Network: "test", Target: "Schumacher", Nick: "bob", Text: "psst"})
+	for len(got) < 2 {
+		select {
+		case m := <-echo.messages:
+			if m.Text == "psst" {
+				got = append(got, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("private message not seen by the module")
+		}
+	}
+	if got[0].Channel != "#f1" || got[0].Private || got[0].Nick != "alice" {
+		t.Errorf("got channel message %+v", got[0])
+	}
+	if got[1].Channel != "" || !got[1].Private || got[1].Nick != "bob" {
+		t.Errorf("got private message %+v", got[1])
+	}
+	if lines := queuedLines(b); len(lines) == 0 || lines[0] != "PRIVMSG #f1 :test: hello" {
+		t.Errorf("got queued lines %q", lines)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tskModules didn't return on shutdown")
+	}
+}
+
+func TestModuleTables(t *testing.T) {
+	echo := &echoModule{}
+	declared, errs := declaredTables([]bot.Plugin{weather.New(), echo})
+	if len(declared) != 2 || declared[weather.Table].module != "weather" || declared["echo.csv"].module != "echo" {
+		t.Errorf("got tables %+v", declared)
+	}
+	// The echo module can't take the users table of the bot, nor the table of the weather module.
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "invalid name") || !strings.Contains(errs[1].Error(), "owned by module weather") {
+		t.Errorf("got errors %v", errs)
+	}
+	if !contains(tables, weather.Table) {
+		t.Errorf("%s is not one of the tables %q", weather.Table, tables)
+	}
+	b := newTestBot(t, map[string][][]string{
+		usersFile:     {{"alice", "Europe/Lisbon", "10", "#f1"}},
+		weather.Table: {{"alice", "c", "Lisbon"}, {"bob", "k", "Porto"}},
+	})
+	// Each module only reaches the tables it declares.
+	for _, test := range []struct {
+		module bot.Plugin
+		table  string
+		ok     bool
+	}{
+		{weather.New(), weather.Table, true},
+		{weather.New(), usersFile, false},
+		{weather.New(), rolesFile, false},
+		{echo, usersFile, false},
+		{echo, weather.Table, false},
+	} {
+		storage := moduleHost{b, test.module}.Storage()
+		err := storage.View(func(tx bot.Tx) error {
+			_, err := tx.Rows(test.table)
+			return err
+		})
+		if (err == nil) != test.ok {
+			t.Errorf("%s reading %s: got %v", test.module.Name(), test.table, err)
+		}
+		err = storage.Update(func(tx bot.Tx) error {
+			return tx.SetRows(test.table, nil)
+		})
+		if (err == nil) != test.ok {
+			t.Errorf("%s writing %s: got %v", test.module.Name(), test.table, err)
+		}
+	}
+	// The rows of the tables of the modules are checked with their validation, like the rest of the data.
+	b = newTestBot(t, map[string][][]string{weather.Table: {{"alice", "c", "Lisbon"}, {"bob", "k", "Porto"}}})
+	problems := checkStore(b.store)
+	if len(problems) != 1 || !strings.Contains(problems[0].Error(), weather.Table) || !strings.Contains(problems[0].Error(), "units") {
+		t.Errorf("got problems %v", problems)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package bot is the API of the Go plugins built into schumacher, which run in-process on every network.
+//
+// A plugin implements Plugin and is added to the built-in modules of the bot. Its commands are dispatched like
+// the built-in commands, with the same roles, channel settings and help, and it sees every message of each
+// network and gets a tick every TickInterval. It keeps its data on the tables it declares, which are stored and
+// checked with the data of the bot. Programs written in other languages are run as exec plugins instead.
+package bot
+
+import (
+	"net/http"
+	"time"
+)
+
+// Time between the calls to the OnTick method of the plugins.
+const TickInterval = time.Minute
+
+// Type that represents a plugin built into the bot.
+// The OnMessage and OnTick methods of a plugin are called on a single goroutine of each network, one at a time,
+// so a plugin that takes long to handle them should do its work on its own goroutine.
+type Plugin interface {
+	Name() string                         // Name of the plugin, which also names its [plugin.<name>] section of the config.
+	Commands() []Command                  // Commands of the plugin.
+	Tables() []Table                      // Tables of the storage used by the plugin, the only ones it can read and write.
+	OnMessage(host Host, message Message) // Called with each message seen on a network.
+	OnTick(host Host, now time.Time)      // Called every TickInterval on each network.
+}
+
+// Type that can be embedded on the plugins that don't need tables, OnMessage or OnTick.
+type Base struct{}
+
+func (Base) Tables() []Table         { return nil }
+func (Base) OnMessage(Host, Message) {}
+func (Base) OnTick(Host, time.Time)  {}
+
+// Type that represents a table of the storage owned by a plugin. Each table belongs to a single plugin, and can't
+// have the name of a table of the bot.
+type Table struct {
+	Name     string                   // Name of the table, like weather.csv, which is also its file on the csv backend.
+	Validate func(row []string) error // Checks a row, so that the bot reports invalid rows when it starts. Nil accepts any row.
+}
+
+// Type that represents a command of a plugin.
+type Command struct {
+	Name        string
+	Aliases     []string
+	Usage       string // Arguments of the command, shown by help, for example "<title>".
+	Description string
+	Role        string // Minimum role required to run the command: user (default), moderator, admin or owner.
+	ChannelOnly bool   // The command only works on a channel, not on a private message.
+	MinArgs     int    // Arguments the command needs at least.
+	MaxArgs     int    // Arguments the command takes at most, -1 for any number.
+	Handler     func(ctx *Context)
+}
+
+// Type that represents a command being run, with who called it and where, and how to answer.
+type Context struct {
+	Host
+	Responder
+	Caller
+	Nick     string   // Nick that called the command.
+	Account  string   // Services account of the nick, empty when unknown.
+	Channel  string   // Channel of the command, empty on a private message.
+	Private  bool     // The command was sent on a private message to the bot.
+	Role     string   // Role of the caller: user, moderator, admin or owner.
+	Language string   // Language of the channel, empty for the default.
+	Args     []string // Arguments of the command.
+	Log      Logger   // Logger of the command. Logging an error counts the command as failed.
+}
+
+// Type that represents who called a command, beyond its nick.
+type Caller interface {
+	// Registered nick of the caller, which follows it across nick changes, or its nick otherwise.
+	// It is looked up on the first call, which may wait a few seconds for the services account of the caller.
+	User() string
+}
+
+// Type that represents the ways of answering a command.
+type Responder interface {
+	Reply(message string)        // Answer where the command was issued.
+	ReplyPrivate(message string) // Answer on a private message to the caller.
+	Notice(message string)       // Answer on a notice to the caller.
+	Action(message string)       // Answer with an action (/me) where the command was issued.
+}
+
+// Type that represents what the bot offers a plugin on each network.
+type Host interface {
+	Network() string                 // Name of the network.
+	Config() Config                  // Settings of the [plugin.<name>] section of the config.
+	Storage() Storage                // Storage of the bot on the network.
+	HTTPClient() *http.Client        // HTTP client with a timeout, shared by every plugin.
+	Logger() Logger                  // Logger of the plugin on the network.
+	Send(target string, text string) // Send text to a channel or nick, through the send queue of the bot.
+}
+
+// Type that represents a message seen on a network.
+type Message struct {
+	Channel string // Channel of the message, empty on a private message to the bot.
+	Private bool
+	Nick    string
+	Text    string
+	Time    time.Time
+}
+
+// Type that represents the settings of a plugin, as decoded from the config file.
+type Config map[string]interface{}
+
+// The String method returns the string setting key, or def when it isn't set.
+func (c Config) String(key string, def string) string {
+	if value, ok := c[key].(string); ok {
+		return value
+	}
+	return def
+}
+
+// The Int method returns the integer setting key, or def when it isn't set.
+func (c Config) Int(key string, def int) int {
+	if value, ok := c[key].(int64); ok {
+		return int(value)
+	}
+	return def
+}
+
+// Type that represents the storage of the bot, where every read and write happens inside a transaction.
+type Storage interface {
+	View(fn func(tx Tx) error) error   // Runs fn on a read-only transaction.
+	Update(fn func(tx Tx) error) error // Runs fn on a read-write transaction, which is discarded if fn returns an error.
+}
+
+// Type that represents a transaction on the storage. Tables are named after the CSV files that hold them on the
+// csv backend, like weather.csv, and hold rows of strings. Only the tables known to the bot can be used.
+type Tx interface {
+	Rows(table string) ([][]string, error)
+	SetRows(table string, rows [][]string) error
+}
+
+// Type that represents a structured logger, which takes a message and pairs of keys and values.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
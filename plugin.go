@@ -0,0 +1,510 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version of the plugin protocol spoken by the bot.
+//
+// Every plugin is run with the nick and the arguments of the command as its arguments, who called it on the
+// SCHUMACHER_* environment variables, and a pluginRequest as JSON on stdin. A plugin that speaks the protocol
+// answers with a pluginResponse as JSON on stdout, for instance:
+//
+//	{"version": 2, "actions": [{"type": "say", "text": "Hello."}, {"type": "pm", "text": "Just for you."}]}
+//
+// Anything else on stdout is taken as the plain text of a legacy plugin, which is replied line by line.
+// Either way, stderr is only logged, so that it never shows up on the channel.
+const pluginProtocol = 2
+
+// Type that represents the settings of a plugin, from its [plugin.<name>] section of the config.
+type PluginConfig map[string]interface{}
+
+// Type that represents the request envelope sent to a plugin on stdin.
+type pluginRequest struct {
+	Version  int          `json:"version"`
+	Command  string       `json:"command"`
+	Network  string       `json:"network"`
+	Channel  string       `json:"channel"` // Empty on a private message.
+	Private  bool         `json:"private"`
+	Nick     string       `json:"nick"`
+	Account  string       `json:"account"` // Services account of the nick, empty when unknown.
+	Source   string       `json:"source"`  // Hostmask of the nick, as nick!user@host.
+	Role     string       `json:"role"`
+	Args     []string     `json:"args"`
+	Prefix   string       `json:"prefix"`   // Prefix of the commands where the plugin was called.
+	Language string       `json:"language"` // Language of the channel, empty for the default.
+	Config   PluginConfig `json:"config"`   // Settings of the [plugin.<name>] section of the config.
+}
+
+// Type that represents the response of a plugin that speaks the protocol.
+type pluginResponse struct {
+	Version int            `json:"version"`
+	Actions []pluginAction `json:"actions"`
+}
+
+// Type that represents something a plugin wants the bot to do.
+// The type is say (reply where the command was issued), notice or pm (to the nick), action (/me) or error.
+// An error is replied like say, but is logged and counted as a failure of the plugin.
+type pluginAction struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// Time waited for the output of a killed plugin to be closed, before giving up on it.
+const pluginKillGrace = 2 * time.Second
+
+// Type that represents the limits a plugin runs under.
+type pluginLimits struct {
+	Timeout time.Duration // Time after which the plugin is killed, along with every process it started.
+	Memory  int           // Megabytes of address space of each process (RLIMIT_AS), unlimited when 0.
+	CPU     int           // Seconds of CPU time of each process (RLIMIT_CPU), unlimited when 0.
+	Output  int           // Bytes kept from stdout and from stderr. A plugin that writes more to stdout is killed.
+}
+
+// Keys of the [plugin.<name>] sections that override the limits of a plugin.
+var pluginLimitKeys = []string{"timeout", "memory", "cpu", "output"}
+
+// Keys of the [plugin.<name>] sections read by the bot itself, which aren't sent to the plugin.
+var pluginBotKeys = append([]string{"daemon"}, pluginLimitKeys...)
+
+// The pluginSettings method returns the settings of the [plugin.<name>] section of the config sent to the plugin.
+func (c *Config) pluginSettings(name string) PluginConfig {
+	settings := PluginConfig{}
+	for key, value := range c.Plugins[strings.ToLower(name)] {
+		if !containsFold(pluginBotKeys, key) {
+			settings[key] = value
+		}
+	}
+	return settings
+}
+
+// The pluginDaemon method returns whether the plugin name runs as a daemon, as set by its section of the config.
+func (c *Config) pluginDaemon(name string) bool {
+	for key, value := range c.Plugins[strings.ToLower(name)] {
+		if daemon, ok := value.(bool); ok && strings.EqualFold(key, "daemon") {
+			return daemon
+		}
+	}
+	return false
+}
+
+// The limits method returns the limits of a plugin, from the global settings overridden by the timeout of its
+// manifest, and then by its section of the config.
+func (c *Config) pluginLimits(name string) pluginLimits {
+	values := map[string]int{"timeout": c.PluginTimeout, "memory": c.PluginMemory, "cpu": c.PluginCPU, "output": c.PluginOutput}
+	if manifest := registry.Manifest(name); manifest != nil && manifest.Timeout > 0 {
+		values["timeout"] = manifest.Timeout
+	}
+	for key, value := range c.Plugins[strings.ToLower(name)] {
+		if n, ok := value.(int64); ok && containsFold(pluginLimitKeys, key) {
+			values[strings.ToLower(key)] = int(n)
+		}
+	}
+	return pluginLimits{
+		Timeout: time.Duration(values["timeout"]) * time.Second,
+		Memory:  values["memory"],
+		CPU:     values["cpu"],
+		Output:  values["output"] * 1024,
+	}
+}
+
+// Type that represents the plugins running for each user, which keeps one user from running too many at once.
+type pluginSlots struct {
+	sync.Mutex
+	running map[string]int // Plugins running by lower case user key.
+}
+
+// The acquire method takes a slot for user, unless user already runs max plugins.
+func (s *pluginSlots) acquire(user string, max int) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.running == nil {
+		s.running = make(map[string]int)
+	}
+	user = strings.ToLower(user)
+	if s.running[user] >= max {
+		return false
+	}
+	s.running[user]++
+	return true
+}
+
+// The release method gives back a slot taken by user.
+func (s *pluginSlots) release(user string) {
+	s.Lock()
+	defer s.Unlock()
+	user = strings.ToLower(user)
+	if s.running[user]--; s.running[user] <= 0 {
+		delete(s.running, user)
+	}
+}
+
+// Type that represents a writer that keeps up to max bytes, dropping the rest.
+// The full channel is closed once something is dropped, so that the writer of the output can be stopped.
+// The buffer isn't embedded, since io.Copy would then fill it with its ReadFrom method, past max.
+type cappedBuffer struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	max  int
+	full chan struct{}
+}
+
+func newCappedBuffer(max int) *cappedBuffer {
+	return &cappedBuffer{max: max, full: make(chan struct{})}
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if room := c.max - c.buf.Len(); len(p) > room {
+		if room > 0 {
+			c.buf.Write(p[:room])
+		}
+		select {
+		case <-c.full:
+		default:
+			close(c.full)
+		}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+// The Bytes method returns the bytes kept so far.
+func (c *cappedBuffer) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Bytes()
+}
+
+// The String method returns the bytes kept so far as a string.
+func (c *cappedBuffer) String() string {
+	return string(c.Bytes())
+}
+
+// The Truncated method returns whether part of what was written was dropped.
+func (c *cappedBuffer) Truncated() bool {
+	select {
+	case <-c.full:
+		return true
+	default:
+		return false
+	}
+}
+
+// The plugin command receives a context and a name.
+// It then tries to execute the given plugin name if a file with that name is found on the plugins folder.
+// Each plugin runs on its own process group, under the limits of the config, with a restricted environment and its
+// own working directory inside the plugins folder. Its processes are killed when it times out or the bot shuts down.
+// Users can only run a few plugins at once, so that nobody can flood the host with processes.
+func (b *Bot) cmdPlugin(ctx *Context, name string, finishedCh chan bool) {
+	path := filepath.Join(config.PluginsFolder, name)
+	if !fileExists(path) {
+		pluginFinished(finishedCh)
+		ctx.Reply("Unknown command or plugin.")
+		return
+	}
+	// Users are told apart by account when identified, and by host otherwise, so that changing nick doesn't help.
+	user := ctx.Account
+	if user == "" {
+		user = ctx.Source[strings.LastIndex(ctx.Source, "@")+1:]
+	}
+	if user == "" {
+		user = ctx.Nick
+	}
+	if !b.plugins.acquire(user, config.PluginConcurrency) {
+		pluginFinished(finishedCh)
+		ctx.Reply(fmt.Sprintf("You already have %d plugins running, wait for them to finish.", config.PluginConcurrency))
+		return
+	}
+	defer b.plugins.release(user)
+	if d := b.daemon(name); d != nil {
+		b.cmdDaemon(ctx, d, finishedCh)
+		return
+	}
+	request, err := json.Marshal(b.pluginRequest(ctx, name))
+	if err != nil {
+		pluginFinished(finishedCh)
+		ctx.Reply("Error executing plugin.")
+		ctx.Log.Error("Error encoding plugin request.", "plugin", name, "err", err)
+		return
+	}
+	limits := config.pluginLimits(name)
+	dir, err := pluginFolder(name)
+	if err != nil {
+		pluginFinished(finishedCh)
+		ctx.Reply("Error executing plugin.")
+		ctx.Log.Error("Error executing plugin.", "plugin", name, "err", err)
+		return
+	}
+	cmd := exec.Command(path, append([]string{ctx.Nick}, ctx.Args...)...)
+	cmd.Dir = dir
+	// Plugins get who called them on the environment, so they can check the role instead of comparing nicks.
+	// The channel is empty on a private message. Nothing else of the environment of the bot is passed on.
+	channel := ctx.Channel
+	if ctx.Private {
+		channel = ""
+	}
+	cmd.Env = append(pluginEnv(dir),
+		"SCHUMACHER_NICK="+ctx.Nick,
+		"SCHUMACHER_CHANNEL="+channel,
+		"SCHUMACHER_ACCOUNT="+ctx.Account,
+		"SCHUMACHER_ROLE="+ctx.Role.String(),
+		fmt.Sprintf("SCHUMACHER_PROTOCOL=%d", pluginProtocol),
+	)
+	stdout, stderr := newCappedBuffer(limits.Output), newCappedBuffer(limits.Output)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	sandbox(cmd, limits)
+	start := time.Now()
+	err = b.runPlugin(cmd, limits, stdout.full)
+	pluginDuration.Observe(time.Since(start).Seconds(), b.config.Name, name)
+	pluginFinished(finishedCh)
+	if len(stderr.Bytes()) > 0 {
+		ctx.Log.Warn("Plugin wrote to stderr.", "plugin", name, "stderr", strings.TrimSpace(stderr.String()), "truncated", stderr.Truncated())
+	}
+	// A plugin that exited with an error still gets its response read, unless it was killed.
+	var exitErr *exec.ExitError
+	killed := err != nil && !errors.As(err, &exitErr)
+	protocol := 0
+	if manifest := registry.Manifest(name); manifest != nil {
+		protocol = manifest.Protocol
+	}
+	response, ok, perr := parsePluginResponse(stdout.Bytes(), protocol)
+	if perr != nil && err == nil {
+		err = perr
+	}
+	if err != nil {
+		pluginFailures.Inc(b.config.Name, name)
+		ctx.Log.Error("Error executing plugin.", "plugin", name, "err", err)
+		// The actions of a plugin that failed are still run, since they may explain what went wrong.
+		if killed || !ok || len(response.Actions) == 0 {
+			ctx.Reply("Error executing plugin.")
+			return
+		}
+	}
+	if !ok {
+		for _, line := range strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n") {
+			ctx.Reply(line)
+		}
+		return
+	}
+	b.runPluginActions(ctx, name, response.Actions)
+}
+
+// The plugins command receives a context with a subcommand and a plugin name.
+// It then lists the plugins on the plugins folder, reloads them with their manifests, or enables or disables one.
+// Disabled plugins are kept on the plugins folder, so they stay disabled across restarts.
+func (b *Bot) cmdPlugins(ctx *Context) {
+	subcommand := "list"
+	if len(ctx.Args) > 0 {
+		subcommand = strings.ToLower(ctx.Args[0])
+	}
+	if err := registry.RefreshPlugins(config.PluginsFolder); err != nil {
+		ctx.Reply("Error reading plugins.")
+		ctx.Log.Error("Error reading plugins.", "err", err)
+		return
+	}
+	switch {
+	case subcommand == "list" && len(ctx.Args) <= 1:
+		var list []string
+		var broken []pluginInfo
+		for _, plugin := range registry.Plugins() {
+			list = append(list, plugin.Name+" ("+plugin.status()+")")
+			if plugin.Err != nil {
+				broken = append(broken, plugin)
+			}
+		}
+		if len(list) == 0 {
+			ctx.Reply("No plugins found.")
+			return
+		}
+		ctx.Reply("Plugins: " + strings.Join(list, ", ") + ".")
+		for _, plugin := range broken {
+			ctx.Reply(plugin.Name + ": " + plugin.Err.Error())
+		}
+	case subcommand == "reload" && len(ctx.Args) == 1:
+		ctx.Reply(fmt.Sprintf("Reloaded %d plugins.", len(registry.Plugins())))
+	case (subcommand == "enable" || subcommand == "disable") && len(ctx.Args) == 2:
+		var plugin *pluginInfo
+		for _, p := range registry.Plugins() {
+			if strings.EqualFold(p.Name, ctx.Args[1]) {
+				plugin = &p
+				break
+			}
+		}
+		if plugin == nil {
+			ctx.Reply("Unknown plugin " + ctx.Args[1] + ".")
+			return
+		}
+		if err := registry.EnablePlugin(config.PluginsFolder, plugin.Name, subcommand == "enable"); err != nil {
+			ctx.Reply("Error storing plugin state.")
+			ctx.Log.Error("Error storing plugin state.", "plugin", plugin.Name, "err", err)
+			return
+		}
+		state := "Disabled"
+		if subcommand == "enable" {
+			state = "Enabled"
+		}
+		ctx.Reply(state + " plugin " + plugin.Name + ".")
+	default:
+		ctx.Reply("Usage: " + b.prefix(ctx.Channel) + "plugins [list/reload] or <enable/disable> <plugin>")
+	}
+}
+
+// The runPlugin method runs cmd until it exits, and kills its process group when it runs past the timeout of limits,
+// writes more than it may to stdout (closing full), or the bot shuts down. Only then is an error other than
+// *exec.ExitError returned.
+func (b *Bot) runPlugin(cmd *exec.Cmd, limits pluginLimits, full <-chan struct{}) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	timer := time.NewTimer(limits.Timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-done:
+		return err
+	case <-timer.C:
+		err = fmt.Errorf("Error running plugin: timed out after %s.", limits.Timeout)
+	case <-full:
+		err = fmt.Errorf("Error running plugin: more than %d bytes of output.", limits.Output)
+	case <-b.ctx.Done():
+		err = errors.New("Error running plugin: the bot is shutting down.")
+	}
+	killGroup(cmd)
+	// A process that left the group may still hold the output open, which would keep Wait from returning.
+	select {
+	case <-done:
+	case <-time.After(pluginKillGrace):
+	}
+	return err
+}
+
+// Small utility function that creates the working folder of the plugin name, inside the plugins folder, and returns it.
+func pluginFolder(name string) (string, error) {
+	dir := filepath.Join(config.PluginsFolder, pluginDataFolder, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("Error creating plugin folder %s: %w", dir, err)
+	}
+	return dir, nil
+}
+
+// Small utility function that returns the environment of a plugin running on dir, without the settings of the bot.
+// Only the variables needed to run programs, and to format text and times, are kept.
+func pluginEnv(dir string) []string {
+	env := []string{"HOME=" + dir}
+	if _, ok := os.LookupEnv("PATH"); !ok {
+		env = append(env, "PATH=/usr/local/bin:/usr/bin:/bin")
+	}
+	for _, name := range []string{"PATH", "LANG", "LC_ALL", "TZ"} {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// The pluginRequest method builds the request envelope sent to a plugin called with ctx.
+func (b *Bot) pluginRequest(ctx *Context, name string) pluginRequest {
+	request := pluginRequest{
+		Version: pluginProtocol,
+		Command: name,
+		Network: b.config.Name,
+		Private: ctx.Private,
+		Nick:    ctx.Nick,
+		Account: ctx.Account,
+		Source:  ctx.Source,
+		Role:    ctx.Role.String(),
+		Args:    append([]string{}, ctx.Args...),
+		Prefix:  b.prefix(ctx.Channel),
+		Config:  config.pluginSettings(name),
+	}
+	if !ctx.Private {
+		request.Channel = ctx.Channel
+		request.Language = b.settings(ctx.Channel).Language
+	}
+	return request
+}
+
+// The runPluginActions method carries out the actions of a plugin response, in order.
+func (b *Bot) runPluginActions(ctx *Context, name string, actions []pluginAction) {
+	for _, action := range actions {
+		switch strings.ToLower(action.Type) {
+		case "say":
+			ctx.Reply(action.Text)
+		case "notice":
+			ctx.Notice(action.Text)
+		case "pm":
+			ctx.ReplyPrivate(action.Text)
+		case "action":
+			ctx.Action(action.Text)
+		case "error":
+			pluginFailures.Inc(b.config.Name, name)
+			ctx.Reply(action.Text)
+			ctx.Log.Error("Plugin reported an error.", "plugin", name, "err", action.Text)
+		default:
+			ctx.Log.Warn("Unknown plugin action.", "plugin", name, "type", action.Type)
+		}
+	}
+}
+
+// Small utility function that parses the stdout of a plugin, which speaks the protocol version of its manifest.
+// It returns false when the output isn't a protocol response, which means it's the plain text of a legacy plugin,
+// and an error when it is one but of a version the bot doesn't speak. Without a protocol version, the output is
+// taken as a response when it looks like one, and the output of a protocol 1 plugin is always plain text.
+func parsePluginResponse(output []byte, protocol int) (response pluginResponse, ok bool, err error) {
+	if protocol == 1 {
+		return pluginResponse{}, false, nil
+	}
+	trimmed := bytes.TrimSpace(output)
+	if !bytes.HasPrefix(trimmed, []byte("{")) || json.Unmarshal(trimmed, &response) != nil || response.Version == 0 {
+		if protocol == pluginProtocol {
+			return pluginResponse{}, false, errors.New("Error parsing plugin response: expected a JSON response.")
+		}
+		return pluginResponse{}, false, nil
+	}
+	if response.Version != pluginProtocol {
+		return response, false, fmt.Errorf("Error parsing plugin response: unsupported protocol version %d.", response.Version)
+	}
+	return response, true, nil
+}
+
+// Small utility function that lets the handler of a plugin know that it finished, so it stops waiting.
+func pluginFinished(finishedCh chan bool) {
+	select {
+	case finishedCh <- true:
+	case <-time.After(1 * time.Second):
+		// If the main thread doesn't read the channel, then timeout after 1 second.
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Small utility function that writes an executable shell script to the plugins folder of the config.
+func writePlugin(t *testing.T, name string, script string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(config.PluginsFolder, name), []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	b := newTestBot(t, nil)
+	folder := config.PluginsFolder
+	config.PluginsFolder = t.TempDir()
+	config.Plugins = map[string]PluginConfig{"hello": {"greeting": "Hi", "timeout": int64(5)}}
+	config.PluginTimeout, config.PluginOutput, config.PluginConcurrency = 5, 64, 2
+	defer func() { config.PluginsFolder, config.Plugins = folder, nil }()
+	request := filepath.Join(config.PluginsFolder, "request.json")
+	writePlugin(t, "legacy", "echo \"Args: $*\"\necho \"Second line.\"\necho \"oops\" >&2\n")
+	writePlugin(t, "hello", "cat > "+request+"\n"+`echo '{"version": 2, "actions": [{"type": "say", "text": "Hi there."}, {"type": "pm", "text": "Psst."}, {"type": "notice", "text": "Note."}, {"type": "action", "text": "waves."}]}'`+"\n")
+	writePlugin(t, "failing", `echo '{"version": 2, "actions": [{"type": "error", "text": "No such driver."}]}'; exit 1`+"\n")
+	writePlugin(t, "future", `echo '{"version": 3, "actions": []}'`+"\n")
+	writePlugin(t, "crash", "echo \"half\"\nexit 2\n")
+	tests := []struct {
+		plugin  string
+		private bool
+		args    []string
+		want    []string
+		failed  bool
+	}{
+		{"legacy", false, []string{"a", "b"}, []string{"reply Args: gluon a b", "reply Second line."}, false},
+		{"hello", true, []string{"x y"}, []string{"reply Hi there.", "private Psst.", "notice Note.", "action waves."}, false},
+		{"failing", false, nil, []string{"reply No such driver."}, true},
+		{"future", false, nil, []string{"reply Error executing plugin."}, true},
+		{"crash", false, nil, []string{"reply Error executing plugin."}, true},
+	}
+	for _, test := range tests {
+		ctx, r := newFakeContext("gluon", "#f1", test.args...)
+		ctx.Private = test.private
+		ctx.Account = "gluon"
+		ctx.Log = b.logger.trackErrors()
+		b.cmdPlugin(ctx, test.plugin, make(chan bool, 1))
+		if !reflect.DeepEqual(r.messages, test.want) || ctx.Log.Failed() != test.failed {
+			t.Errorf("%s replied %q (failed %t), want %q (failed %t)", test.plugin, r.messages, ctx.Log.Failed(), test.want, test.failed)
+		}
+	}
+	data, err := os.ReadFile(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got pluginRequest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := pluginRequest{
+		Version: 2,
+		Command: "hello",
+		Network: "test",
+		Private: true,
+		Nick:    "gluon",
+		Account: "gluon",
+		Source:  "gluon!~gluon@example.com",
+		Role:    "user",
+		Args:    []string{"x y"},
+		Prefix:  "!",
+		Config:  PluginConfig{"greeting": "Hi"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("request = %+v, want %+v", got, want)
+	}
+}
+
+func TestParsePluginResponse(t *testing.T) {
+	for _, test := range []struct {
+		output   string
+		protocol int
+		ok       bool
+		err      bool
+	}{
+		{"Plain text.\n", 0, false, false},
+		{"{not json}\n", 0, false, false},
+		{`{"title": "JSON of a legacy plugin"}`, 0, false, false},
+		{`  {"version": 2, "actions": [{"type": "say", "text": "Hi."}]}`, 0, true, false},
+		{`{"version": 1}`, 0, false, true},
+		{`{"version": 2, "actions": []}`, 1, false, false},
+		{"Plain text.\n", 2, false, true},
+	} {
+		_, ok, err := parsePluginResponse([]byte(test.output), test.protocol)
+		if ok != test.ok || (err != nil) != test.err {
+			t.Errorf("parsePluginResponse(%q) = %t, %v", strings.TrimSpace(test.output), ok, err)
+		}
+	}
+}
+
+func TestPluginSandbox(t *testing.T) {
+	b := newTestBot(t, nil)
+	folder := config.PluginsFolder
+	config.PluginsFolder = t.TempDir()
+	config.Plugins = map[string]PluginConfig{"slow": {"timeout": int64(1)}}
+	config.PluginTimeout, config.PluginOutput, config.PluginConcurrency = 5, 1, 1
+	defer func() { config.PluginsFolder, config.Plugins = folder, nil }()
+	os.Setenv("SCHUMACHER_PASSWORD", "secret")
+	defer os.Unsetenv("SCHUMACHER_PASSWORD")
+	child := filepath.Join(config.PluginsFolder, "child.pid")
+	writePlugin(t, "slow", "sleep 30 &\necho $! > "+child+"\nwait\n")
+	writePlugin(t, "chatty", "yes\n")
+	writePlugin(t, "env", "pwd\necho \"${SCHUMACHER_PASSWORD:-none} $HOME\"\n")
+	tests := []struct {
+		plugin string
+		want   []string
+		failed bool
+	}{
+		{"slow", []string{"reply Error executing plugin."}, true},
+		{"chatty", []string{"reply Error executing plugin."}, true},
+		{"env", []string{
+			"reply " + filepath.Join(config.PluginsFolder, pluginDataFolder, "env"),
+			"reply none " + filepath.Join(config.PluginsFolder, pluginDataFolder, "env"),
+		}, false},
+	}
+	for _, test := range tests {
+		ctx, r := newFakeContext("gluon", "#f1")
+		ctx.Log = b.logger.trackErrors()
+		start := time.Now()
+		b.cmdPlugin(ctx, test.plugin, make(chan bool, 1))
+		if !reflect.DeepEqual(r.messages, test.want) || ctx.Log.Failed() != test.failed {
+			t.Errorf("%s replied %q (failed %t), want %q (failed %t)", test.plugin, r.messages, ctx.Log.Failed(), test.want, test.failed)
+		}
+		if elapsed := time.Since(start); elapsed > 4*time.Second {
+			t.Errorf("%s took %s", test.plugin, elapsed)
+		}
+	}
+	data, err := os.ReadFile(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The killed child may linger as a zombie until it's reaped, which is as dead as it gets.
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err == nil && !strings.Contains(string(stat), ") Z ") {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("child %d of the timed out plugin is still running", pid)
+	}
+}
+
+func TestPluginSlots(t *testing.T) {
+	var slots pluginSlots
+	if !slots.acquire("gluon", 2) || !slots.acquire("Gluon", 2) {
+		t.Fatal("first two plugins were refused")
+	}
+	if slots.acquire("GLUON", 2) {
+		t.Error("third plugin was allowed")
+	}
+	if !slots.acquire("other", 2) {
+		t.Error("plugin of another user was refused")
+	}
+	slots.release("gluon")
+	if !slots.acquire("gluon", 2) {
+		t.Error("plugin was refused after a release")
+	}
+}
+
+func TestPluginLimits(t *testing.T) {
+	c := Config{PluginTimeout: 30, PluginMemory: 512, PluginCPU: 10, PluginOutput: 64, PluginConcurrency: 2}
+	c.Plugins = map[string]PluginConfig{"omdb": {"Timeout": int64(5), "memory": int64(0), "api_key": "x"}}
+	want := pluginLimits{Timeout: 5 * time.Second, CPU: 10, Output: 64 * 1024}
+	if got := c.pluginLimits("OMDB"); got != want {
+		t.Errorf("pluginLimits = %+v, want %+v", got, want)
+	}
+	c.Plugins["omdb"]["output"] = "lots"
+	if problems := c.validatePlugins(); len(problems) != 1 {
+		t.Errorf("validatePlugins = %q, want one problem", problems)
+	}
+}
@@ -1,6 +1,7 @@
 use csv_db::DataBase;
 use f1_plugin::consts;
 use f1_plugin::entities::Driver;
+use f1_plugin::utils;
 use std::env;
 
 fn show_usage() {
@@ -15,6 +16,15 @@ fn main() {
         return;
     }
 
+    let _lock = match utils::lock_db(false) {
+        Ok(lock) => lock,
+        Err(_) => {
+            println!("Error locking database.");
+
+            return;
+        }
+    };
+
     let db = DataBase::new(consts::PATH, None);
 
     match db.select::<Driver>("drivers", None) {
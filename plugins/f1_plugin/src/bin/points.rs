@@ -1,6 +1,7 @@
 use csv_db::DataBase;
 use f1_plugin::consts;
 use f1_plugin::entities::User;
+use f1_plugin::utils;
 use regex::Regex;
 use std::env;
 
@@ -16,6 +17,15 @@ fn main() {
         return;
     }
 
+    let _lock = match utils::lock_db(false) {
+        Ok(lock) => lock,
+        Err(_) => {
+            println!("Error locking database.");
+
+            return;
+        }
+    };
+
     let db = DataBase::new(consts::PATH, None);
 
     let mut users: Vec<User> = match db.select("users", None) {
@@ -9,21 +9,27 @@ const FASTEST_LAP: u32 = 1;
 const BOOST: u32 = 10;
 
 fn main() {
-    let nick = match utils::parse_args() {
-        Ok(nick) => nick,
-        Err(error) => {
-            println!("{}", error);
+    if let Err(error) = utils::parse_args() {
+        println!("{}", error);
 
-            return;
-        }
-    };
+        return;
+    }
 
-    if nick.to_lowercase() != "gluon" {
-        println!("Only the bot admin can use this command.");
+    if !utils::is_admin() {
+        println!("Only the bot admins can use this command.");
 
         return;
     }
 
+    let _lock = match utils::lock_db(true) {
+        Ok(lock) => lock,
+        Err(_) => {
+            println!("Error locking database.");
+
+            return;
+        }
+    };
+
     let db = DataBase::new(consts::PATH, None);
 
     let mut race_results: Vec<RaceResult> = match db.select("race_results", None) {
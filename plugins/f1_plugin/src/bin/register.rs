@@ -1,6 +1,7 @@
 use csv_db::DataBase;
 use f1_plugin::consts;
 use f1_plugin::entities::User;
+use f1_plugin::utils;
 use std::env;
 
 fn show_usage() {
@@ -23,6 +24,15 @@ fn main() {
         String::from(""),
     );
 
+    let _lock = match utils::lock_db(true) {
+        Ok(lock) => lock,
+        Err(_) => {
+            println!("Error locking database.");
+
+            return;
+        }
+    };
+
     let db = DataBase::new(consts::PATH, None);
 
     match db.select("users", None) {
@@ -1 +1,2 @@
 pub const PATH: &str = "/home/gluon/var/irc/bots/Schumacher/";
+pub const LOCK_FILE: &str = "schumacher.lock";
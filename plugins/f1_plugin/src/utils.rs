@@ -1,6 +1,9 @@
+use crate::consts;
 use std::env;
 use std::error::Error;
 use std::fmt;
+use std::fs::{File, OpenOptions};
+use std::path::Path;
 
 #[derive(Debug)]
 pub enum F1PluginError {
@@ -19,6 +22,32 @@ impl fmt::Display for F1PluginError {
     }
 }
 
+// The bot passes the role of the user who ran the command on SCHUMACHER_ROLE.
+pub fn is_admin() -> bool {
+    match env::var("SCHUMACHER_ROLE") {
+        Ok(role) => role == "admin" || role == "owner",
+        Err(_) => false,
+    }
+}
+
+// The bot flocks LOCK_FILE on its folder while it uses the CSV files, shared to read them and exclusive to write them.
+// Binaries that write take the exclusive lock before their first read, so nothing changes between the read and
+// the write, and binaries that only read take the shared lock. The lock is released when the file is dropped.
+pub fn lock_db(exclusive: bool) -> Result<File, Box<dyn Error>> {
+    let file = OpenOptions::new()
+        .write(true)
+        .create(true)
+        .open(Path::new(consts::PATH).join(consts::LOCK_FILE))?;
+
+    if exclusive {
+        file.lock()?;
+    } else {
+        file.lock_shared()?;
+    }
+
+    Ok(file)
+}
+
 pub fn parse_args() -> Result<String, Box<dyn Error>> {
     let args: Vec<String> = env::args().collect();
 
@@ -0,0 +1,483 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var registry = newRegistry() // Registry of all the commands, shared by every network.
+
+// Type that represents a command of the bot, with the metadata used to dispatch it and to generate its help.
+type CommandDef struct {
+	Name        string
+	Aliases     []string
+	Usage       string
+	Description string
+	Role        Role       // Minimum role required to run the command.
+	Async       bool       // Run the handler on its own goroutine, for commands that may take a while.
+	Priority    Priority   // Priority of the replies on the send queue.
+	Reply       ReplyMode  // Where the replies go, where the command was issued by default.
+	ChannelOnly bool       // The command only works on a channel, not on a private message.
+	Channels    []string   // Channels where the command works, every channel and private messages when empty.
+	Plugin      bool       // The command is an executable on the plugins folder.
+	Args        *ArgSchema // Arguments checked before running the handler, nil to pass them as they are.
+	Handler     func(b *Bot, ctx *Context)
+}
+
+// The usage method returns how to use the command, for example "!bet <first> <second> <third> <fl_driver>".
+func (def *CommandDef) usage(prefix string) string {
+	usage := prefix + def.Name
+	if def.Usage != "" {
+		usage += " " + def.Usage
+	}
+	return usage
+}
+
+// The available method returns whether the command works on a channel, or on a private message.
+func (def *CommandDef) available(channel string, private bool) bool {
+	if private {
+		return !def.ChannelOnly && len(def.Channels) == 0
+	}
+	return len(def.Channels) == 0 || containsFold(def.Channels, channel)
+}
+
+// Type that represents a registry of commands indexed by name and aliases.
+type Registry struct {
+	sync.RWMutex
+	commands map[string]*CommandDef // Commands indexed by name.
+	index    map[string]*CommandDef // Commands indexed by name and aliases.
+	plugins  map[string]*pluginInfo // Plugins found on the plugins folder by lower case name, registered or not.
+}
+
+// The newRegistry function creates an empty registry of commands.
+func newRegistry() *Registry {
+	return &Registry{
+		commands: make(map[string]*CommandDef),
+		index:    make(map[string]*CommandDef),
+		plugins:  make(map[string]*pluginInfo),
+	}
+}
+
+// The Register method adds a command to the registry.
+// It fails if the name or any of the aliases of the command is already taken by another command.
+func (r *Registry) Register(def *CommandDef) error {
+	r.Lock()
+	defer r.Unlock()
+	return r.register(def)
+}
+
+func (r *Registry) register(def *CommandDef) error {
+	keys := append([]string{def.Name}, def.Aliases...)
+	for _, key := range keys {
+		if _, ok := r.index[strings.ToLower(key)]; ok {
+			return errors.New("Command name or alias already registered: " + key + ".")
+		}
+	}
+	r.commands[strings.ToLower(def.Name)] = def
+	for _, key := range keys {
+		r.index[strings.ToLower(key)] = def
+	}
+	return nil
+}
+
+func (r *Registry) unregister(def *CommandDef) {
+	delete(r.commands, strings.ToLower(def.Name))
+	for _, key := range append([]string{def.Name}, def.Aliases...) {
+		delete(r.index, strings.ToLower(key))
+	}
+}
+
+// The Lookup method returns the command matching a name or alias, ignoring case.
+func (r *Registry) Lookup(name string) (def *CommandDef, ok bool) {
+	r.RLock()
+	defer r.RUnlock()
+	def, ok = r.index[strings.ToLower(name)]
+	return
+}
+
+// The Commands method returns all the commands of the registry sorted by name.
+func (r *Registry) Commands() (defs []*CommandDef) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, def := range r.commands {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return
+}
+
+// The RefreshPlugins method syncs the plugin commands of the registry with the executables on the plugins folder.
+// New executables are registered, commands of removed or disabled executables are unregistered, and the commands
+// of plugins whose manifest changed are registered again from it. With plugin_manifests set, executables without
+// a manifest are left out. Plugins never shadow a built-in command, so an executable with the name or alias of
+// another command is left out as well.
+func (r *Registry) RefreshPlugins(folder string) error {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return fmt.Errorf("Error reading plugins folder %s: %w", folder, err)
+	}
+	disabled, err := readDisabledPlugins(folder)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]*pluginInfo) // Plugins indexed by lower case name.
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() || info.Mode()&0111 == 0 || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		found[strings.ToLower(entry.Name())] = &pluginInfo{Name: entry.Name(), Disabled: disabled[strings.ToLower(entry.Name())]}
+	}
+	for _, entry := range entries {
+		plugin, ok := found[strings.ToLower(strings.TrimSuffix(entry.Name(), manifestExt))]
+		if info, err := entry.Info(); ok && err == nil && strings.HasSuffix(entry.Name(), manifestExt) {
+			plugin.Modified = info.ModTime().UnixNano()
+		}
+	}
+	r.Lock()
+	defer r.Unlock()
+	for name, def := range r.commands {
+		if !def.Plugin {
+			continue
+		}
+		plugin, ok := found[name]
+		if !ok || plugin.Disabled || (config.PluginManifests && plugin.Modified == 0) ||
+			r.plugins[name] == nil || plugin.Modified != r.plugins[name].Modified {
+			r.unregister(def)
+		}
+	}
+	for name, plugin := range found {
+		// Manifests are only read again when they change, and so are their errors only logged then.
+		old, ok := r.plugins[name]
+		changed := !ok || old.Modified != plugin.Modified
+		if !changed {
+			plugin.Manifest = old.Manifest
+			if old.Manifest == nil && old.Modified != 0 {
+				plugin.Err = old.Err
+			}
+		} else if plugin.Modified != 0 {
+			plugin.Manifest, plugin.Err = loadManifest(filepath.Join(folder, plugin.Name+manifestExt), plugin.Name)
+		}
+		if plugin.Manifest == nil && plugin.Err == nil && config.PluginManifests {
+			plugin.Err = errors.New("Missing plugin manifest.")
+		}
+		if _, registered := r.commands[name]; registered || plugin.Disabled || plugin.Err != nil {
+			if plugin.Err != nil && changed {
+				defaultLogger.Warn("Skipping plugin.", "plugin", plugin.Name, "err", plugin.Err)
+			}
+			continue
+		}
+		if err := r.register(pluginDef(plugin)); err != nil {
+			plugin.Err = err
+			if changed {
+				defaultLogger.Warn("Skipping plugin.", "plugin", plugin.Name, "err", err)
+			}
+			continue
+		}
+		if changed {
+			defaultLogger.Info("Plugin loaded.", "plugin", plugin.Name, "manifest", plugin.Manifest != nil)
+		}
+	}
+	r.plugins = found
+	return nil
+}
+
+// The Manifest method returns the manifest of the plugin name, or nil when it has none.
+func (r *Registry) Manifest(name string) *PluginManifest {
+	r.RLock()
+	defer r.RUnlock()
+	if plugin, ok := r.plugins[strings.ToLower(name)]; ok {
+		return plugin.Manifest
+	}
+	return nil
+}
+
+// The Plugins method returns all the plugins found on the plugins folder sorted by name, registered or not.
+func (r *Registry) Plugins() (plugins []pluginInfo) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, plugin := range r.plugins {
+		plugins = append(plugins, *plugin)
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return
+}
+
+// The EnablePlugin method enables or disables the plugin name, which is kept on the plugins folder across restarts.
+// The registry is then refreshed, so that the command of the plugin is registered or unregistered right away.
+func (r *Registry) EnablePlugin(folder string, name string, enabled bool) error {
+	disabled, err := readDisabledPlugins(folder)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		delete(disabled, strings.ToLower(name))
+	} else {
+		disabled[strings.ToLower(name)] = true
+	}
+	if err := writeDisabledPlugins(folder, disabled); err != nil {
+		return err
+	}
+	return r.RefreshPlugins(folder)
+}
+
+// Small utility function that returns the command definition of a plugin executable, described by its manifest.
+// Only executables found on the plugins folder get a definition, so arbitrary paths can never be run.
+func pluginDef(plugin *pluginInfo) *CommandDef {
+	name := plugin.Name
+	def := &CommandDef{
+		Name:        name,
+		Description: "Plugin command.",
+		Async:       true,
+		Plugin:      true,
+		Handler: func(b *Bot, ctx *Context) {
+			// Let the user know when a plugin takes a while, since it runs as an external process.
+			finishedCh := make(chan bool)
+			go func() {
+				select {
+				case <-finishedCh:
+				case <-time.After(4 * time.Second):
+					ctx.Reply("Command is taking long to run... Please wait.")
+				}
+			}()
+			b.cmdPlugin(ctx, name, finishedCh)
+		},
+	}
+	if manifest := plugin.Manifest; manifest != nil {
+		def.Aliases = manifest.Aliases
+		def.Usage = manifest.Usage
+		def.Channels = manifest.Channels
+		if manifest.Description != "" {
+			def.Description = manifest.Description
+		}
+		if manifest.Role != "" {
+			def.Role, _ = parseRole(manifest.Role)
+		}
+		if manifest.Reply != "" {
+			def.Reply, _ = parseReplyMode(manifest.Reply)
+		}
+	}
+	return def
+}
+
+// The builtinCommands function returns the definitions of all the built-in commands of the bot.
+func builtinCommands() []*CommandDef {
+	return []*CommandDef{
+		{
+			Name:        "ask",
+			Aliases:     []string{"a"},
+			Usage:       "<question>",
+			Description: "Ask the bot a question.",
+			Args:        &ArgSchema{Min: 1, Max: -1},
+			Handler:     (*Bot).cmdAsk,
+		},
+		{
+			Name:        "bet",
+			Aliases:     []string{"b"},
+			Usage:       "<first> <second> <third> <fl_driver> or [log/nick]",
+			Description: "Place a bet for the next F1 race or get bet info, privately on a private message to the bot.",
+			Async:       true,
+			Args:        &ArgSchema{Counts: []int{0, 1, 4}},
+			Handler:     (*Bot).cmdBet,
+		},
+		{
+			Name:        "channel",
+			Usage:       "[setting] [value]",
+			Description: "Show the settings of the channel, or change one of category, commands, prefix, feeds, titles and language (default restores it).",
+			Role:        RoleAdmin,
+			Args: &ArgSchema{Max: -1, Options: []OptionDef{
+				{Name: "channel", Value: true, Description: "Channel to configure, the current one by default."},
+			}},
+			Handler: (*Bot).cmdChannel,
+		},
+		{
+			Name:        "grant",
+			Usage:       "<mask> <role>",
+			Description: "Grant a role to the users matching a hostmask (nick!user@host) or an account ($a:account).",
+			Role:        RoleAdmin,
+			Args:        &ArgSchema{Counts: []int{2}},
+			Handler:     (*Bot).cmdGrant,
+		},
+		{
+			Name:        "bind",
+			Usage:       "<nick> <mask>",
+			Description: "Bind a registered nick to the hostmask (nick!user@host) or account ($a:account) of its owner.",
+			Role:        RoleAdmin,
+			Args:        &ArgSchema{Counts: []int{2}},
+			Handler:     (*Bot).cmdBind,
+		},
+		{
+			Name:        "health",
+			Description: "Show the state of the connection of the bot to the network.",
+			Role:        RoleAdmin,
+			Reply:       ReplyNotice,
+			Args:        &ArgSchema{},
+			Handler:     (*Bot).cmdHealth,
+		},
+		{
+			Name:        "help",
+			Aliases:     []string{"c", "h", "commands"},
+			Usage:       "[command]",
+			Description: "Show this help message.",
+			Args:        &ArgSchema{Max: 1},
+			Handler:     (*Bot).cmdHelp,
+		},
+		{
+			Name:        "join",
+			Usage:       "<channel>",
+			Description: "Join a channel and stay on it across restarts.",
+			Role:        RoleAdmin,
+			Args:        &ArgSchema{Counts: []int{1}},
+			Handler:     (*Bot).cmdJoin,
+		},
+		{
+			Name:        "next",
+			Aliases:     []string{"n"},
+			Usage:       "[category]",
+			Description: "Show the next motorsport event.",
+			Async:       true,
+			Args:        &ArgSchema{Max: -1},
+			Handler:     (*Bot).cmdNext,
+		},
+		{
+			Name:        "notify",
+			Aliases:     []string{"ny"},
+			Usage:       "<on/off>",
+			Description: "Turn on/off notifications for the current channel.",
+			Async:       true,
+			Args:        &ArgSchema{Counts: []int{1}},
+			ChannelOnly: true,
+			Handler:     (*Bot).cmdNotify,
+		},
+		{
+			Name:        "part",
+			Usage:       "[channel]",
+			Description: "Leave a channel, the current one by default, and stay off it across restarts.",
+			Role:        RoleAdmin,
+			Args:        &ArgSchema{Max: 1},
+			Handler:     (*Bot).cmdPart,
+		},
+		{
+			Name:        "plugins",
+			Usage:       "[list/reload] or <enable/disable> <plugin>",
+			Description: "List the plugins, reload them with their manifests, or enable or disable one.",
+			Role:        RoleAdmin,
+			Args:        &ArgSchema{Max: 2},
+			Handler:     (*Bot).cmdPlugins,
+		},
+		{
+			Name:        "poll",
+			Aliases:     []string{"p"},
+			Usage:       "[--timeout seconds] <question;option_1;option_2;option_n> or stop",
+			Description: "Start a poll on the current channel.",
+			Async:       true,
+			Priority:    PriorityHigh,
+			Args: &ArgSchema{Min: 1, Max: -1, Options: []OptionDef{
+				{Name: "timeout", Value: true, Description: "Seconds to vote."},
+			}},
+			ChannelOnly: true,
+			Handler:     (*Bot).cmdPoll,
+		},
+		/*
+			{
+				Name:        "processbets",
+				Aliases:     []string{"pb"},
+				Description: "Process the bets of the last race.",
+				Role:        RoleAdmin,
+				Handler:     (*Bot).cmdProcessBets,
+			},
+		*/
+		{
+			Name:        "quiz",
+			Aliases:     []string{"qz"},
+			Usage:       "[--timeout seconds] [number] or stop",
+			Description: "Start an F1 quiz game.",
+			Async:       true,
+			Priority:    PriorityHigh,
+			Args: &ArgSchema{Max: 1, Options: []OptionDef{
+				{Name: "timeout", Value: true, Description: "Seconds to answer each question."},
+			}},
+			ChannelOnly: true,
+			Handler:     (*Bot).cmdQuiz,
+		},
+		{
+			Name:        "quote",
+			Aliases:     []string{"q"},
+			Usage:       "[get/add] [text]",
+			Description: "Get a random quote or add one.",
+			Args:        &ArgSchema{Max: -1},
+			ChannelOnly: true,
+			Handler:     (*Bot).cmdQuote,
+		},
+		{
+			Name:        "register",
+			Aliases:     []string{"rr"},
+			Description: "Register your nick with the bot.",
+			Async:       true,
+			Handler:     (*Bot).cmdRegister,
+		},
+		/*
+			{
+				Name:        "wbc",
+				Aliases:     []string{"points"},
+				Description: "Show the current Betting Championship standings.",
+				Async:       true,
+				Handler:     func(b *Bot, ctx *Context) { b.cmdStandings(ctx, "bet") },
+			},
+		*/
+		{
+			Name:        "revoke",
+			Usage:       "<mask>",
+			Description: "Revoke the role granted to a hostmask or an account.",
+			Role:        RoleAdmin,
+			Args:        &ArgSchema{Counts: []int{1}},
+			Handler:     (*Bot).cmdRevoke,
+		},
+		{
+			Name:        "roles",
+			Description: "Show the roles granted to users and your own role.",
+			Role:        RoleModerator,
+			Reply:       ReplyNotice,
+			Args:        &ArgSchema{},
+			Handler:     (*Bot).cmdRoles,
+		},
+		{
+			Name:        "wcc",
+			Description: "Show the current World Constructor Championship standings.",
+			Async:       true,
+			Args:        &ArgSchema{},
+			Handler:     func(b *Bot, ctx *Context) { b.cmdStandings(ctx, "constructor") },
+		},
+		{
+			Name:        "wdc",
+			Description: "Show the current World Driver Championship standings.",
+			Async:       true,
+			Args:        &ArgSchema{},
+			Handler:     func(b *Bot, ctx *Context) { b.cmdStandings(ctx, "driver") },
+		},
+	}
+}
@@ -0,0 +1,435 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// The records of each table, used to decode and validate its rows.
+var tableRecords = map[string]func() Record{
+	answersFile:    func() Record { return &Answer{} },
+	betsFile:       func() Record { return &Bet{} },
+	channelsFile:   func() Record { return &ChannelSettings{} },
+	driversFile:    func() Record { return &Driver{} },
+	eventsFile:     func() Record { return &Event{} },
+	feedsFile:      func() Record { return &Feed{} },
+	identitiesFile: func() Record { return &Identity{} },
+	quizFile:       func() Record { return &Question{} },
+	quotesFile:     func() Record { return &Quote{} },
+	resultsFile:    func() Record { return &RaceResult{} },
+	rolesFile:      func() Record { return &RoleGrant{} },
+	usersFile:      func() Record { return &User{} },
+}
+
+// The newRecord function returns an empty record of a table, either of the bot or declared by a module.
+func newRecord(table string) Record {
+	if record, ok := tableRecords[table]; ok {
+		return record()
+	}
+	return &moduleRecord{validate: moduleTables[table].Validate}
+}
+
+// Type that represents the repository of registered users.
+type UserRepo struct{ tx *Tx }
+
+// Type that represents the repository of bets.
+type BetRepo struct{ tx *Tx }
+
+// Type that represents the repository of race results.
+type ResultRepo struct{ tx *Tx }
+
+// Type that represents the repository of drivers.
+type DriverRepo struct{ tx *Tx }
+
+// Type that represents the repository of events.
+type EventRepo struct{ tx *Tx }
+
+// Type that represents the repository of news feeds.
+type FeedRepo struct{ tx *Tx }
+
+// Type that represents the repository of quotes.
+type QuoteRepo struct{ tx *Tx }
+
+// Type that represents the repository of quiz questions.
+type QuestionRepo struct{ tx *Tx }
+
+// Type that represents the repository of answers of the ask command.
+type AnswerRepo struct{ tx *Tx }
+
+// Type that represents the repository of the roles granted to users.
+type RoleRepo struct{ tx *Tx }
+
+// Type that represents the repository of channel settings.
+type ChannelRepo struct{ tx *Tx }
+
+func (tx *Tx) Users() UserRepo         { return UserRepo{tx} }
+func (tx *Tx) Bets() BetRepo           { return BetRepo{tx} }
+func (tx *Tx) Results() ResultRepo     { return ResultRepo{tx} }
+func (tx *Tx) Drivers() DriverRepo     { return DriverRepo{tx} }
+func (tx *Tx) Events() EventRepo       { return EventRepo{tx} }
+func (tx *Tx) Feeds() FeedRepo         { return FeedRepo{tx} }
+func (tx *Tx) Quotes() QuoteRepo       { return QuoteRepo{tx} }
+func (tx *Tx) Questions() QuestionRepo { return QuestionRepo{tx} }
+func (tx *Tx) Answers() AnswerRepo     { return AnswerRepo{tx} }
+func (tx *Tx) Roles() RoleRepo         { return RoleRepo{tx} }
+func (tx *Tx) Channels() ChannelRepo   { return ChannelRepo{tx} }
+
+// The decode method returns the records of a table, in the order they are stored.
+// Invalid rows are logged with their file and line and skipped, so one bad row doesn't take a whole table down.
+func (tx *Tx) decode(table string) (records []Record, err error) {
+	rows, err := tx.Rows(table)
+	if err != nil {
+		return
+	}
+	for i, row := range rows {
+		record := newRecord(table)
+		err := record.UnmarshalCSV(row)
+		if err != nil {
+			defaultLogger.Warn("Skipping invalid row.", "err", tx.rowError(table, i, err))
+			continue
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+// The put method replaces the first record of a table for which match returns true, or appends record if none does.
+// Invalid rows are kept as they are, so that they can still be fixed by hand.
+func (tx *Tx) put(table string, record Record, match func(Record) bool) error {
+	rows, err := tx.Rows(table)
+	if err != nil {
+		return err
+	}
+	updated := append([][]string{}, rows...)
+	for i, row := range updated {
+		current := newRecord(table)
+		if current.UnmarshalCSV(row) == nil && match(current) {
+			updated[i] = record.MarshalCSV()
+			return tx.SetRows(table, updated)
+		}
+	}
+	return tx.SetRows(table, append(updated, record.MarshalCSV()))
+}
+
+// The remove method removes the records of a table for which match returns true, and returns how many were removed.
+// Invalid rows are kept as they are, like on put.
+func (tx *Tx) remove(table string, match func(Record) bool) (removed int, err error) {
+	rows, err := tx.Rows(table)
+	if err != nil {
+		return
+	}
+	var kept [][]string
+	for _, row := range rows {
+		current := newRecord(table)
+		if current.UnmarshalCSV(row) == nil && match(current) {
+			removed++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	if removed > 0 {
+		err = tx.SetRows(table, kept)
+	}
+	return
+}
+
+// The rowError method returns the error of an invalid row, pointing to where the row is stored.
+func (tx *Tx) rowError(table string, index int, err error) error {
+	return &RowError{Source: tx.tables.source(table), Line: index + 1, Err: err}
+}
+
+// The validate method checks every row of every table and returns the errors of all the invalid rows.
+func (tx *Tx) validate() (problems []error) {
+	for _, table := range tables {
+		rows, err := tx.Rows(table)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		for i, row := range rows {
+			err := newRecord(table).UnmarshalCSV(row)
+			if err != nil {
+				problems = append(problems, tx.rowError(table, i, err))
+			}
+		}
+	}
+	return
+}
+
+// The All method returns every registered user, with the mask of its identity.
+func (r UserRepo) All() (users []User, err error) {
+	records, err := r.tx.decode(usersFile)
+	if err != nil {
+		return
+	}
+	identities, err := r.tx.decode(identitiesFile)
+	if err != nil {
+		return
+	}
+	masks := make(map[string]string)
+	for _, record := range identities {
+		identity := record.(*Identity)
+		masks[strings.ToLower(identity.Nick)] = identity.Mask
+	}
+	for _, record := range records {
+		user := *record.(*User)
+		user.Mask = masks[strings.ToLower(user.Nick)]
+		users = append(users, user)
+	}
+	return
+}
+
+// The Get method returns the user with a nick, ignoring case.
+func (r UserRepo) Get(nick string) (user User, ok bool, err error) {
+	users, err := r.All()
+	for _, user := range users {
+		if strings.EqualFold(user.Nick, nick) {
+			return user, true, nil
+		}
+	}
+	return
+}
+
+// The Identify method returns the user matching an account or hostmask (nick!user@host).
+// Users without a mask, registered before users had an identity, are only matched by a services account named
+// after them, since holding their nick proves nothing. The others need an admin to bind them to their identity.
+func (r UserRepo) Identify(source string, account string) (user User, ok bool, err error) {
+	users, err := r.All()
+	for _, user := range users {
+		if user.Mask != "" && matchMask(user.Mask, source, account) {
+			return user, true, nil
+		}
+	}
+	for _, user := range users {
+		if user.Mask == "" && account != "" && strings.EqualFold(user.Nick, account) {
+			return user, true, nil
+		}
+	}
+	return
+}
+
+// The Put method adds a user, or replaces the user with the same nick, and binds its nick to its mask when it has one.
+func (r UserRepo) Put(user User) error {
+	err := r.tx.put(usersFile, &user, func(record Record) bool {
+		return strings.EqualFold(record.(*User).Nick, user.Nick)
+	})
+	if err != nil || user.Mask == "" {
+		return err
+	}
+	records, err := r.tx.decode(identitiesFile)
+	for _, record := range records {
+		if identity := record.(*Identity); strings.EqualFold(identity.Nick, user.Nick) && identity.Mask == user.Mask {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	identity := Identity{Nick: user.Nick, Mask: user.Mask}
+	return r.tx.put(identitiesFile, &identity, func(record Record) bool {
+		return strings.EqualFold(record.(*Identity).Nick, user.Nick)
+	})
+}
+
+// The All method returns every bet, from the oldest to the newest.
+func (r BetRepo) All() (bets []Bet, err error) {
+	records, err := r.tx.decode(betsFile)
+	for _, record := range records {
+		bets = append(bets, *record.(*Bet))
+	}
+	return
+}
+
+// The Get method returns the bet of a nick for a race, ignoring case.
+func (r BetRepo) Get(race string, nick string) (bet Bet, ok bool, err error) {
+	bets, err := r.All()
+	for _, bet := range bets {
+		if strings.EqualFold(bet.Race, race) && strings.EqualFold(bet.Nick, nick) {
+			return bet, true, nil
+		}
+	}
+	return
+}
+
+// The Put method adds a bet, or replaces the bet of the same nick for the same race.
+func (r BetRepo) Put(bet Bet) error {
+	return r.tx.put(betsFile, &bet, func(record Record) bool {
+		current := record.(*Bet)
+		return strings.EqualFold(current.Race, bet.Race) && strings.EqualFold(current.Nick, bet.Nick)
+	})
+}
+
+// The Last method returns the results of the last race, which are the first row of the table.
+func (r ResultRepo) Last() (result RaceResult, err error) {
+	records, err := r.tx.decode(resultsFile)
+	if err == nil && len(records) == 0 {
+		err = errors.New("Error getting results: no valid results found.")
+	}
+	if err != nil {
+		return
+	}
+	return *records[0].(*RaceResult), nil
+}
+
+// The Put method replaces the results of a race, or adds them when the race has none.
+func (r ResultRepo) Put(result RaceResult) error {
+	return r.tx.put(resultsFile, &result, func(record Record) bool {
+		return strings.EqualFold(record.(*RaceResult).Race, result.Race)
+	})
+}
+
+// The All method returns every driver.
+func (r DriverRepo) All() (drivers []Driver, err error) {
+	records, err := r.tx.decode(driversFile)
+	for _, record := range records {
+		drivers = append(drivers, *record.(*Driver))
+	}
+	return
+}
+
+// The Get method returns the driver with a code, ignoring case.
+func (r DriverRepo) Get(code string) (driver Driver, ok bool, err error) {
+	drivers, err := r.All()
+	for _, driver := range drivers {
+		if strings.EqualFold(driver.Code, code) {
+			return driver, true, nil
+		}
+	}
+	return
+}
+
+// The All method returns every event, in the order they are stored, which is chronological.
+func (r EventRepo) All() (events []Event, err error) {
+	records, err := r.tx.decode(eventsFile)
+	for _, record := range records {
+		events = append(events, *record.(*Event))
+	}
+	return
+}
+
+// The All method returns every news feed.
+func (r FeedRepo) All() (feeds []Feed, err error) {
+	records, err := r.tx.decode(feedsFile)
+	for _, record := range records {
+		feeds = append(feeds, *record.(*Feed))
+	}
+	return
+}
+
+// The Put method adds a feed, or replaces the feed with the same URL on the same channel.
+func (r FeedRepo) Put(feed Feed) error {
+	return r.tx.put(feedsFile, &feed, func(record Record) bool {
+		current := record.(*Feed)
+		return current.URL == feed.URL && strings.EqualFold(current.Channel, feed.Channel)
+	})
+}
+
+// The Channel method returns the quotes added to a channel.
+func (r QuoteRepo) Channel(channel string) (quotes []Quote, err error) {
+	records, err := r.tx.decode(quotesFile)
+	for _, record := range records {
+		if quote := record.(*Quote); strings.EqualFold(quote.Channel, channel) {
+			quotes = append(quotes, *quote)
+		}
+	}
+	return
+}
+
+// The Add method adds a quote.
+func (r QuoteRepo) Add(quote Quote) error {
+	return r.tx.put(quotesFile, &quote, func(Record) bool { return false })
+}
+
+// The Channel method returns the quiz questions of a channel.
+func (r QuestionRepo) Channel(channel string) (questions []Question, err error) {
+	records, err := r.tx.decode(quizFile)
+	for _, record := range records {
+		if question := record.(*Question); strings.EqualFold(question.Channel, channel) {
+			questions = append(questions, *question)
+		}
+	}
+	return
+}
+
+// The All method returns every answer of the ask command.
+func (r AnswerRepo) All() (answers []Answer, err error) {
+	records, err := r.tx.decode(answersFile)
+	for _, record := range records {
+		answers = append(answers, *record.(*Answer))
+	}
+	return
+}
+
+// The All method returns every role granted to users.
+func (r RoleRepo) All() (grants []RoleGrant, err error) {
+	records, err := r.tx.decode(rolesFile)
+	for _, record := range records {
+		grants = append(grants, *record.(*RoleGrant))
+	}
+	return
+}
+
+// The Put method grants a role to a mask, replacing the role the same mask had, ignoring case.
+func (r RoleRepo) Put(grant RoleGrant) error {
+	return r.tx.put(rolesFile, &grant, func(record Record) bool {
+		return strings.EqualFold(record.(*RoleGrant).Mask, grant.Mask)
+	})
+}
+
+// The Delete method revokes the role of a mask, ignoring case, and returns weather it had one.
+func (r RoleRepo) Delete(mask string) (ok bool, err error) {
+	removed, err := r.tx.remove(rolesFile, func(record Record) bool {
+		return strings.EqualFold(record.(*RoleGrant).Mask, mask)
+	})
+	return removed > 0, err
+}
+
+// The All method returns the settings of every channel of every network.
+func (r ChannelRepo) All() (settings []ChannelSettings, err error) {
+	records, err := r.tx.decode(channelsFile)
+	for _, record := range records {
+		settings = append(settings, *record.(*ChannelSettings))
+	}
+	return
+}
+
+// The Get method returns the settings of a channel of a network, ignoring case.
+func (r ChannelRepo) Get(network string, channel string) (settings ChannelSettings, ok bool, err error) {
+	records, err := r.tx.decode(channelsFile)
+	for _, record := range records {
+		if settings := record.(*ChannelSettings); settings.is(network, channel) {
+			return *settings, true, nil
+		}
+	}
+	return
+}
+
+// The Put method adds the settings of a channel, or replaces the ones of the same channel of the same network.
+func (r ChannelRepo) Put(settings ChannelSettings) error {
+	return r.tx.put(channelsFile, &settings, func(record Record) bool {
+		return record.(*ChannelSettings).is(settings.Network, settings.Channel)
+	})
+}
+
+// The is method returns whether the settings are the ones of a channel of a network, ignoring case.
+func (c ChannelSettings) is(network string, channel string) bool {
+	return strings.EqualFold(c.Network, network) && strings.EqualFold(c.Channel, channel)
+}
@@ -0,0 +1,103 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Type that represents the ways a command handler can answer the user who issued a command.
+// Handlers only talk to a Responder, so that they don't depend on the IRC connection.
+type Responder interface {
+	Reply(message string)        // Send a message to the channel where the command was issued.
+	ReplyPrivate(message string) // Send a private message to the user who issued the command.
+	Notice(message string)       // Send a notice to the user who issued the command.
+	Action(message string)       // Send an action (/me) to the channel where the command was issued.
+}
+
+// Type that represents where the replies of a command go.
+type ReplyMode int
+
+const (
+	ReplyPublic  ReplyMode = iota // To the channel where the command was issued, or to the user on a private message.
+	ReplyPrivate                  // To the user, on a private message, so that the rest of the channel doesn't see them.
+	ReplyNotice                   // To the user, as a notice.
+)
+
+// Names of the reply modes, as set on the manifests of the plugins.
+var replyModeNames = []string{"public", "private", "notice"}
+
+// Small utility function that parses the name of a reply mode, ignoring case.
+func parseReplyMode(name string) (ReplyMode, error) {
+	for i, modeName := range replyModeNames {
+		if strings.EqualFold(name, modeName) {
+			return ReplyMode(i), nil
+		}
+	}
+	return ReplyPublic, fmt.Errorf("invalid reply %q, expected one of %s.", name, strings.Join(replyModeNames, ", "))
+}
+
+// Type that represents the context of a command, which is passed to every command handler.
+type Context struct {
+	Command
+	Responder
+	Log *Logger // Logger that adds the network, channel, nick and command to every record.
+}
+
+// Type that represents a Responder that answers through the send queue of an IRC connection.
+type ircResponder struct {
+	queue    *SendQueue
+	priority Priority
+	mode     ReplyMode
+	channel  string
+	nick     string
+}
+
+// The newContext function creates the context of a command issued on an IRC connection, answered with priority.
+// Replies follow mode, while private, notice and action replies always go where they say.
+func newContext(queue *SendQueue, command Command, priority Priority, mode ReplyMode) *Context {
+	return &Context{
+		Command:   command,
+		Responder: &ircResponder{queue: queue, priority: priority, mode: mode, channel: command.Channel, nick: command.Nick},
+	}
+}
+
+func (r *ircResponder) Reply(message string) {
+	switch r.mode {
+	case ReplyPrivate:
+		r.ReplyPrivate(message)
+	case ReplyNotice:
+		r.Notice(message)
+	default:
+		r.queue.Privmsg(r.priority, r.channel, message)
+	}
+}
+
+func (r *ircResponder) ReplyPrivate(message string) {
+	r.queue.Privmsg(r.priority, r.nick, message)
+}
+
+func (r *ircResponder) Notice(message string) {
+	r.queue.Notice(r.priority, r.nick, message)
+}
+
+func (r *ircResponder) Action(message string) {
+	r.queue.Action(r.priority, r.channel, message)
+}
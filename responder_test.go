@@ -0,0 +1,122 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+// Type that represents an in-memory Responder, which records every message instead of sending it.
+// It is safe for concurrent use, since games run on their own goroutine.
+type fakeResponder struct {
+	sync.Mutex
+	messages []string
+}
+
+// The newFakeContext function creates the context of a command that is answered by a fakeResponder.
+func newFakeContext(nick string, channel string, args ...string) (*Context, *fakeResponder) {
+	r := &fakeResponder{}
+	return &Context{Command: Command{Nick: nick, Source: nick + "!~" + nick + "@example.com", Channel: channel, Args: args}, Responder: r}, r
+}
+
+func (r *fakeResponder) record(kind string, message string) {
+	r.Lock()
+	defer r.Unlock()
+	r.messages = append(r.messages, kind+" "+message)
+}
+
+func (r *fakeResponder) Reply(message string)        { r.record("reply", message) }
+func (r *fakeResponder) ReplyPrivate(message string) { r.record("private", message) }
+func (r *fakeResponder) Notice(message string)       { r.record("notice", message) }
+func (r *fakeResponder) Action(message string)       { r.record("action", message) }
+
+// The replies method returns the messages sent with Reply so far.
+func (r *fakeResponder) replies() (replies []string) {
+	r.Lock()
+	defer r.Unlock()
+	for _, m := range r.messages {
+		if strings.HasPrefix(m, "reply ") {
+			replies = append(replies, strings.TrimPrefix(m, "reply "))
+		}
+	}
+	return
+}
+
+// The contains method checks if any reply contains the given text.
+func (r *fakeResponder) contains(text string) bool {
+	for _, reply := range r.replies() {
+		if strings.Contains(reply, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIRCResponderModes(t *testing.T) {
+	q := newSendQueue(nil, nil, 1, 0)
+	command := Command{Nick: "alice", Channel: "#f1"}
+	for _, mode := range []ReplyMode{ReplyPublic, ReplyPrivate, ReplyNotice} {
+		newContext(q, command, PriorityNormal, mode).Reply("hi")
+	}
+	want := "PRIVMSG #f1 :hi|PRIVMSG alice :hi|NOTICE alice :hi"
+	if lines := strings.Join(q.queues[PriorityNormal], "|"); lines != want {
+		t.Errorf("queued %q, want %q", lines, want)
+	}
+}
+
+func TestPrivateMessages(t *testing.T) {
+	useBuiltins(t)
+	b := newTestBot(t, nil)
+	for _, message := range []string{"!help", "!poll Best?;Senna;Prost", "!nope", "!bet"} {
+		b.onPrivmsg(&irc.Event{Code: "PRIVMSG", Nick: "alice", Source: "alice!u@host", Arguments: []string{"Schumacher", message}})
+	}
+	b.work.Wait()
+	var lines []string
+	for _, queue := range b.queue.queues {
+		lines = append(lines, queue...)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "PRIVMSG alice :") {
+			t.Errorf("reply %q wasn't sent to the sender", line)
+		}
+	}
+	if got := strings.Join(lines, "|"); !strings.Contains(got, "This is a list of all the commands") || strings.Contains(got, "!poll") ||
+		!strings.Contains(got, "This command only works on a channel.") || !strings.Contains(got, "Unknown command or plugin.") ||
+		!strings.Contains(got, "You're not a registered user.") {
+		t.Errorf("replies %q", got)
+	}
+	// On a channel, replies stay on the channel, so that everyone sees the bets looked up with !bet <nick>.
+	b = newTestBot(t, nil)
+	b.onPrivmsg(&irc.Event{Code: "PRIVMSG", Nick: "alice", Source: "alice!u@host", Arguments: []string{"#f1", "!bet"}})
+	b.work.Wait()
+	if lines := queuedLines(b); len(lines) != 1 || !strings.HasPrefix(lines[0], "PRIVMSG #f1 :You're not a registered user.") {
+		t.Errorf("channel replies %q", lines)
+	}
+	// The roles of the users aren't shown on the channel, but to the one who asked for them, as a notice.
+	b = newTestBot(t, nil)
+	b.onPrivmsg(&irc.Event{Code: "PRIVMSG", Nick: "gluon", Source: "gluon!u@host", Tags: map[string]string{"account": "gluon"}, Arguments: []string{"#f1", "!roles"}})
+	b.work.Wait()
+	if lines := queuedLines(b); len(lines) != 1 || lines[0] != "NOTICE gluon :No roles granted. Your role: owner." {
+		t.Errorf("roles replies %q", lines)
+	}
+}
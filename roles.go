@@ -0,0 +1,233 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Type that represents the role of a user, which sets the commands the user can run.
+// Roles are ordered, so each role can do everything the roles below it can.
+type Role int
+
+const (
+	RoleUser      Role = iota // Anyone, the role of users without a granted role.
+	RoleModerator             // Users that can moderate games and other channel activity.
+	RoleAdmin                 // Users that can run admin commands and grant the roles below admin.
+	RoleOwner                 // Owners of the bot, set on the config, who can grant any other role.
+)
+
+var roleNames = []string{"user", "moderator", "admin", "owner"}
+
+func (r Role) String() string {
+	if r < RoleUser || r > RoleOwner {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// Small utility function that returns the role with a name, ignoring case.
+func parseRole(name string) (Role, error) {
+	for i, roleName := range roleNames {
+		if strings.EqualFold(name, roleName) {
+			return Role(i), nil
+		}
+	}
+	return RoleUser, fmt.Errorf("invalid role %q, expected one of %s.", name, strings.Join(roleNames, ", "))
+}
+
+// Small utility function that checks if a mask is a hostmask like nick!user@host or an account like $a:account.
+func checkMask(mask string) error {
+	if strings.HasPrefix(mask, "$a:") && len(mask) > 3 {
+		return nil
+	}
+	bang := strings.Index(mask, "!")
+	at := strings.LastIndex(mask, "@")
+	if bang < 1 || at < bang+2 || at == len(mask)-1 || strings.ContainsAny(mask, " ,") {
+		return fmt.Errorf("invalid mask %q, expected nick!user@host or $a:account.", mask)
+	}
+	return nil
+}
+
+// Small utility function that checks if a user with a source (nick!user@host) and account matches a mask.
+// Account masks never match users without an account, and both kinds of masks accept * and ? wildcards.
+func matchMask(mask string, source string, account string) bool {
+	if strings.HasPrefix(mask, "$a:") {
+		return account != "" && wildcardMatch(strings.ToLower(mask[3:]), strings.ToLower(account))
+	}
+	return source != "" && wildcardMatch(strings.ToLower(mask), strings.ToLower(source))
+}
+
+// Small utility function that matches a string against a pattern, where * matches any text and ? any character.
+func wildcardMatch(pattern string, s string) bool {
+	var p, i, star, mark = 0, 0, -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// The roleOf method returns the highest role of a user, given its source (nick!user@host) and account.
+// Owners come from the config, every other role comes from the roles granted on the storage.
+func (b *Bot) roleOf(source string, account string) (role Role) {
+	for _, mask := range b.config.ownerMasks() {
+		if matchMask(mask, source, account) {
+			return RoleOwner
+		}
+	}
+	// The grants are kept in memory, since they are needed for every command, and read again after they change.
+	value, err := b.cache.get(rolesFile, func() (interface{}, error) {
+		var grants []RoleGrant
+		err := b.store.View(func(tx *Tx) (err error) {
+			grants, err = tx.Roles().All()
+			return
+		})
+		return grants, err
+	})
+	if err != nil {
+		b.logger.Error("Error getting roles.", "err", err)
+	}
+	grants, _ := value.([]RoleGrant)
+	for _, grant := range grants {
+		if grant.Role > role && matchMask(grant.Mask, source, account) {
+			role = grant.Role
+		}
+	}
+	return
+}
+
+// The grant command receives a context with a mask and a role.
+// It then grants the role to the users matching the mask, as long as the role is below the role of the nick.
+// A mask that already has a role, or belongs to an owner, can only be granted another one when its current role
+// is below the role of the nick too, so that nobody can demote their peers.
+func (b *Bot) cmdGrant(ctx *Context) {
+	mask := ctx.Args[0]
+	if checkMask(mask) != nil {
+		ctx.Reply("Invalid mask, use a hostmask like nick!user@host or an account like $a:account.")
+		return
+	}
+	role, err := parseRole(ctx.Args[1])
+	if err != nil {
+		ctx.Reply("Invalid role, use one of " + strings.Join(roleNames[:RoleOwner], ", ") + ".")
+		return
+	}
+	if role >= ctx.Role {
+		ctx.Reply("You can only grant roles below your own role (" + ctx.Role.String() + ").")
+		return
+	}
+	reply := "Granted the " + role.String() + " role to " + mask + "."
+	if containsFold(b.config.ownerMasks(), mask) {
+		ctx.Reply("You can only change roles below your own role (" + ctx.Role.String() + ").")
+		return
+	}
+	defer b.cache.invalidate(rolesFile)
+	err = b.store.Update(func(tx *Tx) error {
+		grants, err := tx.Roles().All()
+		if err != nil {
+			return err
+		}
+		for _, grant := range grants {
+			if strings.EqualFold(grant.Mask, mask) && grant.Role >= ctx.Role {
+				reply = "You can only change roles below your own role (" + ctx.Role.String() + ")."
+				return nil
+			}
+		}
+		return tx.Roles().Put(RoleGrant{Mask: mask, Role: role})
+	})
+	if err != nil {
+		ctx.Reply("Error storing role.")
+		ctx.Log.Error("Error storing role.", "err", err)
+		return
+	}
+	ctx.Reply(reply)
+}
+
+// The revoke command receives a context with a mask.
+// It then revokes the role granted to the mask, as long as that role is below the role of the nick.
+func (b *Bot) cmdRevoke(ctx *Context) {
+	mask := ctx.Args[0]
+	var reply string
+	defer b.cache.invalidate(rolesFile)
+	err := b.store.Update(func(tx *Tx) error {
+		grants, err := tx.Roles().All()
+		if err != nil {
+			return err
+		}
+		for _, grant := range grants {
+			if strings.EqualFold(grant.Mask, mask) && grant.Role >= ctx.Role {
+				reply = "You can only revoke roles below your own role (" + ctx.Role.String() + ")."
+				return nil
+			}
+		}
+		ok, err := tx.Roles().Delete(mask)
+		if err == nil && !ok {
+			reply = mask + " has no role."
+		} else {
+			reply = "Revoked the role of " + mask + "."
+		}
+		return err
+	})
+	if err != nil {
+		ctx.Reply("Error storing role.")
+		ctx.Log.Error("Error storing role.", "err", err)
+		return
+	}
+	ctx.Reply(reply)
+}
+
+// The roles command receives a context.
+// It then shows the roles granted to users, along with the role of the nick.
+func (b *Bot) cmdRoles(ctx *Context) {
+	var grants []RoleGrant
+	err := b.store.View(func(tx *Tx) (err error) {
+		grants, err = tx.Roles().All()
+		return
+	})
+	if err != nil {
+		ctx.Reply("Error getting roles.")
+		ctx.Log.Error("Error getting roles.", "err", err)
+		return
+	}
+	if len(grants) == 0 {
+		ctx.Reply("No roles granted. Your role: " + ctx.Role.String() + ".")
+		return
+	}
+	var list []string
+	for _, grant := range grants {
+		list = append(list, grant.Mask+" ("+grant.Role.String()+")")
+	}
+	ctx.Reply("Roles: " + strings.Join(list, ", ") + ". Your role: " + ctx.Role.String() + ".")
+}
@@ -0,0 +1,127 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "testing"
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask    string
+		source  string
+		account string
+		want    bool
+	}{
+		{"gluon!*@*.users.quakenet.org", "gluon!~vasco@gluon.users.quakenet.org", "", true},
+		{"GLUON!*@*", "gluon!~vasco@example.com", "", true},
+		{"gluon!*@*.users.quakenet.org", "gluon!~vasco@example.com", "", false},
+		{"*!?vasco@*", "other!~vasco@example.com", "", true},
+		{"$a:gluon", "gluon!~vasco@example.com", "", false},
+		{"$a:gluon", "impostor!~x@example.com", "Gluon", true},
+		{"$a:glu*", "gluon!~vasco@example.com", "gluon", true},
+		{"$a:gluon", "gluon!~vasco@example.com", "other", false},
+	}
+	for _, test := range tests {
+		if got := matchMask(test.mask, test.source, test.account); got != test.want {
+			t.Errorf("matchMask(%q, %q, %q) = %v, want %v", test.mask, test.source, test.account, got, test.want)
+		}
+	}
+}
+
+func TestCheckMask(t *testing.T) {
+	for _, mask := range []string{"gluon!*@*", "*!*@example.com", "$a:gluon"} {
+		if err := checkMask(mask); err != nil {
+			t.Errorf("checkMask(%q): %v", mask, err)
+		}
+	}
+	for _, mask := range []string{"gluon", ":", "gluon!@host", "gluon!user@", "!user@host", "a!b@c,d!e@f"} {
+		if err := checkMask(mask); err == nil {
+			t.Errorf("checkMask(%q): expected an error", mask)
+		}
+	}
+}
+
+func TestRoleOf(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{
+		rolesFile: {
+			{"*!*@mods.example.com", "moderator"},
+			{"$a:alice", "admin"},
+			{"bob!*@*", "superuser"}, // Invalid rows are skipped.
+		},
+	})
+	b.config.Owners = "owner!*@home.example.com"
+	tests := []struct {
+		source  string
+		account string
+		want    Role
+	}{
+		{"owner!~me@home.example.com", "", RoleOwner},
+		{"alice!~alice@mods.example.com", "alice", RoleAdmin},
+		{"carol!~carol@mods.example.com", "", RoleModerator},
+		{"bob!~bob@example.com", "", RoleUser},
+		{"gluon!~vasco@example.com", "gluon", RoleUser}, // Owners replace the admin nick.
+	}
+	for _, test := range tests {
+		if got := b.roleOf(test.source, test.account); got != test.want {
+			t.Errorf("roleOf(%q, %q) = %v, want %v", test.source, test.account, got, test.want)
+		}
+	}
+	b.config.Owners = ""
+	if got := b.roleOf("someone!~x@example.com", "gluon"); got != RoleOwner {
+		t.Errorf("roleOf with the admin nick account = %v, want owner", got)
+	}
+	// Without owners or admin_nick on the config, nobody is an owner.
+	b.config.AdminNick = defaultConfig().AdminNick
+	if got := b.roleOf("gluon!~vasco@example.com", "gluon"); got != RoleUser {
+		t.Errorf("roleOf without owners = %v, want user", got)
+	}
+}
+
+func TestCmdGrantRevoke(t *testing.T) {
+	b := newTestBot(t, nil)
+	tests := []struct {
+		cmd  func(*Context)
+		role Role
+		args []string
+		want string
+	}{
+		{b.cmdGrant, RoleAdmin, []string{"carol", "moderator"}, "Invalid mask, use a hostmask like nick!user@host or an account like $a:account."},
+		{b.cmdGrant, RoleAdmin, []string{"$a:carol", "boss"}, "Invalid role, use one of user, moderator, admin."},
+		{b.cmdGrant, RoleAdmin, []string{"$a:carol", "admin"}, "You can only grant roles below your own role (admin)."},
+		{b.cmdGrant, RoleAdmin, []string{"$a:carol", "moderator"}, "Granted the moderator role to $a:carol."},
+		{b.cmdGrant, RoleOwner, []string{"$a:dave", "admin"}, "Granted the admin role to $a:dave."},
+		{b.cmdGrant, RoleAdmin, []string{"$a:DAVE", "user"}, "You can only change roles below your own role (admin)."},
+		{b.cmdGrant, RoleAdmin, []string{"$a:gluon", "moderator"}, "You can only change roles below your own role (admin)."},
+		{b.cmdRevoke, RoleAdmin, []string{"$a:dave"}, "You can only revoke roles below your own role (admin)."},
+		{b.cmdRevoke, RoleAdmin, []string{"$a:CAROL"}, "Revoked the role of $a:CAROL."},
+		{b.cmdRevoke, RoleAdmin, []string{"$a:carol"}, "$a:carol has no role."},
+		{b.cmdRoles, RoleModerator, nil, "Roles: $a:dave (admin). Your role: moderator."},
+	}
+	for _, test := range tests {
+		ctx, r := newFakeContext("alice", "#f1", test.args...)
+		ctx.Role = test.role
+		test.cmd(ctx)
+		if !r.contains(test.want) {
+			t.Errorf("%v as %s: got %q, want %q", test.args, test.role, r.replies(), test.want)
+		}
+	}
+	// The admin role of dave survives the attempt of another admin to lower it.
+	if got := b.roleOf("dave!~dave@example.com", "dave"); got != RoleAdmin {
+		t.Errorf("roleOf(dave) = %v, want admin", got)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// The sandbox function makes cmd run on its own process group, under the memory and CPU limits of limits.
+// Go can't set the rlimits of a child process, so a shell sets them with ulimit and then execs the plugin.
+func sandbox(cmd *exec.Cmd, limits pluginLimits) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var ulimits []string
+	if limits.Memory > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -v %d", limits.Memory*1024))
+	}
+	if limits.CPU > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -t %d", limits.CPU))
+	}
+	if len(ulimits) == 0 {
+		return
+	}
+	// The plugin becomes $0 of the script and its arguments $@, so none of them is ever parsed by the shell.
+	cmd.Args = append([]string{"/bin/sh", "-c", strings.Join(ulimits, " && ") + ` && exec "$0" "$@"`}, cmd.Args...)
+	cmd.Path = "/bin/sh"
+}
+
+// The killGroup function kills the process group of cmd, so that the processes started by a plugin die with it.
+func killGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
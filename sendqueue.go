@@ -0,0 +1,208 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxLineLength   = 512 // Maximum length of an IRC line in bytes, including the trailing CRLF.
+	maxPrefixLength = 100 // Room left for the nick!user@host prefix that the server adds when relaying a message.
+)
+
+// Type that represents the priority of an outgoing message.
+type Priority int
+
+const (
+	PriorityNormal Priority = iota // Replies to commands and event announcements.
+	PriorityHigh                   // Replies of games and services authentication, which are time sensitive.
+	PriorityLow                    // Feed items and anything else that can wait.
+	priorities                     // Number of priorities.
+)
+
+var sendOrder = [priorities]Priority{PriorityHigh, PriorityNormal, PriorityLow} // Order in which the priorities are sent.
+
+// Type that represents the queue of outgoing messages of a connection.
+// Messages are sent by priority, and in order within the same priority, at the pace of a token bucket:
+// up to burst messages are sent at once, then one more every interval, so that the bot never floods the server.
+type SendQueue struct {
+	sync.Mutex
+	queues   [priorities][]string // Raw lines waiting to be sent, one queue per priority.
+	sending  bool                 // Bool to check if a line was taken from the queues and is being sent.
+	wake     chan struct{}        // Signals the sending loop that there are new lines.
+	send     func(line string)    // Writes a raw line to the connection.
+	nick     func() string        // Returns the nick of the bot, used to leave room for its prefix.
+	burst    int
+	interval time.Duration
+}
+
+// The newSendQueue function creates a queue that writes lines with send, allowing burst lines at once and then one every interval.
+func newSendQueue(send func(line string), nick func() string, burst int, interval time.Duration) *SendQueue {
+	return &SendQueue{
+		wake:     make(chan struct{}, 1),
+		send:     send,
+		nick:     nick,
+		burst:    burst,
+		interval: interval,
+	}
+}
+
+// The Privmsg method queues a message to a channel or nick, split into as many lines as needed.
+func (q *SendQueue) Privmsg(priority Priority, target string, message string) {
+	q.push(priority, "PRIVMSG "+target+" :", "", message)
+}
+
+// The Notice method queues a notice to a channel or nick, split into as many lines as needed.
+func (q *SendQueue) Notice(priority Priority, target string, message string) {
+	q.push(priority, "NOTICE "+target+" :", "", message)
+}
+
+// The Action method queues an action (/me) to a channel or nick, split into as many lines as needed.
+func (q *SendQueue) Action(priority Priority, target string, message string) {
+	q.push(priority, "PRIVMSG "+target+" :\x01ACTION ", "\x01", message)
+}
+
+// The Raw method queues a raw IRC command, like JOIN or PART, which is sent as it is.
+func (q *SendQueue) Raw(priority Priority, line string) {
+	q.Lock()
+	q.queues[priority] = append(q.queues[priority], line)
+	q.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *SendQueue) push(priority Priority, head string, tail string, message string) {
+	limit := maxLineLength - len("\r\n") - len(head) - len(tail) - maxPrefixLength
+	if q.nick != nil {
+		limit -= len(q.nick())
+	}
+	var lines []string
+	for _, text := range strings.Split(strings.ReplaceAll(message, "\r", ""), "\n") {
+		for _, part := range splitText(text, limit) {
+			lines = append(lines, head+part+tail)
+		}
+	}
+	q.Lock()
+	q.queues[priority] = append(q.queues[priority], lines...)
+	q.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// The pop method removes and returns the next line to send, from the queue with the highest priority.
+func (q *SendQueue) pop() (line string, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+	for _, i := range sendOrder {
+		if len(q.queues[i]) > 0 {
+			line = q.queues[i][0]
+			q.queues[i] = q.queues[i][1:]
+			q.sending = true
+			return line, true
+		}
+	}
+	return
+}
+
+// The Len method returns the number of lines waiting to be sent.
+func (q *SendQueue) Len() (n int) {
+	q.Lock()
+	defer q.Unlock()
+	for _, queue := range q.queues {
+		n += len(queue)
+	}
+	return
+}
+
+// The Drain method waits up to timeout for every queued line to be sent, and returns whether they were.
+func (q *SendQueue) Drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		q.Lock()
+		idle := !q.sending
+		q.Unlock()
+		if idle && q.Len() == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// The run method sends the queued lines until stop is closed, refilling one token every interval up to burst.
+func (q *SendQueue) run(stop <-chan struct{}) {
+	tokens := q.burst
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	for {
+		for tokens > 0 {
+			line, ok := q.pop()
+			if !ok {
+				break
+			}
+			q.send(line)
+			q.Lock()
+			q.sending = false
+			q.Unlock()
+			tokens--
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if tokens < q.burst {
+				tokens++
+			}
+		case <-q.wake:
+		}
+	}
+}
+
+// Small utility function that splits a text into parts of up to limit bytes.
+// Texts are split on the last space that fits, or else on the last complete UTF-8 character that fits.
+func splitText(text string, limit int) (parts []string) {
+	if limit < utf8.UTFMax {
+		limit = utf8.UTFMax
+	}
+	for len(text) > limit {
+		cut := strings.LastIndex(text[:limit+1], " ")
+		if cut <= 0 {
+			cut = limit
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			parts = append(parts, text[:cut])
+			text = text[cut:]
+			continue
+		}
+		parts = append(parts, text[:cut])
+		text = text[cut+1:]
+	}
+	return append(parts, text)
+}
@@ -0,0 +1,139 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Type that represents a connection that records the lines sent to it, with the time they were sent.
+type fakeConn struct {
+	sync.Mutex
+	lines []string
+	times []time.Time
+}
+
+func (c *fakeConn) send(line string) {
+	c.Lock()
+	defer c.Unlock()
+	c.lines = append(c.lines, line)
+	c.times = append(c.times, time.Now())
+}
+
+func (c *fakeConn) sent() ([]string, []time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string{}, c.lines...), append([]time.Time{}, c.times...)
+}
+
+func TestSendQueuePriorities(t *testing.T) {
+	conn := &fakeConn{}
+	q := newSendQueue(conn.send, nil, 3, time.Hour)
+	q.Privmsg(PriorityLow, "#f1", "feed")
+	q.Privmsg(PriorityNormal, "#f1", "reply")
+	q.Notice(PriorityHigh, "alice", "answer")
+	q.Privmsg(PriorityNormal, "#f1", "second reply")
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(stop)
+	time.Sleep(50 * time.Millisecond)
+	lines, _ := conn.sent()
+	want := []string{"NOTICE alice :answer", "PRIVMSG #f1 :reply", "PRIVMSG #f1 :second reply"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("sent %q, want %q", lines, want)
+	}
+	if q.Len() != 1 {
+		t.Errorf("Len() = %d, want the feed item still queued", q.Len())
+	}
+}
+
+func TestSendQueuePacing(t *testing.T) {
+	conn := &fakeConn{}
+	q := newSendQueue(conn.send, nil, 2, 50*time.Millisecond)
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(stop)
+	start := time.Now()
+	q.Privmsg(PriorityNormal, "#f1", "1\n2\n3\n4\n5")
+	for deadline := time.Now().Add(2 * time.Second); q.Len() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	lines, times := conn.sent()
+	if len(lines) != 5 || lines[4] != "PRIVMSG #f1 :5" {
+		t.Fatalf("sent %q", lines)
+	}
+	// The burst goes out at once, then one line for each interval.
+	if times[1].Sub(start) > 40*time.Millisecond {
+		t.Errorf("the burst took %v", times[1].Sub(start))
+	}
+	if elapsed := times[4].Sub(start); elapsed < 140*time.Millisecond {
+		t.Errorf("5 lines were sent in %v, want at least 3 intervals", elapsed)
+	}
+}
+
+func TestSendQueueSplitsLines(t *testing.T) {
+	conn := &fakeConn{}
+	q := newSendQueue(conn.send, func() string { return "Schumacher" }, 100, time.Hour)
+	message := strings.Repeat("Räikkönen ", 60) + strings.Repeat("ü", 400)
+	q.Action(PriorityNormal, "#f1", message)
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(stop)
+	time.Sleep(50 * time.Millisecond)
+	lines, _ := conn.sent()
+	if len(lines) < 3 {
+		t.Fatalf("sent %d lines, want the message split", len(lines))
+	}
+	var text string
+	for _, line := range lines {
+		if len(line)+len("\r\n")+maxPrefixLength+len("Schumacher") > maxLineLength {
+			t.Errorf("line of %d bytes is too long", len(line))
+		}
+		if !strings.HasPrefix(line, "PRIVMSG #f1 :\x01ACTION ") || !strings.HasSuffix(line, "\x01") || !utf8.ValidString(line) {
+			t.Errorf("malformed line %q", line)
+		}
+		text += strings.TrimSuffix(strings.TrimPrefix(line, "PRIVMSG #f1 :\x01ACTION "), "\x01")
+	}
+	if strings.ReplaceAll(text, " ", "") != strings.ReplaceAll(message, " ", "") {
+		t.Error("the split lines don't add up to the message")
+	}
+}
+
+func TestSendQueueDrain(t *testing.T) {
+	conn := &fakeConn{}
+	q := newSendQueue(conn.send, nil, 1, 20*time.Millisecond)
+	q.Privmsg(PriorityNormal, "#f1", "1\n2\n3")
+	if q.Drain(0) {
+		t.Error("Drain(0) = true with lines queued")
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(stop)
+	if !q.Drain(time.Second) {
+		t.Fatalf("Drain() = false with %d lines still queued", q.Len())
+	}
+	if lines, _ := conn.sent(); len(lines) != 3 {
+		t.Errorf("sent %q after draining, want 3 lines", lines)
+	}
+}
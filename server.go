@@ -0,0 +1,113 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The newHTTPHandler function creates the handler of the HTTP server, which reports on bots.
+// /healthz answers 200 when every bot is connected and can read its storage, and 503 otherwise,
+// with the health of each network as JSON. /metrics exposes the metrics on the Prometheus text format.
+func newHTTPHandler(bots []*Bot) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		healthy := true
+		statuses := make([]HealthStatus, 0, len(bots))
+		for _, b := range bots {
+			status := b.status()
+			if !status.Connected || status.Storage != "ok" {
+				healthy = false
+			}
+			statuses = append(statuses, status)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Healthy  bool           `json:"healthy"`
+			Networks []HealthStatus `json:"networks"`
+		}{healthy, statuses})
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.WriteTo(w)
+	})
+	return mux
+}
+
+// The serveHTTP function serves handler on addr until ctx is cancelled, then shuts the server down.
+// The address is either host:port or unix: followed by the path of a unix socket, which only its owner can use.
+// Requests get ctx as their context, so that streams end when the bot shuts down instead of holding the server up.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) error {
+	listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	defaultLogger.Info("Serving HTTP.", "addr", addr)
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		<-done
+		return nil
+	}
+	return err
+}
+
+// Small utility function that listens on a host:port or unix:path address.
+// A socket left behind by a previous run is removed first, but any other file on the path is left alone.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Error restricting socket %s: %w", path, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,83 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	b := newTestBot(t, map[string][][]string{eventsFile: testEvents()})
+	handler := newHTTPHandler([]*Bot{b})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	var health struct {
+		Healthy  bool
+		Networks []HealthStatus
+	}
+	w := get("/healthz")
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable || health.Healthy || len(health.Networks) != 1 || health.Networks[0].Storage != "ok" {
+		t.Errorf("/healthz while offline = %d %s", w.Code, w.Body)
+	}
+	b.health.SetOnline()
+	b.health.Pong()
+	w = get("/healthz")
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || !health.Healthy || health.Networks[0].Network != "test" || health.Networks[0].LastPong == nil {
+		t.Errorf("/healthz while online = %d %s", w.Code, w.Body)
+	}
+	commandsTotal.Inc(b.config.Name, "next", "ok")
+	w = get("/metrics")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `schumacher_commands_total{network="test",command="next",outcome="ok"}`) {
+		t.Errorf("/metrics = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCommandOutcomes(t *testing.T) {
+	b := newTestBot(t, nil)
+	useBuiltins(t)
+	def, _ := registry.Lookup("next")
+	ctx, _ := newFakeContext("gluon", "#f1")
+	ctx.Log = b.logger.trackErrors()
+	// Without its folder the storage can't be read, which fails the command.
+	os.RemoveAll(b.config.Folder)
+	b.dispatch(ctx, def)
+	b.work.Wait()
+	if !ctx.Log.Failed() {
+		t.Error("next without storage didn't log an error")
+	}
+	var text strings.Builder
+	metrics.WriteTo(&text)
+	if !strings.Contains(text.String(), `schumacher_commands_total{network="test",command="next",outcome="error"}`) {
+		t.Errorf("metrics don't count the failed command:\n%s", text.String())
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The tables of the storage, named after the CSV files that hold them on the csv backend, followed by the ones
+// declared by the modules.
+var tables = append([]string{answersFile, betsFile, channelsFile, driversFile, eventsFile, feedsFile, identitiesFile, quizFile, quotesFile, resultsFile, rolesFile, usersFile}, moduleTableNames(modules)...)
+
+var errWriteOnView = errors.New("Error writing to storage: read-only transaction.")
+
+// Type that represents the storage of a bot instance, where all of its state is kept.
+// Every read and write happens inside a transaction, so concurrent commands and tasks can't lose each other's updates.
+type Store interface {
+	View(fn func(tx *Tx) error) error   // Runs fn on a read-only transaction.
+	Update(fn func(tx *Tx) error) error // Runs fn on a read-write transaction, which is discarded if fn returns an error.
+	Close() error
+}
+
+// Type that represents the tables of a storage backend as seen from inside a transaction.
+type tableSet interface {
+	read(table string) ([][]string, error)
+	write(table string, rows [][]string) error
+	source(table string) string // Where the table is stored, used to report invalid rows.
+}
+
+// Type that represents a transaction on the storage.
+// The typed repositories of each kind of data are obtained from it, so all of them share the transaction.
+type Tx struct {
+	tables tableSet
+}
+
+// The Rows method returns all the rows of a table as they are stored.
+// Code outside of the storage should use the typed repositories instead, which validate each row.
+func (tx *Tx) Rows(table string) ([][]string, error) {
+	return tx.tables.read(table)
+}
+
+// The SetRows method replaces all the rows of a table as they are.
+func (tx *Tx) SetRows(table string, rows [][]string) error {
+	return tx.tables.write(table, rows)
+}
+
+var (
+	stores   = make(map[string]Store) // Open stores indexed by backend and folder, so networks can share a folder.
+	storesMu sync.Mutex
+	caches   = make(map[Store]*storeCache) // Caches of the stores, shared by the networks that share a store.
+)
+
+// Time a cached table is used before it is read again, so that changes made outside of the bot still apply.
+const cacheTime = time.Minute
+
+// Type that represents the tables of a store that are read on every message or command, kept in memory.
+// The bot drops a table from the cache whenever it changes it, and every table is read again after cacheTime.
+type storeCache struct {
+	sync.Mutex
+	tables map[string]cachedTable
+}
+
+// Type that represents a table kept in memory, decoded the way its users need it.
+type cachedTable struct {
+	value  interface{}
+	loaded time.Time
+}
+
+// The cacheOf function returns the cache of a store, creating it on first use.
+func cacheOf(store Store) *storeCache {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	cache, ok := caches[store]
+	if !ok {
+		cache = &storeCache{tables: make(map[string]cachedTable)}
+		caches[store] = cache
+	}
+	return cache
+}
+
+// The get method returns the cached value of a table, calling load to read it when it isn't cached or is too old.
+// Failed loads aren't cached, so that they are retried on the next use.
+func (c *storeCache) get(table string, load func() (interface{}, error)) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+	if cached, ok := c.tables[table]; ok && time.Since(cached.loaded) < cacheTime {
+		return cached.value, nil
+	}
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.tables[table] = cachedTable{value, time.Now()}
+	return value, nil
+}
+
+// The invalidate method drops a table from the cache, after it was changed.
+func (c *storeCache) invalidate(table string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.tables, table)
+}
+
+// The openStore function opens the storage of a network with the backend chosen on its config.
+// Networks that share a folder and a backend share the same store.
+func openStore(n NetworkConfig) (store Store, err error) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	key := strings.ToLower(n.Storage) + ":" + filepath.Clean(n.Folder)
+	if store, ok := stores[key]; ok {
+		return store, nil
+	}
+	switch strings.ToLower(n.Storage) {
+	case "csv":
+		store = newCSVStore(n.Folder, n.Backups)
+	case "", "bolt":
+		store, err = openBoltStore(n.path(boltFile))
+	default:
+		err = errors.New("Error opening storage: unknown backend " + n.Storage + ".")
+	}
+	if err != nil {
+		return
+	}
+	stores[key] = store
+	return
+}
+
+// The needsImport function reports weather a network uses the bolt storage without a database yet, while its folder
+// has CSV files, as when upgrading from the csv storage. Those files should be imported with -import first.
+func needsImport(n NetworkConfig) bool {
+	if !strings.EqualFold(n.Storage, "bolt") {
+		return false
+	}
+	if _, err := os.Stat(n.path(boltFile)); !os.IsNotExist(err) {
+		return false
+	}
+	for _, table := range tables {
+		if _, err := os.Stat(n.path(table)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// The closeStores function closes every open store.
+func closeStores() {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	for key, store := range stores {
+		store.Close()
+		delete(stores, key)
+	}
+}
+
+// The checkStore function validates every row of every table of store and returns the errors of the invalid rows.
+// Invalid rows are skipped by the repositories, so this is how they get reported before they go unnoticed.
+func checkStore(store Store) (problems []error) {
+	err := store.View(func(tx *Tx) error {
+		problems = tx.validate()
+		return nil
+	})
+	if err != nil {
+		problems = append(problems, err)
+	}
+	return
+}
+
+// The importCSV function copies every CSV file found on folder to the matching table of store.
+// Tables whose CSV file doesn't exist are left untouched, the others are replaced as a whole.
+// All the tables are imported on a single transaction, so a failed import doesn't leave the store half imported.
+func importCSV(folder string, store Store) (imported map[string]int, err error) {
+	source := newCSVStore(folder, 0)
+	imported = make(map[string]int)
+	err = store.Update(func(tx *Tx) error {
+		return source.View(func(csvTx *Tx) error {
+			for _, table := range tables {
+				if !fileExists(filepath.Join(folder, table)) {
+					continue
+				}
+				rows, err := csvTx.Rows(table)
+				if err != nil {
+					return err
+				}
+				err = tx.SetRows(table, rows)
+				if err != nil {
+					return fmt.Errorf("Error importing %s: %w", table, err)
+				}
+				imported[table] = len(rows)
+			}
+			return nil
+		})
+	})
+	return
+}
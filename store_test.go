@@ -0,0 +1,242 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Small utility function that returns one store of each backend, both on temporary folders.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	bolt, err := openBoltStore(filepath.Join(t.TempDir(), boltFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+	return map[string]Store{"csv": newCSVStore(t.TempDir(), 0), "bolt": bolt}
+}
+
+func TestStoreRepositories(t *testing.T) {
+	for name, store := range testStores(t) {
+		err := store.Update(func(tx *Tx) error {
+			for _, user := range []User{
+				{Nick: "alice", TimeZone: "Europe/Lisbon", Channels: []string{"#f1"}},
+				{Nick: "bob", TimeZone: "Europe/Berlin"},
+				{Nick: "Alice", TimeZone: "Europe/Lisbon", Points: 10, Channels: []string{"#f1", "#motorsport"}},
+			} {
+				if err := tx.Users().Put(user); err != nil {
+					return err
+				}
+			}
+			return tx.Feeds().Put(Feed{Name: "F1", URL: "https://example.com/rss", Channel: "#f1", LastTime: time.Date(2023, 5, 28, 13, 0, 0, 0, time.UTC)})
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var users []User
+		var feeds []Feed
+		err = store.View(func(tx *Tx) (err error) {
+			users, err = tx.Users().All()
+			if err != nil {
+				return
+			}
+			feeds, err = tx.Feeds().All()
+			return
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := []User{
+			{Nick: "Alice", TimeZone: "Europe/Lisbon", Points: 10, Channels: []string{"#f1", "#motorsport"}},
+			{Nick: "bob", TimeZone: "Europe/Berlin"},
+		}
+		if !reflect.DeepEqual(users, want) {
+			t.Errorf("%s: users = %+v, want %+v", name, users, want)
+		}
+		if len(feeds) != 1 || !feeds[0].LastTime.Equal(time.Date(2023, 5, 28, 13, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s: feeds = %+v", name, feeds)
+		}
+	}
+}
+
+func TestStoreRollback(t *testing.T) {
+	for name, store := range testStores(t) {
+		failure := errors.New("failure")
+		err := store.Update(func(tx *Tx) error {
+			if err := tx.Quotes().Add(Quote{Date: "01-01-2023", Text: "Lights out", Channel: "#f1"}); err != nil {
+				return err
+			}
+			return failure
+		})
+		if err != failure {
+			t.Errorf("%s: got error %v, want %v", name, err, failure)
+		}
+		err = store.View(func(tx *Tx) error {
+			quotes, err := tx.Quotes().Channel("#f1")
+			if err == nil && len(quotes) != 0 {
+				t.Errorf("%s: quotes of a failed transaction were stored: %v", name, quotes)
+			}
+			return err
+		})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		err = store.View(func(tx *Tx) error {
+			return tx.Quotes().Add(Quote{Text: "Read only"})
+		})
+		if err == nil {
+			t.Errorf("%s: writing on a read-only transaction should fail", name)
+		}
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	folder := t.TempDir()
+	for name, data := range map[string][][]string{
+		usersFile:   {{"alice", "Europe/Lisbon", "3", "#f1"}},
+		driversFile: {{"1", "ver", "1"}, {"44", "ham", "2"}},
+		quizFile:    {{"Who won the 2007 title?", "Raikkonen", "#f1"}},
+	} {
+		if err := writeCSV(filepath.Join(folder, name), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := openBoltStore(filepath.Join(folder, boltFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	imported, err := importCSV(folder, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{usersFile: 1, driversFile: 2, quizFile: 1}; !reflect.DeepEqual(imported, want) {
+		t.Errorf("imported = %v, want %v", imported, want)
+	}
+	err = store.View(func(tx *Tx) error {
+		user, ok, err := tx.Users().Get("ALICE")
+		if err != nil || !ok || user.Points != 3 || !reflect.DeepEqual(user.Channels, []string{"#f1"}) {
+			t.Errorf("user = %+v, %v, %v", user, ok, err)
+		}
+		drivers, err := tx.Rows(driversFile)
+		if err != nil || len(drivers) != 2 || drivers[1][1] != "ham" {
+			t.Errorf("drivers = %v, %v", drivers, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenStoreShared(t *testing.T) {
+	defer closeStores()
+	folder := t.TempDir()
+	first, err := openStore(NetworkConfig{Folder: folder, Storage: "bolt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := openStore(NetworkConfig{Folder: folder + "/", Storage: "bolt"})
+	if err != nil || first != second {
+		t.Errorf("networks sharing a folder should share the store: %v", err)
+	}
+	if _, err := openStore(NetworkConfig{Folder: folder, Storage: "sqlite"}); err == nil {
+		t.Error("opening an unknown backend should fail")
+	}
+}
+
+func TestNeedsImport(t *testing.T) {
+	defer closeStores()
+	n := NetworkConfig{Folder: t.TempDir(), Storage: "bolt"}
+	if needsImport(n) {
+		t.Error("an empty folder has nothing to import")
+	}
+	if err := writeCSV(n.path(usersFile), [][]string{{"alice", "0", "0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !needsImport(n) || needsImport(NetworkConfig{Folder: n.Folder, Storage: "csv"}) {
+		t.Error("only the bolt storage without a database needs to import the CSV files")
+	}
+	if _, err := openStore(n); err != nil {
+		t.Fatal(err)
+	}
+	if needsImport(n) {
+		t.Error("the database was already created")
+	}
+}
+
+func TestCSVStoreBackups(t *testing.T) {
+	folder := t.TempDir()
+	store := newCSVStore(folder, 2)
+	for i := 0; i < 4; i++ {
+		err := store.Update(func(tx *Tx) error {
+			return tx.Quotes().Add(Quote{Date: "01-01-2023", Text: strconv.Itoa(i), Channel: "#f1"})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ := filepath.Glob(filepath.Join(folder, backupsFolder, quotesFile+".*"))
+	if len(backups) != 2 {
+		t.Fatalf("got %d backups, want 2", len(backups))
+	}
+	// The newest backup holds the quotes before the last update.
+	sort.Strings(backups)
+	rows, err := readCSV(backups[1])
+	if err != nil || len(rows) != 3 {
+		t.Errorf("newest backup = %v, %v", rows, err)
+	}
+}
+
+func TestCSVStoreLock(t *testing.T) {
+	folder := t.TempDir()
+	store := newCSVStore(folder, 0)
+	// An external program holding the lock file blocks the transactions of the store until it releases it.
+	unlock, err := lockFile(filepath.Join(folder, lockFileName), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- store.Update(func(tx *Tx) error {
+			return tx.Quotes().Add(Quote{Text: "Lights out", Channel: "#f1"})
+		})
+	}()
+	select {
+	case <-done:
+		t.Fatal("the update didn't wait for the lock")
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the update didn't get the lock")
+	}
+}
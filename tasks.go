@@ -19,19 +19,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
 	"github.com/gocolly/colly"
 	"github.com/mmcdole/gofeed"
-	irc "github.com/thoj/go-ircevent"
 	"mvdan.cc/xurls/v2"
 )
 
 // The tskFeeds function runs in the background as a goroutine polling a collection of news feeds.
-func tskFeeds(irccon *irc.Connection) {
+func (b *Bot) tskFeeds() {
 	// Simple structure type used to send feed data to a go channel.
 	// It stores a key that indexes each different feed and a value.
 	// This allows the reading thread (this function) to access those two variables from the channel.
@@ -40,28 +39,35 @@ func tskFeeds(irccon *irc.Connection) {
 		Key   int
 		Value *gofeed.Feed
 	}
-	var timeFormat = "2006-01-02 15:04:05 +0000 UTC" // Time format string used by the time package.
-	// Loop that runs every feedInterval seconds opening the feeds CSV file and fetching news.
-	for {
-		time.Sleep(feedInterval * time.Second)
+	// Loop that runs every feedInterval seconds reading the feeds from the storage and fetching news.
+	// Feeds are only polled while the bot is online, so that news aren't queued during an outage.
+	for b.sleep(time.Duration(b.config.FeedInterval) * time.Second) {
 		//start := time.Now()
-		feeds, err := readCSV(feedsFile)
-		feedDataCh := make(chan FeedData)
+		var feeds []Feed
+		err := b.store.View(func(tx *Tx) (err error) {
+			feeds, err = tx.Feeds().All()
+			return
+		})
+		// The channel has room for every feed, so that workers never block once the reading loop stops.
+		feedDataCh := make(chan FeedData, len(feeds))
 		if err != nil {
-			log.Println("tskFeeds:", err)
+			b.logger.Error("Error getting feeds.", "err", err)
 			continue
 		}
-		// Loop that spawns a goroutine worker thread per each feed source in the feeds CSV file.
+		// Loop that spawns a goroutine worker thread per each feed source.
 		// The annonymous goroutine function accepts the k and v parameters, passed as arguments.
 		// This is to avoid undesired indeterministic effects from using a closure as a goroutine.
-		// The goroutine builds a Feed type by parsing the URL field for each feed in the CSV file.
+		// The goroutine builds a gofeed.Feed type by parsing the URL field of each feed.
 		// A FeedData type is built and sent to the go channel to be received by the reading thread.
 		for key, value := range feeds {
-			go func(k int, v []string) {
+			go func(k int, v Feed) {
 				fp := gofeed.NewParser()
-				feed, err := fp.ParseURL(v[1])
+				start := time.Now()
+				feed, err := fp.ParseURLWithContext(v.URL, b.ctx)
+				feedDuration.Observe(time.Since(start).Seconds(), b.config.Name, v.Name)
 				if err != nil {
-					log.Println("feed:", err)
+					feedErrors.Inc(b.config.Name, v.Name)
+					b.logger.Warn("Error fetching feed.", "feed", v.Name, "url", v.URL, "err", err)
 					return
 				}
 				feedData := FeedData{k, feed}
@@ -70,20 +76,20 @@ func tskFeeds(irccon *irc.Connection) {
 		}
 		// Loop that runs a select on the go channel for as long as there's data to be read or until a timeout occurs.
 		// In case feedData can be read from the communication channel, process all the feed items and show new ones.
-		// In case this thread needs to wait more than 2 minutes to receive data from the goroutines a tiemout occurs.
+		// In case this thread needs to wait more than 60 seconds to receive data from the goroutines a tiemout occurs.
 		for {
 			timeout := false
 			select {
 			case feedData := <-feedDataCh:
+				feed := &feeds[feedData.Key]
 				for _, item := range feedData.Value.Items {
-					// The lastTime variable keeps track of when the last feed item was retrieved.
-					// If we cannot parse the time (first time) then we use timeFormat as lastTime.
-					// We could use any time in the past here, but timeFormat is already available.
-					lastTime, err := time.Parse(timeFormat, feeds[feedData.Key][3])
-					if err != nil {
-						lastTime, _ = time.Parse(timeFormat, timeFormat)
-					}
+					// The LastTime field keeps track of when the last feed item was retrieved.
+					// It is the zero time when the feed was never read, which is before any item.
+					lastTime := feed.LastTime
 					itemTime := item.PublishedParsed
+					if itemTime == nil {
+						continue
+					}
 					// We only want to show a feed item if itemTime > lastTime.
 					// Additionally we also want to make sure the feed item is no older than 2 hours.
 					// This assures only current news when restarting the bot or changing the feeds.
@@ -91,18 +97,29 @@ func tskFeeds(irccon *irc.Connection) {
 						if strings.Contains(item.Link, "?") && strings.Contains(item.Link, "&") {
 							item.Link = strings.Split(item.Link, "?")[0]
 						}
-						irccon.Privmsg(
-							feeds[feedData.Key][2],
-							fmt.Sprintf("\x02[%s] [%s]\x02", feeds[feedData.Key][0], item.Title))
-						irccon.Privmsg(feeds[feedData.Key][2], item.Link)
-						feeds[feedData.Key][3] = fmt.Sprintf("%s", itemTime)
-						writeCSV(feedsFile, feeds)
-						time.Sleep(1 * time.Second)
+						// Channels with feeds off still move past the item, so that it isn't shown once feeds are back on.
+						if b.settings(feed.Channel).Feeds {
+							b.queue.Privmsg(
+								PriorityLow,
+								feed.Channel,
+								fmt.Sprintf("\x02[%s] [%s]\x02", feed.Name, item.Title))
+							b.queue.Privmsg(PriorityLow, feed.Channel, item.Link)
+						}
+						feed.LastTime = *itemTime
+						err := b.store.Update(func(tx *Tx) error {
+							return tx.Feeds().Put(*feed)
+						})
+						if err != nil {
+							b.logger.Error("Error storing feed.", "feed", feed.Name, "err", err)
+						}
 					}
 				}
 			case <-time.After(60 * time.Second):
 				timeout = true
 				break // Break out of the select statement.
+			case <-b.ctx.Done():
+				timeout = true
+				break // The bot is shutting down, the feeds that weren't fetched yet are left for the next start.
 			}
 			if timeout {
 				break // We need this second break when a timeout occurs to break out of the select loop.
@@ -112,31 +129,21 @@ func tskFeeds(irccon *irc.Connection) {
 }
 
 // The tskEvents function runs in the background as a goroutine polling for new events.
-func tskEvents(irccon *irc.Connection) {
-	var announced [5]string                    // Small buffer to hold recently announced events.
-	var index = 0                              // Index used to reference the buffer above.
-	var timeFormat = "2006-01-02 15:04:05 UTC" // Time format string used by the time package.
-	// This is a separate thread, we must check if the main one is connected to IRC.
-	// While not connected to IRC sleep for 10 seconds before trying again.
-	// If eventually a connection is established we jump out of this loop and resume.
-	for !irccon.Connected() {
-		log.Println("tskEvents: Waiting for an IRC connection.")
-		time.Sleep(10 * time.Second)
-	}
-	// Loop that runs every minute opening the events CSV file and querying any event that starts within 5 minutes.
-	for {
-		time.Sleep(60 * time.Second)
-		event, err := findNext("any", "any")
+func (b *Bot) tskEvents() {
+	var announced [5]string // Small buffer to hold recently announced events.
+	var index = 0           // Index used to reference the buffer above.
+	// Loop that runs every minute querying any event that starts within 5 minutes.
+	// This is a separate thread, so it pauses while the bot is offline and resumes once it reconnects.
+	// It returns when the bot shuts down.
+	for b.sleep(60 * time.Second) {
+		event, err := b.findNext("any", "any")
 		if err != nil {
-			log.Println("tskEvents:", err)
-			continue
-		}
-		t, err := time.Parse(timeFormat, event[3])
-		if err != nil {
-			log.Println("tskEvents: Error parsing time.")
+			if !errors.Is(err, errNoEvent) {
+				b.logger.Error("Error finding the next event.", "err", err)
+			}
 			continue
 		}
-		delta := time.Until(t)
+		delta := time.Until(event.Time)
 		if delta.Minutes() > 5 {
 			continue
 		}
@@ -147,40 +154,61 @@ func tskEvents(irccon *irc.Connection) {
 		if index > 4 {
 			index = 0
 		} else {
-			if !contains(announced[0:5], event[0]+" "+event[1]+" "+event[2]) {
-				irccon.Privmsg(
-					event[4],
-					fmt.Sprintf(
-						"\x034Starting in 5 minutes:\x03 \x02%s %s %s\x02",
-						event[0], event[1], event[2]))
-				announced[index] = event[0] + " " + event[1] + " " + event[2]
+			title := event.Category + " " + event.Name + " " + event.Session
+			if !contains(announced[0:5], title) {
+				announced[index] = title
 				index++
-				if event[5] != "" {
-					irccon.Privmsg(event[4], "Event link: "+event[5])
-				}
-				users, err := readCSV(usersFile)
-				if err != nil {
-					log.Println("tksEvents:", err)
-					continue
-				}
-				var mentions string
-				for _, user := range users {
-					channels := strings.Split(user[3], ":")
-					if strings.ToLower(event[6]) == "notify" && contains(channels, event[4]) {
-						mentions += user[0] + " "
-					}
-				}
-				if mentions != "" {
-					irccon.Privmsg(event[4], mentions)
-					irccon.Privmsg(event[4], "Use !notify off to stop getting mentions for events on this channel.")
+				if err := b.announce(event, "Starting in 5 minutes:"); err != nil {
+					b.logger.Error("Error getting users.", "err", err)
 				}
 			}
 		}
 	}
 }
 
+// The announce method announces an event on its channel, with the given heading and its link.
+// Users subscribed to the notifications of the channel are mentioned, when the event notifies them.
+func (b *Bot) announce(event Event, heading string) error {
+	title := event.Category + " " + event.Name + " " + event.Session
+	b.queue.Privmsg(
+		PriorityNormal,
+		event.Channel,
+		fmt.Sprintf("\x034%s\x03 \x02%s\x02", heading, title))
+	announcementsTotal.Inc(b.config.Name, event.Channel)
+	if event.Link != "" {
+		b.queue.Privmsg(PriorityNormal, event.Channel, "Event link: "+event.Link)
+	}
+	if !event.Notify {
+		return nil
+	}
+	var users []User
+	err := b.store.View(func(tx *Tx) (err error) {
+		users, err = tx.Users().All()
+		return
+	})
+	if err != nil {
+		return err
+	}
+	var mentions string
+	for _, user := range users {
+		if contains(user.Channels, event.Channel) {
+			// Users are mentioned with the nick they use now, which may not be their registered nick.
+			nick, ok := b.idents.NickOf(user)
+			if !ok {
+				nick = user.Nick
+			}
+			mentions += nick + " "
+		}
+	}
+	if mentions != "" {
+		b.queue.Privmsg(PriorityNormal, event.Channel, mentions)
+		b.queue.Privmsg(PriorityNormal, event.Channel, "Use !notify off to stop getting mentions for events on this channel.")
+	}
+	return nil
+}
+
 // The tskHTMLTitle function runs in the background as a goroutine that scrapes HTML titles from links.
-func tskHTMLTitle(irccon *irc.Connection, channel string, message string) {
+func (b *Bot) tskHTMLTitle(channel string, message string) {
 	var titles []string // Slice of string to hold all scraped titles.
 	// Use the xurls package to get the first url of the message.
 	// Strict means only full URL schemes (including protocol) are considered.
@@ -194,25 +222,18 @@ func tskHTMLTitle(irccon *irc.Connection, channel string, message string) {
 	c.Visit(url)
 	// Since badly formatted HTML documents may contain multiple titles, we wait 3 seconds.
 	// Then if at least one title tag was extracted, we show the first one on the channel.
-	time.Sleep(3 * time.Second)
-	if len(titles) > 0 {
-		irccon.Privmsg(channel, "Title: "+titles[0])
+	if b.sleep(3*time.Second) && len(titles) > 0 {
+		b.queue.Privmsg(PriorityLow, channel, "Title: "+titles[0])
 	}
 }
 
-// The tskWrite function runs in the background as a goroutine that reads messages from an input file and outputs them.
-func tskWrite(irccon *irc.Connection, inputFile string) {
-	for {
-		time.Sleep(1 * time.Second)
-		message, err := readIn(inputFile)
-		if err != nil {
-			log.Println("tskWrite:", err)
-			return
-		}
-		// We need to make sure the message starts with a # prefixed word and use that as a target channel.
-		splitMessage := strings.Split(message, " ")
-		if len(splitMessage) > 1 && strings.HasPrefix(splitMessage[0], "#") {
-			irccon.Privmsg(splitMessage[0], strings.Join(splitMessage[1:], " "))
+// The tskRejoin function runs in the background as a goroutine that rejoins the configured channels the bot isn't on.
+// This brings the bot back to channels it couldn't join, for instance when banned or after a netsplit.
+func (b *Bot) tskRejoin() {
+	for b.sleep(rejoinInterval) {
+		if missing := b.health.Missing(b.channels()); len(missing) > 0 {
+			b.logger.Info("Rejoining channels.", "channels", strings.Join(missing, ","))
+			sendRaw(b.connection(), "JOIN "+strings.Join(missing, ","))
 		}
 	}
 }
@@ -22,8 +22,14 @@ package main
 type Command struct {
 	Name    string
 	Args    []string
+	Options map[string]string // Options given as --name value, only set for commands with an ArgSchema.
 	Nick    string
-	Channel string
+	Channel string  // Channel where the command was issued, or the nick of the user on a private message.
+	Private bool    // The command was sent on a private message to the bot.
+	Source  string  // Hostmask of the user, as nick!user@host.
+	Account string  // Services account of the user, empty when unknown.
+	Role    Role    // Role of the user, resolved from the source and account.
+	tokens  []token // Tokens of the arguments, used to tell quoted arguments from options.
 }
 
 // Type that represents the F1 World Driver Championship standings.
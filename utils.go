@@ -21,9 +21,11 @@ package main
 import (
 	"encoding/csv"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -37,27 +39,20 @@ func contains(s []string, str string) bool {
 	return false
 }
 
-// Small utility function that returns a map[string]string given a [][]string and a key/value pair.
-func toStringMap(s [][]string, key int, value int) (result map[string]string, err error) {
-	if len(s) == 0 || key < 0 || value < 0 || key >= value {
-		err := errors.New("Invalid slice, key or value.")
-		return result, err
-	}
-	result = make(map[string]string)
+// Small utility function that checks if a slice contains a string, ignoring case.
+func containsFold(s []string, str string) bool {
 	for _, v := range s {
-		if (key > (len(v) - 1)) || (value > (len(v) - 1)) {
-			err := errors.New("Invalid slice, key or value.")
-			return result, err
+		if strings.EqualFold(v, str) {
+			return true
 		}
-		result[v[key]] = v[value]
 	}
-	return
+	return false
 }
 
-// Small utility function that returns weather a nick is a user or not.
-func isUser(nick string, users [][]string) bool {
-	for _, user := range users {
-		if strings.ToLower(nick) == strings.ToLower(user[0]) {
+// Small utility function that returns weather a string starts with any of the given prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
 			return true
 		}
 	}
@@ -65,44 +60,91 @@ func isUser(nick string, users [][]string) bool {
 }
 
 // Small utility function that reads a CSV file and returns the data as slice of slice of strings.
+// A malformed file is reported with the line where the problem was found.
 func readCSV(path string) (data [][]string, err error) {
 	f, err := os.Open(path)
-	defer f.Close()
 	if err != nil {
-		err = errors.New("Error opening CSV file: " + path + ".")
+		err = fmt.Errorf("Error opening CSV file %s: %w", path, err)
 		return
 	}
+	defer f.Close()
 	r := csv.NewReader(f)
+	// The number of columns is checked by the records of each table, so that a short row doesn't hide the whole file.
+	r.FieldsPerRecord = -1
 	data, err = r.ReadAll()
 	if err != nil {
-		err = errors.New("Error reading data from: " + path + ".")
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			err = fmt.Errorf("Error reading data from %s:%d: %w", path, parseErr.Line, parseErr.Err)
+		} else {
+			err = fmt.Errorf("Error reading data from %s: %w", path, err)
+		}
 		return
 	}
 	return
 }
 
 // Small utility function that writes a slice of slice of strings to a CSV file.
-func writeCSV(path string, data [][]string) (err error) {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	defer f.Close()
+// The data is written to a temporary file on the same folder, which is synced and then renamed over path.
+// This way a crash in the middle of a write leaves either the old or the new file, never a truncated one.
+func writeCSV(path string, data [][]string) error {
+	temp, err := createCSV(path, data)
 	if err != nil {
-		err = errors.New("Error opening CSV file: " + path + ".")
-		return
+		return err
+	}
+	return replaceFile(temp, path)
+}
+
+// Small utility function that writes a slice of slice of strings to a synced temporary file next to path.
+// It returns the name of the temporary file, which should be renamed over path with replaceFile.
+func createCSV(path string, data [][]string) (temp string, err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("Error creating temporary file for %s: %w", path, err)
 	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
 	w := csv.NewWriter(f)
 	err = w.WriteAll(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Close()
+	}
 	if err != nil {
-		err = errors.New("Error writing data to: " + path + ".")
-		return
+		return "", fmt.Errorf("Error writing data to %s: %w", path, err)
 	}
-	return
+	return f.Name(), nil
+}
+
+// Small utility function that renames a temporary file over path, removing it when that fails.
+func replaceFile(temp string, path string) error {
+	err := os.Rename(temp, path)
+	if err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("Error replacing %s: %w", path, err)
+	}
+	// Sync the folder too, so that the rename itself survives a crash.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
 }
 
 // Small utility function that reads messages from an input file.
 func readIn(path string) (message string, err error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		err = errors.New("Error reading message from: " + path + ".")
+		err = fmt.Errorf("Error reading message from %s: %w", path, err)
 		return
 	}
 	message = string(data)
@@ -115,46 +157,58 @@ func writeOut(path string, message string) (err error) {
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	defer f.Close()
 	if err != nil {
-		err = errors.New("Error opening output file: " + path + ".")
+		err = fmt.Errorf("Error opening output file %s: %w", path, err)
 		return
 	}
 	_, err = f.WriteString(message)
 	if err != nil {
-		err = errors.New("Error writing message to: " + path + ".")
+		err = fmt.Errorf("Error writing message to %s: %w", path, err)
 		return
 	}
 	return
 }
 
 // Small utility function that fetches and returns raw data from an URL using HTTP.
+// A response with a status other than 2xx is an error, so that an error page is never taken for the data.
 func getURL(url string) (data []byte, err error) {
 	res, err := http.Get(url)
 	if err != nil {
-		err = errors.New("Error getting HTTP data.")
+		err = fmt.Errorf("Error getting HTTP data: %w", err)
 		return
 	}
 	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		err = fmt.Errorf("Error getting HTTP data from %s: %s.", url, res.Status)
+		return
+	}
 	data, err = ioutil.ReadAll(res.Body)
 	if err != nil {
-		err = errors.New("Error getting HTTP data.")
+		err = fmt.Errorf("Error getting HTTP data from %s: %w", url, err)
 		return
 	}
 	return
 }
 
 // Small utility function that takes a message string and breaks it down into a Command.
-func parseCommand(message string, nick string, channel string) (command Command, err error) {
-	if len(message) > 1 && strings.HasPrefix(message, prefix) {
-		split := strings.Split(message, " ")
-		command.Name = split[0][1:]
-		command.Args = split[1:]
-		command.Nick = nick
-		command.Channel = channel
+// The arguments are split by the tokenize function, so quoted arguments can contain spaces.
+func parseCommand(message string, prefix string, nick string, channel string) (command Command, err error) {
+	if !strings.HasPrefix(message, prefix) {
+		err = errors.New("parsecmd: Invalid command.")
 		return
-	} else {
+	}
+	tokens := tokenize(message)
+	if len(tokens) == 0 || tokens[0].quoted || len(tokens[0].text) <= len(prefix) {
 		err = errors.New("parsecmd: Invalid command.")
 		return
 	}
+	command.Name = tokens[0].text[len(prefix):]
+	command.tokens = tokens[1:]
+	for _, t := range command.tokens {
+		command.Args = append(command.Args, t.text)
+	}
+	command.Nick = nick
+	command.Channel = channel
+	return
 }
 
 // Small utility function that checks if a file exists and is not a directory.
@@ -0,0 +1,110 @@
+/*
+ *  schumacher, a simple general purpose bot for IRC.
+ *  Copyright (C) 2021-2022  Vasco Costa (gluon)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		message string
+		prefix  string
+		want    Command
+		ok      bool
+	}{
+		{"!next", "!", Command{Name: "next"}, true},
+		{"!bet ver ham lec ver", "!", Command{Name: "bet", Args: []string{"ver", "ham", "lec", "ver"}}, true},
+		{"!poll Best team?;Ferrari;McLaren", "!", Command{Name: "poll", Args: []string{"Best", "team?;Ferrari;McLaren"}}, true},
+		{".quote add hello", ".", Command{Name: "quote", Args: []string{"add", "hello"}}, true},
+		{">>help next", ">>", Command{Name: "help", Args: []string{"next"}}, true},
+		{"!", "!", Command{}, false},
+		{"! next", "!", Command{}, false},
+		{"hello there", "!", Command{}, false},
+		{"", "!", Command{}, false},
+		{"next!", "!", Command{}, false},
+		{"!next   f1  ", "!", Command{Name: "next", Args: []string{"f1"}}, true},
+		{`!quote add "Lights out  and away we go" --x`, "!", Command{Name: "quote", Args: []string{"add", "Lights out  and away we go", "--x"}}, true},
+		{`!"next"`, "!", Command{}, false},
+	}
+	for _, test := range tests {
+		command, err := parseCommand(test.message, test.prefix, "gluon", "#f1")
+		if (err == nil) != test.ok {
+			t.Errorf("parseCommand(%q): got error %v, want ok %v", test.message, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		test.want.Nick = "gluon"
+		test.want.Channel = "#f1"
+		command.tokens = nil
+		if !reflect.DeepEqual(command, test.want) {
+			t.Errorf("parseCommand(%q) = %+v, want %+v", test.message, command, test.want)
+		}
+	}
+}
+
+func TestReadCSVReportsLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), usersFile)
+	os.WriteFile(path, []byte("alice,Europe/Lisbon,0,\nbob,Europe/Berlin,0,\ncarol,\"Europe/Lisbon\"x,0,\n"), 0644)
+	_, err := readCSV(path)
+	if err == nil || !strings.Contains(err.Error(), usersFile+":3:") {
+		t.Errorf("readCSV: got error %v, want the file and line 3", err)
+	}
+	// Rows with a different number of columns are read, they are reported by the records of the table instead.
+	os.WriteFile(path, []byte("alice,Europe/Lisbon,0,\ncarol,0\n"), 0644)
+	data, err := readCSV(path)
+	if err != nil || len(data) != 2 {
+		t.Errorf("readCSV = %q, %v, want 2 rows", data, err)
+	}
+	os.WriteFile(path, []byte("alice,\"Europe/Lisbon,0,\n"), 0644)
+	_, err = readCSV(path)
+	if err == nil || !strings.Contains(err.Error(), usersFile+":") {
+		t.Errorf("readCSV: got error %v, want the file and line", err)
+	}
+}
+
+func TestWriteCSVReplacesAtomically(t *testing.T) {
+	folder := t.TempDir()
+	path := filepath.Join(folder, betsFile)
+	for _, data := range [][][]string{{{"a", "1"}}, {{"b", "2"}, {"c", "3"}}} {
+		if err := writeCSV(path, data); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readCSV(path)
+		if err != nil || !reflect.DeepEqual(got, data) {
+			t.Errorf("readCSV = %v, %v, want %v", got, err, data)
+		}
+	}
+	entries, _ := os.ReadDir(folder)
+	if len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0644 {
+		t.Errorf("unexpected mode %v", info.Mode())
+	}
+	if err := writeCSV(filepath.Join(folder, "missing", betsFile), nil); err == nil {
+		t.Error("writeCSV on a missing folder should fail")
+	}
+}